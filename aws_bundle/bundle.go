@@ -0,0 +1,96 @@
+package aws_bundle
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"time"
+)
+
+// Result describes a bundle made by Bundle().
+type Result struct {
+	// ManifestFilename is the name of the manifest file written to the sink,
+	// which is what gets registered, e.g. "image.manifest.xml".
+	ManifestFilename string
+
+	// Info describes the bundle itself.
+	Info
+
+	// CompressionRatio is ImageSize divided by BundledSize, so 4 means the
+	// parts are a quarter the size of the image.
+	CompressionRatio float64
+
+	// Started is when bundling started. BundleDuration is how long it took to
+	// read and bundle the image, including writing the parts to the sink, and
+	// ManifestDuration is how long it took to write the manifest.
+	Started          time.Time
+	BundleDuration   time.Duration
+	ManifestDuration time.Duration
+}
+
+// Bundle() bundles an image of size bytes read from src, writing the parts
+// and then the manifest to sink, and describes the result.
+//
+// This does everything a Writer and Metadata.WriteManifest() do, in the right
+// order: the metadata is validated before anything is read, the image is
+// copied into a Writer made with opts (so src may be shorter than size if
+// PadShortImage() is among them), the Writer is closed, and the manifest is
+// written. Any error stops the process, and no manifest is written for a
+// bundle which failed.
+//
+// Canceling ctx stops bundling at the next write. The part being written is
+// abandoned (see Sink), but whatever parts were already written to sink stay
+// there; it's up to the caller to clean them up.
+func Bundle(ctx context.Context, src io.Reader, size int64, sink Sink, md Metadata, opts ...WriterOption) (*Result, error) {
+	if err := md.Validate(); err != nil {
+		return nil, err
+	}
+	result := &Result{Started: time.Now()}
+
+	bw, err := NewWriter(md.Name, size, sink, opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	// copy into a Writer which stops on cancellation, which leaves io.Copy()
+	// free to use src's WriteTo(), if it has one
+	if n, err := io.Copy(&contextWriter{ctx: ctx, w: bw}, src); err != nil {
+		// a failed read or a cancellation breaks the Writer too, so that
+		// Close() abandons the part being written rather than finishing it
+		if bw.err == nil {
+			bw.err = err
+		}
+		bw.Close()
+		return nil, fmt.Errorf("bundling failed after %d bytes: %w", n, err)
+	}
+	if err := bw.Close(); err != nil {
+		return nil, err
+	}
+	result.BundleDuration = time.Since(result.Started)
+
+	started := time.Now()
+	if err := md.WriteManifest(bw, sink); err != nil {
+		return nil, err
+	}
+	result.ManifestDuration = time.Since(started)
+
+	result.ManifestFilename = fmt.Sprintf("%s.manifest.xml", bw.basename)
+	result.Info = bw.info()
+	if result.BundledSize > 0 {
+		result.CompressionRatio = float64(result.ImageSize) / float64(result.BundledSize)
+	}
+	return result, nil
+}
+
+// contextWriter fails writes once its context is done.
+type contextWriter struct {
+	ctx context.Context
+	w   io.Writer
+}
+
+func (cw *contextWriter) Write(p []byte) (int, error) {
+	if err := cw.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return cw.w.Write(p)
+}
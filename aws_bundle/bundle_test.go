@@ -0,0 +1,145 @@
+package aws_bundle
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"errors"
+	"fmt"
+	"io"
+	"testing"
+	"testing/iotest"
+)
+
+func TestBundle(t *testing.T) {
+	image := testImage()
+	md := testMetadata()
+
+	sink := newAccumulatingSink()
+	result, err := Bundle(context.Background(), bytes.NewReader(image), int64(len(image)), sink, md, RoundUpSize(1<<20))
+	if err != nil {
+		t.Fatalf("Bundle() error = %v", err)
+	}
+
+	if result.ManifestFilename != "test.manifest.xml" || sink.files[result.ManifestFilename] == nil {
+		t.Errorf("ManifestFilename = %q", result.ManifestFilename)
+	}
+	m, err := unmarshalManifest(sink.files[result.ManifestFilename].Bytes())
+	if err != nil {
+		t.Fatalf("unmarshalManifest() error = %v", err)
+	}
+	if result.ImageDigest != m.Image.Digest.Value || result.ImageSize != m.Image.Size || result.BundledSize != m.Image.BundledSize {
+		t.Errorf("Result = %+v, doesn't match manifest %+v", result, m.Image)
+	}
+	if result.ImageSize != 12<<20 || result.CompressionRatio <= 0.9 || result.CompressionRatio >= 1 {
+		t.Errorf("ImageSize = %d, CompressionRatio = %v", result.ImageSize, result.CompressionRatio)
+	}
+	if result.Started.IsZero() || result.BundleDuration <= 0 || result.ManifestDuration <= 0 {
+		t.Errorf("timings = %v, %v, %v", result.Started, result.BundleDuration, result.ManifestDuration)
+	}
+
+	if len(result.Parts) != 2 {
+		t.Fatalf("Parts = %+v, expected 2", result.Parts)
+	}
+	var total int64
+	for i, part := range result.Parts {
+		contents := sink.files[part.Filename]
+		if part.Index != i || part.Filename != fmt.Sprintf("test.part.%d", i) || contents == nil {
+			t.Errorf("Parts[%d] = %+v", i, part)
+			continue
+		}
+		if part.Size != int64(contents.Len()) || part.SHA1 != fmt.Sprintf("%x", sha1.Sum(contents.Bytes())) {
+			t.Errorf("Parts[%d] = %+v, expected %d bytes with SHA1 %x", i, part, contents.Len(), sha1.Sum(contents.Bytes()))
+		}
+		if m.Image.PartsContainer.Parts[i].Digest.Value != part.SHA1 {
+			t.Errorf("Parts[%d].SHA1 doesn't match the manifest", i)
+		}
+		total += part.Size
+	}
+	if total != result.BundledSize {
+		t.Errorf("parts total %d bytes, BundledSize = %d", total, result.BundledSize)
+	}
+}
+
+func TestBundleFailures(t *testing.T) {
+	image := []byte("hello, world")
+	md := testMetadata()
+	canceled, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	for _, test := range []struct {
+		name   string
+		ctx    context.Context
+		src    io.Reader
+		md     Metadata
+		target error
+	}{
+		{"canceled", canceled, bytes.NewReader(image), md, context.Canceled},
+		{"read error", context.Background(), iotest.TimeoutReader(iotest.OneByteReader(bytes.NewReader(image))), md, iotest.ErrTimeout},
+		{"invalid metadata", context.Background(), bytes.NewReader(image), Metadata{Name: "test"}, nil},
+		{"short", context.Background(), bytes.NewReader(image[:5]), md, nil},
+	} {
+		// padding would finish the bundle, unless the failure prevents it
+		sink := newAccumulatingSink()
+		var opts []WriterOption
+		if test.name != "short" {
+			opts = append(opts, PadShortImage())
+		}
+		result, err := Bundle(test.ctx, test.src, 100<<20, sink, test.md, opts...)
+		if err == nil || result != nil {
+			t.Errorf("%s: Bundle() = %+v, %v", test.name, result, err)
+		} else if test.target != nil && !errors.Is(err, test.target) {
+			t.Errorf("%s: Bundle() error = %v, expected %v", test.name, err, test.target)
+		}
+		if sink.files["test.manifest.xml"] != nil {
+			t.Errorf("%s: wrote a manifest", test.name)
+		}
+		for name, contents := range sink.files {
+			if contents.Len() > 10<<10 {
+				t.Errorf("%s: wrote %d bytes to %s", test.name, contents.Len(), name)
+			}
+		}
+	}
+}
+
+// cancelingReader cancels a context, then reads from r.
+type cancelingReader struct {
+	cancel func()
+	r      io.Reader
+}
+
+func (cr cancelingReader) Read(p []byte) (int, error) {
+	cr.cancel()
+	return cr.r.Read(p)
+}
+
+func TestBundleAbandonsPart(t *testing.T) {
+	image := testImage()
+	md := testMetadata()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// each fails partway through the second part, which mustn't be finished
+	for _, test := range []struct {
+		name string
+		ctx  context.Context
+		src  io.Reader
+	}{
+		{"read error", context.Background(), io.MultiReader(bytes.NewReader(image[:11<<20]), iotest.TimeoutReader(bytes.NewReader(image)))},
+		{"canceled", ctx, io.MultiReader(bytes.NewReader(image[:11<<20]), cancelingReader{cancel, bytes.NewReader(image[11<<20:])})},
+		{"short", context.Background(), bytes.NewReader(image[:11<<20])},
+	} {
+		sink := newFaultySink()
+		if _, err := Bundle(test.ctx, test.src, int64(len(image)), sink, md); err == nil {
+			t.Errorf("%s: Bundle() succeeded", test.name)
+		}
+		if len(sink.aborted) != 1 || len(sink.open) != 0 {
+			t.Errorf("%s: abandoned %v, left %v open", test.name, sink.aborted, sink.open)
+		}
+		for name, contents := range sink.files {
+			if contents.Len() != 10<<20 {
+				t.Errorf("%s: finished %s with %d bytes", test.name, name, contents.Len())
+			}
+		}
+	}
+}
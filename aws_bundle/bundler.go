@@ -0,0 +1,240 @@
+package aws_bundle
+
+import (
+	"crypto/sha1"
+	"fmt"
+	"hash"
+	"io"
+	"sync"
+)
+
+// A Bundler bundles an image like Bundle() does, but rather than pushing
+// files into a Sink, it hands them out one at a time from Next(), for the
+// caller to read. This suits uploaders which want to decide for themselves
+// when and how each file is sent.
+//
+// Bundling happens in the background, as the parts are read: the image is
+// read from src only as fast as the parts are consumed, and each part streams
+// through without being held in memory, so a Bundler needs about as much
+// memory as a Writer regardless of the image's size.
+type Bundler struct {
+	w     *Writer
+	parts chan *Part
+
+	// closing is closed by Close(), to stop the pipeline
+	closing   chan struct{}
+	closeOnce sync.Once
+
+	// used by the pipeline only, until it closes parts
+	index    int
+	manifest bool
+	pending  *io.PipeWriter // the last file, whose end waits for the outcome
+	err      error
+
+	// used by the caller only
+	current  *Part
+	finished bool
+}
+
+// A Part is a file of a bundle, as returned by Bundler.Next(). Read it to get
+// its contents.
+type Part struct {
+	// Filename is the name of the file, e.g. "image.part.0" or
+	// "image.manifest.xml".
+	Filename string
+
+	// Index is the part's position in the bundle, or -1 for the manifest.
+	Index int
+
+	r    *io.PipeReader
+	sha1 hash.Hash
+	size int64
+	err  error // how reading ended, io.EOF if it succeeded
+}
+
+// Read() reads the part's contents, which are produced as they're read. The
+// last file to be returned ends with the error which stopped the bundle, if
+// any, rather than io.EOF.
+func (p *Part) Read(b []byte) (int, error) {
+	if p.err != nil {
+		return 0, p.err
+	}
+	n, err := p.r.Read(b)
+	p.sha1.Write(b[:n])
+	p.size += int64(n)
+	if err != nil {
+		p.err = err
+	}
+	return n, err
+}
+
+// Info() describes the part, once it's been read completely.
+func (p *Part) Info() (PartInfo, error) {
+	if p.err != io.EOF {
+		return PartInfo{}, ErrPartNotRead
+	}
+	return PartInfo{
+		Index:    p.Index,
+		Filename: p.Filename,
+		Size:     p.size,
+		SHA1:     fmt.Sprintf("%x", p.sha1.Sum(nil)),
+	}, nil
+}
+
+// NewBundler() starts bundling an image of size bytes read from src, with
+// the manifest described by md. opts are as for NewWriter().
+//
+// Call Next() to get each of the bundle's parts in turn, followed by its
+// manifest, reading each completely before asking for the next. Parts are
+// 10 MiB, except the last, whose size isn't known until it's been read. A
+// failure stops the process, and no manifest is produced for a bundle which
+// failed.
+//
+// Call Close() when done with the Bundler, whether or not it finished.
+func NewBundler(src io.Reader, size int64, md Metadata, opts ...WriterOption) (*Bundler, error) {
+	if err := md.Validate(); err != nil {
+		return nil, err
+	}
+
+	b := &Bundler{
+		parts:   make(chan *Part),
+		closing: make(chan struct{}),
+	}
+	w, err := NewWriter(md.Name, size, (*bundlerSink)(b), opts...)
+	if err != nil {
+		return nil, err
+	}
+	b.w = w
+
+	go b.run(src, md)
+	return b, nil
+}
+
+// run() bundles the image and writes the manifest, then ends the last file
+// according to the outcome, so that its reader learns of any failure.
+func (b *Bundler) run(src io.Reader, md Metadata) {
+	defer close(b.parts)
+	b.err = b.bundle(src, md)
+	if b.pending != nil {
+		b.pending.CloseWithError(b.err)
+	}
+}
+
+// bundle() does what Bundle() does, writing to the Bundler's Writer.
+func (b *Bundler) bundle(src io.Reader, md Metadata) error {
+	if n, err := io.Copy(b.w, src); err != nil {
+		if b.w.err == nil {
+			b.w.err = err
+		}
+		b.w.Close()
+		return fmt.Errorf("bundling failed after %d bytes: %w", n, err)
+	}
+	if err := b.w.Close(); err != nil {
+		return err
+	}
+
+	b.manifest = true
+	return md.WriteManifest(b.w, (*bundlerSink)(b))
+}
+
+// Next() returns the bundle's next file, once the previous one has been read
+// completely, or until it failed. It returns io.EOF after the manifest, or
+// whatever error stopped the bundle.
+func (b *Bundler) Next() (*Part, error) {
+	if b.finished {
+		if b.err != nil {
+			return nil, b.err
+		}
+		return nil, io.EOF
+	}
+	if b.current != nil && b.current.err == nil {
+		return nil, ErrPartNotRead
+	}
+	part, ok := <-b.parts
+	if !ok {
+		b.finished = true
+		if b.err != nil {
+			return nil, b.err
+		}
+		return nil, io.EOF
+	}
+	b.current = part
+	return part, nil
+}
+
+// Info() describes the bundle, once Next() has returned io.EOF.
+func (b *Bundler) Info() (*Info, error) {
+	if !b.finished {
+		return nil, ErrBundlerNotFinished
+	}
+	return b.w.Info()
+}
+
+// Close() stops bundling, if it hasn't finished, and waits for the pipeline
+// to stop. Unless the bundle had already finished, reads from the current
+// part fail with ErrBundlerClosed, as do subsequent calls to Next(). Note
+// that a read from src which is in progress must return before the pipeline
+// can stop.
+func (b *Bundler) Close() error {
+	b.closeOnce.Do(func() {
+		close(b.closing)
+	})
+	if b.current != nil {
+		b.current.r.CloseWithError(ErrBundlerClosed)
+		if b.current.err == nil {
+			b.current.err = ErrBundlerClosed
+		}
+	}
+	for part := range b.parts {
+		part.r.CloseWithError(ErrBundlerClosed)
+	}
+	if !b.finished {
+		b.finished = true
+		b.err = ErrBundlerClosed
+	}
+	return nil
+}
+
+// bundlerSink is the Sink through which a Bundler's Writer hands files to
+// Next().
+type bundlerSink Bundler
+
+func (bs *bundlerSink) WriteBundleFile(filename string) (io.WriteCloser, error) {
+	// a new file means the previous one is complete
+	if bs.pending != nil {
+		bs.pending.Close()
+		bs.pending = nil
+	}
+
+	pr, pw := io.Pipe()
+	part := &Part{Filename: filename, Index: -1, r: pr, sha1: sha1.New()}
+	if !bs.manifest {
+		part.Index = bs.index
+		bs.index++
+	}
+
+	select {
+	case bs.parts <- part:
+		return &bundlerFile{PipeWriter: pw, sink: bs}, nil
+	case <-bs.closing:
+		return nil, ErrBundlerClosed
+	}
+}
+
+// bundlerFile is a file being read from a Bundler. Closing it doesn't end it
+// yet, since the bundle might still fail.
+type bundlerFile struct {
+	*io.PipeWriter
+	sink *bundlerSink
+}
+
+func (bf *bundlerFile) Close() error {
+	bf.sink.pending = bf.PipeWriter
+	return nil
+}
+
+// CloseWithError() is the same as Close(), since the file ends with the
+// bundle's error either way.
+func (bf *bundlerFile) CloseWithError(err error) error {
+	return bf.Close()
+}
@@ -0,0 +1,161 @@
+package aws_bundle
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"testing"
+	"testing/iotest"
+)
+
+func TestBundler(t *testing.T) {
+	image := testImage()
+	md := testMetadata()
+
+	b, err := NewBundler(bytes.NewReader(image), int64(len(image)), md)
+	if err != nil {
+		t.Fatalf("NewBundler() error = %v", err)
+	}
+	defer b.Close()
+	if _, err := b.Info(); err != ErrBundlerNotFinished {
+		t.Errorf("Info() before finishing error = %v", err)
+	}
+
+	sink := newAccumulatingSink()
+	var filenames []string
+	var parts []PartInfo
+	for {
+		part, err := b.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatalf("Next() error = %v", err)
+		}
+		if _, err := part.Info(); err != ErrPartNotRead {
+			t.Errorf("%s: Info() before reading error = %v", part.Filename, err)
+		}
+		contents, err := ioutil.ReadAll(iotest.OneByteReader(io.LimitReader(part, 1000)))
+		if err != nil {
+			t.Fatalf("%s: Read() error = %v", part.Filename, err)
+		}
+		rest, err := ioutil.ReadAll(part)
+		if err != nil {
+			t.Fatalf("%s: Read() error = %v", part.Filename, err)
+		}
+		contents = append(contents, rest...)
+		sink.files[part.Filename] = bytes.NewBuffer(contents)
+		filenames = append(filenames, part.Filename)
+
+		info, err := part.Info()
+		if err != nil || info.Index != part.Index || info.Filename != part.Filename ||
+			info.Size != int64(len(contents)) || info.SHA1 != fmt.Sprintf("%x", sha1.Sum(contents)) {
+			t.Errorf("%s: Info() = %+v, %v", part.Filename, info, err)
+		}
+		if part.Index >= 0 {
+			parts = append(parts, info)
+		}
+	}
+	if fmt.Sprint(filenames) != "[test.part.0 test.part.1 test.manifest.xml]" {
+		t.Fatalf("Next() returned %v", filenames)
+	}
+
+	info, err := b.Info()
+	if err != nil {
+		t.Fatalf("Info() error = %v", err)
+	}
+	if fmt.Sprint(info.Parts) != fmt.Sprint(parts) {
+		t.Errorf("Info().Parts = %+v, but the parts read were %+v", info.Parts, parts)
+	}
+	m, err := unmarshalManifest(sink.files["test.manifest.xml"].Bytes())
+	if err != nil {
+		t.Fatalf("unmarshalManifest() error = %v", err)
+	}
+	if m.Image.Digest.Value != info.ImageDigest || m.Image.BundledSize != info.BundledSize {
+		t.Errorf("manifest %+v doesn't match Info() %+v", m.Image, info)
+	}
+	if _, bundled := readTestBundle(t, sink, b.w); !bytes.Equal(bundled, image) {
+		t.Errorf("the bundled image doesn't match the original")
+	}
+
+	if _, err := b.Next(); err != io.EOF {
+		t.Errorf("Next() after finishing error = %v", err)
+	}
+}
+
+func TestBundlerFailures(t *testing.T) {
+	image := testImage()
+	md := testMetadata()
+
+	if _, err := NewBundler(bytes.NewReader(image), int64(len(image)), Metadata{Name: "test"}); err == nil {
+		t.Errorf("NewBundler() with invalid metadata succeeded")
+	}
+
+	// parts have to be read in order
+	b, err := NewBundler(bytes.NewReader(image), int64(len(image)), md)
+	if err != nil {
+		t.Fatalf("NewBundler() error = %v", err)
+	}
+	part, err := b.Next()
+	if err != nil {
+		t.Fatalf("Next() error = %v", err)
+	}
+	if _, err := b.Next(); err != ErrPartNotRead {
+		t.Errorf("Next() before reading the part error = %v", err)
+	}
+
+	// closing stops the pipeline, failing reads
+	part.Read(make([]byte, 100))
+	if err := b.Close(); err != nil {
+		t.Errorf("Close() error = %v", err)
+	}
+	if _, err := ioutil.ReadAll(part); err != ErrBundlerClosed {
+		t.Errorf("Read() after Close() error = %v", err)
+	}
+	if _, err := b.Next(); err != ErrBundlerClosed {
+		t.Errorf("Next() after Close() error = %v", err)
+	}
+	if err := b.Close(); err != nil {
+		t.Errorf("second Close() error = %v", err)
+	}
+
+	// a failure ends the last file with an error, and no manifest follows
+	for _, test := range []struct {
+		name   string
+		src    io.Reader
+		target error
+	}{
+		{"read error", io.MultiReader(bytes.NewReader(image[:11<<20]), iotest.TimeoutReader(bytes.NewReader(image))), iotest.ErrTimeout},
+		{"short", bytes.NewReader(image[:11<<20]), nil},
+	} {
+		b, err := NewBundler(test.src, int64(len(image)), md)
+		if err != nil {
+			t.Fatalf("NewBundler() error = %v", err)
+		}
+		var filenames []string
+		var readErr error
+		for {
+			part, err := b.Next()
+			if err != nil {
+				var mismatch *SizeMismatchError
+				if err == io.EOF || (test.target != nil && !errors.Is(err, test.target)) || (test.target == nil && !errors.As(err, &mismatch)) {
+					t.Errorf("%s: Next() error = %v", test.name, err)
+				}
+				break
+			}
+			filenames = append(filenames, part.Filename)
+			_, readErr = ioutil.ReadAll(part)
+		}
+		// how many parts there were depends on compression's buffering, but
+		// whatever was still being written ends with the error
+		if readErr == nil || len(filenames) == 0 || filenames[len(filenames)-1] == "test.manifest.xml" {
+			t.Errorf("%s: read %v, ending with error %v", test.name, filenames, readErr)
+		}
+		if _, err := b.Info(); err == nil {
+			t.Errorf("%s: Info() succeeded", test.name)
+		}
+		b.Close()
+	}
+}
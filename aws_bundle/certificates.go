@@ -1,9 +1,16 @@
 package aws_bundle
 
 import (
+	"crypto/rsa"
+	"crypto/sha256"
 	"crypto/x509"
 	"encoding/pem"
 	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
 )
 
 // According to the docs [1], different EC2 regions decrypt instance store AMIs
@@ -93,26 +100,245 @@ Bw/yCpzeJoLBWvFDlunBNu2s0Y3ddFdnlna/k7CQM1Js6+OGQBMh1zTtJlPkkHj3
 mbaTR6i5yro01FowChTryrRTVfMe
 -----END CERTIFICATE-----`
 
-func CertificateForEC2Region(region string) (*x509.Certificate, error) {
-	var pemStr string
+// A CertificateRegistry maps EC2 regions to the certificates whose public keys
+// are used to encrypt bundle secrets for those regions.
+//
+// Certificates can be registered for individual regions or for entire
+// partitions; a region's own certificate takes precedence over its partition's.
+// This matters because AWS adds regions faster than ec2-ami-tools ships
+// certificates, and because encrypting a manifest to the wrong key produces
+// an AMI which can be registered but never launched.
+type CertificateRegistry struct {
+	mu         sync.RWMutex
+	strict     bool
+	regions    map[string]*x509.Certificate
+	partitions map[string]*x509.Certificate
+}
 
+// DefaultCertificates is the registry used by CertificateForEC2Region() and
+// by Metadata.WriteManifest() when no other registry is specified.
+var DefaultCertificates = NewCertificateRegistry()
+
+// NewCertificateRegistry() returns a registry containing the certificates
+// shipped with ec2-ami-tools:
+//
+//   - cert-ec2.pem for the "aws" partition
+//   - cert-ec2-gov.pem for us-gov-west-1
+//   - cert-ec2-cn-north-1.pem for cn-north-1
+//
+// Other regions in the "aws-cn" and "aws-us-gov" partitions have no known
+// certificate; register one if you need it.
+func NewCertificateRegistry() *CertificateRegistry {
 	// Docs:
 	//  --ec2cert path
 	//    The path to the Amazon EC2 X.509 public key certificate used to encrypt the image manifest.
 	//    Required: Only for the us-gov-west-1 and cn-north-1 regions.
 	// http://docs.aws.amazon.com/AWSEC2/latest/CommandLineReference/CLTRG-ami-bundle-image.html
+	r := &CertificateRegistry{
+		regions:    make(map[string]*x509.Certificate),
+		partitions: make(map[string]*x509.Certificate),
+	}
+	r.RegisterPartition(PartitionAWS, mustParseCertificatePEM(certEc2))
+	r.RegisterRegion("us-gov-west-1", mustParseCertificatePEM(certEc2Gov))
+	r.RegisterRegion("cn-north-1", mustParseCertificatePEM(certEc2CnNorth1))
+	return r
+}
+
+// SetStrict() causes lookups for regions not in KnownRegions() and without
+// their own certificate to fail, rather than fall back to the partition's
+// certificate. This catches typos.
+func (r *CertificateRegistry) SetStrict(strict bool) {
+	r.mu.Lock()
+	r.strict = strict
+	r.mu.Unlock()
+}
+
+// RegisterRegion() sets the certificate for a region, replacing any existing
+// certificate.
+func (r *CertificateRegistry) RegisterRegion(region string, cert *x509.Certificate) {
+	r.mu.Lock()
+	r.regions[region] = cert
+	r.mu.Unlock()
+}
+
+// RegisterPartition() sets the certificate for all regions in a partition
+// which do not have their own, replacing any existing certificate.
+func (r *CertificateRegistry) RegisterPartition(partition string, cert *x509.Certificate) {
+	r.mu.Lock()
+	r.partitions[partition] = cert
+	r.mu.Unlock()
+}
+
+// RegisterRegionPEM() is like RegisterRegion(), but parses a PEM-encoded
+// certificate, e.g. one passed to ec2-ami-tools via --ec2cert.
+func (r *CertificateRegistry) RegisterRegionPEM(region string, pemBytes []byte) error {
+	cert, err := ParseCertificatePEM(pemBytes)
+	if err != nil {
+		return err
+	}
+
+	r.RegisterRegion(region, cert)
+	return nil
+}
+
+// RegisterPartitionPEM() is like RegisterPartition(), but parses a
+// PEM-encoded certificate.
+func (r *CertificateRegistry) RegisterPartitionPEM(partition string, pemBytes []byte) error {
+	cert, err := ParseCertificatePEM(pemBytes)
+	if err != nil {
+		return err
+	}
+
+	r.RegisterPartition(partition, cert)
+	return nil
+}
+
+// hasRegion() indicates if the region has its own certificate.
+func (r *CertificateRegistry) hasRegion(region string) bool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	_, ok := r.regions[region]
+	return ok
+}
+
+// CertificateForRegion() returns the certificate to be used for the given
+// region.
+func (r *CertificateRegistry) CertificateForRegion(region string) (*x509.Certificate, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
 
-	switch region {
-	case "us-gov-west-1":
-		pemStr = certEc2Gov
-	case "cn-north-1":
-		pemStr = certEc2CnNorth1
-	default:
-		pemStr = certEc2
+	// Does this region have its own certificate?
+	if cert, ok := r.regions[region]; ok {
+		return cert, nil
 	}
 
+	// Do we know this region?
+	if r.strict && !IsKnownRegion(region) {
+		return nil, &CertificateError{Region: region, Partition: PartitionForRegion(region), Err: ErrUnknownRegion}
+	}
+
+	// Does its partition have a certificate?
+	partition := PartitionForRegion(region)
+	if cert, ok := r.partitions[partition]; ok {
+		return cert, nil
+	}
+
+	return nil, &CertificateError{Region: region, Partition: partition, Err: ErrNoCertificate}
+}
+
+// CertificateInfo describes which certificate applies to a region or
+// partition, for the benefit of humans who need to know which public key
+// their bundles are encrypted to.
+type CertificateInfo struct {
+	Region    string // empty if this entry describes a partition
+	Partition string
+	Inherited bool // the region has no certificate of its own, and uses the partition's
+
+	Certificate *x509.Certificate // nil if no certificate applies
+	Error       error             // the reason no certificate applies
+
+	Subject           string
+	Serial            string // hexadecimal, like `openssl x509 -serial`
+	SHA256Fingerprint string // colon-separated hexadecimal, like `openssl x509 -fingerprint`
+	KeyBits           int
+	NotBefore         time.Time
+	NotAfter          time.Time
+}
+
+// Inventory() describes every partition with a certificate, followed by every
+// region which is either known or has a certificate registered, sorted by
+// name.
+func (r *CertificateRegistry) Inventory() []CertificateInfo {
+	r.mu.RLock()
+	partitions := make([]string, 0, len(r.partitions))
+	for partition := range r.partitions {
+		partitions = append(partitions, partition)
+	}
+	regions := KnownRegions()
+	for region := range r.regions {
+		if !IsKnownRegion(region) {
+			regions = append(regions, region)
+		}
+	}
+	r.mu.RUnlock()
+
+	sort.Strings(partitions)
+	sort.Strings(regions)
+
+	inventory := make([]CertificateInfo, 0, len(partitions)+len(regions))
+	for _, partition := range partitions {
+		r.mu.RLock()
+		cert := r.partitions[partition]
+		r.mu.RUnlock()
+
+		inventory = append(inventory, newCertificateInfo("", partition, cert))
+	}
+	for _, region := range regions {
+		cert, err := r.CertificateForRegion(region)
+		info := newCertificateInfo(region, PartitionForRegion(region), cert)
+		info.Error = err
+		info.Inherited = cert != nil && !r.hasRegion(region)
+
+		inventory = append(inventory, info)
+	}
+
+	return inventory
+}
+
+// CertificateInventory() returns DefaultCertificates.Inventory().
+func CertificateInventory() []CertificateInfo {
+	return DefaultCertificates.Inventory()
+}
+
+func newCertificateInfo(region, partition string, cert *x509.Certificate) CertificateInfo {
+	info := CertificateInfo{
+		Region:      region,
+		Partition:   partition,
+		Certificate: cert,
+	}
+	if cert == nil {
+		return info
+	}
+
+	info.Subject = cert.Subject.String()
+	info.Serial = fmt.Sprintf("%X", cert.SerialNumber)
+	info.NotBefore = cert.NotBefore
+	info.NotAfter = cert.NotAfter
+
+	sum := sha256.Sum256(cert.Raw)
+	hexBytes := make([]string, len(sum))
+	for i, b := range sum {
+		hexBytes[i] = fmt.Sprintf("%02X", b)
+	}
+	info.SHA256Fingerprint = strings.Join(hexBytes, ":")
+
+	if key, ok := cert.PublicKey.(*rsa.PublicKey); ok {
+		info.KeyBits = key.N.BitLen()
+	}
+
+	return info
+}
+
+// EncodeCertificatePEM() returns a certificate in PEM format, e.g. for
+// comparison against the files shipped with ec2-ami-tools.
+func EncodeCertificatePEM(cert *x509.Certificate) []byte {
+	return pem.EncodeToMemory(&pem.Block{
+		Type:  "CERTIFICATE",
+		Bytes: cert.Raw,
+	})
+}
+
+// CertificateForEC2Region() returns the certificate to be used for the given
+// region according to DefaultCertificates.
+func CertificateForEC2Region(region string) (*x509.Certificate, error) {
+	return DefaultCertificates.CertificateForRegion(region)
+}
+
+// ParseCertificatePEM() parses the first certificate in a PEM file.
+func ParseCertificatePEM(pemBytes []byte) (*x509.Certificate, error) {
 	// Parse the PEM block to get DER
-	block, _ := pem.Decode([]byte(pemStr))
+	block, _ := pem.Decode(pemBytes)
 	if block == nil {
 		return nil, errors.New("unable to parse PEM block")
 	}
@@ -120,3 +346,11 @@ func CertificateForEC2Region(region string) (*x509.Certificate, error) {
 	// Parse the DER to get a certificate
 	return x509.ParseCertificate(block.Bytes)
 }
+
+func mustParseCertificatePEM(pemStr string) *x509.Certificate {
+	cert, err := ParseCertificatePEM([]byte(pemStr))
+	if err != nil {
+		panic(err)
+	}
+	return cert
+}
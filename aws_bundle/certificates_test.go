@@ -2,6 +2,8 @@ package aws_bundle
 
 import (
 	"crypto/rsa"
+	"crypto/x509"
+	"errors"
 	"testing"
 )
 
@@ -39,3 +41,176 @@ func TestCertificateForEC2Region(t *testing.T) {
 		}
 	}
 }
+
+// the certificates' moduli, as checked by TestCertificateForEC2Region()
+var (
+	ec2Modulus         = certificateModulus(mustParseCertificatePEM(certEc2))
+	ec2GovModulus      = certificateModulus(mustParseCertificatePEM(certEc2Gov))
+	ec2CnNorth1Modulus = certificateModulus(mustParseCertificatePEM(certEc2CnNorth1))
+)
+
+func certificateModulus(cert *x509.Certificate) string {
+	if cert != nil && cert.PublicKey != nil {
+		return cert.PublicKey.(*rsa.PublicKey).N.Text(16)
+	}
+	return ""
+}
+
+func TestCertificateRegistry(t *testing.T) {
+	r := NewCertificateRegistry()
+
+	// partitions without a certificate must not fall back to the standard one
+	for _, region := range []string{"cn-northwest-1", "us-gov-east-1", "us-iso-east-1"} {
+		var certErr *CertificateError
+		if cert, err := r.CertificateForRegion(region); err == nil {
+			t.Errorf("CertificateForRegion(%q) = modulus %v, expected an error", region, certificateModulus(cert))
+		} else if !errors.Is(err, ErrNoCertificate) || !errors.As(err, &certErr) || certErr.Region != region {
+			t.Errorf("CertificateForRegion(%q) error = %#v, expected ErrNoCertificate", region, err)
+		}
+	}
+
+	// registering a region takes precedence over its partition
+	r.RegisterRegion("cn-northwest-1", mustParseCertificatePEM(certEc2CnNorth1))
+	r.RegisterRegion("us-west-2", mustParseCertificatePEM(certEc2Gov))
+	if err := r.RegisterRegionPEM("us-gov-east-1", []byte(certEc2Gov)); err != nil {
+		t.Errorf("RegisterRegionPEM() error = %v", err)
+	}
+	if err := r.RegisterRegionPEM("us-gov-east-2", []byte("garbage")); err == nil {
+		t.Errorf("RegisterRegionPEM() succeeded with garbage")
+	}
+
+	// registering a partition covers regions not known yet
+	if err := r.RegisterPartitionPEM(PartitionAWSISO, []byte(certEc2Gov)); err != nil {
+		t.Errorf("RegisterPartitionPEM() error = %v", err)
+	}
+
+	tests := []struct {
+		region   string
+		expected string
+	}{
+		{"us-east-1", ec2Modulus},
+		{"us-west-2", ec2GovModulus},
+		{"atlantis-4", ec2Modulus},
+		{"cn-north-1", ec2CnNorth1Modulus},
+		{"cn-northwest-1", ec2CnNorth1Modulus},
+		{"us-gov-east-1", ec2GovModulus},
+		{"us-iso-west-9", ec2GovModulus},
+	}
+	for _, tt := range tests {
+		cert, err := r.CertificateForRegion(tt.region)
+		if err != nil {
+			t.Errorf("CertificateForRegion(%q) error = %v", tt.region, err)
+		} else if modulus := certificateModulus(cert); modulus != tt.expected {
+			t.Errorf("CertificateForRegion(%q) = modulus %v, expected %v", tt.region, modulus, tt.expected)
+		}
+	}
+
+	// strict mode rejects regions we don't know, unless they have their own certificate
+	r.SetStrict(true)
+	for _, region := range []string{"atlantis-4", "us-esat-1", "us-iso-west-9"} {
+		if _, err := r.CertificateForRegion(region); !errors.Is(err, ErrUnknownRegion) {
+			t.Errorf("strict CertificateForRegion(%q) error = %v, expected ErrUnknownRegion", region, err)
+		}
+	}
+	r.RegisterRegion("atlantis-4", mustParseCertificatePEM(certEc2))
+	for _, region := range []string{"us-east-1", "cn-northwest-1", "atlantis-4"} {
+		if _, err := r.CertificateForRegion(region); err != nil {
+			t.Errorf("strict CertificateForRegion(%q) error = %v", region, err)
+		}
+	}
+
+	// none of this should have touched the defaults
+	if _, err := CertificateForEC2Region("cn-northwest-1"); err == nil {
+		t.Errorf("CertificateForEC2Region(\"cn-northwest-1\") succeeded after registering on another registry")
+	}
+}
+
+func TestPartitionForRegion(t *testing.T) {
+	tests := []struct {
+		region    string
+		partition string
+	}{
+		{"us-east-1", PartitionAWS},
+		{"eu-central-2", PartitionAWS},
+		{"atlantis-4", PartitionAWS},
+		{"cn-north-1", PartitionAWSCN},
+		{"cn-northwest-1", PartitionAWSCN},
+		{"us-gov-west-1", PartitionAWSUSGov},
+		{"us-gov-east-1", PartitionAWSUSGov},
+		{"us-iso-east-1", PartitionAWSISO},
+		{"us-isob-east-1", PartitionAWSISOB},
+	}
+	for _, tt := range tests {
+		if partition := PartitionForRegion(tt.region); partition != tt.partition {
+			t.Errorf("PartitionForRegion(%q) = %q, expected %q", tt.region, partition, tt.partition)
+		}
+	}
+}
+
+func TestCertificateInventory(t *testing.T) {
+	inventory := CertificateInventory()
+
+	byName := make(map[string]CertificateInfo)
+	for _, info := range inventory {
+		name := info.Region
+		if name == "" {
+			name = "partition " + info.Partition
+		}
+		byName[name] = info
+	}
+
+	// the standard certificate, as described by `openssl x509 -fingerprint -sha256 -serial`
+	if info := byName["partition aws"]; info.Certificate == nil {
+		t.Errorf("expected a certificate for the aws partition")
+	} else {
+		if info.SHA256Fingerprint != "F5:70:7A:ED:B5:42:51:79:8F:6B:BC:C1:A1:0A:9C:FD:1F:21:FC:69:90:9E:A1:27:63:19:AA:2F:09:8E:47:90" {
+			t.Errorf("unexpected fingerprint %v", info.SHA256Fingerprint)
+		}
+		if info.Serial != "B0E7655FA5A59752" {
+			t.Errorf("unexpected serial %v", info.Serial)
+		}
+		if info.KeyBits != 1024 {
+			t.Errorf("unexpected key size %d", info.KeyBits)
+		}
+		if info.NotAfter.Year() != 2006 {
+			t.Errorf("unexpected expiration %v", info.NotAfter)
+		}
+	}
+
+	tests := []struct {
+		region    string
+		modulus   string
+		inherited bool
+	}{
+		{"us-east-1", ec2Modulus, true},
+		{"eu-west-1", ec2Modulus, true},
+		{"us-gov-west-1", ec2GovModulus, false},
+		{"cn-north-1", ec2CnNorth1Modulus, false},
+		{"cn-northwest-1", "", false},
+		{"us-gov-east-1", "", false},
+	}
+	for _, tt := range tests {
+		info, ok := byName[tt.region]
+		if !ok {
+			t.Errorf("expected %q in the inventory", tt.region)
+			continue
+		}
+		if modulus := certificateModulus(info.Certificate); modulus != tt.modulus {
+			t.Errorf("inventory for %q has modulus %v, expected %v", tt.region, modulus, tt.modulus)
+		}
+		if info.Inherited != tt.inherited {
+			t.Errorf("inventory for %q has Inherited = %v, expected %v", tt.region, info.Inherited, tt.inherited)
+		}
+		if (info.Certificate == nil) != (info.Error != nil) {
+			t.Errorf("inventory for %q has certificate %v and error %v", tt.region, info.Certificate != nil, info.Error)
+		}
+	}
+
+	// exported PEMs should round-trip
+	cert := byName["cn-north-1"].Certificate
+	if parsed, err := ParseCertificatePEM(EncodeCertificatePEM(cert)); err != nil {
+		t.Errorf("ParseCertificatePEM(EncodeCertificatePEM()) error = %v", err)
+	} else if !parsed.Equal(cert) {
+		t.Errorf("ParseCertificatePEM(EncodeCertificatePEM()) returned a different certificate")
+	}
+}
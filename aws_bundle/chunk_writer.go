@@ -1,6 +1,7 @@
 package aws_bundle
 
 import (
+	"errors"
 	"fmt"
 	"io"
 )
@@ -23,6 +24,9 @@ type chunkWriter struct {
 	}
 
 	sha1 map[string]string
+
+	err    error // the first error we encountered, returned by all subsequent calls
+	closed bool
 }
 
 func newChunkWriter(sink Sink, name string, chunkSize int) *chunkWriter {
@@ -36,13 +40,23 @@ func newChunkWriter(sink Sink, name string, chunkSize int) *chunkWriter {
 }
 
 func (cw *chunkWriter) Write(p []byte) (n int, err error) {
+	if cw.closed {
+		return 0, ErrWriterClosed
+	}
+	if cw.err != nil {
+		return 0, cw.err
+	}
+
 	for len(p) > 0 {
 		// we have something to write
 		// how many bytes can we write in this chunk?
 		bytes := cw.bytesRemainingInChunk()
 		if bytes == 0 {
 			// rotate
-			cw.newChunk()
+			if err := cw.newChunk(); err != nil {
+				cw.err = err
+				return n, err
+			}
 		} else {
 			// determine how many bytes we want to write
 			if bytes > len(p) {
@@ -59,8 +73,12 @@ func (cw *chunkWriter) Write(p []byte) (n int, err error) {
 			cw.current.offset += thisN
 
 			// handle errors
+			if thisErr == nil && thisN < len(now) {
+				thisErr = io.ErrShortWrite
+			}
 			if thisErr != nil {
-				return n, thisErr
+				cw.err = cw.sinkError("write", thisErr)
+				return n, cw.err
 			}
 		}
 	}
@@ -68,18 +86,50 @@ func (cw *chunkWriter) Write(p []byte) (n int, err error) {
 	return n, nil
 }
 
+// Close() closes the current chunk, if any. If an earlier write failed, the
+// chunk is incomplete, so it's abandoned instead.
 func (cw *chunkWriter) Close() error {
-	if cw.current.w != nil {
-		return cw.closeChunk()
+	if cw.closed {
+		return ErrWriterClosed
 	}
+	cw.closed = true
 
-	return nil
+	var closeErr error
+	if cw.current.w != nil && cw.err != nil {
+		closeErr = cw.abandonChunk(cw.err)
+	} else if cw.current.w != nil {
+		closeErr = cw.closeChunk()
+	}
+
+	// report the earlier error first, since that is likely the underlying cause
+	return errors.Join(cw.err, closeErr)
+}
+
+// abort() fails the chunkWriter with err, unless it already failed, and
+// closes it, abandoning the current chunk.
+func (cw *chunkWriter) abort(err error) error {
+	if cw.err == nil && !cw.closed {
+		cw.err = err
+	}
+	return cw.Close()
 }
 
 func (cw *chunkWriter) closeChunk() error {
 	err := cw.current.w.Close()
 	cw.current.w = nil
-	return err
+	if err != nil {
+		return cw.sinkError("close", err)
+	}
+	return nil
+}
+
+func (cw *chunkWriter) abandonChunk(cause error) error {
+	err := closeWithError(cw.current.w, cause)
+	cw.current.w = nil
+	if err != nil {
+		return cw.sinkError("close", err)
+	}
+	return nil
 }
 
 func (cw *chunkWriter) newChunk() error {
@@ -93,7 +143,7 @@ func (cw *chunkWriter) newChunk() error {
 	cw.current.index++
 	cw.current.offset = 0
 	if w, err := cw.sink.WriteBundleFile(cw.current.filename); err != nil {
-		return err
+		return cw.sinkError("open", err)
 	} else {
 		cw.current.w = w
 	}
@@ -101,6 +151,16 @@ func (cw *chunkWriter) newChunk() error {
 	return nil
 }
 
+// sinkError() describes a failure involving the current chunk.
+func (cw *chunkWriter) sinkError(op string, err error) error {
+	return &SinkError{
+		Op:       op,
+		Filename: cw.current.filename,
+		Index:    cw.current.index - 1,
+		Err:      err,
+	}
+}
+
 func (cw *chunkWriter) bytesRemainingInChunk() int {
 	if cw.current.w == nil {
 		// no current chunk
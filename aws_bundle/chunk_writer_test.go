@@ -2,6 +2,7 @@ package aws_bundle
 
 import (
 	"bytes"
+	"errors"
 	"io"
 	"testing"
 )
@@ -35,6 +36,111 @@ func (nopWriteCloser) Close() error {
 	return nil
 }
 
+var errInjected = errors.New("injected fault")
+
+// faultySink is an accumulatingSink which fails at configurable points:
+// opening, writing to, or closing the file with a given index. Indices are
+// -1 to never fail.
+type faultySink struct {
+	*accumulatingSink
+
+	failOpen       int // fail WriteBundleFile() for this file
+	failWrite      int // fail writes to this file...
+	failWriteAfter int // ...once this many bytes have been written to it
+	failClose      int // fail Close() for this file
+
+	opened  int      // how many files were opened
+	open    []string // which files are still open
+	aborted []string // which files were closed with an error, and discarded
+}
+
+func newFaultySink() *faultySink {
+	return &faultySink{
+		accumulatingSink: newAccumulatingSink(),
+		failOpen:         -1,
+		failWrite:        -1,
+		failClose:        -1,
+	}
+}
+
+func (fs *faultySink) WriteBundleFile(filename string) (io.WriteCloser, error) {
+	index := fs.opened
+	fs.opened++
+	if index == fs.failOpen {
+		return nil, errInjected
+	}
+
+	w, err := fs.accumulatingSink.WriteBundleFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	fs.open = append(fs.open, filename)
+
+	return &faultySinkFile{sink: fs, filename: filename, index: index, w: w}, nil
+}
+
+type faultySinkFile struct {
+	sink     *faultySink
+	filename string
+	index    int
+	w        io.WriteCloser
+	written  int
+	closed   bool
+}
+
+func (f *faultySinkFile) Write(p []byte) (n int, err error) {
+	if f.closed {
+		panic("write to closed file " + f.filename)
+	}
+
+	if f.index == f.sink.failWrite {
+		if remaining := f.sink.failWriteAfter - f.written; remaining < len(p) {
+			if remaining < 0 {
+				remaining = 0
+			}
+			n, _ = f.w.Write(p[:remaining])
+			f.written += n
+			return n, errInjected
+		}
+	}
+
+	n, err = f.w.Write(p)
+	f.written += n
+	return n, err
+}
+
+func (f *faultySinkFile) Close() error {
+	f.release()
+
+	if f.index == f.sink.failClose {
+		f.w.Close()
+		return errInjected
+	}
+	return f.w.Close()
+}
+
+func (f *faultySinkFile) CloseWithError(err error) error {
+	f.release()
+	f.sink.aborted = append(f.sink.aborted, f.filename)
+	delete(f.sink.files, f.filename)
+	return nil
+}
+
+// release() marks the file closed, which it must not have been already.
+func (f *faultySinkFile) release() {
+	if f.closed {
+		panic("double close of file " + f.filename)
+	}
+	f.closed = true
+
+	for i, name := range f.sink.open {
+		if name == f.filename {
+			f.sink.open = append(f.sink.open[:i], f.sink.open[i+1:]...)
+			break
+		}
+	}
+}
+
 func testChunkWriter(t *testing.T, writeSize int) {
 	sink := newAccumulatingSink()
 	cw := newChunkWriter(sink, "test", 100)
@@ -96,3 +202,60 @@ func TestChunkWriter(t *testing.T) {
 		testChunkWriter(t, size)
 	}
 }
+
+func TestChunkWriterFaults(t *testing.T) {
+	input := bytes.Repeat([]byte("0123456789"), 100)
+
+	tests := []struct {
+		name  string
+		setup func(fs *faultySink)
+	}{
+		{"open first", func(fs *faultySink) { fs.failOpen = 0 }},
+		{"open later", func(fs *faultySink) { fs.failOpen = 3 }},
+		{"write first", func(fs *faultySink) { fs.failWrite = 0; fs.failWriteAfter = 0 }},
+		{"write partway", func(fs *faultySink) { fs.failWrite = 2; fs.failWriteAfter = 37 }},
+		{"close rotated", func(fs *faultySink) { fs.failClose = 1 }},
+		{"close last", func(fs *faultySink) { fs.failClose = 9 }},
+	}
+	for _, tt := range tests {
+		for _, writeSize := range []int{1000, 100, 33, 1} {
+			fs := newFaultySink()
+			tt.setup(fs)
+			cw := newChunkWriter(fs, "test", 100)
+
+			// write until something fails
+			var writeErr error
+			for p := input; len(p) > 0 && writeErr == nil; {
+				n := writeSize
+				if n > len(p) {
+					n = len(p)
+				}
+				_, writeErr = cw.Write(p[:n])
+				p = p[n:]
+			}
+
+			// once failed, always failed
+			if writeErr != nil {
+				if _, err := cw.Write([]byte("more")); err != writeErr {
+					t.Errorf("%s/%d: Write() after failure = %v, expected %v", tt.name, writeSize, err, writeErr)
+				}
+			}
+
+			closeErr := cw.Close()
+			if !errors.Is(closeErr, errInjected) {
+				t.Errorf("%s/%d: Close() = %v, expected the injected fault", tt.name, writeSize, closeErr)
+			}
+			if len(fs.open) > 0 {
+				t.Errorf("%s/%d: files left open: %v", tt.name, writeSize, fs.open)
+			}
+
+			// closed is closed
+			if _, err := cw.Write([]byte("more")); err == nil {
+				t.Errorf("%s/%d: Write() after Close() succeeded", tt.name, writeSize)
+			}
+			if err := cw.Close(); err == nil {
+				t.Errorf("%s/%d: second Close() succeeded", tt.name, writeSize)
+			}
+		}
+	}
+}
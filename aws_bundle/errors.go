@@ -0,0 +1,94 @@
+package aws_bundle
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Errors returned by this package can be inspected using errors.Is() and
+// errors.As(). Broadly, a *SinkError means the output side failed and the
+// bundle might succeed if retried, while the others indicate a problem with
+// the input or the metadata which retrying won't fix.
+
+// ErrWriterClosed is returned when writing to or closing a Writer which was
+// already closed.
+var ErrWriterClosed = errors.New("Writer is already closed")
+
+// ErrWriterNotClosed is returned when asking for a Writer's Info() before
+// it's been closed.
+var ErrWriterNotClosed = errors.New("Writer is not closed yet")
+
+// ErrBundlerClosed is returned when reading from a Bundler, or from one of its
+// Parts, after the Bundler was closed.
+var ErrBundlerClosed = errors.New("Bundler is closed")
+
+// ErrPartNotRead is returned by Bundler.Next() when the previous Part hasn't
+// been read completely, and by Part.Info() when that Part hasn't.
+var ErrPartNotRead = errors.New("Part has not been read completely")
+
+// ErrBundlerNotFinished is returned when asking for a Bundler's Info() before
+// Next() has returned io.EOF.
+var ErrBundlerNotFinished = errors.New("Bundler has not finished yet")
+
+// Reasons for a *CertificateError.
+var (
+	ErrUnknownRegion     = errors.New("unknown region")
+	ErrNoCertificate     = errors.New("no certificate is known")
+	ErrCertificateNotRSA = errors.New("certificate does not contain an RSA key")
+)
+
+// SizeMismatchError indicates that the number of bytes written to a Writer
+// differed from the size given to NewWriter(). Overruns are detected as soon
+// as they're attempted, so for those, Actual is a lower bound.
+type SizeMismatchError struct {
+	Expected int64
+	Actual   int64
+}
+
+func (e *SizeMismatchError) Error() string {
+	if e.Actual > e.Expected {
+		return fmt.Sprintf("image exceeds expected size: expected %d bytes, tried to write at least %d bytes", e.Expected, e.Actual)
+	}
+	return fmt.Sprintf("expected %d bytes, actually wrote %d bytes", e.Expected, e.Actual)
+}
+
+// SinkError indicates that a Sink, or one of the io.WriteClosers it returned,
+// failed.
+type SinkError struct {
+	Op       string // "open", "write", or "close"
+	Filename string // the bundle file, e.g. "image.part.3" or "image.manifest.xml"
+	Index    int    // the part index, or -1 for the manifest
+	Err      error  // the error returned by the Sink
+}
+
+func (e *SinkError) Error() string {
+	return fmt.Sprintf("unable to %s bundle file %q: %v", e.Op, e.Filename, e.Err)
+}
+
+func (e *SinkError) Unwrap() error {
+	return e.Err
+}
+
+// CertificateError indicates that no usable EC2 certificate could be found
+// for a region. Err is ErrUnknownRegion, ErrNoCertificate, or
+// ErrCertificateNotRSA.
+type CertificateError struct {
+	Region    string
+	Partition string
+	Err       error
+}
+
+func (e *CertificateError) Error() string {
+	switch e.Err {
+	case ErrUnknownRegion:
+		return fmt.Sprintf("unknown region %q", e.Region)
+	case ErrNoCertificate:
+		return fmt.Sprintf("no certificate is known for region %q in partition %q", e.Region, e.Partition)
+	default:
+		return fmt.Sprintf("certificate for region %q: %v", e.Region, e.Err)
+	}
+}
+
+func (e *CertificateError) Unwrap() error {
+	return e.Err
+}
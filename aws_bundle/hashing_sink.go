@@ -16,6 +16,7 @@ type hashingSink struct {
 type hashingSinkFile struct {
 	filename string
 	hash     []byte
+	size     int64
 }
 
 func newHashingSink(sink Sink) *hashingSink {
@@ -28,6 +29,7 @@ type hashingSinkWriter struct {
 	sink *hashingSink
 	name string
 	h    hash.Hash
+	size int64
 	w    io.WriteCloser
 }
 
@@ -55,7 +57,9 @@ func (hsw *hashingSinkWriter) Write(p []byte) (n int, err error) {
 	}
 
 	// delegate
-	return hsw.w.Write(p)
+	n, err = hsw.w.Write(p)
+	hsw.size += int64(n)
+	return n, err
 }
 
 func (hsw *hashingSinkWriter) Close() error {
@@ -63,6 +67,7 @@ func (hsw *hashingSinkWriter) Close() error {
 	file := hashingSinkFile{
 		filename: hsw.name,
 		hash:     hsw.h.Sum(nil),
+		size:     hsw.size,
 	}
 
 	// record this file on the hashing sink
@@ -73,3 +78,8 @@ func (hsw *hashingSinkWriter) Close() error {
 	// delegate
 	return hsw.w.Close()
 }
+
+// CloseWithError() abandons the file, which therefore isn't recorded.
+func (hsw *hashingSinkWriter) CloseWithError(err error) error {
+	return closeWithError(hsw.w, err)
+}
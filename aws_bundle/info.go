@@ -0,0 +1,115 @@
+package aws_bundle
+
+import (
+	"crypto"
+	"crypto/sha256"
+	"crypto/x509"
+	"fmt"
+)
+
+// Info describes a bundle, as written by a Writer.
+type Info struct {
+	// ImageDigest is the hex-encoded SHA1 of the tarred image, as recorded in
+	// the manifest.
+	ImageDigest string
+
+	// ImageSize is the size of the image in the bundle, including any
+	// padding, and BundledSize is the total size of the parts.
+	ImageSize   int64
+	BundledSize int64
+
+	// Parts lists the bundle's part files, in order.
+	Parts []PartInfo
+
+	// UserKeyFingerprint identifies the user key which signed the manifest,
+	// and to which the manifest's secrets are encrypted; see
+	// PublicKeyFingerprint(). It's empty until WriteManifest() has written a
+	// manifest, and if it's been called more than once, it's the last key.
+	UserKeyFingerprint string
+}
+
+// PartInfo describes a part file of a bundle.
+type PartInfo struct {
+	Index    int
+	Filename string
+	Size     int64
+
+	// SHA1 is the hex-encoded SHA1 of the part file, as recorded in the
+	// manifest.
+	SHA1 string
+}
+
+// Info() describes the bundle, once the Writer has been closed successfully,
+// so that it can be logged or recorded. It's the same information the
+// manifest holds.
+func (bw *Writer) Info() (*Info, error) {
+	if !bw.closed {
+		return nil, ErrWriterNotClosed
+	} else if bw.err != nil {
+		return nil, fmt.Errorf("bundle failed: %w", bw.err)
+	}
+	info := bw.info()
+	return &info, nil
+}
+
+func (bw *Writer) info() Info {
+	bw.hs.Lock()
+	defer bw.hs.Unlock()
+
+	info := Info{
+		ImageDigest:        fmt.Sprintf("%x", bw.sha1.Sum(nil)),
+		ImageSize:          bw.trueSize.n,
+		BundledSize:        bw.bundledSize.n,
+		Parts:              make([]PartInfo, len(bw.hs.files)),
+		UserKeyFingerprint: bw.userKeyFingerprint,
+	}
+	for i, file := range bw.hs.files {
+		info.Parts[i] = PartInfo{
+			Index:    i,
+			Filename: file.filename,
+			Size:     file.size,
+			SHA1:     fmt.Sprintf("%x", file.hash),
+		}
+	}
+	return info
+}
+
+// PublicKeyFingerprint() returns the hex-encoded SHA-256 of a public key in
+// DER-encoded PKIX form, which is what `openssl rsa -pubout -outform DER |
+// sha256sum` prints for the corresponding private key.
+func PublicKeyFingerprint(pub crypto.PublicKey) (string, error) {
+	der, err := x509.MarshalPKIXPublicKey(pub)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%x", sha256.Sum256(der)), nil
+}
+
+// ManifestInfo() describes the bundle a manifest refers to, as far as the
+// manifest says: parts' sizes aren't recorded, so they're zero, and neither
+// is the user key, so its fingerprint is empty. This is enough to check a
+// bundle's parts against their SHA1s.
+func ManifestInfo(manifestBytes []byte) (*Info, error) {
+	m, err := unmarshalManifest(manifestBytes)
+	if err != nil {
+		return nil, err
+	}
+
+	info := &Info{
+		ImageDigest: m.Image.Digest.Value,
+		ImageSize:   m.Image.Size,
+		BundledSize: m.Image.BundledSize,
+		Parts:       make([]PartInfo, len(m.Image.PartsContainer.Parts)),
+	}
+	for i, part := range m.Image.PartsContainer.Parts {
+		if part.Index != i {
+			return nil, fmt.Errorf("manifest lists part %d in position %d", part.Index, i)
+		}
+		info.Parts[i] = PartInfo{
+			Index:    part.Index,
+			Filename: part.Filename,
+			SHA1:     part.Digest.Value,
+		}
+	}
+	return info, nil
+}
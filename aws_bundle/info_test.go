@@ -0,0 +1,113 @@
+package aws_bundle
+
+import (
+	"crypto/sha256"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"testing"
+)
+
+func TestWriterInfo(t *testing.T) {
+	image := testImage()
+	sink := newAccumulatingSink()
+
+	w, err := NewWriter("test", int64(len(image)), sink)
+	if err != nil {
+		t.Fatalf("NewWriter() error = %v", err)
+	}
+	if _, err := w.Info(); err != ErrWriterNotClosed {
+		t.Errorf("Info() before Close() error = %v", err)
+	}
+	if _, err := w.Write(image); err != nil {
+		t.Fatalf("Write() error = %v", err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("Close() error = %v", err)
+	}
+
+	info, err := w.Info()
+	if err != nil {
+		t.Fatalf("Info() error = %v", err)
+	}
+	if info.ImageSize != int64(len(image)) || info.BundledSize <= info.ImageSize || len(info.Parts) != 2 {
+		t.Errorf("Info() = %+v", info)
+	}
+	var total int64
+	for i, part := range info.Parts {
+		if part.Index != i || part.Filename != fmt.Sprintf("test.part.%d", i) || part.Size != int64(sink.files[part.Filename].Len()) {
+			t.Errorf("Parts[%d] = %+v", i, part)
+		}
+		total += part.Size
+	}
+	if total != info.BundledSize {
+		t.Errorf("parts total %d bytes, BundledSize = %d", total, info.BundledSize)
+	}
+	if info.UserKeyFingerprint != "" {
+		t.Errorf("UserKeyFingerprint = %q before a manifest was written", info.UserKeyFingerprint)
+	}
+
+	// the manifest says the same things
+	userKey, err := GenerateUserKey(2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	md := testMetadata()
+	md.UserKey = userKey
+	if err := md.WriteManifest(w, sink); err != nil {
+		t.Fatalf("WriteManifest() error = %v", err)
+	}
+	manifestBytes := sink.files["test.manifest.xml"].Bytes()
+	m, err := unmarshalManifest(manifestBytes)
+	if err != nil {
+		t.Fatalf("unmarshalManifest() error = %v", err)
+	}
+	if m.Image.Digest.Value != info.ImageDigest || m.Image.Size != info.ImageSize || m.Image.BundledSize != info.BundledSize {
+		t.Errorf("manifest %+v doesn't match Info() %+v", m.Image, info)
+	}
+	for i, part := range m.Image.PartsContainer.Parts {
+		if part.Filename != info.Parts[i].Filename || part.Digest.Value != info.Parts[i].SHA1 {
+			t.Errorf("manifest part %+v doesn't match %+v", part, info.Parts[i])
+		}
+	}
+	parsed, err := ManifestInfo(manifestBytes)
+	if err != nil {
+		t.Fatalf("ManifestInfo() error = %v", err)
+	}
+	expected := *info
+	expected.Parts = append([]PartInfo(nil), info.Parts...)
+	for i := range expected.Parts {
+		expected.Parts[i].Size = 0
+	}
+	if fmt.Sprint(*parsed) != fmt.Sprint(expected) {
+		t.Errorf("ManifestInfo() = %+v, expected %+v", *parsed, expected)
+	}
+	if _, err := ManifestInfo([]byte("<manifest>")); err == nil {
+		t.Errorf("ManifestInfo() accepted a truncated manifest")
+	}
+
+	// and now the user key is known
+	der, err := x509.MarshalPKIXPublicKey(userKey.Public())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info, err := w.Info(); err != nil {
+		t.Fatalf("Info() error = %v", err)
+	} else if expected := fmt.Sprintf("%x", sha256.Sum256(der)); info.UserKeyFingerprint != expected {
+		t.Errorf("UserKeyFingerprint = %q, expected %q", info.UserKeyFingerprint, expected)
+	}
+}
+
+func TestWriterInfoFailed(t *testing.T) {
+	w, err := NewWriter("test", 100, newAccumulatingSink())
+	if err != nil {
+		t.Fatalf("NewWriter() error = %v", err)
+	}
+	w.Write([]byte("short"))
+	w.Close()
+
+	var mismatch *SizeMismatchError
+	if info, err := w.Info(); !errors.As(err, &mismatch) {
+		t.Errorf("Info() = %+v, %v, expected a *SizeMismatchError", info, err)
+	}
+}
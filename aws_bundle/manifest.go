@@ -6,6 +6,7 @@ import (
 	"crypto/rand"
 	"crypto/rsa"
 	"crypto/sha1"
+	"encoding/hex"
 	"encoding/xml"
 	"fmt"
 )
@@ -59,16 +60,16 @@ type valueAndAlgorithm struct {
 	Value     string `xml:",chardata"`
 }
 
-func (m *manifest) EncryptSecrets(key, iv []byte, region string, userKey *rsa.PublicKey) error {
+func (m *manifest) EncryptSecrets(key, iv []byte, region string, certs *CertificateRegistry, userKey *rsa.PublicKey) error {
 	// We need two public keys: one for EC2, one for the user
 	// We were given the user's, so now we just need EC2's
 	var ec2key *rsa.PublicKey
 
 	// Look up the EC2 key by region
-	if cert, err := CertificateForEC2Region(region); err != nil {
-		return fmt.Errorf("unable to get certificate for region %q: %v", region, err)
+	if cert, err := certs.CertificateForRegion(region); err != nil {
+		return err
 	} else if key, ok := cert.PublicKey.(*rsa.PublicKey); !ok {
-		return fmt.Errorf("certificate for region %q does not contain an RSA key", region)
+		return &CertificateError{Region: region, Partition: PartitionForRegion(region), Err: ErrCertificateNotRSA}
 	} else {
 		ec2key = key
 	}
@@ -113,7 +114,37 @@ func (m *manifest) EncryptSecrets(key, iv []byte, region string, userKey *rsa.Pu
 	return nil
 }
 
-func (m manifest) SignAndMarshal(key *rsa.PrivateKey) ([]byte, error) {
+// DecryptSecrets() recovers the bundle's AES key and IV from the copies which
+// were encrypted to the user's RSA key.
+//
+// The key may be anything which can decrypt, e.g. an HSM.
+func (m *manifest) DecryptSecrets(userKey crypto.Decrypter) (key, iv []byte, err error) {
+	if key, err = decryptSecret(userKey, m.Image.UserEncryptedKey.Value); err != nil {
+		return nil, nil, fmt.Errorf("unable to decrypt key: %v", err)
+	}
+	if iv, err = decryptSecret(userKey, m.Image.UserEncryptedIV); err != nil {
+		return nil, nil, fmt.Errorf("unable to decrypt IV: %v", err)
+	}
+
+	return key, iv, nil
+}
+
+func decryptSecret(userKey crypto.Decrypter, value string) ([]byte, error) {
+	// The secrets are hex-encoded ciphertexts of hex-encoded plaintexts
+	ciphertext, err := hex.DecodeString(value)
+	if err != nil {
+		return nil, err
+	}
+
+	plaintext, err := userKey.Decrypt(rand.Reader, ciphertext, &rsa.PKCS1v15DecryptOptions{})
+	if err != nil {
+		return nil, err
+	}
+
+	return hex.DecodeString(string(plaintext))
+}
+
+func (m manifest) SignAndMarshal(key crypto.Signer) ([]byte, error) {
 	// The RSA signature is calculated over a SHA1 of the marshalled XML representing
 	// <machine_configuration/> concatenated with <image/>.
 
@@ -128,8 +159,12 @@ func (m manifest) SignAndMarshal(key *rsa.PrivateKey) ([]byte, error) {
 	}
 
 	// Generate the signature
+	// (An RSA crypto.Signer given a crypto.Hash produces a PKCS#1 v1.5 signature.)
+	if _, ok := key.Public().(*rsa.PublicKey); !ok {
+		return nil, fmt.Errorf("signing key must be an RSA key, not %T", key.Public())
+	}
 	sum := sha1.Sum(signedData.Bytes())
-	signature, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA1, sum[:])
+	signature, err := key.Sign(rand.Reader, sum[:], crypto.SHA1)
 	if err != nil {
 		return nil, err
 	}
@@ -159,3 +194,36 @@ func (m manifest) SignAndMarshal(key *rsa.PrivateKey) ([]byte, error) {
 	// Success
 	return output.Bytes(), nil
 }
+
+func unmarshalManifest(manifestBytes []byte) (*manifest, error) {
+	var parsed struct {
+		XMLName xml.Name `xml:"manifest"`
+
+		Bundler              Application           `xml:"bundler"`
+		MachineConfiguration manifestMachineConfig `xml:"machine_configuration"`
+		Image                manifestImage         `xml:"image"`
+	}
+	if err := xml.Unmarshal(manifestBytes, &parsed); err != nil {
+		return nil, err
+	}
+
+	return &manifest{
+		Bundler:              parsed.Bundler,
+		MachineConfiguration: parsed.MachineConfiguration,
+		Image:                parsed.Image,
+	}, nil
+}
+
+// DecryptManifestSecrets() parses a bundle manifest and recovers the bundle's
+// AES-128-CBC key and IV using the user key with which it was written.
+//
+// userKey is a crypto.Decrypter so that it can be held in an HSM, a PKCS#11
+// token, a cloud KMS, or the like; an *rsa.PrivateKey works too.
+func DecryptManifestSecrets(manifestBytes []byte, userKey crypto.Decrypter) (key, iv []byte, err error) {
+	m, err := unmarshalManifest(manifestBytes)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return m.DecryptSecrets(userKey)
+}
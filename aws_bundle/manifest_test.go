@@ -0,0 +1,108 @@
+package aws_bundle
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rsa"
+	"crypto/sha1"
+	"encoding/hex"
+	"io"
+	"regexp"
+	"testing"
+)
+
+// opaqueUserKey is an in-process stand-in for a key held elsewhere, e.g. in an
+// HSM. It exposes only crypto.Signer and crypto.Decrypter, so nothing can
+// reach in and grab the *rsa.PrivateKey.
+type opaqueUserKey struct {
+	key *rsa.PrivateKey
+
+	signs, decrypts int
+}
+
+func (k *opaqueUserKey) Public() crypto.PublicKey {
+	return k.key.Public()
+}
+
+func (k *opaqueUserKey) Sign(rand io.Reader, digest []byte, opts crypto.SignerOpts) ([]byte, error) {
+	k.signs++
+	return k.key.Sign(rand, digest, opts)
+}
+
+func (k *opaqueUserKey) Decrypt(rand io.Reader, ciphertext []byte, opts crypto.DecrypterOpts) ([]byte, error) {
+	k.decrypts++
+	return k.key.Decrypt(rand, ciphertext, opts)
+}
+
+func writeTestBundle(t *testing.T, sink Sink, image []byte) *Writer {
+	w, err := NewWriter("test", int64(len(image)), sink)
+	if err != nil {
+		t.Fatalf("NewWriter() error = %v", err)
+	}
+	if _, err := w.Write(image); err != nil {
+		t.Fatalf("Write() error = %v", err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("Close() error = %v", err)
+	}
+	return w
+}
+
+func TestManifestUserKey(t *testing.T) {
+	rsaKey, err := ParseUserKey([]byte(userKeyPKCS1), nil)
+	if err != nil {
+		t.Fatalf("ParseUserKey() error = %v", err)
+	}
+	userKey := &opaqueUserKey{key: rsaKey}
+
+	sink := newAccumulatingSink()
+	w := writeTestBundle(t, sink, []byte("hello, world"))
+
+	md := Metadata{
+		Name:         "test",
+		Architecture: "x86_64",
+		AWSAccountID: "123456789012",
+		AWSRegion:    "us-east-1",
+		UserKey:      userKey,
+	}
+	if err := md.WriteManifest(w, sink); err != nil {
+		t.Fatalf("WriteManifest() error = %v", err)
+	}
+	if userKey.signs != 1 {
+		t.Errorf("expected the user key to sign once, got %d", userKey.signs)
+	}
+
+	manifestBytes := sink.files["test.manifest.xml"].Bytes()
+
+	// the signature must cover <machine_configuration/> and <image/>
+	match := regexp.MustCompile(`</bundler>(.*)<signature>([0-9a-f]+)</signature>`).FindSubmatch(manifestBytes)
+	if match == nil {
+		t.Fatalf("unable to find signed data in manifest: %s", manifestBytes)
+	}
+	signature, _ := hex.DecodeString(string(match[2]))
+	sum := sha1.Sum(match[1])
+	if err := rsa.VerifyPKCS1v15(&rsaKey.PublicKey, crypto.SHA1, sum[:], signature); err != nil {
+		t.Errorf("manifest signature did not verify: %v", err)
+	}
+
+	// the user key must be able to recover the secrets
+	key, iv, err := DecryptManifestSecrets(manifestBytes, userKey)
+	if err != nil {
+		t.Fatalf("DecryptManifestSecrets() error = %v", err)
+	}
+	if !bytes.Equal(key, w.key) || !bytes.Equal(iv, w.iv) {
+		t.Errorf("DecryptManifestSecrets() = %x, %x, expected %x, %x", key, iv, w.key, w.iv)
+	}
+	if userKey.decrypts != 2 {
+		t.Errorf("expected the user key to decrypt twice, got %d", userKey.decrypts)
+	}
+
+	// some other key must not
+	otherKey, err := GenerateUserKey(MinUserKeyBits)
+	if err != nil {
+		t.Fatalf("GenerateUserKey() error = %v", err)
+	}
+	if _, _, err := DecryptManifestSecrets(manifestBytes, otherKey); err == nil {
+		t.Errorf("DecryptManifestSecrets() succeeded using the wrong key")
+	}
+}
@@ -1,18 +1,25 @@
 package aws_bundle
 
 import (
-	"crypto/rand"
+	"crypto"
 	"crypto/rsa"
+	"errors"
 	"fmt"
+	"io"
+	"regexp"
+	"strings"
 )
 
 type Metadata struct {
-	Name         string          // restrictions unclear; probably best to stick to [A-Za-z0-9-_.]+
-	Architecture string          // "x86_64" or "i386"
-	AWSAccountID string          // just digits, no dashes
-	AWSRegion    string          // the region to which this bundle this will be sent for registration
-	UserKey      *rsa.PrivateKey // an optional private key, in case you'd like to decrypt the bundle later
-	Type         string          // assumed to be "machine" if unspecified
+	Name         string        // restrictions unclear; Validate() sticks to [A-Za-z0-9-_.]{1,128}
+	Architecture string        // "x86_64", "i386", "arm64", etc.; see Architectures
+	AWSAccountID string        // just digits, no dashes
+	AWSRegion    string        // the region to which this bundle this will be sent for registration
+	UserKey      crypto.Signer // an optional RSA private key, in case you'd like to decrypt the bundle later
+	UserKeyBits  int           // size of the key generated if UserKey is nil; assumed to be DefaultUserKeyBits if unspecified
+	Type         string        // "machine", "kernel", or "ramdisk"; assumed to be "machine" if unspecified
+
+	Certificates *CertificateRegistry // EC2 certificates by region; assumed to be DefaultCertificates if unspecified
 
 	Bundler Application
 }
@@ -25,6 +32,80 @@ type Application struct {
 	Comment string `xml:",comment"` // optional XML comment
 }
 
+// Architectures accepted by EC2's RegisterImage.
+var Architectures = []string{"i386", "x86_64", "arm64", "x86_64_mac", "arm64_mac"}
+
+// ImageTypes accepted by ec2-bundle-image.
+var ImageTypes = []string{"machine", "kernel", "ramdisk"}
+
+// The bundle name becomes part of S3 keys and of the manifest, so keep it tame
+var validName = regexp.MustCompile(`^[A-Za-z0-9._-]+$`)
+
+const maxNameLength = 128
+
+var validAccountID = regexp.MustCompile(`^[0-9]{12}$`)
+
+// Validate() checks the metadata for mistakes which would otherwise only come
+// to light when registering the image, i.e. after the bundle is uploaded.
+// All problems are reported at once.
+func (md Metadata) Validate() error {
+	problems := []string{}
+
+	if md.Name == "" {
+		problems = append(problems, "name is empty")
+	} else if !validName.MatchString(md.Name) {
+		problems = append(problems, fmt.Sprintf("name %q may contain only letters, digits, '.', '_', and '-'", md.Name))
+	} else if len(md.Name) > maxNameLength {
+		problems = append(problems, fmt.Sprintf("name is %d characters long, exceeding %d", len(md.Name), maxNameLength))
+	}
+
+	if !contains(Architectures, md.Architecture) {
+		problems = append(problems, fmt.Sprintf("architecture %q is not one of %s", md.Architecture, strings.Join(Architectures, ", ")))
+	}
+
+	if !validAccountID.MatchString(md.AWSAccountID) {
+		problems = append(problems, fmt.Sprintf("AWS account ID %q must be exactly 12 digits, without dashes", md.AWSAccountID))
+	}
+
+	certs := md.Certificates
+	if certs == nil {
+		certs = DefaultCertificates
+	}
+	if md.AWSRegion == "" {
+		problems = append(problems, "AWS region is empty")
+	} else if !IsKnownRegion(md.AWSRegion) && !certs.hasRegion(md.AWSRegion) {
+		problems = append(problems, fmt.Sprintf("AWS region %q is unknown", md.AWSRegion))
+	} else if _, err := certs.CertificateForRegion(md.AWSRegion); err != nil {
+		problems = append(problems, err.Error())
+	}
+
+	if md.Type != "" && !contains(ImageTypes, md.Type) {
+		problems = append(problems, fmt.Sprintf("image type %q is not one of %s", md.Type, strings.Join(ImageTypes, ", ")))
+	}
+
+	if md.UserKey != nil {
+		if _, ok := md.UserKey.Public().(*rsa.PublicKey); !ok {
+			problems = append(problems, fmt.Sprintf("user key must be an RSA key, not %T", md.UserKey.Public()))
+		}
+	} else if md.UserKeyBits != 0 && md.UserKeyBits < MinUserKeyBits {
+		problems = append(problems, fmt.Sprintf("user key must be at least %d bits, not %d", MinUserKeyBits, md.UserKeyBits))
+	}
+
+	if len(problems) > 0 {
+		return fmt.Errorf("invalid metadata: %s", strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
 func (md Metadata) toManifest() manifest {
 	m := manifest{
 		Bundler: md.Bundler,
@@ -47,6 +128,13 @@ func (md Metadata) toManifest() manifest {
 }
 
 func (md Metadata) WriteManifest(bundle *Writer, sink Sink) error {
+	// A manifest for a broken bundle would be worse than useless
+	if !bundle.closed {
+		return errors.New("bundle must be closed before writing its manifest")
+	} else if bundle.err != nil {
+		return fmt.Errorf("bundle failed, refusing to write its manifest: %w", bundle.err)
+	}
+
 	// Generate a manifest struct
 	m := md.toManifest()
 
@@ -55,18 +143,32 @@ func (md Metadata) WriteManifest(bundle *Writer, sink Sink) error {
 
 	// Generate a user key if the caller didn't provide one
 	// (This doesn't do any good if the user wants to decrypt their image
-	// later, but does anyone actually do that?)
+	// later; see GenerateUserKey() and MarshalUserKey() for that.)
 	userKey := md.UserKey
 	if userKey == nil {
-		if key, err := rsa.GenerateKey(rand.Reader, 1024); err != nil {
+		bits := md.UserKeyBits
+		if bits == 0 {
+			bits = DefaultUserKeyBits
+		}
+		if key, err := GenerateUserKey(bits); err != nil {
 			return err
 		} else {
 			userKey = key
 		}
 	}
 
+	// The user key can be anything that signs, e.g. an HSM, but it must be RSA
+	userPublicKey, ok := userKey.Public().(*rsa.PublicKey)
+	if !ok {
+		return fmt.Errorf("user key must be an RSA key, not %T", userKey.Public())
+	}
+
 	// Ask the manifest to encrypt the bundle's key and IV for both the target region and the user
-	if err := m.EncryptSecrets(bundle.key, bundle.iv, md.AWSRegion, &userKey.PublicKey); err != nil {
+	certs := md.Certificates
+	if certs == nil {
+		certs = DefaultCertificates
+	}
+	if err := m.EncryptSecrets(bundle.key, bundle.iv, md.AWSRegion, certs, userPublicKey); err != nil {
 		return err
 	}
 
@@ -77,17 +179,27 @@ func (md Metadata) WriteManifest(bundle *Writer, sink Sink) error {
 	}
 
 	// Write the manifest
-	if writer, err := sink.WriteBundleFile(fmt.Sprintf("%s.manifest.xml", bundle.basename)); err != nil {
-		return err
+	filename := fmt.Sprintf("%s.manifest.xml", bundle.basename)
+	if writer, err := sink.WriteBundleFile(filename); err != nil {
+		return &SinkError{Op: "open", Filename: filename, Index: -1, Err: err}
 	} else if n, err := writer.Write(manifestBytes); err != nil {
 		writer.Close()
-		return err
+		return &SinkError{Op: "write", Filename: filename, Index: -1, Err: err}
 	} else if n < len(manifestBytes) {
 		writer.Close()
-		return fmt.Errorf("short manifest write: %d vs %d", n, len(manifestBytes))
+		return &SinkError{Op: "write", Filename: filename, Index: -1, Err: io.ErrShortWrite}
 	} else if err := writer.Close(); err != nil {
+		return &SinkError{Op: "close", Filename: filename, Index: -1, Err: err}
+	}
+
+	// Note who signed it
+	fingerprint, err := PublicKeyFingerprint(userPublicKey)
+	if err != nil {
 		return err
 	}
+	bundle.hs.Lock()
+	bundle.userKeyFingerprint = fingerprint
+	bundle.hs.Unlock()
 
 	// Success!
 	return nil
@@ -0,0 +1,75 @@
+package aws_bundle
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"strings"
+	"testing"
+)
+
+func TestMetadataValidate(t *testing.T) {
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("unable to generate ECDSA key: %v", err)
+	}
+
+	certs := NewCertificateRegistry()
+	certs.RegisterRegion("atlantis-4", mustParseCertificatePEM(certEc2))
+
+	valid := Metadata{
+		Name:         "my-image_1.0",
+		Architecture: "x86_64",
+		AWSAccountID: "123456789012",
+		AWSRegion:    "us-east-1",
+	}
+
+	tests := []struct {
+		name    string
+		modify  func(md *Metadata)
+		problem string // expected in the error, or "" if valid
+	}{
+		{"valid", func(md *Metadata) {}, ""},
+		{"arm64", func(md *Metadata) { md.Architecture = "arm64" }, ""},
+		{"i386 kernel", func(md *Metadata) { md.Architecture = "i386"; md.Type = "kernel" }, ""},
+		{"gov region", func(md *Metadata) { md.AWSRegion = "us-gov-west-1" }, ""},
+		{"registered region", func(md *Metadata) { md.AWSRegion = "atlantis-4"; md.Certificates = certs }, ""},
+		{"long name", func(md *Metadata) { md.Name = strings.Repeat("a", 128) }, ""},
+
+		{"empty name", func(md *Metadata) { md.Name = "" }, "name is empty"},
+		{"name with spaces", func(md *Metadata) { md.Name = "my image" }, "may contain only"},
+		{"name with slash", func(md *Metadata) { md.Name = "../image" }, "may contain only"},
+		{"too long name", func(md *Metadata) { md.Name = strings.Repeat("a", 129) }, "exceeding 128"},
+		{"bad architecture", func(md *Metadata) { md.Architecture = "amd64" }, "architecture \"amd64\""},
+		{"empty architecture", func(md *Metadata) { md.Architecture = "" }, "architecture \"\""},
+		{"dashed account", func(md *Metadata) { md.AWSAccountID = "1234-5678-9012" }, "12 digits"},
+		{"short account", func(md *Metadata) { md.AWSAccountID = "12345678901" }, "12 digits"},
+		{"empty region", func(md *Metadata) { md.AWSRegion = "" }, "region is empty"},
+		{"typo region", func(md *Metadata) { md.AWSRegion = "us-esat-1" }, "\"us-esat-1\" is unknown"},
+		{"region without certificate", func(md *Metadata) { md.AWSRegion = "cn-northwest-1" }, "no certificate"},
+		{"bad type", func(md *Metadata) { md.Type = "kernal" }, "image type"},
+		{"ECDSA user key", func(md *Metadata) { md.UserKey = ecKey }, "RSA key"},
+		{"small user key", func(md *Metadata) { md.UserKeyBits = 1024 }, "at least 2048 bits"},
+	}
+	for _, tt := range tests {
+		md := valid
+		tt.modify(&md)
+
+		err := md.Validate()
+		if tt.problem == "" {
+			if err != nil {
+				t.Errorf("%s: Validate() error = %v", tt.name, err)
+			}
+		} else if err == nil {
+			t.Errorf("%s: Validate() succeeded, expected %q", tt.name, tt.problem)
+		} else if !strings.Contains(err.Error(), tt.problem) {
+			t.Errorf("%s: Validate() error = %v, expected %q", tt.name, err, tt.problem)
+		}
+	}
+
+	// multiple problems are reported together
+	err = Metadata{Name: "a b", Architecture: "x86_64", AWSAccountID: "1-2", AWSRegion: "us-east-1"}.Validate()
+	if err == nil || !strings.Contains(err.Error(), "name") || !strings.Contains(err.Error(), "account") {
+		t.Errorf("Validate() error = %v, expected both name and account problems", err)
+	}
+}
@@ -0,0 +1,104 @@
+package aws_bundle
+
+import (
+	"sort"
+	"strings"
+)
+
+// EC2 regions are grouped into partitions, each of which is its own little
+// world: separate credentials, separate endpoints, and -- as far as bundles are
+// concerned -- separate certificates.
+const (
+	PartitionAWS      = "aws"
+	PartitionAWSCN    = "aws-cn"
+	PartitionAWSUSGov = "aws-us-gov"
+	PartitionAWSISO   = "aws-iso"
+	PartitionAWSISOB  = "aws-iso-b"
+	PartitionAWSISOE  = "aws-iso-e"
+	PartitionAWSISOF  = "aws-iso-f"
+)
+
+// Region name prefixes which identify partitions other than "aws"
+var partitionPrefixes = []struct {
+	prefix    string
+	partition string
+}{
+	{"cn-", PartitionAWSCN},
+	{"us-gov-", PartitionAWSUSGov},
+	{"us-iso-", PartitionAWSISO},
+	{"us-isob-", PartitionAWSISOB},
+	{"eu-isoe-", PartitionAWSISOE},
+	{"us-isof-", PartitionAWSISOF},
+}
+
+// Regions this package knows about, by partition. New regions show up every so
+// often; register a certificate for a region to make it known.
+var knownRegions = map[string]string{
+	"af-south-1":     PartitionAWS,
+	"ap-east-1":      PartitionAWS,
+	"ap-east-2":      PartitionAWS,
+	"ap-northeast-1": PartitionAWS,
+	"ap-northeast-2": PartitionAWS,
+	"ap-northeast-3": PartitionAWS,
+	"ap-south-1":     PartitionAWS,
+	"ap-south-2":     PartitionAWS,
+	"ap-southeast-1": PartitionAWS,
+	"ap-southeast-2": PartitionAWS,
+	"ap-southeast-3": PartitionAWS,
+	"ap-southeast-4": PartitionAWS,
+	"ap-southeast-5": PartitionAWS,
+	"ap-southeast-7": PartitionAWS,
+	"ca-central-1":   PartitionAWS,
+	"ca-west-1":      PartitionAWS,
+	"eu-central-1":   PartitionAWS,
+	"eu-central-2":   PartitionAWS,
+	"eu-north-1":     PartitionAWS,
+	"eu-south-1":     PartitionAWS,
+	"eu-south-2":     PartitionAWS,
+	"eu-west-1":      PartitionAWS,
+	"eu-west-2":      PartitionAWS,
+	"eu-west-3":      PartitionAWS,
+	"il-central-1":   PartitionAWS,
+	"me-central-1":   PartitionAWS,
+	"me-south-1":     PartitionAWS,
+	"mx-central-1":   PartitionAWS,
+	"sa-east-1":      PartitionAWS,
+	"us-east-1":      PartitionAWS,
+	"us-east-2":      PartitionAWS,
+	"us-west-1":      PartitionAWS,
+	"us-west-2":      PartitionAWS,
+
+	"cn-north-1":     PartitionAWSCN,
+	"cn-northwest-1": PartitionAWSCN,
+
+	"us-gov-east-1": PartitionAWSUSGov,
+	"us-gov-west-1": PartitionAWSUSGov,
+}
+
+// PartitionForRegion() returns the partition containing region, as determined
+// by its name. Anything unrecognized is assumed to be in "aws".
+func PartitionForRegion(region string) string {
+	for _, pp := range partitionPrefixes {
+		if strings.HasPrefix(region, pp.prefix) {
+			return pp.partition
+		}
+	}
+	return PartitionAWS
+}
+
+// KnownRegions() returns the names of all regions this package knows about,
+// sorted.
+func KnownRegions() []string {
+	regions := make([]string, 0, len(knownRegions))
+	for region := range knownRegions {
+		regions = append(regions, region)
+	}
+	sort.Strings(regions)
+	return regions
+}
+
+// IsKnownRegion() indicates if region is in KnownRegions().
+func IsKnownRegion(region string) bool {
+	_, ok := knownRegions[region]
+	return ok
+}
@@ -4,6 +4,20 @@ import "io"
 
 // A Sink is provided by the application to receive data produced by an
 // aws_bundle.Writer. Pass back an io.WriteCloser as requested.
+//
+// If bundling fails partway through a file, the Writer abandons it rather
+// than closing it, so that a truncated part isn't mistaken for a whole one.
+// To learn of that, give the file a CloseWithError() method like an
+// io.PipeWriter's, which should throw away whatever was written and release
+// the file. Files without one are simply closed.
 type Sink interface {
 	WriteBundleFile(filename string) (io.WriteCloser, error)
 }
+
+// closeWithError() abandons a Sink's file, closing it with err if it can be.
+func closeWithError(w io.WriteCloser, err error) error {
+	if ew, ok := w.(interface{ CloseWithError(error) error }); ok {
+		return ew.CloseWithError(err)
+	}
+	return w.Close()
+}
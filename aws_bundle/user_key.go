@@ -0,0 +1,121 @@
+package aws_bundle
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+
+	"github.com/youmark/pkcs8"
+)
+
+// The user key is the RSA key to which the manifest's second copy of the
+// bundle's AES key and IV is encrypted, and which signs the manifest. Anyone
+// holding it can decrypt the bundle and verify the manifest later, so unlike
+// the EC2 certificates, it's worth keeping around.
+
+// DefaultUserKeyBits is the size of the user key generated by
+// Metadata.WriteManifest() when no UserKey is provided.
+const DefaultUserKeyBits = 2048
+
+// MinUserKeyBits is the smallest key GenerateUserKey() will produce, or
+// ParseUserKey() will accept.
+const MinUserKeyBits = 2048
+
+// GenerateUserKey() returns a new RSA key suitable for Metadata.UserKey.
+//
+// bits must be at least MinUserKeyBits. Be sure to save the key using
+// MarshalUserKey() if you'd like to decrypt the bundle later.
+func GenerateUserKey(bits int) (*rsa.PrivateKey, error) {
+	if bits < MinUserKeyBits {
+		return nil, fmt.Errorf("user key must be at least %d bits, not %d", MinUserKeyBits, bits)
+	}
+
+	return rsa.GenerateKey(rand.Reader, bits)
+}
+
+// MarshalUserKey() encodes an RSA private key as a PKCS#1 "RSA PRIVATE KEY"
+// PEM block, which is the format `openssl genrsa` produces and ec2-ami-tools
+// consumes.
+func MarshalUserKey(key *rsa.PrivateKey) []byte {
+	return pem.EncodeToMemory(&pem.Block{
+		Type:  "RSA PRIVATE KEY",
+		Bytes: x509.MarshalPKCS1PrivateKey(key),
+	})
+}
+
+// ParseUserKey() decodes an RSA private key from PEM.
+//
+// Accepted formats are PKCS#1 ("RSA PRIVATE KEY", optionally encrypted using
+// legacy OpenSSL "Proc-Type: 4,ENCRYPTED" headers), PKCS#8 ("PRIVATE KEY"),
+// and PBES2-encrypted PKCS#8 ("ENCRYPTED PRIVATE KEY"), the last of which is
+// what `openssl genpkey -aes256` produces. passphrase is only consulted for
+// encrypted keys. Keys smaller than MinUserKeyBits are rejected.
+func ParseUserKey(pemBytes []byte, passphrase []byte) (*rsa.PrivateKey, error) {
+	key, err := parseUserKeyPEM(pemBytes, passphrase)
+	if err != nil {
+		return nil, err
+	}
+
+	if bits := key.N.BitLen(); bits < MinUserKeyBits {
+		return nil, fmt.Errorf("user key must be at least %d bits, not %d", MinUserKeyBits, bits)
+	}
+	return key, nil
+}
+
+func parseUserKeyPEM(pemBytes []byte, passphrase []byte) (*rsa.PrivateKey, error) {
+	block, _ := pem.Decode(pemBytes)
+	if block == nil {
+		return nil, errors.New("unable to parse PEM block")
+	}
+
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		der := block.Bytes
+		if x509.IsEncryptedPEMBlock(block) {
+			if passphrase == nil {
+				return nil, errors.New("user key is encrypted, but no passphrase was provided")
+			}
+			var err error
+			if der, err = x509.DecryptPEMBlock(block, passphrase); err != nil {
+				return nil, err
+			}
+		}
+		return x509.ParsePKCS1PrivateKey(der)
+
+	case "PRIVATE KEY":
+		return parsePKCS8RSAKey(block.Bytes)
+
+	case "ENCRYPTED PRIVATE KEY":
+		if passphrase == nil {
+			return nil, errors.New("user key is encrypted, but no passphrase was provided")
+		}
+		// github.com/youmark/pkcs8 decrypts PBES2, which the standard library doesn't
+		key, err := pkcs8.ParsePKCS8PrivateKey(block.Bytes, passphrase)
+		if err != nil {
+			return nil, fmt.Errorf("unable to decrypt user key: %v", err)
+		}
+		return rsaUserKey(key)
+
+	default:
+		return nil, fmt.Errorf("unsupported PEM block type %q", block.Type)
+	}
+}
+
+func parsePKCS8RSAKey(der []byte) (*rsa.PrivateKey, error) {
+	key, err := x509.ParsePKCS8PrivateKey(der)
+	if err != nil {
+		return nil, err
+	}
+	return rsaUserKey(key)
+}
+
+func rsaUserKey(key interface{}) (*rsa.PrivateKey, error) {
+	if rsaKey, ok := key.(*rsa.PrivateKey); !ok {
+		return nil, fmt.Errorf("user key must be an RSA key, not %T", key)
+	} else {
+		return rsaKey, nil
+	}
+}
@@ -34,13 +34,15 @@ import (
 // You will also require a manifest for the bundle to be useful; see
 // Metadata.WriteManifest() for details.
 type Writer struct {
-	basename string
-	size     int64
-	sink     Sink
+	basename   string
+	size       int64 // the number of bytes we expect to be written
+	paddedSize int64 // the size of the image in the bundle, >= size
+	padShort   bool  // pad with zeros if fewer than size bytes are written
+	sink       Sink
 
 	sha1 hash.Hash
 	hs   *hashingSink
-	cw   io.WriteCloser
+	cw   *chunkWriter
 	aes  io.WriteCloser
 	gz   io.WriteCloser
 	tar  *tar.Writer
@@ -50,9 +52,54 @@ type Writer struct {
 
 	didInitialWrite bool
 	closed          bool
+	err             error // the first error we encountered, returned by all subsequent writes
 
 	key []byte
 	iv  []byte
+
+	userKeyFingerprint string // of the key which signed the last manifest, guarded by hs
+}
+
+// A WriterOption changes how a Writer treats its image; see NewWriter().
+// Options are applied in order.
+type WriterOption func(*Writer) error
+
+// PadShortImage() causes a Writer which receives fewer bytes than expected to
+// pad the image with zeros on Close(), rather than to fail.
+func PadShortImage() WriterOption {
+	return func(bw *Writer) error {
+		bw.padShort = true
+		return nil
+	}
+}
+
+// RoundUpSize() rounds the size of the bundled image up to a multiple of
+// boundary, e.g. 1<<20 for a MiB boundary, by appending zeros on Close().
+// Exactly the expected number of bytes must still be written, unless
+// PadShortImage() is also specified.
+func RoundUpSize(boundary int64) WriterOption {
+	return func(bw *Writer) error {
+		if boundary <= 0 {
+			return fmt.Errorf("invalid size boundary %d", boundary)
+		}
+		bw.paddedSize = (bw.paddedSize + boundary - 1) / boundary * boundary
+		return nil
+	}
+}
+
+// GrowTo() makes the bundled image target bytes long by appending zeros on
+// Close(), which is useful for making a bigger root disk out of a smaller
+// image. The zeros are streamed straight into the bundle, where they compress
+// to almost nothing; they're never materialized anywhere else. target must
+// not be smaller than the image.
+func GrowTo(target int64) WriterOption {
+	return func(bw *Writer) error {
+		if target < bw.paddedSize {
+			return fmt.Errorf("target size %d is smaller than the image (%d bytes)", target, bw.paddedSize)
+		}
+		bw.paddedSize = target
+		return nil
+	}
 }
 
 // NewWriter() returns an aws_bundle.Writer.
@@ -61,8 +108,10 @@ type Writer struct {
 // "basename.part.0". These files will be written to the Sink you provide.
 //
 // The AWS bundle format requires the size to be specified before any data is
-// written, so you must supply it here.
-func NewWriter(basename string, size int64, sink Sink) (*Writer, error) {
+// written, so you must supply it here. Writes beyond this size fail
+// immediately with a *SizeMismatchError, as does Close() if too few bytes
+// were written, unless you pass PadShortImage().
+func NewWriter(basename string, size int64, sink Sink, opts ...WriterOption) (*Writer, error) {
 	// Bundling an AMI requires a processing chain on the image stream:
 	// 1. tar the image
 	// 2. gzip the tarred image
@@ -77,14 +126,23 @@ func NewWriter(basename string, size int64, sink Sink) (*Writer, error) {
 	// in order to generate a manifest.
 
 	// Start by making a Writer struct, since we'll need that
+	if size < 0 {
+		return nil, fmt.Errorf("invalid image size %d", size)
+	}
 	bw := Writer{
-		basename: basename,
-		size:     size,
-		sink:     sink,
+		basename:   basename,
+		size:       size,
+		paddedSize: size,
+		sink:       sink,
 
 		key: make([]byte, 16),
 		iv:  make([]byte, 16),
 	}
+	for _, opt := range opts {
+		if err := opt(&bw); err != nil {
+			return nil, err
+		}
+	}
 
 	// Generate some random secrets
 	if _, err := rand.Read(bw.key); err != nil {
@@ -133,7 +191,7 @@ func (bw *Writer) doInitialWrite() error {
 		Gid:      0,
 		Uname:    "root",
 		Gname:    "root",
-		Size:     bw.size,
+		Size:     bw.paddedSize,
 		ModTime:  time.Now(),
 		Typeflag: 0x30,
 	}
@@ -146,15 +204,55 @@ func (bw *Writer) doInitialWrite() error {
 }
 
 // Write bytes to the bundle.
+//
+// Once a write fails, the Writer is broken: all subsequent writes return the
+// same error, and the bundle must be discarded. Close() it anyway to abandon
+// the file the Sink has open.
 func (bw *Writer) Write(p []byte) (n int, err error) {
+	if bw.closed {
+		return 0, ErrWriterClosed
+	}
+	if bw.err != nil {
+		return 0, bw.err
+	}
+
+	// Refuse to go past the end of the image, since that can only end badly
+	if bw.trueSize.n+int64(len(p)) > bw.size {
+		bw.err = &SizeMismatchError{Expected: bw.size, Actual: bw.trueSize.n + int64(len(p))}
+		return 0, bw.err
+	}
+
 	if !bw.didInitialWrite {
 		if err := bw.doInitialWrite(); err != nil {
+			bw.err = err
 			return 0, err
 		}
 	}
 
 	// Forward bytes into the top of the chain
-	return bw.trueSize.Write(p)
+	n, err = bw.trueSize.Write(p)
+	if err != nil {
+		bw.err = err
+	}
+	return n, err
+}
+
+// pad() writes zeros until the image reaches paddedSize.
+func (bw *Writer) pad() error {
+	if bw.trueSize.n >= bw.paddedSize {
+		return nil
+	}
+
+	zeros := make([]byte, 256<<10)
+	for remaining := bw.paddedSize - bw.trueSize.n; remaining > 0; remaining = bw.paddedSize - bw.trueSize.n {
+		if remaining < int64(len(zeros)) {
+			zeros = zeros[:remaining]
+		}
+		if _, err := bw.trueSize.Write(zeros); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
 // Close the bundle. Closing more than once is an error.
@@ -162,68 +260,117 @@ func (bw *Writer) Write(p []byte) (n int, err error) {
 // Close() flushes all internal buffers, adds endings to various data
 // structures, finalizes several hashes, etc. In other words, Close() causes
 // writes. Check the return value.
+//
+// Every layer is closed even if an earlier one fails, and all of the
+// resulting errors are joined, earliest first. If the bundle is broken, the
+// part being written is abandoned instead of finished; see Sink.
 func (bw *Writer) Close() error {
 	if bw.closed {
-		return errors.New("Writer is already closed")
+		return ErrWriterClosed
+	}
+	bw.closed = true
+
+	errs := []error{}
+	var addErr func(error)
+	addErr = func(err error) {
+		// flatten errors which were already joined by lower layers
+		if joined, ok := err.(interface{ Unwrap() []error }); ok {
+			for _, err := range joined.Unwrap() {
+				addErr(err)
+			}
+			return
+		}
+
+		// layers tend to report the same underlying error repeatedly
+		for _, existing := range errs {
+			if err == existing {
+				return
+			}
+		}
+		errs = append(errs, err)
+	}
+
+	if bw.err != nil {
+		addErr(bw.err)
 	}
 
-	errors := []error{}
+	// check that the image we received was exactly the size we expected
+	if bw.trueSize.n != bw.size && !bw.padShort {
+		addErr(&SizeMismatchError{Expected: bw.size, Actual: bw.trueSize.n})
+	}
+
+	// finish the image, even if it's empty, padding as needed
+	if len(errs) == 0 && !bw.didInitialWrite {
+		if err := bw.doInitialWrite(); err != nil {
+			addErr(err)
+		}
+	}
+	if len(errs) == 0 {
+		if err := bw.pad(); err != nil {
+			addErr(err)
+		}
+	}
+
+	// a broken bundle's last part is abandoned before the layers above it are
+	// closed, so that what they flush can't make it look complete; they're
+	// closed only to release them
+	if len(errs) > 0 {
+		if err := bw.cw.abort(errs[0]); err != nil {
+			addErr(err)
+		}
+		bw.tar.Close()
+		bw.gz.Close()
+		bw.aes.Close()
+		bw.err = errs[0]
+		return errors.Join(errs...)
+	}
 
 	// close the tar file, which does not close the underlying writer
 	if err := bw.tar.Close(); err != nil {
-		errors = append(errors, err)
+		addErr(err)
 	}
 
 	// close the gzip stream, which does not close the underlying writer
 	if err := bw.gz.Close(); err != nil {
-		errors = append(errors, err)
+		addErr(err)
 	}
 
 	// close the AES stream
 	if err := bw.aes.Close(); err != nil {
-		errors = append(errors, err)
+		addErr(err)
 	}
 
 	// close the chunkWriter, which *does* bubble down through the remaining layers
 	if err := bw.cw.Close(); err != nil {
-		errors = append(errors, err)
+		addErr(err)
 	}
 
-	// check that the image we wrote was exactly the size we promised in the tar header
-	if bw.size != bw.trueSize.n {
-		errors = append(errors, fmt.Errorf("expected %d bytes, actually wrote %d bytes", bw.size, bw.trueSize.n))
-	}
-
-	bw.closed = true
-
-	if len(errors) > 0 {
-		// return the first error, since that is likely the underlying cause
-		return errors[0]
-	} else {
-		// no errors
-		return nil
+	if len(errs) > 0 {
+		bw.err = errs[0]
 	}
+	return errors.Join(errs...)
 }
 
 func (bw *Writer) populateManifest(m *manifest) {
+	info := bw.info()
+
 	// Fill in the scalars
 	m.Image.Digest.Algorithm = "SHA1"
-	m.Image.Digest.Value = fmt.Sprintf("%x", bw.sha1.Sum(nil))
+	m.Image.Digest.Value = info.ImageDigest
 
-	m.Image.Size = bw.trueSize.n
-	m.Image.BundledSize = bw.bundledSize.n
+	m.Image.Size = info.ImageSize
+	m.Image.BundledSize = info.BundledSize
 
 	// Populate parts from the hashing sink
-	for i, file := range bw.hs.files {
-		part := manifestPart{
-			Index:    i,
-			Filename: file.filename,
+	for _, part := range info.Parts {
+		m.Image.PartsContainer.Parts = append(m.Image.PartsContainer.Parts, manifestPart{
+			Index:    part.Index,
+			Filename: part.Filename,
 			Digest: valueAndAlgorithm{
-				Value:     fmt.Sprintf("%x", file.hash),
+				Value:     part.SHA1,
 				Algorithm: "SHA1",
 			},
-		}
-		m.Image.PartsContainer.Parts = append(m.Image.PartsContainer.Parts, part)
+		})
 	}
-	m.Image.PartsContainer.Count = len(bw.hs.files)
+	m.Image.PartsContainer.Count = len(info.Parts)
 }
@@ -0,0 +1,281 @@
+package aws_bundle
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"testing"
+)
+
+// testImage() returns 12 MiB of random data, which is incompressible, so it
+// makes two 10 MiB parts.
+func testImage() []byte {
+	image := make([]byte, 12<<20)
+	rand.Read(image)
+	return image
+}
+
+// testMetadata() returns metadata which is valid for bundling.
+func testMetadata() Metadata {
+	return Metadata{Name: "test", Architecture: "x86_64", AWSAccountID: "123456789012", AWSRegion: "us-east-1"}
+}
+
+func TestWriterFaults(t *testing.T) {
+	image := testImage()
+
+	tests := []struct {
+		name  string
+		setup func(fs *faultySink)
+		op    string
+		index int
+	}{
+		{"open first", func(fs *faultySink) { fs.failOpen = 0 }, "open", 0},
+		{"open second", func(fs *faultySink) { fs.failOpen = 1 }, "open", 1},
+		{"write first", func(fs *faultySink) { fs.failWrite = 0; fs.failWriteAfter = 1000 }, "write", 0},
+		{"write second", func(fs *faultySink) { fs.failWrite = 1; fs.failWriteAfter = 5 }, "write", 1},
+		{"close first", func(fs *faultySink) { fs.failClose = 0 }, "close", 0},
+		{"close last", func(fs *faultySink) { fs.failClose = 1 }, "close", 1},
+	}
+	for _, tt := range tests {
+		fs := newFaultySink()
+		tt.setup(fs)
+
+		w, err := NewWriter("test", int64(len(image)), fs)
+		if err != nil {
+			t.Fatalf("%s: NewWriter() error = %v", tt.name, err)
+		}
+
+		// write in pieces until something fails
+		var writeErr error
+		for p := image; len(p) > 0 && writeErr == nil; {
+			n := 1 << 20
+			if n > len(p) {
+				n = len(p)
+			}
+			_, writeErr = w.Write(p[:n])
+			p = p[n:]
+		}
+
+		// once failed, always failed
+		if writeErr != nil {
+			if _, err := w.Write([]byte("more")); err != writeErr {
+				t.Errorf("%s: Write() after failure = %v, expected %v", tt.name, err, writeErr)
+			}
+		}
+
+		closeErr := w.Close()
+		if !errors.Is(closeErr, errInjected) {
+			t.Errorf("%s: Close() = %v, expected the injected fault", tt.name, closeErr)
+		}
+		var sinkErr *SinkError
+		if !errors.As(closeErr, &sinkErr) {
+			t.Errorf("%s: Close() = %v, expected a *SinkError", tt.name, closeErr)
+		} else if sinkErr.Op != tt.op || sinkErr.Index != tt.index || sinkErr.Filename != fmt.Sprintf("test.part.%d", tt.index) {
+			t.Errorf("%s: Close() = %#v, expected %s of part %d", tt.name, sinkErr, tt.op, tt.index)
+		}
+		if len(fs.open) > 0 {
+			t.Errorf("%s: files left open: %v", tt.name, fs.open)
+		}
+
+		// closed is closed
+		if _, err := w.Write([]byte("more")); err != ErrWriterClosed {
+			t.Errorf("%s: Write() after Close() = %v, expected ErrWriterClosed", tt.name, err)
+		}
+		if err := w.Close(); err != ErrWriterClosed {
+			t.Errorf("%s: second Close() = %v, expected ErrWriterClosed", tt.name, err)
+		}
+
+		// and broken bundles get no manifest
+		md := testMetadata()
+		if err := md.WriteManifest(w, fs); err == nil {
+			t.Errorf("%s: WriteManifest() succeeded for a broken bundle", tt.name)
+		}
+		if fs.files["test.manifest.xml"] != nil {
+			t.Errorf("%s: WriteManifest() wrote a manifest for a broken bundle", tt.name)
+		}
+	}
+}
+
+func TestWriterManifestFault(t *testing.T) {
+	fs := newFaultySink()
+	fs.failOpen = 1 // the manifest, after the only part
+	w := writeTestBundle(t, fs, []byte("hello, world"))
+
+	md := testMetadata()
+	var sinkErr *SinkError
+	if err := md.WriteManifest(w, fs); !errors.Is(err, errInjected) {
+		t.Errorf("WriteManifest() = %v, expected the injected fault", err)
+	} else if !errors.As(err, &sinkErr) || sinkErr.Index != -1 || sinkErr.Filename != "test.manifest.xml" {
+		t.Errorf("WriteManifest() = %#v, expected a *SinkError for the manifest", err)
+	}
+
+	fs.failOpen, fs.failClose = -1, 2
+	if err := md.WriteManifest(w, fs); !errors.Is(err, errInjected) {
+		t.Errorf("WriteManifest() = %v, expected the injected fault", err)
+	}
+	if len(fs.open) > 0 {
+		t.Errorf("files left open: %v", fs.open)
+	}
+}
+
+// readTestBundle() reverses the bundling process, returning the tar header and
+// the image within.
+func readTestBundle(t *testing.T, sink *accumulatingSink, w *Writer) (*tar.Header, []byte) {
+	// reassemble the parts
+	var ciphertext []byte
+	for i := 0; ; i++ {
+		part := sink.files[fmt.Sprintf("%s.part.%d", w.basename, i)]
+		if part == nil {
+			break
+		}
+		ciphertext = append(ciphertext, part.Bytes()...)
+	}
+
+	// decrypt and unpad
+	block, err := aes.NewCipher(w.key)
+	if err != nil {
+		t.Fatalf("aes.NewCipher() error = %v", err)
+	}
+	if len(ciphertext) == 0 || len(ciphertext)%16 != 0 {
+		t.Fatalf("bundle is %d bytes, which is not a whole number of blocks", len(ciphertext))
+	}
+	plaintext := make([]byte, len(ciphertext))
+	cipher.NewCBCDecrypter(block, w.iv).CryptBlocks(plaintext, ciphertext)
+	plaintext = plaintext[:len(plaintext)-int(plaintext[len(plaintext)-1])]
+
+	// decompress and untar
+	gz, err := gzip.NewReader(bytes.NewReader(plaintext))
+	if err != nil {
+		t.Fatalf("gzip.NewReader() error = %v", err)
+	}
+	tr := tar.NewReader(gz)
+	hdr, err := tr.Next()
+	if err != nil {
+		t.Fatalf("tar.Next() error = %v", err)
+	}
+	image, err := ioutil.ReadAll(tr)
+	if err != nil {
+		t.Fatalf("reading tar entry: %v", err)
+	}
+	if _, err := tr.Next(); err != io.EOF {
+		t.Errorf("expected exactly one tar entry, got %v", err)
+	}
+
+	return hdr, image
+}
+
+func TestWriterSizeMismatch(t *testing.T) {
+	for _, actual := range []int64{0, 1, 99} {
+		w, err := NewWriter("test", 100, newAccumulatingSink())
+		if err != nil {
+			t.Fatalf("NewWriter() error = %v", err)
+		}
+		if _, err := w.Write(make([]byte, actual)); err != nil {
+			t.Fatalf("Write() error = %v", err)
+		}
+
+		var mismatch *SizeMismatchError
+		if err := w.Close(); !errors.As(err, &mismatch) {
+			t.Errorf("writing %d of 100 bytes: Close() = %v, expected a *SizeMismatchError", actual, err)
+		} else if mismatch.Expected != 100 || mismatch.Actual != actual {
+			t.Errorf("writing %d of 100 bytes: Close() = %#v", actual, mismatch)
+		}
+	}
+}
+
+func TestWriterOverrun(t *testing.T) {
+	w, err := NewWriter("test", 100, newAccumulatingSink())
+	if err != nil {
+		t.Fatalf("NewWriter() error = %v", err)
+	}
+	if _, err := w.Write(make([]byte, 60)); err != nil {
+		t.Fatalf("Write() error = %v", err)
+	}
+
+	// the write which would cross the end fails immediately, writing nothing
+	var mismatch *SizeMismatchError
+	if n, err := w.Write(make([]byte, 41)); !errors.As(err, &mismatch) || n != 0 {
+		t.Errorf("overrunning Write() = %d, %v, expected 0, a *SizeMismatchError", n, err)
+	} else if mismatch.Expected != 100 || mismatch.Actual != 101 {
+		t.Errorf("overrunning Write() = %#v", mismatch)
+	}
+
+	// and stays failed
+	if _, err := w.Write(make([]byte, 1)); err != mismatch {
+		t.Errorf("Write() after overrun = %v, expected %v", err, mismatch)
+	}
+	if err := w.Close(); !errors.As(err, &mismatch) {
+		t.Errorf("Close() after overrun = %v, expected a *SizeMismatchError", err)
+	}
+}
+
+func TestWriterPadding(t *testing.T) {
+	tests := []struct {
+		name     string
+		size     int64
+		written  int64
+		opts     []WriterOption
+		expected int64
+	}{
+		{"exact", 100, 100, nil, 100},
+		{"empty", 0, 0, nil, 0},
+		{"pad short", 100, 37, []WriterOption{PadShortImage()}, 100},
+		{"pad empty", 100, 0, []WriterOption{PadShortImage()}, 100},
+		{"round up", 100, 100, []WriterOption{RoundUpSize(1 << 20)}, 1 << 20},
+		{"round up aligned", 1 << 20, 1 << 20, []WriterOption{RoundUpSize(1 << 20)}, 1 << 20},
+		{"round up and pad", (1 << 20) + 1, 5, []WriterOption{RoundUpSize(1 << 20), PadShortImage()}, 2 << 20},
+		{"grow", 100, 100, []WriterOption{GrowTo(3 << 20)}, 3 << 20},
+		{"grow to same", 100, 100, []WriterOption{GrowTo(100)}, 100},
+		{"grow and round up", 100, 100, []WriterOption{GrowTo(1000), RoundUpSize(512)}, 1024},
+		{"grow and pad", 100, 10, []WriterOption{GrowTo(1000), PadShortImage()}, 1000},
+	}
+	for _, tt := range tests {
+		data := make([]byte, tt.written)
+		rand.Read(data)
+
+		sink := newAccumulatingSink()
+		w, err := NewWriter("test", tt.size, sink, tt.opts...)
+		if err != nil {
+			t.Fatalf("%s: NewWriter() error = %v", tt.name, err)
+		}
+		if len(data) > 0 {
+			if _, err := w.Write(data); err != nil {
+				t.Fatalf("%s: Write() error = %v", tt.name, err)
+			}
+		}
+		if err := w.Close(); err != nil {
+			t.Fatalf("%s: Close() error = %v", tt.name, err)
+		}
+
+		hdr, image := readTestBundle(t, sink, w)
+		if hdr.Size != tt.expected || int64(len(image)) != tt.expected {
+			t.Errorf("%s: bundled %d bytes with header size %d, expected %d", tt.name, len(image), hdr.Size, tt.expected)
+			continue
+		}
+		if !bytes.Equal(image[:len(data)], data) {
+			t.Errorf("%s: bundled image does not start with the data written", tt.name)
+		}
+		if !bytes.Equal(image[len(data):], make([]byte, tt.expected-tt.written)) {
+			t.Errorf("%s: bundled image is not padded with zeros", tt.name)
+		}
+	}
+}
+
+func TestWriterInvalidOptions(t *testing.T) {
+	for _, opts := range [][]WriterOption{
+		{GrowTo(99)},
+		{RoundUpSize(1 << 20), GrowTo(1000)},
+		{RoundUpSize(0)},
+	} {
+		if _, err := NewWriter("test", 100, newAccumulatingSink(), opts...); err == nil {
+			t.Errorf("NewWriter() with invalid options succeeded")
+		}
+	}
+}
@@ -0,0 +1,108 @@
+package aws_bundle_glue
+
+import (
+	"archive/tar"
+	"bytes"
+	"crypto/sha1"
+	"fmt"
+	"io"
+	"os"
+	"time"
+)
+
+// ArchiveIndexFilename is the name of the last file in an archive written by
+// an ArchiveSink, which lists the others and their SHA1s in the format of
+// `sha1sum`, so that `sha1sum -c` can check them once they're extracted.
+const ArchiveIndexFilename = "SHA1SUMS"
+
+// ArchiveSink writes a whole bundle into a single tar archive, which is
+// easier to carry around than hundreds of part files. Its files are the
+// bundle's parts, then its manifest, then an index; UploadArchive() uploads
+// them from there.
+//
+// Tar records each file's size before its contents, so files are added to the
+// archive as they're closed, not as they're written.
+type ArchiveSink struct {
+	tw       *tar.Writer
+	file     io.Closer
+	filename string
+
+	index bytes.Buffer
+	err   error // the first error, after which the archive is useless
+}
+
+// NewArchiveSink() returns an ArchiveSink writing to w.
+func NewArchiveSink(w io.Writer) *ArchiveSink {
+	return &ArchiveSink{tw: tar.NewWriter(w)}
+}
+
+// CreateArchiveSink() returns an ArchiveSink writing to a new file, which
+// Close() closes.
+func CreateArchiveSink(filename string) (*ArchiveSink, error) {
+	f, err := os.Create(filename)
+	if err != nil {
+		return nil, err
+	}
+	sink := NewArchiveSink(f)
+	sink.file, sink.filename = f, filename
+	return sink, nil
+}
+
+// Location() implements the Destination interface, returning the archive's
+// filename, if known.
+func (sink *ArchiveSink) Location(filename string) (string, bool) {
+	return sink.filename, false
+}
+
+// WriteBundleFile() implements the aws_bundle.Sink interface.
+func (sink *ArchiveSink) WriteBundleFile(filename string) (io.WriteCloser, error) {
+	if sink.err != nil {
+		return nil, sink.err
+	}
+	return newBufferedFile(func(contents []byte) error {
+		return sink.add(filename, contents)
+	}), nil
+}
+
+// add() adds a file to the archive.
+func (sink *ArchiveSink) add(filename string, contents []byte) error {
+	if sink.err != nil {
+		return sink.err
+	}
+	hdr := tar.Header{
+		Name:     filename,
+		Mode:     0644,
+		Size:     int64(len(contents)),
+		ModTime:  time.Now(),
+		Typeflag: tar.TypeReg,
+	}
+	if err := sink.tw.WriteHeader(&hdr); err != nil {
+		sink.err = err
+		return err
+	}
+	if _, err := sink.tw.Write(contents); err != nil {
+		sink.err = err
+		return err
+	}
+	fmt.Fprintf(&sink.index, "%x  %s\n", sha1.Sum(contents), filename)
+	return nil
+}
+
+// Close() finishes the archive by adding the index, and closes the file if
+// CreateArchiveSink() made it. It doesn't close a writer given to
+// NewArchiveSink().
+func (sink *ArchiveSink) Close() error {
+	err := sink.add(ArchiveIndexFilename, sink.index.Bytes())
+	if err == nil {
+		err = sink.tw.Close()
+	}
+	if sink.file != nil {
+		if closeErr := sink.file.Close(); err == nil {
+			err = closeErr
+		}
+	}
+	if sink.err == nil {
+		sink.err = fmt.Errorf("archive is closed")
+	}
+	return err
+}
@@ -0,0 +1,138 @@
+package aws_bundle_glue
+
+import (
+	"archive/tar"
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+type archiveEntry struct {
+	name     string
+	contents []byte
+}
+
+// readArchive() returns the files in a tar archive.
+func readArchive(t *testing.T, archive []byte) []archiveEntry {
+	t.Helper()
+	var entries []archiveEntry
+	tr := tar.NewReader(bytes.NewReader(archive))
+	for {
+		hdr, err := tr.Next()
+		if err != nil {
+			return entries
+		}
+		contents, err := ioutil.ReadAll(tr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		entries = append(entries, archiveEntry{hdr.Name, contents})
+	}
+}
+
+// writeArchive() writes an archive with an ArchiveSink, which adds the index.
+func writeArchive(t *testing.T, entries []archiveEntry) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	sink := NewArchiveSink(&buf)
+	for _, entry := range entries {
+		w, err := sink.WriteBundleFile(entry.name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.Write(entry.contents)
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := sink.Close(); err != nil {
+		t.Fatalf("Close() error = %v", err)
+	}
+	return buf.Bytes()
+}
+
+func TestArchive(t *testing.T) {
+	var buf bytes.Buffer
+	sink := NewArchiveSink(&buf)
+	result := bundleTo(t, sink)
+	if err := sink.Close(); err != nil {
+		t.Fatalf("Close() error = %v", err)
+	}
+
+	var names []string
+	entries := readArchive(t, buf.Bytes())
+	for _, entry := range entries {
+		names = append(names, entry.name)
+	}
+	if fmt.Sprint(names) != "[test.part.0 test.part.1 test.manifest.xml SHA1SUMS]" {
+		t.Fatalf("archive contains %v", names)
+	}
+	index := string(entries[3].contents)
+	if expected := fmt.Sprintf("%s  test.part.0\n", result.Parts[0].SHA1); index[:len(expected)] != expected {
+		t.Errorf("index = %q", index)
+	}
+
+	// upload it somewhere else
+	dir, err := ioutil.TempDir("", "archive")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	info, err := UploadArchive(bytes.NewReader(buf.Bytes()), NewFileSink(dir))
+	if err != nil {
+		t.Fatalf("UploadArchive() error = %v", err)
+	}
+	checkBundleFiles(t, dir, result)
+	if info.ManifestFilename != result.ManifestFilename || info.ImageDigest != result.ImageDigest || info.BundledSize != result.BundledSize || fmt.Sprint(info.Parts) != fmt.Sprint(result.Parts) {
+		t.Errorf("UploadArchive() = %+v, expected %+v", info, result.Info)
+	}
+}
+
+func TestUploadArchiveFailures(t *testing.T) {
+	var buf bytes.Buffer
+	sink := NewArchiveSink(&buf)
+	bundleTo(t, sink)
+	sink.Close()
+	archive := buf.Bytes()
+	entries := readArchive(t, archive)[:3]
+
+	corrupted := append([]byte(nil), archive...)
+	corrupted[len(corrupted)/3] ^= 1
+	tampered := append([]archiveEntry(nil), entries...)
+	tampered[1].contents = append([]byte("x"), tampered[1].contents[1:]...)
+	extra := append(append([]archiveEntry(nil), entries[:2]...), archiveEntry{"test.part.2", []byte("extra")}, entries[2])
+
+	for _, test := range []struct {
+		name     string
+		archive  []byte
+		checksum string
+	}{
+		{"incomplete", archive[:len(archive)-4096], ""},
+		{"corrupted", corrupted, "index"},
+		{"tampered", writeArchive(t, tampered), "manifest"},
+		{"missing part", writeArchive(t, []archiveEntry{entries[0], entries[2]}), ""},
+		{"extra part", writeArchive(t, extra), ""},
+		{"no manifest", writeArchive(t, entries[:2]), ""},
+		{"duplicate", writeArchive(t, append(entries[:1:1], entries...)), ""},
+	} {
+		dir, err := ioutil.TempDir("", "archive")
+		if err != nil {
+			t.Fatal(err)
+		}
+		info, err := UploadArchive(bytes.NewReader(test.archive), NewFileSink(dir))
+		var checksumErr *ChecksumError
+		if err == nil {
+			t.Errorf("%s: UploadArchive() = %+v", test.name, info)
+		} else if test.checksum != "" && (!errors.As(err, &checksumErr) || checksumErr.Source != test.checksum) {
+			t.Errorf("%s: UploadArchive() error = %v, expected a mismatch with the %s", test.name, err, test.checksum)
+		}
+		if _, err := os.Stat(filepath.Join(dir, "test.manifest.xml")); err == nil {
+			t.Errorf("%s: the manifest was written", test.name)
+		}
+		os.RemoveAll(dir)
+	}
+}
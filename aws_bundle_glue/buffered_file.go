@@ -0,0 +1,49 @@
+package aws_bundle_glue
+
+import (
+	"bytes"
+	"io"
+)
+
+// bufferedFile is a bundle file for destinations which need to know a file's
+// length before its contents: it's held in memory until it's closed, then
+// handed over all at once. Bundle parts are 10 MiB, so that's not much.
+type bufferedFile struct {
+	done   func(contents []byte) error
+	buf    bytes.Buffer
+	closed bool
+}
+
+// newBufferedFile() returns a bufferedFile which calls done with its contents
+// when it's closed, and returns what done returns.
+func newBufferedFile(done func(contents []byte) error) *bufferedFile {
+	return &bufferedFile{done: done}
+}
+
+func (f *bufferedFile) Write(p []byte) (int, error) {
+	if f.closed {
+		return 0, io.ErrClosedPipe
+	}
+	return f.buf.Write(p)
+}
+
+func (f *bufferedFile) Close() error {
+	if f.closed {
+		return io.ErrClosedPipe
+	}
+	f.closed = true
+	err := f.done(f.buf.Bytes())
+	f.buf = bytes.Buffer{}
+	return err
+}
+
+// CloseWithError() discards the file's contents rather than handing them
+// over, since bundling failed partway through it.
+func (f *bufferedFile) CloseWithError(err error) error {
+	if f.closed {
+		return io.ErrClosedPipe
+	}
+	f.closed = true
+	f.buf = bytes.Buffer{}
+	return nil
+}
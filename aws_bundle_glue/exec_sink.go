@@ -0,0 +1,75 @@
+package aws_bundle_glue
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+)
+
+// ExecSinkFilenameVariable is the environment variable in which an ExecSink's
+// command finds the name of the file it's reading.
+const ExecSinkFilenameVariable = "BUNDLE_FILENAME"
+
+// ExecSink pipes each bundle file into a shell command, which can upload it
+// however it likes. The command is run with "sh -c" once per file, reading
+// the file from its standard input, with the filename in $BUNDLE_FILENAME.
+// Its output goes to standard error, and a file is written successfully if
+// the command exits successfully.
+type ExecSink struct {
+	command string
+}
+
+// NewExecSink() returns an ExecSink running command.
+func NewExecSink(command string) *ExecSink {
+	return &ExecSink{command: command}
+}
+
+// Location() implements the Destination interface. An ExecSink doesn't know
+// where its command put the file.
+func (sink *ExecSink) Location(filename string) (string, bool) {
+	return "", false
+}
+
+// WriteBundleFile() implements the aws_bundle.Sink interface.
+func (sink *ExecSink) WriteBundleFile(filename string) (io.WriteCloser, error) {
+	cmd := exec.Command("sh", "-c", sink.command)
+	cmd.Env = append(os.Environ(), ExecSinkFilenameVariable+"="+filename)
+	cmd.Stdout = os.Stderr
+	cmd.Stderr = os.Stderr
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+	return &execSinkFile{cmd: cmd, stdin: stdin}, nil
+}
+
+type execSinkFile struct {
+	cmd   *exec.Cmd
+	stdin io.WriteCloser
+}
+
+func (f *execSinkFile) Write(p []byte) (int, error) {
+	return f.stdin.Write(p)
+}
+
+// Close() waits for the command to finish, even if it didn't read everything.
+func (f *execSinkFile) Close() error {
+	f.stdin.Close()
+	if err := f.cmd.Wait(); err != nil {
+		return fmt.Errorf("%q: %w", f.cmd.Args[2], err)
+	}
+	return nil
+}
+
+// CloseWithError() kills the command before it sees the end of the file,
+// since bundling failed partway through it, then waits for it.
+func (f *execSinkFile) CloseWithError(err error) error {
+	f.cmd.Process.Kill()
+	f.stdin.Close()
+	f.cmd.Wait()
+	return nil
+}
@@ -0,0 +1,48 @@
+package aws_bundle_glue
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// FileSink writes bundle files to a local directory, e.g. for a dry run, or
+// to upload later.
+type FileSink struct {
+	dir string
+}
+
+// NewFileSink() returns a FileSink writing to dir, which is created if
+// necessary. Existing files are overwritten.
+func NewFileSink(dir string) *FileSink {
+	return &FileSink{dir: dir}
+}
+
+// Location() implements the Destination interface.
+func (sink *FileSink) Location(filename string) (string, bool) {
+	return filepath.Join(sink.dir, filename), false
+}
+
+// WriteBundleFile() implements the aws_bundle.Sink interface.
+func (sink *FileSink) WriteBundleFile(filename string) (io.WriteCloser, error) {
+	if err := os.MkdirAll(sink.dir, 0o755); err != nil {
+		return nil, err
+	}
+	f, err := os.Create(filepath.Join(sink.dir, filename))
+	if err != nil {
+		return nil, err
+	}
+	return fileSinkFile{f}, nil
+}
+
+// fileSinkFile is a bundle file being written to disk.
+type fileSinkFile struct {
+	*os.File
+}
+
+// CloseWithError() removes the file, since bundling failed partway through
+// it.
+func (f fileSinkFile) CloseWithError(err error) error {
+	f.File.Close()
+	return os.Remove(f.Name())
+}
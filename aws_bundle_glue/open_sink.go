@@ -0,0 +1,90 @@
+package aws_bundle_glue
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/willglynn/go_ami_tools/aws_bundle"
+)
+
+// A Destination is a Sink which can say where it put each file.
+type Destination interface {
+	aws_bundle.Sink
+
+	// Location() says where filename went, and whether that's in S3. If it
+	// is, the location is "bucket/key", which is how registering an AMI
+	// refers to its manifest; otherwise, it's a path or URL, or "" if it's
+	// unknown.
+	Location(filename string) (string, bool)
+}
+
+// OpenSink() returns a Destination for a URL:
+//
+//	file:///path/to/dir/              a FileSink writing to that directory
+//	tar:///path/to/bundle.tar         an ArchiveSink writing that file
+//	s3://bucket/prefix/?region=...    an S3Sink, using the usual credentials
+//	https://broker/...                a PresignedSink asking that broker
+//	exec:command                      an ExecSink running that command
+//
+// If an s3:// URL doesn't specify the region, it's looked up, which requires
+// s3:GetBucketLocation. An ArchiveSink must be closed once the bundle is
+// written, to finish the archive.
+func OpenSink(dest string) (Destination, error) {
+	if command := strings.TrimPrefix(dest, "exec:"); command != dest {
+		if command == "" {
+			return nil, fmt.Errorf("invalid destination %q, expected exec:<command>", dest)
+		}
+		return NewExecSink(command), nil
+	}
+
+	u, err := url.Parse(dest)
+	if err != nil {
+		return nil, err
+	}
+	switch u.Scheme {
+	case "file":
+		if u.Host != "" && u.Host != "localhost" || u.Path == "" {
+			return nil, fmt.Errorf("invalid destination %q, expected file:///path/to/directory/", dest)
+		}
+		return NewFileSink(u.Path), nil
+
+	case "tar":
+		if u.Host != "" && u.Host != "localhost" || u.Path == "" {
+			return nil, fmt.Errorf("invalid destination %q, expected tar:///path/to/bundle.tar", dest)
+		}
+		sink, err := CreateArchiveSink(u.Path)
+		if err != nil {
+			return nil, err
+		}
+		return sink, nil
+
+	case "s3":
+		if u.Host == "" {
+			return nil, fmt.Errorf("invalid destination %q, expected s3://bucket/prefix/", dest)
+		}
+		region := u.Query().Get("region")
+		if region == "" {
+			if region, err = BucketRegion(u.Host); err != nil {
+				return nil, fmt.Errorf("unable to s3:GetBucketLocation for %q; please specify ?region=: %v", u.Host, err)
+			}
+		}
+		s3Svc := s3.New(session.New(), aws.NewConfig().WithRegion(region))
+		sink := NewS3Sink(s3Svc, u.Host, strings.TrimPrefix(u.Path, "/"))
+		sink.region = region
+		return sink, nil
+
+	case "http", "https":
+		sink, err := NewBrokerSink(dest)
+		if err != nil {
+			return nil, err
+		}
+		return sink, nil
+
+	default:
+		return nil, fmt.Errorf("unsupported destination %q, expected file://, tar://, s3://, https://, or exec:", dest)
+	}
+}
@@ -0,0 +1,183 @@
+package aws_bundle_glue
+
+import (
+	"archive/tar"
+	"crypto/sha1"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	"github.com/willglynn/go_ami_tools/aws_bundle"
+)
+
+// checkBundleFiles() checks that dir holds the bundle's files, intact.
+func checkBundleFiles(t *testing.T, dir string, result *aws_bundle.Result) {
+	t.Helper()
+	for _, part := range result.Parts {
+		contents, err := ioutil.ReadFile(filepath.Join(dir, part.Filename))
+		if err != nil || fmt.Sprintf("%x", sha1.Sum(contents)) != part.SHA1 {
+			t.Errorf("%s wasn't written intact (%v)", part.Filename, err)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(dir, result.ManifestFilename)); err != nil {
+		t.Errorf("the manifest wasn't written: %v", err)
+	}
+}
+
+func TestOpenSink(t *testing.T) {
+	dir, err := ioutil.TempDir("", "open_sink")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// file:// creates the directory
+	fileDir := filepath.Join(dir, "file", "bundle")
+	dest, err := OpenSink("file://" + fileDir + "/")
+	if err != nil {
+		t.Fatalf("OpenSink() error = %v", err)
+	}
+	if _, ok := dest.(*FileSink); !ok {
+		t.Fatalf("OpenSink(file://) = %T", dest)
+	}
+	result := bundleTo(t, dest)
+	checkBundleFiles(t, fileDir, result)
+	if location, s3 := dest.Location("test.manifest.xml"); location != filepath.Join(fileDir, "test.manifest.xml") || s3 {
+		t.Errorf("Location() = %q, %v", location, s3)
+	}
+
+	// tar:// writes an archive, once it's closed
+	archive := filepath.Join(dir, "bundle.tar")
+	dest, err = OpenSink("tar://" + archive)
+	if err != nil {
+		t.Fatalf("OpenSink() error = %v", err)
+	}
+	result = bundleTo(t, dest)
+	if err := dest.(*ArchiveSink).Close(); err != nil {
+		t.Fatalf("Close() error = %v", err)
+	}
+	if location, s3 := dest.Location("test.manifest.xml"); location != archive || s3 {
+		t.Errorf("Location() = %q, %v", location, s3)
+	}
+	if f, err := os.Open(archive); err != nil {
+		t.Error(err)
+	} else {
+		if _, err := UploadArchive(f, NewFileSink(filepath.Join(dir, "extracted"))); err != nil {
+			t.Errorf("UploadArchive() error = %v", err)
+		}
+		f.Close()
+		checkBundleFiles(t, filepath.Join(dir, "extracted"), result)
+	}
+
+	// exec: runs the command for each file
+	if _, err := exec.LookPath("sh"); err == nil {
+		execDir := filepath.Join(dir, "exec")
+		os.Mkdir(execDir, 0o755)
+		dest, err := OpenSink(fmt.Sprintf(`exec:cat > '%s'/"$%s"`, execDir, ExecSinkFilenameVariable))
+		if err != nil {
+			t.Fatalf("OpenSink() error = %v", err)
+		}
+		checkBundleFiles(t, execDir, bundleTo(t, dest))
+
+		dest, _ = OpenSink("exec:cat >/dev/null; exit 3")
+		w, err := dest.WriteBundleFile("test.part.0")
+		if err != nil {
+			t.Fatalf("WriteBundleFile() error = %v", err)
+		}
+		w.Write([]byte("hello"))
+		if err := w.Close(); err == nil {
+			t.Errorf("Close() succeeded despite the command failing")
+		}
+	}
+
+	// s3:// with a region doesn't need to look it up
+	dest, err = OpenSink("s3://mybucket/images/?region=us-west-2")
+	if err != nil {
+		t.Fatalf("OpenSink() error = %v", err)
+	}
+	if s3Sink, ok := dest.(*S3Sink); !ok || s3Sink.Region() != "us-west-2" {
+		t.Errorf("OpenSink(s3://) = %#v", dest)
+	} else if location, s3 := dest.Location("test.manifest.xml"); location != "mybucket/images/test.manifest.xml" || !s3 {
+		t.Errorf("Location() = %q, %v", location, s3)
+	}
+
+	// https:// asks a broker
+	tb := newTestBucket()
+	defer tb.server.Close()
+	dest, err = OpenSink(tb.server.URL + "/broker?build=1")
+	if err != nil {
+		t.Fatalf("OpenSink() error = %v", err)
+	}
+	result = bundleTo(t, dest)
+	if tb.objects["prefix/"+result.ManifestFilename] == nil {
+		t.Errorf("the manifest wasn't uploaded")
+	}
+	if location, s3 := dest.Location(result.ManifestFilename); location != tb.server.URL+"/bucket/prefix/test.manifest.xml" || s3 {
+		t.Errorf("Location() = %q, %v", location, s3)
+	}
+
+	for _, invalid := range []string{"", "bucket/prefix", "ftp://example.com/", "exec:", "file://host/path", "file://", "tar://", "tar:///nonexistent/bundle.tar", "s3:///prefix"} {
+		if dest, err := OpenSink(invalid); err == nil {
+			t.Errorf("OpenSink(%q) = %#v", invalid, dest)
+		}
+	}
+}
+
+func TestSinksAbandonFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "open_sink")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	tb := newTestBucket()
+	defer tb.server.Close()
+
+	dests := []string{
+		"file://" + dir + "/file/",
+		"tar://" + filepath.Join(dir, "bundle.tar"),
+		tb.server.URL + "/broker",
+	}
+	if _, err := exec.LookPath("sh"); err == nil {
+		dests = append(dests, fmt.Sprintf(`exec:contents=$(cat); printf %%s "$contents" > '%s'/"$%s"`, dir, ExecSinkFilenameVariable))
+	}
+	for _, d := range dests {
+		dest, err := OpenSink(d)
+		if err != nil {
+			t.Fatalf("OpenSink() error = %v", err)
+		}
+		w, err := dest.WriteBundleFile("test.part.0")
+		if err != nil {
+			t.Fatalf("%s: WriteBundleFile() error = %v", d, err)
+		}
+		w.Write([]byte("hello"))
+		if err := w.(interface{ CloseWithError(error) error }).CloseWithError(errors.New("stop")); err != nil {
+			t.Errorf("%s: CloseWithError() error = %v", d, err)
+		}
+		if archive, ok := dest.(*ArchiveSink); ok {
+			archive.Close()
+		}
+	}
+
+	// nothing was written anywhere
+	if _, err := os.Stat(filepath.Join(dir, "file", "test.part.0")); !os.IsNotExist(err) {
+		t.Errorf("file:// left the file behind (%v)", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "test.part.0")); !os.IsNotExist(err) {
+		t.Errorf("exec: finished the file (%v)", err)
+	}
+	if f, err := os.Open(filepath.Join(dir, "bundle.tar")); err != nil {
+		t.Error(err)
+	} else {
+		defer f.Close()
+		if hdr, err := tar.NewReader(f).Next(); err != nil || hdr.Name != ArchiveIndexFilename {
+			t.Errorf("tar:// archive starts with %+v, %v", hdr, err)
+		}
+	}
+	if len(tb.attempts) != 0 || len(tb.objects) != 0 {
+		t.Errorf("https:// uploaded %v", tb.attempts)
+	}
+}
@@ -0,0 +1,240 @@
+package aws_bundle_glue
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// BundleACL is the canned ACL with which bundle files are uploaded, which
+// lets EC2 read them on the bundle owner's behalf.
+const BundleACL = "aws-exec-read"
+
+// a 10 MiB part takes a while on a slow link, but not this long
+const presignedRequestTimeout = 5 * time.Minute
+
+// A URLSigner returns a presigned URL to which filename can be uploaded with
+// a PUT request. The request includes an x-amz-acl header with the value
+// BundleACL, so the URL must be signed to allow that.
+type URLSigner func(filename string) (string, error)
+
+// PresignedSink uploads bundle files to presigned S3 URLs, so that it needs
+// no AWS credentials of its own: whatever presigns the URLs holds them.
+//
+// Presigned PUTs need to know each file's length up front, so files are
+// uploaded as they're closed, not as they're written.
+type PresignedSink struct {
+	sign URLSigner
+
+	// Client makes the requests. Unless changed, it gives up on a request
+	// after five minutes, so that a stalled upload is retried rather than
+	// hanging forever.
+	Client *http.Client
+
+	// Attempts is how many times a request is tried before giving up, and
+	// RetryDelay is how long to wait after the first failure, which doubles
+	// after each one thereafter. Only server errors and failed connections
+	// are retried, whether uploading or asking a broker for a URL.
+	Attempts   int
+	RetryDelay time.Duration
+
+	mu   sync.Mutex
+	urls map[string]string
+}
+
+// NewPresignedSink() returns a PresignedSink which gets a URL for each file
+// from sign.
+func NewPresignedSink(sign URLSigner) *PresignedSink {
+	return &PresignedSink{
+		sign:       sign,
+		Client:     &http.Client{Timeout: presignedRequestTimeout},
+		Attempts:   5,
+		RetryDelay: time.Second,
+		urls:       make(map[string]string),
+	}
+}
+
+// NewBrokerSink() returns a PresignedSink which gets a URL for each file from
+// a broker: an HTTP endpoint which, given a GET request for its URL with a
+// "filename" query parameter added, responds with the presigned URL as the
+// body of a 200 OK response.
+func NewBrokerSink(broker string) (*PresignedSink, error) {
+	brokerURL, err := url.Parse(broker)
+	if err != nil {
+		return nil, err
+	} else if brokerURL.Scheme != "http" && brokerURL.Scheme != "https" {
+		return nil, fmt.Errorf("broker URL %q is not http:// or https://", broker)
+	}
+
+	sink := NewPresignedSink(nil)
+	sink.sign = func(filename string) (string, error) {
+		return sink.askBroker(*brokerURL, filename)
+	}
+	return sink, nil
+}
+
+// askBroker() asks the broker at brokerURL for filename's URL, retrying as
+// needed.
+func (sink *PresignedSink) askBroker(brokerURL url.URL, filename string) (string, error) {
+	query := brokerURL.Query()
+	query.Set("filename", filename)
+	brokerURL.RawQuery = query.Encode()
+
+	var presigned string
+	attempts, _, err := sink.retry(func() (int, bool, error) {
+		resp, err := sink.Client.Get(brokerURL.String())
+		if err != nil {
+			return 0, true, err
+		}
+		defer resp.Body.Close()
+		body, err := ioutil.ReadAll(io.LimitReader(resp.Body, 16<<10))
+		if err != nil {
+			return 0, true, err
+		} else if resp.StatusCode != http.StatusOK {
+			return resp.StatusCode, resp.StatusCode >= 500, fmt.Errorf("broker responded %s: %s", resp.Status, strings.TrimSpace(string(body)))
+		}
+
+		presigned = strings.TrimSpace(string(body))
+		if u, err := url.Parse(presigned); err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+			return resp.StatusCode, false, fmt.Errorf("broker responded with %q, not a URL", redactURL(presigned))
+		}
+		return resp.StatusCode, false, nil
+	})
+	if err != nil && attempts > 1 {
+		return "", fmt.Errorf("%w (after %d attempts)", err, attempts)
+	}
+	return presigned, err
+}
+
+// URL() returns the URL, without its query string, to which filename was
+// uploaded, or "" if it wasn't.
+func (sink *PresignedSink) URL(filename string) string {
+	sink.mu.Lock()
+	defer sink.mu.Unlock()
+	return sink.urls[filename]
+}
+
+// Location() implements the Destination interface, returning the "bucket/key"
+// of filename if its URL is recognizably S3's, or the URL otherwise.
+func (sink *PresignedSink) Location(filename string) (string, bool) {
+	u := sink.URL(filename)
+	if location, ok := s3Location(u); ok {
+		return location, true
+	}
+	return u, false
+}
+
+// WriteBundleFile() implements the aws_bundle.Sink interface.
+func (sink *PresignedSink) WriteBundleFile(filename string) (io.WriteCloser, error) {
+	return newBufferedFile(func(contents []byte) error {
+		return sink.upload(filename, contents)
+	}), nil
+}
+
+// upload() PUTs body to filename's presigned URL, retrying as needed.
+func (sink *PresignedSink) upload(filename string, body []byte) error {
+	presigned, err := sink.sign(filename)
+	if err != nil {
+		return &UploadError{Filename: filename, Err: fmt.Errorf("unable to presign URL: %w", err)}
+	}
+
+	attempts, status, err := sink.retry(func() (int, bool, error) {
+		return sink.put(presigned, body)
+	})
+	if err != nil {
+		return &UploadError{Filename: filename, Attempts: attempts, StatusCode: status, Err: err}
+	}
+
+	sink.mu.Lock()
+	sink.urls[filename] = redactURL(presigned)
+	sink.mu.Unlock()
+	return nil
+}
+
+// retry() makes an attempt, which returns the response's status code, if
+// there was a response, and whether a failure is worth retrying, until it
+// succeeds, fails for good, or has been tried sink.Attempts times. It returns
+// how many attempts were made, and the last one's status code and error.
+func (sink *PresignedSink) retry(attempt func() (int, bool, error)) (int, int, error) {
+	delay := sink.RetryDelay
+	for attempts := 1; ; attempts++ {
+		status, retryable, err := attempt()
+		if err == nil || !retryable || attempts >= sink.Attempts {
+			return attempts, status, err
+		}
+		time.Sleep(delay)
+		delay *= 2
+	}
+}
+
+// put() makes one attempt at uploading body. Server errors and failed
+// connections are worth retrying, but nothing else is.
+func (sink *PresignedSink) put(presigned string, body []byte) (int, bool, error) {
+	req, err := http.NewRequest(http.MethodPut, presigned, bytes.NewReader(body))
+	if err != nil {
+		return 0, false, redactError(err)
+	}
+	req.Header.Set("x-amz-acl", BundleACL)
+
+	resp, err := sink.Client.Do(req)
+	if err != nil {
+		return 0, true, redactError(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 == 2 {
+		io.Copy(ioutil.Discard, resp.Body)
+		return resp.StatusCode, false, nil
+	}
+	// S3 explains itself in a short XML document
+	explanation, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1<<10))
+	return resp.StatusCode, resp.StatusCode >= 500, fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(explanation)))
+}
+
+// redactURL() removes the query string, which holds the signature, from a
+// presigned URL.
+func redactURL(presigned string) string {
+	if i := strings.IndexByte(presigned, '?'); i >= 0 {
+		return presigned[:i]
+	}
+	return presigned
+}
+
+// redactError() removes the signature from the URL in an HTTP client error.
+func redactError(err error) error {
+	var urlErr *url.Error
+	if errors.As(err, &urlErr) {
+		urlErr.URL = redactURL(urlErr.URL)
+	}
+	return err
+}
+
+// UploadError describes a bundle file which a PresignedSink couldn't upload.
+type UploadError struct {
+	Filename string
+
+	// Attempts is how many times the upload was tried, which is 0 if the URL
+	// couldn't be presigned, and StatusCode is the last response's status
+	// code, which is 0 if there wasn't one.
+	Attempts   int
+	StatusCode int
+
+	Err error
+}
+
+func (e *UploadError) Error() string {
+	if e.Attempts == 0 {
+		return fmt.Sprintf("unable to upload %q: %v", e.Filename, e.Err)
+	}
+	return fmt.Sprintf("unable to upload %q after %d attempts: %v", e.Filename, e.Attempts, e.Err)
+}
+
+func (e *UploadError) Unwrap() error {
+	return e.Err
+}
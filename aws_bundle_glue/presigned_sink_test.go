@@ -0,0 +1,213 @@
+package aws_bundle_glue
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha1"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/willglynn/go_ami_tools/aws_bundle"
+)
+
+// testBucket is an S3 stand-in which accepts presigned PUTs, along with a
+// broker which presigns them.
+type testBucket struct {
+	sync.Mutex
+	server   *httptest.Server
+	objects  map[string][]byte
+	attempts map[string]int
+
+	// failures maps keys to the status with which PUTs to them fail, and how
+	// many times (-1 for always); "broker/" and a filename does the same for
+	// the broker
+	failures map[string][2]int
+}
+
+func newTestBucket() *testBucket {
+	tb := &testBucket{
+		objects:  make(map[string][]byte),
+		attempts: make(map[string]int),
+		failures: make(map[string][2]int),
+	}
+	tb.server = httptest.NewServer(tb)
+	return tb
+}
+
+func (tb *testBucket) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	tb.Lock()
+	defer tb.Unlock()
+
+	switch {
+	case r.Method == http.MethodGet && r.URL.Path == "/broker":
+		filename := r.URL.Query().Get("filename")
+		tb.attempts["broker/"+filename]++
+		if tb.fail(w, "broker/"+filename) {
+			return
+		}
+		if filename == "unsignable" {
+			http.Error(w, "no", http.StatusForbidden)
+			return
+		}
+		fmt.Fprintf(w, "%s/bucket/prefix/%s?X-Amz-Signature=secret\n", tb.server.URL, filename)
+
+	case r.Method == http.MethodPut && strings.HasPrefix(r.URL.Path, "/bucket/"):
+		key := strings.TrimPrefix(r.URL.Path, "/bucket/")
+		tb.attempts[key]++
+		if r.URL.Query().Get("X-Amz-Signature") != "secret" || r.Header.Get("x-amz-acl") != BundleACL || r.ContentLength < 0 {
+			http.Error(w, "<Error><Code>SignatureDoesNotMatch</Code></Error>", http.StatusForbidden)
+			return
+		}
+		if tb.fail(w, key) {
+			return
+		}
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		tb.objects[key] = body
+
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// fail() responds with key's failure, if it has one left.
+func (tb *testBucket) fail(w http.ResponseWriter, key string) bool {
+	f, ok := tb.failures[key]
+	if !ok || f[1] == 0 {
+		return false
+	}
+	tb.failures[key] = [2]int{f[0], f[1] - 1}
+	http.Error(w, "<Error><Code>InternalError</Code></Error>", f[0])
+	return true
+}
+
+// bundleTo() bundles a 12 MiB image of random data, which makes two parts, to
+// sink, returning the result.
+func bundleTo(t *testing.T, sink aws_bundle.Sink) *aws_bundle.Result {
+	t.Helper()
+	image := make([]byte, 12<<20)
+	rand.Read(image)
+	md := aws_bundle.Metadata{Name: "test", Architecture: "x86_64", AWSAccountID: "123456789012", AWSRegion: "us-east-1"}
+	result, err := aws_bundle.Bundle(context.Background(), bytes.NewReader(image), int64(len(image)), sink, md)
+	if err != nil {
+		t.Fatalf("Bundle() error = %v", err)
+	}
+	return result
+}
+
+func TestBrokerSink(t *testing.T) {
+	tb := newTestBucket()
+	defer tb.server.Close()
+	tb.failures["prefix/test.part.0"] = [2]int{http.StatusServiceUnavailable, 2}
+	tb.failures["broker/test.part.1"] = [2]int{http.StatusBadGateway, 1}
+
+	sink, err := NewBrokerSink(tb.server.URL + "/broker")
+	if err != nil {
+		t.Fatalf("NewBrokerSink() error = %v", err)
+	}
+	sink.RetryDelay = time.Millisecond
+
+	// bundle an image end to end, with two parts
+	result := bundleTo(t, sink)
+
+	for _, part := range result.Parts {
+		object := tb.objects["prefix/"+part.Filename]
+		if object == nil || fmt.Sprintf("%x", sha1.Sum(object)) != part.SHA1 {
+			t.Errorf("%s wasn't uploaded intact", part.Filename)
+		}
+	}
+	if tb.objects["prefix/test.manifest.xml"] == nil {
+		t.Errorf("the manifest wasn't uploaded")
+	}
+	if tb.attempts["prefix/test.part.0"] != 3 || tb.attempts["prefix/test.part.1"] != 1 ||
+		tb.attempts["broker/test.part.0"] != 1 || tb.attempts["broker/test.part.1"] != 2 {
+		t.Errorf("attempts = %v", tb.attempts)
+	}
+	if url := sink.URL("test.manifest.xml"); url != tb.server.URL+"/bucket/prefix/test.manifest.xml" {
+		t.Errorf("URL() = %q", url)
+	}
+}
+
+func TestBrokerSinkFailures(t *testing.T) {
+	tb := newTestBucket()
+	defer tb.server.Close()
+	tb.failures["prefix/unavailable"] = [2]int{http.StatusServiceUnavailable, -1}
+	tb.failures["prefix/forbidden"] = [2]int{http.StatusForbidden, -1}
+	tb.failures["broker/overloaded"] = [2]int{http.StatusServiceUnavailable, -1}
+
+	sink, err := NewBrokerSink(tb.server.URL + "/broker")
+	if err != nil {
+		t.Fatalf("NewBrokerSink() error = %v", err)
+	}
+	sink.Attempts, sink.RetryDelay = 3, time.Millisecond
+
+	for _, test := range []struct {
+		filename string
+		attempts int
+		status   int
+	}{
+		{"unavailable", 3, http.StatusServiceUnavailable},
+		{"forbidden", 1, http.StatusForbidden},
+		{"unsignable", 0, 0},
+		{"overloaded", 0, 0},
+	} {
+		w, err := sink.WriteBundleFile(test.filename)
+		if err != nil {
+			t.Fatalf("WriteBundleFile() error = %v", err)
+		}
+		w.Write([]byte("hello"))
+		err = w.Close()
+
+		var uploadErr *UploadError
+		if !errors.As(err, &uploadErr) || uploadErr.Filename != test.filename ||
+			uploadErr.Attempts != test.attempts || uploadErr.StatusCode != test.status {
+			t.Errorf("%s: Close() error = %#v", test.filename, err)
+		} else if strings.Contains(err.Error(), "secret") {
+			t.Errorf("%s: error reveals the signature: %v", test.filename, err)
+		}
+		if sink.URL(test.filename) != "" {
+			t.Errorf("%s: URL() = %q", test.filename, sink.URL(test.filename))
+		}
+	}
+	if tb.attempts["broker/unsignable"] != 1 || tb.attempts["broker/overloaded"] != 3 {
+		t.Errorf("broker attempts = %v", tb.attempts)
+	}
+
+	// connection failures are retried too, without revealing the signature
+	sink = NewPresignedSink(func(filename string) (string, error) {
+		return "http://127.0.0.1:1/bucket/" + filename + "?X-Amz-Signature=secret", nil
+	})
+	sink.Attempts, sink.RetryDelay = 2, time.Millisecond
+	w, _ := sink.WriteBundleFile("unreachable")
+	err = w.Close()
+	var uploadErr *UploadError
+	if !errors.As(err, &uploadErr) || uploadErr.Attempts != 2 || strings.Contains(err.Error(), "secret") {
+		t.Errorf("unreachable: Close() error = %v", err)
+	}
+
+	// but a URL which can't make a request at all isn't
+	sink = NewPresignedSink(func(filename string) (string, error) {
+		return "http://127.0.0.1:1/bucket/%zz?X-Amz-Signature=secret", nil
+	})
+	sink.Attempts, sink.RetryDelay = 2, time.Millisecond
+	w, _ = sink.WriteBundleFile("malformed")
+	err = w.Close()
+	if !errors.As(err, &uploadErr) || uploadErr.Attempts != 1 || strings.Contains(err.Error(), "secret") {
+		t.Errorf("malformed: Close() error = %v", err)
+	}
+
+	if _, err := NewBrokerSink("ftp://example.com/"); err == nil {
+		t.Errorf("NewBrokerSink() accepted an ftp:// URL")
+	}
+}
@@ -0,0 +1,43 @@
+package aws_bundle_glue
+
+import (
+	"net/url"
+	"strings"
+)
+
+// s3Location() returns the "bucket/key" which an S3 object URL refers to,
+// whether it's virtual-hosted (https://bucket.s3.region.amazonaws.com/key) or
+// path-style (https://s3.region.amazonaws.com/bucket/key), or false if it
+// doesn't look like either.
+func s3Location(objectURL string) (string, bool) {
+	u, err := url.Parse(objectURL)
+	if err != nil || u.Path == "" {
+		return "", false
+	}
+	host := u.Hostname()
+	key := strings.TrimPrefix(u.Path, "/")
+
+	// strip the domain, e.g. ".amazonaws.com" or ".amazonaws.com.cn"
+	i := strings.Index(host, ".amazonaws.com")
+	if i < 0 {
+		return "", false
+	}
+	labels := strings.Split(host[:i], ".")
+
+	// the service is "s3", "s3-region", or "s3-accelerate" (perhaps followed by
+	// the region or "dualstack"), and anything before it is the bucket
+	for j, label := range labels {
+		if label != "s3" && !strings.HasPrefix(label, "s3-") {
+			continue
+		}
+		if j == 0 {
+			// path-style
+			if !strings.Contains(key, "/") {
+				return "", false
+			}
+			return key, true
+		}
+		return strings.Join(labels[:j], ".") + "/" + key, true
+	}
+	return "", false
+}
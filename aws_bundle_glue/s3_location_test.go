@@ -0,0 +1,24 @@
+package aws_bundle_glue
+
+import "testing"
+
+func TestS3Location(t *testing.T) {
+	for _, test := range []struct {
+		url, location string
+	}{
+		{"https://mybucket.s3.us-west-2.amazonaws.com/images/test.manifest.xml", "mybucket/images/test.manifest.xml"},
+		{"https://mybucket.s3.amazonaws.com/test.manifest.xml", "mybucket/test.manifest.xml"},
+		{"https://my.dotted.bucket.s3-eu-west-1.amazonaws.com/test.manifest.xml", "my.dotted.bucket/test.manifest.xml"},
+		{"https://mybucket.s3.dualstack.us-east-1.amazonaws.com/test.manifest.xml", "mybucket/test.manifest.xml"},
+		{"https://s3.us-west-2.amazonaws.com/mybucket/images/test.manifest.xml", "mybucket/images/test.manifest.xml"},
+		{"https://s3.cn-north-1.amazonaws.com.cn/mybucket/test.manifest.xml", "mybucket/test.manifest.xml"},
+		{"https://s3.amazonaws.com/test.manifest.xml", ""},
+		{"https://storage.example.com/mybucket/test.manifest.xml", ""},
+		{"https://ec2.us-east-1.amazonaws.com/test.manifest.xml", ""},
+	} {
+		location, ok := s3Location(test.url)
+		if location != test.location || ok != (test.location != "") {
+			t.Errorf("s3Location(%q) = %q, %v, expected %q", test.url, location, ok, test.location)
+		}
+	}
+}
@@ -3,6 +3,8 @@ package aws_bundle_glue
 import (
 	"io"
 
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/s3"
 	"github.com/aws/aws-sdk-go/service/s3/s3manager"
 )
@@ -11,6 +13,7 @@ type S3Sink struct {
 	uploader *s3manager.Uploader
 	bucket   string
 	prefix   string
+	region   string
 }
 
 // NewS3Sink() returns an S3Sink pointing to the specified bucket and prefix.
@@ -29,6 +32,40 @@ func NewS3Sink(s3Svc *s3.S3, bucket string, prefix string) *S3Sink {
 	}
 }
 
+// BucketRegion() returns the region in which a bucket is located.
+//
+// requires s3:GetBucketLocation
+func BucketRegion(bucket string) (string, error) {
+	// talk to S3 in  us-east-1
+	s3Svc := s3.New(session.New(), aws.NewConfig().WithRegion("us-east-1"))
+
+	// ask it where the bucket is
+	input := s3.GetBucketLocationInput{
+		Bucket: &bucket,
+	}
+	output, err := s3Svc.GetBucketLocation(&input)
+	if err != nil {
+		return "", err
+	}
+
+	if output.LocationConstraint != nil && *output.LocationConstraint != "" {
+		return *output.LocationConstraint, nil
+	}
+	// looks like us-east-1
+	return "us-east-1", nil
+}
+
+// Region() returns the bucket's region, if the S3Sink came from OpenSink(),
+// or "" otherwise.
+func (sink *S3Sink) Region() string {
+	return sink.region
+}
+
+// Location() implements the Destination interface.
+func (sink *S3Sink) Location(filename string) (string, bool) {
+	return sink.bucket + "/" + sink.prefix + filename, true
+}
+
 // WriteBundleFile() implements the aws_bundle.Sink interface.
 func (sink *S3Sink) WriteBundleFile(filename string) (io.WriteCloser, error) {
 	// Make a pipe
@@ -37,7 +74,7 @@ func (sink *S3Sink) WriteBundleFile(filename string) (io.WriteCloser, error) {
 	// Set up an S3 upload reading from half of this pipe
 	key := sink.prefix + filename
 	contentType := "binary/octet-stream"
-	acl := "aws-exec-read"
+	acl := BundleACL
 	input := &s3manager.UploadInput{
 		Bucket: &sink.bucket,
 		Key:    &key,
@@ -70,7 +107,7 @@ func (sink *S3Sink) WriteBundleFile(filename string) (io.WriteCloser, error) {
 }
 
 type s3SinkFile struct {
-	pipe       io.WriteCloser
+	pipe       *io.PipeWriter
 	completion <-chan error
 }
 
@@ -92,3 +129,11 @@ func (f *s3SinkFile) Close() error {
 
 	return nil
 }
+
+// CloseWithError() fails the upload, which the uploader then aborts, so that
+// no object is created from an incomplete file.
+func (f *s3SinkFile) CloseWithError(err error) error {
+	f.pipe.CloseWithError(err)
+	<-f.completion
+	return nil
+}
@@ -0,0 +1,206 @@
+package aws_bundle_glue
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"crypto/sha1"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+
+	"github.com/willglynn/go_ami_tools/aws_bundle"
+)
+
+// the manifest and index are small, so anything big is something else
+const maxArchiveMetadataSize = 1 << 20
+
+// ChecksumError indicates that a file in an archive didn't match the SHA1
+// which the manifest or the archive's index recorded for it.
+type ChecksumError struct {
+	Filename string
+	Source   string // "manifest" or "index"
+	Expected string
+	Actual   string
+}
+
+func (e *ChecksumError) Error() string {
+	return fmt.Sprintf("%s has SHA1 %s, but the %s says %s", e.Filename, e.Actual, e.Source, e.Expected)
+}
+
+// UploadedArchive describes a bundle uploaded by UploadArchive().
+type UploadedArchive struct {
+	// ManifestFilename is the name of the manifest file written to the sink.
+	ManifestFilename string
+
+	// Info describes the bundle, as far as its manifest and parts say; see
+	// aws_bundle.ManifestInfo().
+	aws_bundle.Info
+}
+
+// UploadArchive() reads an archive written by an ArchiveSink from r, and
+// writes its bundle files to sink, e.g. an S3Sink, describing the bundle.
+//
+// Each part is hashed as it's written, and the manifest is written only once
+// every part has been checked against the SHA1s in the manifest and the
+// archive's index, so that a bundle which was damaged or cut short can't be
+// registered. The parts which were written are left behind if it fails,
+// though.
+func UploadArchive(r io.Reader, sink aws_bundle.Sink) (*UploadedArchive, error) {
+	var manifestFilename string
+	var manifestBytes, indexBytes []byte
+	var parts []aws_bundle.PartInfo
+	hashes := make(map[string]string)
+
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, fmt.Errorf("unable to read archive: %w", err)
+		}
+		if hdr.Typeflag != tar.TypeReg || hdr.Name == "" || strings.ContainsAny(hdr.Name, "/\\") {
+			return nil, fmt.Errorf("unexpected %q in archive", hdr.Name)
+		} else if _, ok := hashes[hdr.Name]; ok {
+			return nil, fmt.Errorf("archive contains %q more than once", hdr.Name)
+		}
+
+		switch {
+		case hdr.Name == ArchiveIndexFilename:
+			if indexBytes != nil {
+				return nil, fmt.Errorf("archive contains %q more than once", hdr.Name)
+			}
+			if indexBytes, err = readArchiveMetadata(tr, hdr); err != nil {
+				return nil, err
+			}
+
+		case strings.HasSuffix(hdr.Name, ".manifest.xml"):
+			if manifestFilename != "" {
+				return nil, fmt.Errorf("archive contains both %q and %q", manifestFilename, hdr.Name)
+			}
+			if manifestBytes, err = readArchiveMetadata(tr, hdr); err != nil {
+				return nil, err
+			}
+			manifestFilename = hdr.Name
+			hashes[hdr.Name] = fmt.Sprintf("%x", sha1.Sum(manifestBytes))
+
+		default:
+			part, err := copyArchivePart(sink, hdr.Name, tr)
+			if err != nil {
+				return nil, err
+			}
+			parts = append(parts, part)
+			hashes[part.Filename] = part.SHA1
+		}
+	}
+
+	// check everything against the index, which comes last
+	if indexBytes == nil {
+		return nil, fmt.Errorf("archive has no %s, so it's probably incomplete", ArchiveIndexFilename)
+	} else if err := checkArchiveIndex(indexBytes, hashes); err != nil {
+		return nil, err
+	}
+
+	// check the parts against the manifest
+	if manifestBytes == nil {
+		return nil, errors.New("archive has no manifest")
+	}
+	info, err := aws_bundle.ManifestInfo(manifestBytes)
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse %s: %w", manifestFilename, err)
+	}
+	if len(parts) != len(info.Parts) {
+		return nil, fmt.Errorf("archive has %d parts, but the manifest lists %d", len(parts), len(info.Parts))
+	}
+	var bundledSize int64
+	for i, part := range info.Parts {
+		if parts[i].Filename != part.Filename {
+			return nil, fmt.Errorf("archive has %q where the manifest lists %q", parts[i].Filename, part.Filename)
+		} else if parts[i].SHA1 != part.SHA1 {
+			return nil, &ChecksumError{Filename: part.Filename, Source: "manifest", Expected: part.SHA1, Actual: parts[i].SHA1}
+		}
+		parts[i].Index = i
+		bundledSize += parts[i].Size
+	}
+	if bundledSize != info.BundledSize {
+		return nil, fmt.Errorf("parts total %d bytes, but the manifest says %d", bundledSize, info.BundledSize)
+	}
+	info.Parts = parts
+
+	// all's well, so the manifest can go
+	if w, err := sink.WriteBundleFile(manifestFilename); err != nil {
+		return nil, &aws_bundle.SinkError{Op: "open", Filename: manifestFilename, Index: -1, Err: err}
+	} else if _, err := w.Write(manifestBytes); err != nil {
+		w.Close()
+		return nil, &aws_bundle.SinkError{Op: "write", Filename: manifestFilename, Index: -1, Err: err}
+	} else if err := w.Close(); err != nil {
+		return nil, &aws_bundle.SinkError{Op: "close", Filename: manifestFilename, Index: -1, Err: err}
+	}
+	return &UploadedArchive{ManifestFilename: manifestFilename, Info: *info}, nil
+}
+
+// readArchiveMetadata() reads the manifest or the index from the archive.
+func readArchiveMetadata(tr *tar.Reader, hdr *tar.Header) ([]byte, error) {
+	if hdr.Size > maxArchiveMetadataSize {
+		return nil, fmt.Errorf("%s is %d bytes, which is too big", hdr.Name, hdr.Size)
+	}
+	contents, err := ioutil.ReadAll(tr)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read %s from archive: %w", hdr.Name, err)
+	}
+	return contents, nil
+}
+
+// copyArchivePart() writes a part from the archive to sink, hashing it on the
+// way.
+func copyArchivePart(sink aws_bundle.Sink, filename string, r io.Reader) (aws_bundle.PartInfo, error) {
+	part := aws_bundle.PartInfo{Index: -1, Filename: filename}
+	w, err := sink.WriteBundleFile(filename)
+	if err != nil {
+		return part, &aws_bundle.SinkError{Op: "open", Filename: filename, Index: -1, Err: err}
+	}
+
+	h := sha1.New()
+	n, err := io.Copy(io.MultiWriter(w, h), r)
+	if err != nil {
+		w.Close()
+		return part, fmt.Errorf("unable to copy %s from archive: %w", filename, err)
+	}
+	if err := w.Close(); err != nil {
+		return part, &aws_bundle.SinkError{Op: "close", Filename: filename, Index: -1, Err: err}
+	}
+
+	part.Size = n
+	part.SHA1 = fmt.Sprintf("%x", h.Sum(nil))
+	return part, nil
+}
+
+// checkArchiveIndex() checks that the index lists exactly the files that
+// were found, with their SHA1s.
+func checkArchiveIndex(indexBytes []byte, hashes map[string]string) error {
+	listed := make(map[string]bool)
+	scanner := bufio.NewScanner(bytes.NewReader(indexBytes))
+	for scanner.Scan() {
+		fields := strings.SplitN(scanner.Text(), "  ", 2)
+		if len(fields) != 2 {
+			return fmt.Errorf("unable to parse %s line %q", ArchiveIndexFilename, scanner.Text())
+		}
+		expected, filename := fields[0], fields[1]
+		actual, ok := hashes[filename]
+		if !ok {
+			return fmt.Errorf("%s lists %q, which isn't in the archive", ArchiveIndexFilename, filename)
+		} else if actual != expected {
+			return &ChecksumError{Filename: filename, Source: "index", Expected: expected, Actual: actual}
+		}
+		listed[filename] = true
+	}
+	for filename := range hashes {
+		if !listed[filename] {
+			return fmt.Errorf("%q isn't listed in %s", filename, ArchiveIndexFilename)
+		}
+	}
+	return nil
+}
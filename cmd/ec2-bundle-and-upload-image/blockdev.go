@@ -0,0 +1,119 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+)
+
+// block devices are read this much at a time, at offsets which are multiples
+// of it, which keeps the kernel's readahead busy and avoids partial sectors
+const blockDeviceChunk = 4 << 20
+
+// blockDevice reads a block device in large aligned chunks.
+type blockDevice struct {
+	file *os.File
+	size int64
+	pos  int64
+
+	buf     []byte
+	pending []byte // the unread part of buf, which ends at pos
+}
+
+// openBlockDevice() prepares to read the block device f, returning it along
+// with its size. It refuses devices which are mounted read-write, since their
+// contents would be changing underneath the bundle, unless force is set.
+func openBlockDevice(f *os.File, force bool) (imageFile, int64, error) {
+	size, err := blockDeviceSize(f)
+	if err != nil {
+		return nil, 0, fmt.Errorf("unable to determine the size of block device %s: %v", f.Name(), err)
+	}
+	log.Printf("Image is a block device of %d bytes", size)
+
+	mountpoint, readWrite, err := blockDeviceMount(f)
+	switch {
+	case err != nil:
+		log.Printf("Unable to check whether %s is mounted: %v", f.Name(), err)
+	case mountpoint != "" && readWrite && !force:
+		return nil, 0, fmt.Errorf("%s is mounted read-write at %s; unmount it, remount it read-only, bundle a snapshot, or use -force-mounted", f.Name(), mountpoint)
+	case mountpoint != "" && readWrite:
+		log.Printf("Warning: %s is mounted read-write at %s, so the bundle may be inconsistent", f.Name(), mountpoint)
+	case mountpoint != "":
+		log.Printf("%s is mounted read-only at %s", f.Name(), mountpoint)
+	}
+
+	return newBlockDevice(f, size), size, nil
+}
+
+func newBlockDevice(f *os.File, size int64) *blockDevice {
+	return &blockDevice{
+		file: f,
+		size: size,
+		buf:  make([]byte, blockDeviceChunk),
+	}
+}
+
+// seekSize() determines the size of f by seeking to its end, which works for
+// block devices on most platforms.
+func seekSize(f *os.File) (int64, error) {
+	size, err := f.Seek(0, io.SeekEnd)
+	if err != nil {
+		return 0, err
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return 0, err
+	}
+	return size, nil
+}
+
+func (bd *blockDevice) Read(p []byte) (n int, err error) {
+	if len(bd.pending) == 0 {
+		if bd.pos >= bd.size {
+			return 0, io.EOF
+		}
+
+		// read up to the next chunk boundary
+		chunk := bd.buf[bd.pos%blockDeviceChunk:]
+		if remaining := bd.size - bd.pos; remaining < int64(len(chunk)) {
+			chunk = chunk[:remaining]
+		}
+		n, err := bd.file.ReadAt(chunk, bd.pos)
+		if n < len(chunk) {
+			if err == nil || err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return 0, err
+		}
+		bd.pos += int64(n)
+		bd.pending = chunk
+	}
+
+	n = copy(p, bd.pending)
+	bd.pending = bd.pending[n:]
+	return n, nil
+}
+
+func (bd *blockDevice) ReadAt(p []byte, off int64) (n int, err error) {
+	return bd.file.ReadAt(p, off)
+}
+
+func (bd *blockDevice) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekCurrent:
+		offset += bd.pos - int64(len(bd.pending))
+	case io.SeekEnd:
+		offset += bd.size
+	}
+	if offset < 0 {
+		return 0, errors.New("negative offset")
+	}
+	bd.pos = offset
+	bd.pending = nil
+	return offset, nil
+}
+
+func (bd *blockDevice) Close() error {
+	return bd.file.Close()
+}
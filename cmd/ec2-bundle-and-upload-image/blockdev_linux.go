@@ -0,0 +1,124 @@
+//go:build linux
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"unsafe"
+)
+
+// the ioctl() which returns a block device's size in bytes, from linux/fs.h
+const blkGetSize64 = 0x80081272 // BLKGETSIZE64
+
+// blockDeviceSize() asks the kernel how big f is, falling back to seeking to
+// the end.
+func blockDeviceSize(f *os.File) (int64, error) {
+	var size uint64
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, f.Fd(), blkGetSize64, uintptr(unsafe.Pointer(&size))); errno == 0 {
+		return int64(size), nil
+	}
+	return seekSize(f)
+}
+
+// deviceNumber() formats a device number as "major:minor", the way sysfs does.
+func deviceNumber(rdev uint64) string {
+	major := (rdev>>8)&0xfff | (rdev>>32)&^0xfff
+	minor := rdev&0xff | (rdev>>12)&^0xff
+	return fmt.Sprintf("%d:%d", major, minor)
+}
+
+// rdev() returns the device number of a device node.
+func rdev(fi os.FileInfo) (uint64, bool) {
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok || fi.Mode()&os.ModeDevice == 0 {
+		return 0, false
+	}
+	return uint64(st.Rdev), true
+}
+
+// blockDeviceMount() returns where f, or a partition on f, is mounted, if
+// anywhere, and whether that mount is read-write.
+func blockDeviceMount(f *os.File) (mountpoint string, readWrite bool, err error) {
+	fi, err := f.Stat()
+	if err != nil {
+		return "", false, err
+	}
+	dev, ok := rdev(fi)
+	if !ok {
+		return "", false, fmt.Errorf("%s is not a device", f.Name())
+	}
+	number := deviceNumber(dev)
+
+	mounts, err := os.Open("/proc/self/mounts")
+	if err != nil {
+		return "", false, err
+	}
+	defer mounts.Close()
+
+	return findMount(mounts, func(source string) bool {
+		fi, err := os.Stat(source)
+		if err != nil {
+			return false
+		}
+		mounted, ok := rdev(fi)
+		if !ok {
+			return false
+		}
+		if mounted == dev {
+			return true
+		}
+
+		// sysfs puts partitions inside the directory of their disk
+		partition, err := filepath.EvalSymlinks("/sys/dev/block/" + deviceNumber(mounted))
+		if err != nil {
+			return false
+		}
+		parent, err := ioutil.ReadFile(filepath.Join(filepath.Dir(partition), "dev"))
+		return err == nil && strings.TrimSpace(string(parent)) == number
+	})
+}
+
+// findMount() searches a mount table in /proc/self/mounts format for a mount
+// whose source matches, preferring read-write mounts.
+func findMount(mounts io.Reader, matches func(source string) bool) (mountpoint string, readWrite bool, err error) {
+	scanner := bufio.NewScanner(mounts)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 4 || !strings.HasPrefix(fields[0], "/") {
+			continue
+		}
+		if !matches(unescapeMountField(fields[0])) {
+			continue
+		}
+
+		rw := false
+		for _, option := range strings.Split(fields[3], ",") {
+			rw = rw || option == "rw"
+		}
+		if mountpoint == "" || (rw && !readWrite) {
+			mountpoint, readWrite = unescapeMountField(fields[1]), rw
+		}
+	}
+	return mountpoint, readWrite, scanner.Err()
+}
+
+// unescapeMountField() undoes the octal escaping of spaces, tabs, newlines,
+// and backslashes in /proc/self/mounts.
+func unescapeMountField(s string) string {
+	for _, escape := range []struct{ escaped, unescaped string }{
+		{`\040`, " "},
+		{`\011`, "\t"},
+		{`\012`, "\n"},
+		{`\134`, `\`},
+	} {
+		s = strings.Replace(s, escape.escaped, escape.unescaped, -1)
+	}
+	return s
+}
@@ -0,0 +1,91 @@
+//go:build linux
+
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestFindMount(t *testing.T) {
+	mounts := strings.Join([]string{
+		`proc /proc proc rw,nosuid,nodev,noexec,relatime 0 0`,
+		`/dev/nvme0n1p1 / ext4 rw,relatime 0 0`,
+		`/dev/nvme1n1p1 /mnt/staging\040area ext4 ro,relatime 0 0`,
+		`/dev/nvme1n1p1 /mnt/again xfs rw,noatime 0 0`,
+		`/dev/nvme2n1 /mnt/archive ext4 ro 0 0`,
+	}, "\n")
+
+	for _, tt := range []struct {
+		source     string
+		mountpoint string
+		readWrite  bool
+	}{
+		{"/dev/nvme0n1p1", "/", true},
+		{"/dev/nvme1n1p1", "/mnt/again", true},
+		{"/dev/nvme2n1", "/mnt/archive", false},
+		{"/dev/nvme3n1", "", false},
+		{"proc", "", false},
+	} {
+		mountpoint, readWrite, err := findMount(strings.NewReader(mounts), func(source string) bool {
+			return source == tt.source
+		})
+		if err != nil || mountpoint != tt.mountpoint || readWrite != tt.readWrite {
+			t.Errorf("findMount(%q) = %q, %v, %v", tt.source, mountpoint, readWrite, err)
+		}
+	}
+
+	// escaping
+	mountpoint, _, err := findMount(strings.NewReader(`/dev/sda1 /mnt/a\040b\134c ext4 ro 0 0`), func(string) bool { return true })
+	if err != nil || mountpoint != `/mnt/a b\c` {
+		t.Errorf("findMount() = %q, %v", mountpoint, err)
+	}
+}
+
+func TestDeviceNumber(t *testing.T) {
+	for rdev, expected := range map[uint64]string{
+		0x0801:   "8:1",
+		0x10301:  "259:1",
+		0x100800: "8:256",
+	} {
+		if actual := deviceNumber(rdev); actual != expected {
+			t.Errorf("deviceNumber(%#x) = %q, expected %q", rdev, actual, expected)
+		}
+	}
+}
+
+func TestOpenLoopDevice(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("loop devices require root")
+	}
+
+	image := compressibleImage(3 << 20)
+	filename := filepath.Join(t.TempDir(), "image.raw")
+	if err := ioutil.WriteFile(filename, image, 0644); err != nil {
+		t.Fatalf("WriteFile() error = %v", err)
+	}
+	out, err := exec.Command("losetup", "--find", "--show", "--read-only", filename).Output()
+	if err != nil {
+		t.Skipf("losetup failed: %v", err)
+	}
+	device := strings.TrimSpace(string(out))
+	defer exec.Command("losetup", "--detach", device).Run()
+
+	r, size, err := open(device)
+	if err != nil {
+		t.Fatalf("open(%s) error = %v", device, err)
+	}
+	defer r.Close()
+	if _, ok := r.(*blockDevice); !ok {
+		t.Errorf("open(%s) returned a %T, expected a *blockDevice", device, r)
+	}
+	actual, err := ioutil.ReadAll(r)
+	if err != nil || size != int64(len(image)) || !bytes.Equal(actual, image) {
+		t.Errorf("open(%s) = %d bytes, read %d, error = %v", device, size, len(actual), err)
+	}
+}
@@ -0,0 +1,18 @@
+//go:build !linux
+
+package main
+
+import (
+	"errors"
+	"os"
+)
+
+// blockDeviceSize() determines how big f is by seeking to the end.
+func blockDeviceSize(f *os.File) (int64, error) {
+	return seekSize(f)
+}
+
+// blockDeviceMount() can only check for mounts on Linux.
+func blockDeviceMount(f *os.File) (mountpoint string, readWrite bool, err error) {
+	return "", false, errors.New("mount detection is only supported on Linux")
+}
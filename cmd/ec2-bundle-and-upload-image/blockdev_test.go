@@ -0,0 +1,74 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestBlockDevice(t *testing.T) {
+	// a regular file reads the same way
+	image := make([]byte, 2*blockDeviceChunk+12345)
+	rand.New(rand.NewSource(1)).Read(image)
+	filename := filepath.Join(t.TempDir(), "image.raw")
+	if err := ioutil.WriteFile(filename, image, 0644); err != nil {
+		t.Fatalf("WriteFile() error = %v", err)
+	}
+	f, err := os.Open(filename)
+	if err != nil {
+		t.Fatalf("Open() error = %v", err)
+	}
+	size, err := seekSize(f)
+	if err != nil || size != int64(len(image)) {
+		t.Fatalf("seekSize() = %d, %v", size, err)
+	}
+	bd := newBlockDevice(f, size)
+	defer bd.Close()
+
+	// odd-sized reads
+	var actual []byte
+	buf := make([]byte, 100000)
+	for {
+		n, err := bd.Read(buf)
+		actual = append(actual, buf[:n]...)
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatalf("Read() error = %v", err)
+		}
+	}
+	if !bytes.Equal(actual, image) {
+		t.Errorf("Read() returned %d bytes, which didn't match", len(actual))
+	}
+
+	// rewinding, and seeking to an unaligned offset
+	for _, offset := range []int64{0, blockDeviceChunk - 1} {
+		if _, err := bd.Seek(offset, io.SeekStart); err != nil {
+			t.Fatalf("Seek() error = %v", err)
+		}
+		actual, err := ioutil.ReadAll(bd)
+		if err != nil || !bytes.Equal(actual, image[offset:]) {
+			t.Errorf("ReadAll() from %d returned %d bytes, error = %v", offset, len(actual), err)
+		}
+	}
+}
+
+func TestBlockDeviceTruncated(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "image.raw")
+	if err := ioutil.WriteFile(filename, make([]byte, 1000), 0644); err != nil {
+		t.Fatalf("WriteFile() error = %v", err)
+	}
+	f, err := os.Open(filename)
+	if err != nil {
+		t.Fatalf("Open() error = %v", err)
+	}
+	bd := newBlockDevice(f, 2000)
+	defer bd.Close()
+	if _, err := ioutil.ReadAll(bd); err != io.ErrUnexpectedEOF {
+		t.Errorf("ReadAll() error = %v, expected io.ErrUnexpectedEOF", err)
+	}
+}
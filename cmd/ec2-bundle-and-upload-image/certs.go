@@ -0,0 +1,90 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/willglynn/go_ami_tools/aws_bundle"
+)
+
+// `ec2-bundle-and-upload-image certs` shows which EC2 certificate would be used
+// for each region, so nobody has to read certificates.go to find out
+func certsMain(args []string) {
+	fs := flag.NewFlagSet("certs", flag.ExitOnError)
+	export := fs.String("export", "", "print the certificate for this region as PEM, rather than listing all certificates")
+	ec2cert := fs.String("ec2cert", "", "PEM file containing an EC2 certificate to use for -region (optional)")
+	region := fs.String("region", "", "region to which -ec2cert applies")
+	strict := fs.Bool("strict-region", false, "treat regions not in the built-in region list, and without their own certificate, as unknown")
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage:\n  %s certs [-export <region>]\n\nFull parameters:\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	certs := aws_bundle.NewCertificateRegistry()
+	certs.SetStrict(*strict)
+	if *ec2cert != "" {
+		if *region == "" {
+			log.Fatal("-ec2cert requires -region")
+		}
+		pemBytes, err := ioutil.ReadFile(*ec2cert)
+		if err != nil {
+			log.Fatalf("Unable to read EC2 certificate: %v", err)
+		}
+		if err := certs.RegisterRegionPEM(*region, pemBytes); err != nil {
+			log.Fatalf("Unable to parse EC2 certificate %q: %v", *ec2cert, err)
+		}
+	}
+
+	if *export != "" {
+		cert, err := certs.CertificateForRegion(*export)
+		if err != nil {
+			log.Fatalf("Unable to find an EC2 certificate: %v", err)
+		}
+		os.Stdout.Write(aws_bundle.EncodeCertificatePEM(cert))
+		return
+	}
+
+	inventory := certs.Inventory()
+
+	// list which certificate applies where
+	tw := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintf(tw, "REGION\tPARTITION\tSOURCE\tSHA-256 FINGERPRINT\n")
+	for _, info := range inventory {
+		region, source := info.Region, "region"
+		if region == "" {
+			region, source = "*", "partition"
+		} else if info.Inherited {
+			source = "partition"
+		}
+
+		fingerprint := info.SHA256Fingerprint
+		if info.Certificate == nil {
+			source, fingerprint = "none", fmt.Sprintf("(%v)", info.Error)
+		}
+
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", region, info.Partition, source, fingerprint)
+	}
+	tw.Flush()
+
+	// describe each distinct certificate once
+	seen := make(map[string]bool)
+	for _, info := range inventory {
+		if info.Certificate == nil || seen[info.SHA256Fingerprint] {
+			continue
+		}
+		seen[info.SHA256Fingerprint] = true
+
+		fmt.Printf("\nSHA-256 fingerprint: %s\n", info.SHA256Fingerprint)
+		fmt.Printf("  Subject:    %s\n", info.Subject)
+		fmt.Printf("  Serial:     %s\n", info.Serial)
+		fmt.Printf("  Key:        %d-bit RSA\n", info.KeyBits)
+		fmt.Printf("  Not before: %s\n", info.NotBefore.UTC().Format(time.RFC3339))
+		fmt.Printf("  Not after:  %s\n", info.NotAfter.UTC().Format(time.RFC3339))
+	}
+}
@@ -0,0 +1,253 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+)
+
+// The bundle format needs the image size up front. Rather than decompressing
+// everything twice, these functions look for the uncompressed size in the
+// compressed file's own metadata, without decompressing anything. Each
+// returns an error if the size can't be determined with confidence. limit is
+// the most the image can be once it's uncompressed, i.e. -image-size, or 0 if
+// that's unknown; only gzip needs it.
+
+// gzipSize() reads the gzip trailer's ISIZE field. ISIZE is the uncompressed
+// size modulo 4 GiB, so it can't be trusted on its own: a disk image of 5 GiB
+// of mostly zeros compresses to a few MB and records an ISIZE of 1 GiB. It's
+// used only if limit, the most the image can be uncompressed, is known and is
+// less than 4 GiB, so that ISIZE can't have wrapped around.
+//
+// ISIZE also describes only the last member of the file, which can't be
+// checked without decompressing it. If there turn out to be more, the Writer
+// refuses the excess rather than produce a bad bundle.
+func gzipSize(r io.ReaderAt, size int64, limit int64) (int64, error) {
+	if limit <= 0 || limit >= 1<<32 {
+		return 0, errors.New("the gzip trailer records the size modulo 4 GiB, and -image-size doesn't say it's smaller than that")
+	}
+	if size < 18 {
+		return 0, io.ErrUnexpectedEOF
+	}
+
+	// BGZF (as made by `bgzip`) is a series of many small members
+	header := make([]byte, 16)
+	if _, err := r.ReadAt(header, 0); err != nil {
+		return 0, err
+	}
+	if header[3]&0x04 != 0 && bytes.Equal(header[12:14], []byte("BC")) {
+		return 0, errors.New("image is BGZF, which has many gzip members")
+	}
+
+	trailer := make([]byte, 4)
+	if _, err := r.ReadAt(trailer, size-4); err != nil {
+		return 0, err
+	}
+	isize := int64(binary.LittleEndian.Uint32(trailer))
+	if isize > limit {
+		return 0, fmt.Errorf("gzip trailer says the image is %d bytes, which is more than -image-size", isize)
+	}
+
+	return isize, nil
+}
+
+// zstdSize() adds up the content sizes declared in each zstd frame header,
+// skipping from frame to frame using the block headers. Frames are not
+// required to declare their size, but `zstd` does when compressing a file.
+func zstdSize(r io.ReaderAt, size int64, limit int64) (int64, error) {
+	const (
+		frameMagic     = 0xFD2FB528
+		skippableMagic = 0x184D2A50
+	)
+
+	var total int64
+	buf := make([]byte, 14) // enough for the longest frame header
+	for offset := int64(0); offset < size; {
+		if _, err := r.ReadAt(buf[:8], offset); err != nil {
+			return 0, unexpectedEOF(err)
+		}
+
+		magic := binary.LittleEndian.Uint32(buf)
+		if magic&0xFFFFFFF0 == skippableMagic {
+			offset += 8 + int64(binary.LittleEndian.Uint32(buf[4:]))
+			continue
+		} else if magic != frameMagic {
+			return 0, fmt.Errorf("bad zstd frame magic number %#08x at offset %d", magic, offset)
+		}
+
+		// frame header descriptor
+		fhd := buf[4]
+		singleSegment := fhd&0x20 != 0
+		hasChecksum := fhd&0x04 != 0
+		if fhd&0x08 != 0 {
+			return 0, fmt.Errorf("zstd frame at offset %d sets a reserved bit", offset)
+		}
+
+		headerLen := int64(5)
+		if !singleSegment {
+			headerLen++ // window descriptor
+		}
+		headerLen += []int64{0, 1, 2, 4}[fhd&0x03] // dictionary ID
+
+		fcsLen := []int64{0, 2, 4, 8}[fhd>>6]
+		if fcsLen == 0 && singleSegment {
+			fcsLen = 1
+		}
+		if fcsLen == 0 {
+			return 0, fmt.Errorf("zstd frame at offset %d does not declare its size", offset)
+		}
+
+		if _, err := r.ReadAt(buf[:fcsLen], offset+headerLen); err != nil {
+			return 0, unexpectedEOF(err)
+		}
+		var fcs uint64
+		for i := fcsLen - 1; i >= 0; i-- {
+			fcs = fcs<<8 | uint64(buf[i])
+		}
+		if fcsLen == 2 {
+			fcs += 256
+		}
+		if fcs > 1<<62 || total+int64(fcs) > 1<<62 {
+			return 0, fmt.Errorf("zstd frame at offset %d declares an implausible size", offset)
+		}
+		total += int64(fcs)
+		offset += headerLen + fcsLen
+
+		// skip the blocks
+		for last := false; !last; {
+			if _, err := r.ReadAt(buf[:3], offset); err != nil {
+				return 0, unexpectedEOF(err)
+			}
+			blockHeader := uint32(buf[0]) | uint32(buf[1])<<8 | uint32(buf[2])<<16
+			last = blockHeader&1 != 0
+			blockSize := int64(blockHeader >> 3)
+			switch (blockHeader >> 1) & 3 {
+			case 1: // RLE: one byte, repeated
+				blockSize = 1
+			case 3:
+				return 0, fmt.Errorf("invalid zstd block at offset %d", offset)
+			}
+			offset += 3 + blockSize
+		}
+		if hasChecksum {
+			offset += 4
+		}
+		if offset > size {
+			return 0, io.ErrUnexpectedEOF
+		}
+	}
+
+	return total, nil
+}
+
+// xzSize() adds up the uncompressed sizes recorded in the index of each xz
+// stream, working backwards from the end of the file.
+func xzSize(r io.ReaderAt, size int64, limit int64) (int64, error) {
+	const maxIndexSize = 64 << 20 // the index is ~16 bytes per block, and blocks are MiBs
+
+	var total int64
+	for end := size; end > 0; {
+		// skip stream padding
+		padding := make([]byte, 4)
+		for end >= 4 {
+			if _, err := r.ReadAt(padding, end-4); err != nil {
+				return 0, err
+			}
+			if !bytes.Equal(padding, []byte{0, 0, 0, 0}) {
+				break
+			}
+			end -= 4
+		}
+		if end == 0 {
+			break
+		}
+		if end < 32 {
+			return 0, errors.New("xz stream is truncated")
+		}
+
+		// stream footer: CRC32, backward size, flags, magic
+		footer := make([]byte, 12)
+		if _, err := r.ReadAt(footer, end-12); err != nil {
+			return 0, err
+		}
+		if !bytes.Equal(footer[10:], []byte("YZ")) {
+			return 0, errors.New("xz stream footer not found")
+		}
+		if crc32.ChecksumIEEE(footer[4:10]) != binary.LittleEndian.Uint32(footer) {
+			return 0, errors.New("xz stream footer is corrupt")
+		}
+
+		indexSize := (int64(binary.LittleEndian.Uint32(footer[4:])) + 1) * 4
+		if indexSize > maxIndexSize || indexSize > end-24 {
+			return 0, errors.New("xz index is implausibly large")
+		}
+
+		// index: indicator, record count, records, padding, CRC32
+		index := make([]byte, indexSize)
+		if _, err := r.ReadAt(index, end-12-indexSize); err != nil {
+			return 0, err
+		}
+		if index[0] != 0 || crc32.ChecksumIEEE(index[:indexSize-4]) != binary.LittleEndian.Uint32(index[indexSize-4:]) {
+			return 0, errors.New("xz index is corrupt")
+		}
+
+		records, p, err := xzVarint(index[1 : indexSize-4])
+		if err != nil {
+			return 0, err
+		}
+		var blocksSize int64
+		for i := uint64(0); i < records; i++ {
+			var unpadded, uncompressed uint64
+			if unpadded, p, err = xzVarint(p); err != nil {
+				return 0, err
+			}
+			if uncompressed, p, err = xzVarint(p); err != nil {
+				return 0, err
+			}
+			if unpadded > 1<<62 || uncompressed > 1<<62 {
+				return 0, errors.New("xz index is corrupt")
+			}
+			blocksSize += (int64(unpadded) + 3) &^ 3
+			total += int64(uncompressed)
+			if blocksSize > end || total > 1<<62 {
+				return 0, errors.New("xz index is corrupt")
+			}
+		}
+
+		// stream header: magic, flags, CRC32
+		start := end - 12 - indexSize - blocksSize - 12
+		if start < 0 {
+			return 0, errors.New("xz index is corrupt")
+		}
+		header := make([]byte, 12)
+		if _, err := r.ReadAt(header, start); err != nil {
+			return 0, err
+		}
+		if !bytes.Equal(header[:6], xzMagic) || !bytes.Equal(header[6:8], footer[8:10]) {
+			return 0, errors.New("xz stream header doesn't match its index")
+		}
+
+		end = start
+	}
+
+	return total, nil
+}
+
+// xzVarint() decodes one of xz's multibyte integers from the front of p.
+func xzVarint(p []byte) (uint64, []byte, error) {
+	v, n := binary.Uvarint(p)
+	if n <= 0 || n > 9 {
+		return 0, nil, errors.New("xz index is corrupt")
+	}
+	return v, p[n:], nil
+}
+
+func unexpectedEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
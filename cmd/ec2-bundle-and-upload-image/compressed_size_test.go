@@ -0,0 +1,209 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	kgzip "github.com/klauspost/compress/gzip"
+	"github.com/klauspost/compress/zstd"
+)
+
+// compressibleImage() returns n bytes which compress reasonably well.
+func compressibleImage(n int) []byte {
+	image := make([]byte, n)
+	rand.New(rand.NewSource(1)).Read(image[:n/4])
+	return image
+}
+
+func TestGzipSize(t *testing.T) {
+	image := compressibleImage(3 << 20)
+	compressed := compressTestImage(t, "gzip", image)
+
+	if size, err := gzipSize(bytes.NewReader(compressed), int64(len(compressed)), 4<<20); err != nil || size != int64(len(image)) {
+		t.Errorf("gzipSize() = %d, %v, expected %d", size, err, len(image))
+	}
+
+	// ISIZE can only be trusted if the image is known to be under 4 GiB
+	for _, limit := range []int64{0, 1 << 32, 2 << 20} {
+		if size, err := gzipSize(bytes.NewReader(compressed), int64(len(compressed)), limit); err == nil {
+			t.Errorf("gzipSize(limit %d) = %d, expected an error", limit, size)
+		}
+	}
+
+	// BGZF
+	bgzf := append([]byte{0x1f, 0x8b, 8, 4, 0, 0, 0, 0, 0, 0xff, 6, 0, 'B', 'C', 2, 0}, compressed[10:]...)
+	if _, err := gzipSize(bytes.NewReader(bgzf), int64(len(bgzf)), 4<<20); err == nil {
+		t.Errorf("gzipSize() accepted BGZF")
+	}
+}
+
+// ISIZE wraps around for images over 4 GiB, even when the compressed file is
+// tiny, so open() must count the bytes instead
+func TestOpenGzipOver4GiB(t *testing.T) {
+	if testing.Short() {
+		t.Skip("decompresses 5 GiB")
+	}
+
+	const imageSize = 5 << 30
+	filename := filepath.Join(t.TempDir(), "image.raw.gz")
+	f, err := os.Create(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	zw, err := kgzip.NewWriterLevel(f, kgzip.BestSpeed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	zeros := make([]byte, 1<<20)
+	for written := 0; written < imageSize; written += len(zeros) {
+		if _, err := zw.Write(zeros); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	fi, err := f.Stat()
+	f.Close()
+	if err != nil {
+		t.Fatal(err)
+	} else if fi.Size() >= 1<<32 {
+		t.Fatalf("compressed image is %d bytes, which doesn't test anything", fi.Size())
+	}
+
+	r, size, err := open(filename)
+	if err != nil {
+		t.Fatalf("open() error = %v", err)
+	}
+	r.Close()
+	if size != imageSize {
+		t.Errorf("open() size = %d, expected %d", size, int64(imageSize))
+	}
+}
+
+func TestZstdSize(t *testing.T) {
+	image := compressibleImage(1 << 20)
+	enc, err := zstd.NewWriter(nil)
+	if err != nil {
+		t.Fatalf("zstd.NewWriter() error = %v", err)
+	}
+	frame := enc.EncodeAll(image, nil)
+	skippable := []byte{0x50, 0x2a, 0x4d, 0x18, 2, 0, 0, 0, 'h', 'i'}
+
+	tests := []struct {
+		name       string
+		compressed []byte
+		expected   int64
+	}{
+		{"one frame", frame, int64(len(image))},
+		{"frames", append(append(append([]byte{}, frame...), skippable...), frame...), 2 * int64(len(image))},
+		{"unsized frame", compressTestImage(t, "zstd", image), -1},
+		{"truncated", frame[:len(frame)-10], -1},
+	}
+	for _, tt := range tests {
+		size, err := zstdSize(bytes.NewReader(tt.compressed), int64(len(tt.compressed)), 0)
+		if tt.expected < 0 && err == nil {
+			t.Errorf("%s: zstdSize() = %d, expected an error", tt.name, size)
+		} else if tt.expected >= 0 && (err != nil || size != tt.expected) {
+			t.Errorf("%s: zstdSize() = %d, %v, expected %d", tt.name, size, err, tt.expected)
+		}
+	}
+}
+
+func TestXzSize(t *testing.T) {
+	image := compressibleImage(1 << 20)
+	stream := compressTestImage(t, "xz", image)
+	corrupt := append([]byte{}, stream...)
+	corrupt[len(corrupt)-14] ^= 0x01
+
+	tests := []struct {
+		name       string
+		compressed []byte
+		expected   int64
+	}{
+		{"one stream", stream, int64(len(image))},
+		{"padded streams", append(append(append([]byte{}, stream...), 0, 0, 0, 0), stream...), 2 * int64(len(image))},
+		{"corrupt index", corrupt, -1},
+		{"truncated", stream[1:], -1},
+		{"empty", nil, 0},
+	}
+	for _, tt := range tests {
+		size, err := xzSize(bytes.NewReader(tt.compressed), int64(len(tt.compressed)), 0)
+		if tt.expected < 0 && err == nil {
+			t.Errorf("%s: xzSize() = %d, expected an error", tt.name, size)
+		} else if tt.expected >= 0 && (err != nil || size != tt.expected) {
+			t.Errorf("%s: xzSize() = %d, %v, expected %d", tt.name, size, err, tt.expected)
+		}
+	}
+}
+
+// the command-line tools make multi-block streams, and record sizes only when
+// compressing files
+func TestCompressedSizeCommands(t *testing.T) {
+	image := compressibleImage(5 << 20)
+	filename := filepath.Join(t.TempDir(), "image.raw")
+	if err := ioutil.WriteFile(filename, image, 0644); err != nil {
+		t.Fatalf("WriteFile() error = %v", err)
+	}
+
+	for _, tt := range []struct {
+		command []string
+		size    func(r io.ReaderAt, size, limit int64) (int64, error)
+	}{
+		{[]string{"xz", "-T2", "--block-size=1MiB", "-c", filename}, xzSize},
+		{[]string{"zstd", "-q", "-c", filename}, zstdSize},
+		{[]string{"gzip", "-c", filename}, gzipSize},
+	} {
+		path, err := exec.LookPath(tt.command[0])
+		if err != nil {
+			t.Logf("%s command not found", tt.command[0])
+			continue
+		}
+
+		compressed, err := exec.Command(path, tt.command[1:]...).Output()
+		if err != nil {
+			t.Fatalf("%v: %v", tt.command, err)
+		}
+
+		if size, err := tt.size(bytes.NewReader(compressed), int64(len(compressed)), 8<<20); err != nil || size != int64(len(image)) {
+			t.Errorf("%v: size = %d, %v, expected %d", tt.command, size, err, len(image))
+		}
+	}
+}
+
+func TestOpenUnknownSize(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "image.bz2")
+	if err := ioutil.WriteFile(filename, bzip2Hello, 0644); err != nil {
+		t.Fatalf("WriteFile() error = %v", err)
+	}
+	defer func() { config.imageSize, config.padShortImage = 0, false }()
+
+	// -image-size alone doesn't stand in for the size bzip2 doesn't record,
+	// since that would pad a truncated image
+	config.imageSize = 1 << 20
+	r, size, err := open(filename)
+	if err != nil {
+		t.Fatalf("open() error = %v", err)
+	}
+	r.Close()
+	if size != int64(len("hello, world\n")) {
+		t.Errorf("open() size = %d, expected it to be counted", size)
+	}
+
+	// -pad-short-image too says padding is fine
+	config.padShortImage = true
+	r, size, err = open(filename)
+	if err != nil {
+		t.Fatalf("open() error = %v", err)
+	}
+	r.Close()
+	if size != -1 {
+		t.Errorf("open() size = %d, expected -1", size)
+	}
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/bzip2"
+	"io"
+	"io/ioutil"
+
+	"github.com/klauspost/compress/zstd"
+	gzip "github.com/klauspost/pgzip"
+	"github.com/pierrec/lz4/v4"
+	"github.com/ulikunitz/xz"
+)
+
+// compression describes a compressed image format we can read
+type compression struct {
+	name  string
+	magic []byte
+	open  func(r io.Reader) (io.ReadCloser, error)
+	size  func(r io.ReaderAt, size, limit int64) (int64, error) // nil if the format doesn't record it
+}
+
+var xzMagic = []byte{0xfd, '7', 'z', 'X', 'Z', 0x00}
+
+// formats are identified by their magic numbers, not by filename, since
+// filenames lie
+var compressions = []compression{
+	{"gzip", []byte{0x1f, 0x8b}, func(r io.Reader) (io.ReadCloser, error) {
+		// pgzip decompresses ahead of the reader in the background
+		return gzip.NewReader(r)
+	}, gzipSize},
+	{"bzip2", []byte("BZh"), func(r io.Reader) (io.ReadCloser, error) {
+		return ioutil.NopCloser(bzip2.NewReader(r)), nil
+	}, nil},
+	{"xz", xzMagic, func(r io.Reader) (io.ReadCloser, error) {
+		xr, err := xz.NewReader(r)
+		if err != nil {
+			return nil, err
+		}
+		return ioutil.NopCloser(xr), nil
+	}, xzSize},
+	{"zstd", []byte{0x28, 0xb5, 0x2f, 0xfd}, func(r io.Reader) (io.ReadCloser, error) {
+		zr, err := zstd.NewReader(r)
+		if err != nil {
+			return nil, err
+		}
+		return zr.IOReadCloser(), nil
+	}, zstdSize},
+	{"lz4", []byte{0x04, 0x22, 0x4d, 0x18}, func(r io.Reader) (io.ReadCloser, error) {
+		return ioutil.NopCloser(newLz4Reader(r)), nil
+	}, nil},
+}
+
+// lz4Reader decompresses a series of LZ4 frames, like `lz4 -d` does, since
+// lz4.Reader stops after the first one. It also treats the input ending within
+// a frame as an error, which lz4.Reader otherwise takes for the frame's end.
+type lz4Reader struct {
+	src *bufio.Reader
+	zr  *lz4.Reader
+}
+
+func newLz4Reader(r io.Reader) *lz4Reader {
+	src := bufio.NewReader(r)
+	return &lz4Reader{src: src, zr: lz4.NewReader(lz4FrameSource{src})}
+}
+
+func (lr *lz4Reader) Read(p []byte) (int, error) {
+	for {
+		n, err := lr.zr.Read(p)
+		if err != io.EOF {
+			return n, err
+		}
+
+		// another frame?
+		if _, err := lr.src.Peek(1); err != nil {
+			return n, io.EOF
+		}
+		lr.zr.Reset(lz4FrameSource{lr.src})
+		if n > 0 {
+			return n, nil
+		}
+	}
+}
+
+// lz4FrameSource is read from within a frame, where io.EOF means truncation.
+type lz4FrameSource struct {
+	r io.Reader
+}
+
+func (fs lz4FrameSource) Read(p []byte) (int, error) {
+	n, err := fs.r.Read(p)
+	return n, unexpectedEOF(err)
+}
+
+// detectCompression() returns the compression whose magic number begins
+// header, or nil if the image isn't compressed (as far as we can tell).
+func detectCompression(header []byte) *compression {
+	for i := range compressions {
+		if bytes.HasPrefix(header, compressions[i].magic) {
+			return &compressions[i]
+		}
+	}
+	return nil
+}
+
+type compressedFile struct {
+	decompressor io.ReadCloser
+	file         io.Closer
+}
+
+func (cf *compressedFile) Read(p []byte) (n int, err error) {
+	return cf.decompressor.Read(p)
+}
+
+func (cf *compressedFile) Close() error {
+	cf.decompressor.Close()
+	return cf.file.Close()
+}
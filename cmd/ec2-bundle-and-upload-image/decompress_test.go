@@ -0,0 +1,139 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/ulikunitz/xz"
+)
+
+// bzip2 of "hello, world\n", since there's no bzip2 compressor in the stdlib
+var bzip2Hello, _ = hex.DecodeString("425a683931415926535954a49784000002d180001040040644908020003100302068620049d4b21f3f17724538509054a49784")
+
+// compressTestImage() compresses image in the named format.
+func compressTestImage(t *testing.T, format string, image []byte) []byte {
+	var buf bytes.Buffer
+	var w io.WriteCloser
+	var err error
+	switch format {
+	case "gzip":
+		w = gzip.NewWriter(&buf)
+	case "xz":
+		w, err = xz.NewWriter(&buf)
+	case "zstd":
+		w, err = zstd.NewWriter(&buf)
+	default:
+		t.Fatalf("can't compress %s", format)
+	}
+	if err != nil {
+		t.Fatalf("%s: NewWriter() error = %v", format, err)
+	}
+	if _, err := w.Write(image); err != nil {
+		t.Fatalf("%s: Write() error = %v", format, err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("%s: Close() error = %v", format, err)
+	}
+	return buf.Bytes()
+}
+
+func TestOpenCompressed(t *testing.T) {
+	hello := []byte("hello, world\n")
+	image := lz4Fixture()
+
+	tests := []struct {
+		format   string // "" for none
+		input    []byte
+		expected []byte
+	}{
+		{"", image, image},
+		{"", []byte("BZ"), []byte("BZ")},
+		{"", nil, nil},
+		{"gzip", compressTestImage(t, "gzip", image), image},
+		{"bzip2", bzip2Hello, hello},
+		{"xz", compressTestImage(t, "xz", image), image},
+		{"zstd", compressTestImage(t, "zstd", image), image},
+		{"lz4", lz4Independent, image},
+	}
+	for _, tt := range tests {
+		detected := detectCompression(tt.input)
+		if (detected == nil && tt.format != "") || (detected != nil && detected.name != tt.format) {
+			t.Errorf("%q: detectCompression() = %v", tt.format, detected)
+			continue
+		}
+
+		// misleading filenames are no problem
+		filename := filepath.Join(t.TempDir(), "image.raw.gz")
+		if err := ioutil.WriteFile(filename, tt.input, 0644); err != nil {
+			t.Fatalf("WriteFile() error = %v", err)
+		}
+
+		r, size, err := open(filename)
+		if err != nil {
+			t.Errorf("%q: open() error = %v", tt.format, err)
+			continue
+		}
+		actual, err := ioutil.ReadAll(r)
+		r.Close()
+		if err != nil {
+			t.Errorf("%q: ReadAll() error = %v", tt.format, err)
+		} else if size != int64(len(tt.expected)) || !bytes.Equal(actual, tt.expected) {
+			t.Errorf("%q: open() = %d bytes with size %d, expected %d bytes", tt.format, len(actual), size, len(tt.expected))
+		}
+	}
+}
+
+func TestOpenMissing(t *testing.T) {
+	if _, _, err := open(filepath.Join(t.TempDir(), "missing")); !os.IsNotExist(err) {
+		t.Errorf("open() error = %v, expected it not to exist", err)
+	}
+}
+
+func TestOpenVirtualDisk(t *testing.T) {
+	// a fixed VHD is a raw image followed by a footer
+	image := lz4Fixture()
+	footer := make([]byte, 512)
+	copy(footer, "conectix")
+	binary.BigEndian.PutUint64(footer[16:], 0xffffffffffffffff)
+	binary.BigEndian.PutUint64(footer[48:], uint64(len(image)))
+	binary.BigEndian.PutUint32(footer[60:], 2)
+	var sum uint32
+	for _, c := range footer {
+		sum += uint32(c)
+	}
+	binary.BigEndian.PutUint32(footer[64:], ^sum)
+
+	filename := filepath.Join(t.TempDir(), "image.vhd")
+	if err := ioutil.WriteFile(filename, append(append([]byte{}, image...), footer...), 0644); err != nil {
+		t.Fatalf("WriteFile() error = %v", err)
+	}
+
+	r, size, err := open(filename)
+	if err != nil {
+		t.Fatalf("open() error = %v", err)
+	}
+	actual, err := ioutil.ReadAll(r)
+	r.Close()
+	if err != nil {
+		t.Errorf("ReadAll() error = %v", err)
+	} else if size != int64(len(image)) || !bytes.Equal(actual, image) {
+		t.Errorf("open() = %d bytes, read %d, expected %d", size, len(actual), len(image))
+	}
+
+	// a broken one is an error, rather than being bundled as-is
+	footer[100]++
+	if err := ioutil.WriteFile(filename, append(append([]byte{}, image...), footer...), 0644); err != nil {
+		t.Fatalf("WriteFile() error = %v", err)
+	}
+	if _, _, err := open(filename); err == nil {
+		t.Errorf("open() of a corrupt VHD succeeded")
+	}
+}
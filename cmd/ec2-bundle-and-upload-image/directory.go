@@ -0,0 +1,209 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/willglynn/go_ami_tools/fs_image"
+)
+
+// stringList is a flag.Value which can be given more than once.
+type stringList []string
+
+func (sl *stringList) String() string {
+	return strings.Join(*sl, ",")
+}
+
+func (sl *stringList) Set(value string) error {
+	*sl = append(*sl, value)
+	return nil
+}
+
+// ociArchitectures maps -arch values to what container images call them.
+var ociArchitectures = map[string]string{
+	"x86_64": "amd64",
+	"arm64":  "arm64",
+	"i386":   "386",
+}
+
+// partitionTables maps -partition-table values to partition tables.
+var partitionTables = map[string]fs_image.PartitionTable{
+	"none": 0,
+	"mbr":  fs_image.MBR,
+	"gpt":  fs_image.GPT,
+}
+
+// isContainerLayout() indicates if dir holds an OCI image layout or an
+// extracted `docker save` archive, rather than a root filesystem.
+func isContainerLayout(dir string) bool {
+	for _, name := range []string{"index.json", "manifest.json"} {
+		if fi, err := os.Stat(filepath.Join(dir, name)); err == nil && fi.Mode().IsRegular() {
+			return true
+		}
+	}
+	return false
+}
+
+// tarHeaderLength is enough bytes to recognize a tarball
+const tarHeaderLength = 512
+
+// isTar() indicates if header, the first bytes of a file, are a tar header.
+func isTar(header []byte) bool {
+	return len(header) >= 262 && string(header[257:262]) == "ustar"
+}
+
+// isCompressedTar() indicates if f decompresses to a tarball, and rewinds f.
+func isCompressedTar(c *compression, f imageFile) (bool, error) {
+	r, err := c.open(f)
+	if err != nil {
+		return false, err
+	}
+	header := make([]byte, tarHeaderLength)
+	n, _ := io.ReadFull(r, header)
+	r.Close()
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return false, err
+	}
+	return isTar(header[:n]), nil
+}
+
+// filesystemOptions() checks the options for building a filesystem image,
+// before anything expensive happens.
+func filesystemOptions() (fs_image.ExtOptions, fs_image.PartitionTable, error) {
+	var opts fs_image.ExtOptions
+	switch config.fsType {
+	case "ext4":
+	case "ext2":
+		opts.Ext2 = true
+	default:
+		return opts, 0, fmt.Errorf("unsupported -fs-type %q, expected \"ext4\" or \"ext2\"", config.fsType)
+	}
+	table, ok := partitionTables[config.partitionTable]
+	if !ok {
+		return opts, 0, fmt.Errorf("unsupported -partition-table %q, expected \"none\", \"mbr\", or \"gpt\"", config.partitionTable)
+	}
+	if config.imageSize == 0 {
+		return opts, 0, fmt.Errorf("-image-size must be specified when -image is a directory or container image")
+	}
+	opts.Size = int64(config.imageSize)
+	if table != 0 {
+		opts.Size = table.PartitionSize(opts.Size)
+	}
+	opts.Label = config.fsLabel
+	return opts, table, nil
+}
+
+// openDirectory() lays out the tree under dir, or the container image in it,
+// as a filesystem image of -image-size bytes, which is generated as it's read.
+func openDirectory(dir string) (io.ReadCloser, int64, error) {
+	opts, table, err := filesystemOptions()
+	if err != nil {
+		return nil, 0, err
+	}
+
+	if isContainerLayout(dir) {
+		log.Printf("Reading container image layout %s", dir)
+		img, err := fs_image.OpenOCI(dir, containerOptions())
+		if err != nil {
+			return nil, 0, err
+		}
+		checkContainerArchitecture(img)
+		return openTree(img.Root, opts, table, img)
+	}
+
+	log.Printf("Reading directory tree %s", dir)
+	root, err := fs_image.FromDirectory(dir, config.excludes)
+	if err != nil {
+		return nil, 0, err
+	}
+	return openTree(root, opts, table)
+}
+
+// openContainerArchive() lays out the container image in a `docker save`
+// archive or OCI image layout tarball as a filesystem image of -image-size
+// bytes, which is generated as it's read.
+func openContainerArchive(f imageFile, size int64) (io.ReadCloser, int64, error) {
+	opts, table, err := filesystemOptions()
+	if err != nil {
+		f.Close()
+		return nil, 0, err
+	}
+
+	log.Printf("Image is a container image archive")
+	img, err := fs_image.OpenOCIArchive(f, size, containerOptions())
+	if err != nil {
+		f.Close()
+		return nil, 0, err
+	}
+	checkContainerArchitecture(img)
+	return openTree(img.Root, opts, table, img, f)
+}
+
+// containerOptions() returns the options for picking a container image.
+func containerOptions() fs_image.OCIOptions {
+	return fs_image.OCIOptions{
+		Reference:    config.imageRef,
+		Architecture: ociArchitectures[config.architecture],
+	}
+}
+
+// checkContainerArchitecture() warns if a container image isn't for -arch.
+func checkContainerArchitecture(img *fs_image.OCIImage) {
+	if img.Architecture != "" && img.Architecture != ociArchitectures[config.architecture] {
+		log.Printf("Warning: the container image is for %q, but the bundle will be for \"-arch %s\"", img.Architecture, config.architecture)
+	}
+}
+
+// openTree() lays out root as a filesystem image, partitioned according to
+// table, which is generated as it's read. Closing it closes sources.
+func openTree(root *fs_image.Node, opts fs_image.ExtOptions, table fs_image.PartitionTable, sources ...io.Closer) (io.ReadCloser, int64, error) {
+	closeSources := func() {
+		for _, c := range sources {
+			c.Close()
+		}
+	}
+
+	ext, err := fs_image.NewExt(root, opts)
+	if sizeErr, ok := err.(*fs_image.SizeError); ok {
+		closeSources()
+		needed := sizeErr.Needed + int64(config.imageSize) - opts.Size
+		return nil, 0, fmt.Errorf("%v; try -image-size %dM", err, (needed+1<<20-1)>>20)
+	} else if err != nil {
+		closeSources()
+		return nil, 0, err
+	}
+
+	var img interface {
+		io.ReadCloser
+		Size() int64
+	} = ext
+	if table != 0 {
+		if img, err = fs_image.NewPartitioned(ext, int64(config.imageSize), table); err != nil {
+			ext.Close()
+			closeSources()
+			return nil, 0, err
+		}
+		log.Printf("Bundling it as an %s filesystem of %d bytes, in a disk image of %d bytes with an %v partition table", config.fsType, opts.Size, img.Size(), table)
+	} else {
+		log.Printf("Bundling it as an %s filesystem of %d bytes", config.fsType, img.Size())
+	}
+	return &treeImage{img, append([]io.Closer{img}, sources...)}, img.Size(), nil
+}
+
+// treeImage is a filesystem image generated from files which stay open until
+// it's closed.
+type treeImage struct {
+	io.Reader
+	closers []io.Closer
+}
+
+func (ti *treeImage) Close() error {
+	for _, c := range ti.closers {
+		c.Close()
+	}
+	return nil
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestOpenDirectory(t *testing.T) {
+	saved := config
+	defer func() { config = saved }()
+
+	dir := t.TempDir()
+	if err := ioutil.WriteFile(filepath.Join(dir, "hostname"), []byte("test\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "big"), make([]byte, 10<<20), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	// the size is required, and must be enough
+	config.fsType = "ext4"
+	if _, _, err := open(dir); err == nil || !strings.Contains(err.Error(), "-image-size") {
+		t.Errorf("open() without -image-size error = %v", err)
+	}
+	config.imageSize = 8 << 20
+	if _, _, err := open(dir); err == nil || !strings.Contains(err.Error(), "try -image-size") {
+		t.Errorf("open() with a small -image-size error = %v", err)
+	}
+	config.fsType = "xfs"
+	if _, _, err := open(dir); err == nil {
+		t.Errorf("open() with -fs-type xfs succeeded")
+	}
+
+	for _, fsType := range []string{"ext4", "ext2"} {
+		config.fsType = fsType
+		config.imageSize = 32 << 20
+		config.fsLabel = "root"
+		config.excludes = stringList{"big"}
+		r, size, err := open(dir)
+		if err != nil {
+			t.Fatalf("%s: open() error = %v", fsType, err)
+		}
+		image, err := ioutil.ReadAll(r)
+		r.Close()
+		if err != nil || size != 32<<20 || int64(len(image)) != size {
+			t.Fatalf("%s: open() = %d bytes, read %d, error %v", fsType, size, len(image), err)
+		}
+
+		sb := image[1024:]
+		if magic := binary.LittleEndian.Uint16(sb[56:]); magic != 0xef53 {
+			t.Errorf("%s: superblock magic = %#x", fsType, magic)
+		}
+		if label := strings.TrimRight(string(sb[120:136]), "\x00"); label != "root" {
+			t.Errorf("%s: label = %q", fsType, label)
+		}
+		extents := binary.LittleEndian.Uint32(sb[96:])&0x40 != 0
+		if extents != (fsType == "ext4") {
+			t.Errorf("%s: extents feature = %v", fsType, extents)
+		}
+	}
+
+	// files aren't mistaken for directories
+	config.excludes = nil
+	if r, size, err := open(filepath.Join(dir, "hostname")); err != nil || size != 5 {
+		t.Errorf("open() of a file = %d bytes, error %v", size, err)
+	} else {
+		r.Close()
+	}
+}
+
+// tarball() returns a tarball of files, in order.
+func tarball(t *testing.T, files ...string) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for i := 0; i < len(files); i += 2 {
+		hdr := &tar.Header{Name: files[i], Mode: 0o644, Size: int64(len(files[i+1])), Typeflag: tar.TypeReg}
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+		tw.Write([]byte(files[i+1]))
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestOpenContainerArchive(t *testing.T) {
+	saved := config
+	defer func() { config = saved }()
+
+	// as docker save makes
+	layer := tarball(t, "etc/hostname", "container\n")
+	archive := tarball(t,
+		"manifest.json", `[{"Config":"config.json","RepoTags":["test:latest"],"Layers":["1/layer.tar"]}]`,
+		"config.json", `{"architecture":"arm64","os":"linux"}`,
+		"1/layer.tar", string(layer),
+	)
+	dir := t.TempDir()
+	filename := filepath.Join(dir, "image.tar")
+	if err := ioutil.WriteFile(filename, archive, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	config.fsType = "ext4"
+	config.imageSize = 32 << 20
+	config.partitionTable = "gpt"
+	r, size, err := open(filename)
+	if err != nil {
+		t.Fatalf("open() error = %v", err)
+	}
+	image, err := ioutil.ReadAll(r)
+	r.Close()
+	if err != nil || size != 32<<20 || int64(len(image)) != size {
+		t.Fatalf("open() = %d bytes, read %d, error %v", size, len(image), err)
+	}
+	if string(image[512:520]) != "EFI PART" {
+		t.Errorf("no GPT header")
+	}
+	if magic := binary.LittleEndian.Uint16(image[1<<20+1024+56:]); magic != 0xef53 {
+		t.Errorf("superblock magic at 1 MiB = %#x", magic)
+	}
+
+	// a compressed archive is refused, rather than bundled as a disk image
+	var compressed bytes.Buffer
+	zw := gzip.NewWriter(&compressed)
+	zw.Write(archive)
+	zw.Close()
+	if err := ioutil.WriteFile(filename+".gz", compressed.Bytes(), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := open(filename + ".gz"); err == nil || !strings.Contains(err.Error(), "decompress it first") {
+		t.Errorf("open() of a compressed archive error = %v", err)
+	}
+
+	// as is an unknown partition table
+	config.partitionTable = "apm"
+	if _, _, err := open(filename); err == nil {
+		t.Errorf("open() with -partition-table apm succeeded")
+	}
+
+	// an extracted archive is a container image too
+	config.partitionTable = "none"
+	extracted := filepath.Join(dir, "extracted")
+	os.MkdirAll(filepath.Join(extracted, "1"), 0o755)
+	ioutil.WriteFile(filepath.Join(extracted, "manifest.json"), []byte(`[{"Config":"config.json","Layers":["1/layer.tar"]}]`), 0o644)
+	ioutil.WriteFile(filepath.Join(extracted, "config.json"), []byte(`{"architecture":"amd64","os":"linux"}`), 0o644)
+	ioutil.WriteFile(filepath.Join(extracted, "1", "layer.tar"), layer, 0o644)
+	r, size, err = open(extracted)
+	if err != nil {
+		t.Fatalf("open() of an extracted archive error = %v", err)
+	}
+	image, err = ioutil.ReadAll(r)
+	r.Close()
+	if err != nil || size != 32<<20 || int64(len(image)) != size {
+		t.Fatalf("open() of an extracted archive = %d bytes, read %d, error %v", size, len(image), err)
+	}
+	if magic := binary.LittleEndian.Uint16(image[1024+56:]); magic != 0xef53 {
+		t.Errorf("superblock magic = %#x", magic)
+	}
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/willglynn/go_ami_tools/disk_inspect"
+)
+
+// teeReader writes everything read from r to w, like io.TeeReader(), but
+// keeps r's WriteTo(), so that sparse files are still copied efficiently. w
+// must not fail, which is true of a disk_inspect.Stream.
+type teeReader struct {
+	r io.Reader
+	w io.Writer
+}
+
+func (tr *teeReader) Read(p []byte) (int, error) {
+	n, err := tr.r.Read(p)
+	tr.w.Write(p[:n])
+	return n, err
+}
+
+func (tr *teeReader) WriteTo(w io.Writer) (int64, error) {
+	return io.Copy(io.MultiWriter(w, tr.w), tr.r)
+}
+
+// hasArchitecture() indicates if the image has a UEFI boot loader for arch.
+func hasArchitecture(report *disk_inspect.Report, arch string) bool {
+	for _, a := range report.EFIArchitectures {
+		if a == arch {
+			return true
+		}
+	}
+	return false
+}
+
+// inspectionWarnings() explains what about the image's contents would keep
+// an AMI registered from it for arch from booting.
+func inspectionWarnings(report *disk_inspect.Report, arch string) []string {
+	var warnings []string
+	switch {
+	case report.PartitionTable == "" && report.Filesystem == "":
+		warnings = append(warnings, "the image has no partition table or filesystem that this tool recognizes; an AMI registered from it probably won't boot")
+	case report.PartitionTable == "":
+		warnings = append(warnings, fmt.Sprintf("the image is a bare %s filesystem, without a partition table or boot loader; it can only boot as a paravirtual AMI using PV-GRUB, which needs /boot/grub/menu.lst", report.Filesystem))
+	case !report.BIOSBoot() && !report.UEFIBoot():
+		warnings = append(warnings, `the image has no boot loader: there's no boot code in its MBR, and no \EFI\BOOT\BOOT*.EFI on an EFI system partition; an AMI registered from it won't boot`)
+	case arch == "arm64" && !hasArchitecture(report, arch):
+		warnings = append(warnings, `arm64 instances only boot with UEFI, but the image has no \EFI\BOOT\BOOTAA64.EFI`)
+	case !report.BIOSBoot() && !hasArchitecture(report, arch):
+		warnings = append(warnings, fmt.Sprintf("the image's UEFI boot loader is for %s, not -arch %s", strings.Join(report.EFIArchitectures, ", "), arch))
+	}
+	if len(warnings) > 0 && report.Incomplete {
+		warnings = append(warnings, "parts of the image couldn't be inspected as it was read, so the above might be mistaken")
+	}
+	return warnings
+}
+
+// bootMode() returns the --boot-mode for an AMI, or "" to leave it to EC2.
+func bootMode(report *disk_inspect.Report, arch string) string {
+	uefi := hasArchitecture(report, arch)
+	bios := report.BIOSBoot() && arch != "arm64"
+	switch {
+	case uefi && bios:
+		return "uefi-preferred"
+	case uefi:
+		return "uefi"
+	case bios:
+		return "legacy-bios"
+	default:
+		return ""
+	}
+}
+
+// registerImageCommand() suggests how to register an AMI from the bundle,
+// according to what the image holds.
+func registerImageCommand(report *disk_inspect.Report, name, arch, manifestLocation string) string {
+	args := []string{"aws ec2 register-image", fmt.Sprintf("--name %q", name), "--architecture " + arch}
+	if report.PartitionTable == "" && report.Filesystem != "" {
+		// a bare filesystem is the root partition of a paravirtual instance
+		args = append(args,
+			"--virtualization-type=paravirtual",
+			"--kernel-id=<the PV-GRUB AKI for your region>",
+			`--block-device-mappings "VirtualName=ami,DeviceName=sda1 VirtualName=ephemeral0,DeviceName=sdb"`,
+			"--root-device-name=/dev/sda1",
+		)
+	} else {
+		args = append(args, "--virtualization-type=hvm")
+		if mode := bootMode(report, arch); mode != "" {
+			args = append(args, "--boot-mode="+mode)
+		}
+		args = append(args,
+			`--block-device-mappings "VirtualName=ami,DeviceName=sda VirtualName=ephemeral0,DeviceName=sdb"`,
+			"--root-device-name=/dev/xvda",
+		)
+	}
+	args = append(args, "--image-location "+manifestLocation)
+	return strings.Join(args, " ")
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/willglynn/go_ami_tools/disk_inspect"
+)
+
+func TestInspectionWarnings(t *testing.T) {
+	linux := []disk_inspect.Partition{{Number: 1, Type: "Linux", Filesystem: "ext4"}}
+	for _, test := range []struct {
+		name     string
+		report   disk_inspect.Report
+		arch     string
+		warnings []string
+		command  string
+	}{
+		{
+			name:    "BIOS",
+			report:  disk_inspect.Report{PartitionTable: "MBR", Partitions: linux, BIOSBootLoader: "GRUB"},
+			arch:    "x86_64",
+			command: `--architecture x86_64 --virtualization-type=hvm --boot-mode=legacy-bios --block-device-mappings`,
+		},
+		{
+			name:    "hybrid",
+			report:  disk_inspect.Report{PartitionTable: "GPT", Partitions: linux, BIOSBootLoader: "GRUB", EFIArchitectures: []string{"x86_64"}},
+			arch:    "x86_64",
+			command: `--boot-mode=uefi-preferred`,
+		},
+		{
+			name:    "arm64",
+			report:  disk_inspect.Report{PartitionTable: "GPT", Partitions: linux, BIOSBootLoader: "GRUB", EFIArchitectures: []string{"arm64", "x86_64"}},
+			arch:    "arm64",
+			command: `--architecture arm64 --virtualization-type=hvm --boot-mode=uefi `,
+		},
+		{
+			name:     "arm64 without UEFI",
+			report:   disk_inspect.Report{PartitionTable: "GPT", Partitions: linux, BIOSBootLoader: "GRUB"},
+			arch:     "arm64",
+			warnings: []string{"arm64 instances only boot with UEFI"},
+			command:  `--virtualization-type=hvm --block-device-mappings`,
+		},
+		{
+			name:     "wrong architecture",
+			report:   disk_inspect.Report{PartitionTable: "GPT", Partitions: linux, EFIArchitectures: []string{"arm64"}},
+			arch:     "x86_64",
+			warnings: []string{"boot loader is for arm64, not -arch x86_64"},
+			command:  `--virtualization-type=hvm --block-device-mappings`,
+		},
+		{
+			name:     "no boot loader",
+			report:   disk_inspect.Report{PartitionTable: "GPT", Partitions: linux, Incomplete: true},
+			arch:     "x86_64",
+			warnings: []string{"the image has no boot loader", "might be mistaken"},
+			command:  `--virtualization-type=hvm --block-device-mappings`,
+		},
+		{
+			name:     "filesystem",
+			report:   disk_inspect.Report{Filesystem: "ext4"},
+			arch:     "x86_64",
+			warnings: []string{"bare ext4 filesystem"},
+			command:  `--virtualization-type=paravirtual --kernel-id=<the PV-GRUB AKI for your region> --block-device-mappings "VirtualName=ami,DeviceName=sda1 VirtualName=ephemeral0,DeviceName=sdb" --root-device-name=/dev/sda1 --image-location bucket/image.manifest.xml`,
+		},
+		{
+			name:     "garbage",
+			report:   disk_inspect.Report{},
+			arch:     "x86_64",
+			warnings: []string{"no partition table or filesystem"},
+			command:  `--virtualization-type=hvm --block-device-mappings`,
+		},
+	} {
+		warnings := inspectionWarnings(&test.report, test.arch)
+		if len(warnings) != len(test.warnings) {
+			t.Errorf("%s: inspectionWarnings() = %q, want %d warnings", test.name, warnings, len(test.warnings))
+		} else {
+			for i, w := range test.warnings {
+				if !strings.Contains(warnings[i], w) {
+					t.Errorf("%s: warning %q doesn't mention %q", test.name, warnings[i], w)
+				}
+			}
+		}
+
+		command := registerImageCommand(&test.report, "image", test.arch, "bucket/image.manifest.xml")
+		if !strings.HasPrefix(command, `aws ec2 register-image --name "image" `) || !strings.Contains(command, test.command) {
+			t.Errorf("%s: registerImageCommand() = %q, want it to include %q", test.name, command, test.command)
+		}
+	}
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"io/ioutil"
+	"math/rand"
+	"os/exec"
+	"testing"
+)
+
+// lz4Fixture() returns the input to the fixtures below: a 64-byte pattern,
+// repeated until it spans two 64 KiB blocks.
+func lz4Fixture() []byte {
+	unit := make([]byte, 64)
+	for i := range unit {
+		unit[i] = byte(i*i + 7*i)
+	}
+	return bytes.Repeat(unit, 1300)
+}
+
+// lz4 -B4 -BD -BX --content-size, i.e. linked blocks with checksums and a size
+var lz4Linked = mustDecodeBase64("" +
+	"BCJNGFxAAEUBAAAAAABtSwEAAP8xAAgSHiw8TmJ4kKrG5AQmSnCYwu4cTH6y6CBaltQUVprg" +
+	"KHK+DFyuAliwCmbEJIbqULgijvxs3lLIQLo2tDS2OkAA////////////////////////////" +
+	"////////////////////////////////////////////////////////////////////////" +
+	"////////////////////////////////////////////////////////////////////////" +
+	"////////////////////////////////////////////////////////////////////////" +
+	"////////////////////////////////////////////////////////////////////////" +
+	"/////////////////////////6hQNrQ0tjpJmM35jwAAAP8xAAgSHiw8TmJ4kKrG5AQmSnCY" +
+	"wu4cTH6y6CBaltQUVprgKHK+DFyuAliwCmbEJIbqULgijvxs3lLIQLo2tDS2OkAA////////" +
+	"////////////////////////////////////////////////////////////////////////" +
+	"///////////sUDa0NLY6z2yzTQAAAAAF6p6C",
+)
+
+// lz4 -B4, i.e. independent blocks with a content checksum
+var lz4Independent = mustDecodeBase64("" +
+	"BCJNGGRAp0sBAAD/MQAIEh4sPE5ieJCqxuQEJkpwmMLuHEx+suggWpbUFFaa4ChyvgxcrgJY" +
+	"sApmxCSG6lC4Io78bN5SyEC6NrQ0tjpAAP//////////////////////////////////////" +
+	"////////////////////////////////////////////////////////////////////////" +
+	"////////////////////////////////////////////////////////////////////////" +
+	"////////////////////////////////////////////////////////////////////////" +
+	"////////////////////////////////////////////////////////////////////////" +
+	"//////////////+oUDa0NLY6jwAAAP8xAAgSHiw8TmJ4kKrG5AQmSnCYwu4cTH6y6CBaltQU" +
+	"VprgKHK+DFyuAliwCmbEJIbqULgijvxs3lLIQLo2tDS2OkAA////////////////////////" +
+	"///////////////////////////////////////////////////////////////////sUDa0" +
+	"NLY6AAAAAAXqnoI=",
+)
+
+func mustDecodeBase64(s string) []byte {
+	b, err := base64.StdEncoding.DecodeString(s)
+	if err != nil {
+		panic(err)
+	}
+	return b
+}
+
+func TestLz4Reader(t *testing.T) {
+	expected := lz4Fixture()
+	skippable := []byte{0x5a, 0x2a, 0x4d, 0x18, 3, 0, 0, 0, 'a', 'b', 'c'}
+
+	tests := []struct {
+		name     string
+		input    []byte
+		expected []byte
+	}{
+		{"linked", lz4Linked, expected},
+		{"independent", lz4Independent, expected},
+		{"concatenated", append(append([]byte{}, lz4Linked...), lz4Independent...), append(append([]byte{}, expected...), expected...)},
+		{"skippable", append(append([]byte{}, skippable...), lz4Independent...), expected},
+	}
+	for _, tt := range tests {
+		actual, err := ioutil.ReadAll(newLz4Reader(bytes.NewReader(tt.input)))
+		if err != nil {
+			t.Errorf("%s: ReadAll() error = %v", tt.name, err)
+		} else if !bytes.Equal(actual, tt.expected) {
+			t.Errorf("%s: decompressed %d bytes which differ from the %d expected", tt.name, len(actual), len(tt.expected))
+		}
+	}
+}
+
+func TestLz4ReaderCorrupt(t *testing.T) {
+	corrupt := func(offset int) []byte {
+		b := append([]byte{}, lz4Linked...)
+		b[offset] ^= 0x01
+		return b
+	}
+
+	for name, input := range map[string][]byte{
+		"empty":            {},
+		"truncated header": lz4Linked[:6],
+		"truncated block":  lz4Linked[:100],
+		"missing end mark": lz4Linked[:len(lz4Linked)-4],
+		"bad magic":        corrupt(0),
+		"bad header":       corrupt(13),
+		"bad block":        corrupt(40),
+		"bad content size": corrupt(6),
+	} {
+		if _, err := ioutil.ReadAll(newLz4Reader(bytes.NewReader(input))); err == nil {
+			t.Errorf("%s: ReadAll() succeeded", name)
+		}
+	}
+}
+
+func TestLz4ReaderRoundTrip(t *testing.T) {
+	lz4, err := exec.LookPath("lz4")
+	if err != nil {
+		t.Skip("lz4 command not found")
+	}
+
+	// something which compresses, but not trivially
+	rng := rand.New(rand.NewSource(1))
+	var input []byte
+	for len(input) < 3<<20 {
+		chunk := make([]byte, rng.Intn(300))
+		if rng.Intn(3) == 0 || len(input) < len(chunk) {
+			rng.Read(chunk)
+		} else {
+			start := rng.Intn(len(input) - len(chunk) + 1)
+			copy(chunk, input[start:])
+		}
+		input = append(input, chunk...)
+	}
+
+	for _, args := range [][]string{
+		{"-1"},
+		{"-9", "-BD"},
+		{"-B4", "-BD", "-BX", "--content-size"},
+		{"-B7", "--no-frame-crc"},
+	} {
+		cmd := exec.Command(lz4, append(args, "-c")...)
+		cmd.Stdin = bytes.NewReader(input)
+		compressed, err := cmd.Output()
+		if err != nil {
+			t.Fatalf("lz4 %v: %v", args, err)
+		}
+
+		actual, err := ioutil.ReadAll(newLz4Reader(bytes.NewReader(compressed)))
+		if err != nil {
+			t.Errorf("lz4 %v: ReadAll() error = %v", args, err)
+		} else if !bytes.Equal(actual, input) {
+			t.Errorf("lz4 %v: decompressed output differs from the input", args)
+		}
+	}
+}
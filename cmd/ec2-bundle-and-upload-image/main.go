@@ -1,27 +1,46 @@
 package main
 
 import (
-	"compress/bzip2"
-	"compress/gzip"
+	"context"
+	"crypto"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"log"
+	"math"
+	"net/url"
 	"os"
-	"path"
+	"os/signal"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/session"
-	"github.com/aws/aws-sdk-go/service/s3"
 	"github.com/aws/aws-sdk-go/service/sts"
 	"github.com/willglynn/go_ami_tools/aws_bundle"
 	"github.com/willglynn/go_ami_tools/aws_bundle_glue"
+	"github.com/willglynn/go_ami_tools/disk_image"
+	"github.com/willglynn/go_ami_tools/disk_inspect"
 )
 
 var config struct {
 	// source
-	image string
+	image         string
+	imageSize     byteSize
+	padShortImage bool
+	roundUpMiB    bool
+	forceMounted  bool
+	zeroFree      bool
+
+	// directory source
+	excludes       stringList
+	fsType         string
+	fsLabel        string
+	partitionTable string
+	imageRef       string
 
 	// metadata
 	name         string
@@ -29,26 +48,74 @@ var config struct {
 	account      string
 	region       string
 
+	// EC2 certificate
+	ec2cert      string
+	strictRegion bool
+
+	// user key
+	userKey               string
+	userKeyPassphraseFile string
+	generateUserKey       string
+	userKeyBits           int
+
 	// sink
+	dest   string
 	bucket string
 	prefix string
+	broker string
 }
 
 func init() {
-	flag.StringVar(&config.image, "image", "", "filename of disk image to bundle/upload")
+	flag.StringVar(&config.image, "image", "", "filename, https:// URL, or s3://bucket/key of disk image to bundle/upload")
+	flag.Var(&config.imageSize, "image-size", "size of the bundled image, e.g. \"20G\"; grows the image by appending zeros, and lets the size recorded by gzip be trusted if it's under 4 GiB (optional)")
+	flag.BoolVar(&config.padShortImage, "pad-short-image", false, "pad the image with zeros if it turns out to be shorter than expected, rather than fail; with -image-size, saves decompressing a compressed image twice when its size isn't recorded")
+	flag.BoolVar(&config.roundUpMiB, "round-up-mib", false, "pad the image with zeros to a whole number of MiB")
+	flag.BoolVar(&config.forceMounted, "force-mounted", false, "bundle a block device even if it's mounted read-write")
+	flag.BoolVar(&config.zeroFree, "zero-free-blocks", false, "bundle zeros in place of ext2/3/4 filesystems' unallocated blocks, which compress better than deleted files' leftovers (the image itself is unchanged)")
+	flag.Var(&config.excludes, "exclude", "when -image is a directory tree, leave out files matching this pattern, e.g. \"/proc/*\" or \"*.pyc\" (repeatable)")
+	flag.StringVar(&config.fsType, "fs-type", "ext4", "when -image is a directory or container image, the filesystem to build (\"ext4\" or \"ext2\")")
+	flag.StringVar(&config.fsLabel, "fs-label", "", "when -image is a directory or container image, the filesystem's volume label (optional)")
+	flag.StringVar(&config.partitionTable, "partition-table", "none", "when -image is a directory or container image, put the filesystem in a partition (\"none\", \"mbr\", or \"gpt\")")
+	flag.StringVar(&config.imageRef, "image-ref", "", "when -image is a container image archive holding several images, the one to use, e.g. \"myimage:latest\"")
 	flag.StringVar(&config.name, "name", "image", "basename to use in resulting image")
-	flag.StringVar(&config.architecture, "arch", "x86_64", "CPU architecture (\"x86_64\" or \"i386\")")
+	flag.StringVar(&config.architecture, "arch", "x86_64", "CPU architecture (\"x86_64\", \"arm64\", or \"i386\")")
 	flag.StringVar(&config.account, "account", "", "AWS account number (without dashes)")
-	flag.StringVar(&config.bucket, "s3-bucket", "", "S3 bucket to which the image should be uploaded")
+	flag.StringVar(&config.dest, "dest", "", "where to write the bundle: s3://bucket/prefix/ (optionally with ?region=), file:///path/to/directory/, the https:// URL of a broker which presigns S3 URLs, or exec:<shell command>")
+	flag.StringVar(&config.bucket, "s3-bucket", "", "S3 bucket to which the image should be uploaded (instead of -dest)")
 	flag.StringVar(&config.prefix, "s3-prefix", "", "prefix to use within the S3 bucket (optional, should probably end with \"/\" if specified)")
+	flag.StringVar(&config.broker, "broker", "", "https:// URL of a broker which presigns S3 URLs (the same as -dest with that URL)")
 	flag.StringVar(&config.region, "region", "", "region to use for S3 upload and image manifest (determined automatically from S3 bucket)")
+	flag.StringVar(&config.ec2cert, "ec2cert", "", "PEM file containing the EC2 certificate for -region (optional, overrides the built-in certificates)")
+	flag.BoolVar(&config.strictRegion, "strict-region", false, "refuse to bundle for regions not in the built-in region list and without their own certificate, rather than assuming the partition's certificate applies")
+	flag.StringVar(&config.userKey, "user-key", "", "PEM file containing an RSA private key with which to sign the manifest (optional)")
+	flag.StringVar(&config.userKeyPassphraseFile, "user-key-passphrase-file", "", "file containing the passphrase for an encrypted -user-key")
+	flag.StringVar(&config.generateUserKey, "generate-user-key", "", "generate a new RSA private key, save it to this PEM file, and sign the manifest with it")
+	flag.IntVar(&config.userKeyBits, "user-key-bits", aws_bundle.DefaultUserKeyBits, "size of any RSA private key generated for the manifest")
 
 	flag.Usage = func() {
-		fmt.Fprintf(os.Stderr, "Usage:\n  %s -image <path/to/disk/image> -s3-bucket <bucket name>\n\nFull parameters:\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "Usage:\n  %s -image <path/to/disk/image> -s3-bucket <bucket name>\n  %s -image <path/to/disk/image> -dest <URL>\n  %s upload -archive <bundle.tar> -s3-bucket <bucket name>\n  %s certs [-export <region>]\n\nFull parameters:\n", os.Args[0], os.Args[0], os.Args[0], os.Args[0])
 		flag.PrintDefaults()
 		fmt.Fprintf(os.Stderr, `
--image must reference a bootable disk image file. If the filename ends in
-.gz or .bz2, it will be transparently decompressed.
+-image must reference a bootable disk image file. If it is compressed with
+gzip, bzip2, xz, zstd, or lz4, it will be transparently decompressed. If it is
+a qcow2, VMDK, VHD, or VHDX virtual disk, it will be transparently converted
+to a raw image. Its partition table, filesystems, and boot loaders are
+inspected as it's bundled, to warn about images which won't boot and to
+suggest how to register it.
+
+-image may also be a directory, such as a container's root filesystem. It is
+laid out as an ext4 (or -fs-type ext2) filesystem of -image-size bytes, with
+ownership, modes, extended attributes, symlinks, device nodes, and hard links
+preserved, and bundled without writing a temporary file. Use -exclude to leave
+out files, e.g. "/proc/*". -image may also be a container image, as a docker
+save archive or an OCI image layout, whose layers are applied in order and laid
+out the same way. Either way, the filesystem has no partition table unless
+-partition-table is given, in which case -image-size is the whole disk.
+
+The manifest contains a copy of the bundle's encryption key which is encrypted
+to, and signed by, a user RSA key. Specify -user-key to use an existing key, or
+-generate-user-key to make and save a new one; otherwise, a throwaway key is
+used, and you will not be able to decrypt or verify the bundle later.
 
 ec2-bundle-and-upload-image searches for credentials the usual way. Specify
 AWS_ACCESS_KEY_ID + AWS_SECRET_ACCESS_KEY environment variables, put keys in
@@ -61,38 +128,80 @@ Usage requires the following AWS permissions:
 	s3:GetBucketLocation   (if -region is unspecified)
 	sts:GetCallerIdentity  (if -account is unspecified)
 
+-dest s3://bucket/prefix/ is the same as -s3-bucket bucket -s3-prefix prefix/.
+Other destinations need no AWS credentials, but do need -region, and -account
+too unless there are credentials to determine it:
+
+  -dest file:///path/to/directory/ writes the bundle's files there.
+
+  -dest tar:///path/to/bundle.tar writes them all into one tar archive, along
+  with a SHA1SUMS index, to be carried elsewhere and uploaded with the upload
+  command.
+
+  -dest https://broker/... uploads each file to a presigned S3 PUT URL, which
+  it gets by requesting the broker's URL with "filename=<file>" added to the
+  query. The broker responds with the URL, which must allow the x-amz-acl
+  header, and decides the bucket and key. -broker https://broker/... is the
+  same thing.
+
+  -dest exec:<command> runs "sh -c <command>" for each file, with the file on
+  its standard input and its name in $BUNDLE_FILENAME.
+
 `)
 	}
 }
 
-// requires s3:GetBucketLocation
-func determineRegion() {
-	if config.bucket == "" {
-		return
+// whether exactly one of -dest, -s3-bucket, and -broker was given
+func oneDestination() bool {
+	given := 0
+	for _, value := range []string{config.dest, config.bucket, config.broker} {
+		if value != "" {
+			given++
+		}
 	}
+	return given == 1
+}
 
-	// talk to S3 in  us-east-1
-	s3Svc := s3.New(session.New(), aws.NewConfig().WithRegion("us-east-1"))
+// open the destination, given by -dest, -s3-bucket, or -broker, determining
+// -region from an S3 bucket if necessary
+//
+// requires s3:GetBucketLocation (for an S3 bucket, if -region is unspecified)
+func openDestination() (aws_bundle_glue.Destination, string) {
+	dest := config.dest
+	switch {
+	case config.bucket != "":
+		dest = (&url.URL{Scheme: "s3", Host: config.bucket, Path: "/" + config.prefix}).String()
+	case config.broker != "":
+		// -broker predates -dest, which took over its job
+		if u, err := url.Parse(config.broker); err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+			log.Fatal("Invalid -broker: expected an https:// URL")
+		}
+		dest = config.broker
+	}
 
-	// ask it where the target bucket is
-	input := s3.GetBucketLocationInput{
-		Bucket: &config.bucket,
+	// an S3 bucket had better be in the target region, so there's no need to look it up
+	if u, err := url.Parse(dest); err == nil && u.Scheme == "s3" && config.region != "" && u.Query().Get("region") == "" {
+		query := u.Query()
+		query.Set("region", config.region)
+		u.RawQuery = query.Encode()
+		dest = u.String()
 	}
-	output, err := s3Svc.GetBucketLocation(&input)
 
-	// blow up if it failed
+	sink, err := aws_bundle_glue.OpenSink(dest)
 	if err != nil {
-		log.Fatal("Unable to s3:GetBucketLocation; please specify -region", err)
+		log.Fatalf("Unable to open -dest: %v", err)
 	}
 
-	if output.LocationConstraint != nil {
-		config.region = *output.LocationConstraint
-	} else {
-		// looks like us-east-1
-		config.region = "us-east-1"
+	if s3Sink, ok := sink.(*aws_bundle_glue.S3Sink); ok && config.region == "" {
+		config.region = s3Sink.Region()
+		log.Printf("Using \"-region %s\" to match S3 bucket", config.region)
 	}
 
-	log.Printf("Using \"-region %s\" to match S3 bucket", config.region)
+	// describe it without any credentials in its query string
+	if i := strings.IndexByte(dest, '?'); i >= 0 && !strings.HasPrefix(dest, "exec:") {
+		dest = dest[:i]
+	}
+	return sink, dest
 }
 
 // requires sts:GetCallerIdentity
@@ -112,12 +221,92 @@ func determineAccount() {
 	log.Printf("Using \"-account %s\" based on active credentials", config.account)
 }
 
+// set up the EC2 certificates, making sure there's one for the target region
+func loadCertificates() *aws_bundle.CertificateRegistry {
+	certs := aws_bundle.NewCertificateRegistry()
+	certs.SetStrict(config.strictRegion)
+
+	if config.ec2cert != "" {
+		pemBytes, err := ioutil.ReadFile(config.ec2cert)
+		if err != nil {
+			log.Fatalf("Unable to read EC2 certificate: %v", err)
+		}
+		if err := certs.RegisterRegionPEM(config.region, pemBytes); err != nil {
+			log.Fatalf("Unable to parse EC2 certificate %q: %v", config.ec2cert, err)
+		}
+	}
+
+	if _, err := certs.CertificateForRegion(config.region); err != nil {
+		log.Fatalf("Unable to find an EC2 certificate: %v; please specify -ec2cert", err)
+	}
+
+	return certs
+}
+
+// load or generate the user key, if requested, returning a nil interface
+// rather than a nil *rsa.PrivateKey otherwise
+func loadUserKey() crypto.Signer {
+	if config.userKey != "" && config.generateUserKey != "" {
+		log.Fatal("Specify at most one of -user-key and -generate-user-key")
+	}
+
+	if config.userKey != "" {
+		pemBytes, err := ioutil.ReadFile(config.userKey)
+		if err != nil {
+			log.Fatalf("Unable to read user key: %v", err)
+		}
+
+		var passphrase []byte
+		if config.userKeyPassphraseFile != "" {
+			if passphrase, err = ioutil.ReadFile(config.userKeyPassphraseFile); err != nil {
+				log.Fatalf("Unable to read user key passphrase: %v", err)
+			}
+			passphrase = []byte(strings.TrimRight(string(passphrase), "\r\n"))
+		}
+
+		key, err := aws_bundle.ParseUserKey(pemBytes, passphrase)
+		if err != nil {
+			log.Fatalf("Unable to parse user key %q: %v", config.userKey, err)
+		}
+
+		log.Printf("Using %d-bit user key from %q", key.N.BitLen(), config.userKey)
+		return key
+	}
+
+	if config.generateUserKey != "" {
+		key, err := aws_bundle.GenerateUserKey(config.userKeyBits)
+		if err != nil {
+			log.Fatalf("Unable to generate user key: %v", err)
+		}
+
+		// refuse to overwrite an existing key, since it may be the only way to decrypt some other bundle
+		f, err := os.OpenFile(config.generateUserKey, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+		if err != nil {
+			log.Fatalf("Unable to save user key: %v", err)
+		}
+		if _, err := f.Write(aws_bundle.MarshalUserKey(key)); err != nil {
+			f.Close()
+			log.Fatalf("Unable to save user key: %v", err)
+		}
+		if err := f.Close(); err != nil {
+			log.Fatalf("Unable to save user key: %v", err)
+		}
+
+		log.Printf("Generated %d-bit user key and saved it to %q", config.userKeyBits, config.generateUserKey)
+		return key
+	}
+
+	log.Printf("No -user-key specified; using a throwaway key, so this bundle can't be decrypted later")
+	return nil
+}
+
 type loggingSink struct {
 	sink aws_bundle.Sink
+	dest string
 }
 
 func (ls loggingSink) WriteBundleFile(filename string) (io.WriteCloser, error) {
-	log.Printf("Writing to s3://%s/%s%s", config.bucket, config.prefix, filename)
+	log.Printf("Writing %s to %s", filename, ls.dest)
 	return ls.sink.WriteBundleFile(filename)
 }
 
@@ -145,68 +334,136 @@ func sizeByReadingUntilEOF(r io.Reader) (int64, error) {
 	}
 }
 
-type compressedFile struct {
-	decompressor io.Reader
-	file         *os.File
+// compressed images can lie about their size, so suggest a way out
+func explainSizeMismatch(err error) {
+	var mismatch *aws_bundle.SizeMismatchError
+	if errors.As(err, &mismatch) {
+		log.Printf("The image is not the expected size; if it's compressed, check that -image-size is big enough, or leave it out to have the image counted first")
+	}
 }
 
-func (cf *compressedFile) Read(p []byte) (n int, err error) {
-	return cf.decompressor.Read(p)
+// byteSize is a flag.Value accepting sizes like `truncate -s` does: a number
+// of bytes, optionally suffixed by K, M, G, T, P, or E, which are powers of
+// 1024 alone or followed by "iB", and powers of 1000 followed by "B" or "D"
+type byteSize int64
+
+func (bs *byteSize) String() string {
+	return strconv.FormatInt(int64(*bs), 10)
 }
 
-func (cf *compressedFile) Close() error {
-	return cf.file.Close()
+func (bs *byteSize) Set(value string) error {
+	digits := strings.TrimRightFunc(value, func(r rune) bool { return r < '0' || r > '9' })
+	suffix := value[len(digits):]
+
+	n, err := strconv.ParseInt(digits, 10, 64)
+	if err != nil || n < 0 || digits[0] == '+' || digits[0] == '-' {
+		return fmt.Errorf("invalid size %q", value)
+	}
+
+	if suffix != "" {
+		// `truncate` accepts lowercase k, m, g, and t, but not p or e
+		power := strings.IndexByte("KMGTPE", suffix[0]) + 1
+		if power == 0 {
+			power = strings.IndexByte("kmgt", suffix[0]) + 1
+		}
+
+		var base int64
+		switch suffix[1:] {
+		case "", "iB":
+			base = 1024
+		case "B", "D":
+			base = 1000
+		}
+		if power == 0 || base == 0 {
+			return fmt.Errorf("invalid size %q, expected a suffix like K, KiB, or KB", value)
+		}
+
+		for ; power > 0; power-- {
+			if n > math.MaxInt64/base {
+				return fmt.Errorf("invalid size %q", value)
+			}
+			n *= base
+		}
+	}
+
+	*bs = byteSize(n)
+	return nil
 }
 
-// open the file, potentially decompressing it
+// open the file or URL, potentially decompressing it. The size is -1 if the
+// image is compressed, the format doesn't say how big it is, and both
+// -image-size and -pad-short-image are given; in that case, the image is
+// padded to -image-size instead.
 func open(filename string) (io.ReadCloser, int64, error) {
+	// build an image from a directory tree
+	if !isRemote(filename) {
+		if fi, err := os.Stat(filename); err == nil && fi.IsDir() {
+			return openDirectory(filename)
+		}
+	}
+
 	// open
-	f, err := os.Open(filename)
+	f, fileSize, err := openImageFile(filename)
 	if err != nil {
 		return nil, 0, err
 	}
 
-	if strings.HasSuffix(filename, ".bz2") {
-		// determine size
-		size, err := sizeByReadingUntilEOF(bzip2.NewReader(f))
-		if err != nil {
-			f.Close()
-			return nil, 0, err
-		}
+	// sniff the first few bytes to see if it's compressed, or a tarball
+	header := make([]byte, tarHeaderLength)
+	n, err := f.ReadAt(header, 0)
+	if err != nil && err != io.EOF {
+		f.Close()
+		return nil, 0, err
+	}
 
-		// rewind
-		if _, err := f.Seek(0, os.SEEK_SET); err != nil {
-			f.Close()
-			return nil, 0, err
-		}
+	if c := detectCompression(header[:n]); c != nil {
+		log.Printf("Image is %s-compressed", c.name)
 
-		// return
-		return &compressedFile{
-			decompressor: bzip2.NewReader(f),
-			file:         f,
-		}, size, nil
-
-	} else if strings.HasSuffix(filename, ".gz") {
-		// determine size
-		r, err := gzip.NewReader(f)
-		if err != nil {
-			return nil, 0, err
-		}
-		size, err := sizeByReadingUntilEOF(r)
-		if err != nil {
+		// container image archives are read in place, which compression prevents
+		if tarball, err := isCompressedTar(c, f); err != nil || tarball {
 			f.Close()
+			if err == nil {
+				err = fmt.Errorf("it's a %s-compressed tarball; to bundle a container image archive, decompress it first", c.name)
+			}
 			return nil, 0, err
 		}
 
-		// rewind
-		if _, err := f.Seek(0, os.SEEK_SET); err != nil {
-			f.Close()
-			return nil, 0, err
+		// determine size, by the cheapest trustworthy means available
+		size := int64(-1)
+		if c.size != nil {
+			if size, err = c.size(f, fileSize, int64(config.imageSize)); err != nil {
+				log.Printf("Unable to determine uncompressed size from %s metadata: %v", c.name, err)
+				size = -1
+			} else {
+				log.Printf("Image is %d bytes uncompressed, according to %s metadata", size, c.name)
+			}
+		}
+		if size < 0 && config.imageSize > 0 && config.padShortImage {
+			// the caller will pad it to -image-size
+			log.Printf("Using -image-size and -pad-short-image instead of determining the uncompressed size")
+		} else if size < 0 {
+			// decompress it all, then rewind
+			r, err := c.open(f)
+			if err != nil {
+				f.Close()
+				return nil, 0, err
+			}
+			size, err = sizeByReadingUntilEOF(r)
+			r.Close()
+			if err != nil {
+				f.Close()
+				return nil, 0, err
+			}
+			if _, err := f.Seek(0, io.SeekStart); err != nil {
+				f.Close()
+				return nil, 0, err
+			}
 		}
 
-		// open again
-		r, err = gzip.NewReader(f)
+		// open for real
+		r, err := c.open(f)
 		if err != nil {
+			f.Close()
 			return nil, 0, err
 		}
 
@@ -217,32 +474,81 @@ func open(filename string) (io.ReadCloser, int64, error) {
 		}, size, nil
 
 	} else {
-		// stat to determine size
-		fi, err := f.Stat()
-		if err != nil {
+		size := fileSize
+
+		// lay out container images as filesystems
+		if isTar(header[:n]) {
+			return openContainerArchive(f, size)
+		}
+
+		// convert virtual disk formats to raw on the fly
+		img, err := disk_image.Open(f, size)
+		if err == nil {
+			log.Printf("Image is a %s virtual disk of %d bytes", img.Format(), img.VirtualSize())
+			return &diskImageFile{img, f}, img.VirtualSize(), nil
+		} else if errors.Is(err, errNoRanges) {
+			log.Printf("Unable to check for virtual disk formats: %v; assuming it's a raw image", err)
+		} else if err != disk_image.ErrUnknownFormat {
 			f.Close()
 			return nil, 0, err
 		}
-		size := fi.Size()
+
+		// skip reading holes, if we can
+		if lf, ok := f.(*os.File); ok {
+			if sf := openSparse(lf, size); sf != nil {
+				return sf, size, nil
+			}
+		}
 
 		// return
 		return f, size, nil
 	}
 }
 
+// diskImageFile reads a virtual disk as a raw image.
+type diskImageFile struct {
+	disk_image.Image
+	file io.Closer
+}
+
+func (df *diskImageFile) Close() error {
+	return df.file.Close()
+}
+
+// freeBlocksImage reads an image with its free blocks zeroed.
+type freeBlocksImage struct {
+	*disk_inspect.FreeBlocks
+	file io.Closer
+}
+
+func (fi *freeBlocksImage) Close() error {
+	return fi.file.Close()
+}
+
 func main() {
+	// subcommands
+	if len(os.Args) > 1 && os.Args[1] == "certs" {
+		certsMain(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "upload" {
+		uploadMain(os.Args[2:])
+		return
+	}
+
 	flag.Parse()
 
 	// validate parameters
-	if config.image == "" || config.bucket == "" {
-		fmt.Fprintf(os.Stderr, "Error: both -image and -s3-bucket must be specified\n\n")
+	if config.image == "" || !oneDestination() {
+		fmt.Fprintf(os.Stderr, "Error: -image and one of -dest, -s3-bucket, or -broker must be specified\n\n")
 		flag.Usage()
 		os.Exit(1)
 	}
 
 	// guess config as needed
+	dest, destDescription := openDestination()
 	if config.region == "" {
-		determineRegion()
+		log.Fatal("Unable to determine the region from -dest; please specify -region")
 	}
 	if config.account == "" {
 		determineAccount()
@@ -251,33 +557,9 @@ func main() {
 		config.name = "image"
 	}
 
-	// open the image
-	image, size, err := open(config.image)
-	if err != nil {
-		log.Fatalf("Unable to open image: %v", err)
-	}
-
-	// set up the sink
-	s3Svc := s3.New(session.New(), aws.NewConfig().WithRegion(config.region))
-	sink := &loggingSink{
-		sink: aws_bundle_glue.NewS3Sink(s3Svc, config.bucket, config.prefix),
-	}
-
-	// set up the bundle writer
-	writer, err := aws_bundle.NewWriter(config.name, size, sink)
-	if err != nil {
-		log.Fatalf("Error starting bundle write: %v", err)
-	}
-
-	// copy the image to the bundle writer
-	if n, err := io.Copy(writer, image); err != nil {
-		log.Fatalf("Error after %d bytes: %v", n, err)
-	}
-
-	// close the bundle writer
-	if err := writer.Close(); err != nil {
-		log.Fatalf("Error closing bundle: %v", err)
-	}
+	// get the certificates and user key before doing anything expensive
+	certs := loadCertificates()
+	userKey := loadUserKey()
 
 	// build the metadata
 	meta := aws_bundle.Metadata{
@@ -285,6 +567,9 @@ func main() {
 		Architecture: config.architecture,
 		AWSAccountID: config.account,
 		AWSRegion:    config.region,
+		UserKey:      userKey,
+		UserKeyBits:  config.userKeyBits,
+		Certificates: certs,
 
 		Bundler: aws_bundle.Application{
 			Name:    "ec2-bundle-and-upload-image",
@@ -293,16 +578,95 @@ func main() {
 		},
 	}
 
-	// turn it into a manifest
-	if err := meta.WriteManifest(writer, sink); err != nil {
-		log.Fatalf("Error writing manifest: %v", err)
+	// make sure it's sane before bundling, since registration happens after a long upload
+	if err := meta.Validate(); err != nil {
+		log.Fatal(err)
+	}
+
+	// open the image
+	image, size, err := open(config.image)
+	if err != nil {
+		log.Fatalf("Unable to open image: %v", err)
+	}
+
+	// zero free blocks as they go by
+	var freeBlocks *disk_inspect.FreeBlocks
+	if config.zeroFree {
+		freeBlocks = disk_inspect.ZeroFreeBlocks(image)
+		image = &freeBlocksImage{freeBlocks, image}
+	}
+
+	// set up the sink
+	sink := &loggingSink{sink: dest, dest: destDescription}
+
+	// set up the bundle writer
+	var opts []aws_bundle.WriterOption
+	if config.padShortImage {
+		opts = append(opts, aws_bundle.PadShortImage())
+	}
+	if size < 0 {
+		// we don't know how big the decompressed image is, but it had better
+		// fit, and -pad-short-image is taking care of the rest
+		size = int64(config.imageSize)
+	}
+	if config.imageSize > 0 {
+		opts = append(opts, aws_bundle.GrowTo(int64(config.imageSize)))
+	}
+	if config.roundUpMiB {
+		opts = append(opts, aws_bundle.RoundUpSize(1<<20))
+	}
+
+	// bundle the image, inspecting it along the way, and write the manifest
+	// (an interrupt stops at the next write, leaving a second one to kill us)
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	go func() {
+		<-ctx.Done()
+		stop()
+	}()
+	inspector := disk_inspect.NewStream(size)
+	result, err := aws_bundle.Bundle(ctx, &teeReader{r: image, w: inspector}, size, sink, meta, opts...)
+	if err != nil {
+		explainSizeMismatch(err)
+		log.Fatalf("Error bundling image: %v", err)
+	}
+	if closer, ok := dest.(io.Closer); ok {
+		// finish the archive
+		if err := closer.Close(); err != nil {
+			log.Fatalf("Error finishing %s: %v", destDescription, err)
+		}
+	}
+	log.Printf("Bundled %d bytes into %d parts totaling %d bytes (%.1f:1) in %v",
+		result.ImageSize, len(result.Parts), result.BundledSize, result.CompressionRatio,
+		(result.BundleDuration + result.ManifestDuration).Round(time.Second))
+	log.Printf("Image SHA1 %s, user key SHA-256 %s", result.ImageDigest, result.UserKeyFingerprint)
+	if freeBlocks != nil {
+		log.Printf("Zeroed %d bytes of free filesystem blocks", freeBlocks.Zeroed())
+	}
+	report, err := inspector.Report()
+	if err != nil {
+		log.Fatalf("Error inspecting image: %v", err)
+	}
+	log.Printf("Image contents: %v", report)
+	for _, warning := range inspectionWarnings(report, config.architecture) {
+		log.Printf("Warning: %s", warning)
 	}
 
 	// done!
-	manifestLocation := fmt.Sprintf("%s/%s%s.manifest.xml", config.bucket, config.prefix, config.name)
+	manifestLocation, inS3 := dest.Location(result.ManifestFilename)
+	if !inS3 {
+		if manifestLocation == "" {
+			manifestLocation = result.ManifestFilename
+		}
+		log.Printf("Bundle creation complete, but it isn't known to be in S3.")
+		log.Printf("Once its files are in S3 with the %q ACL, register the manifest's bucket/key.", aws_bundle_glue.BundleACL)
+		log.Printf("Printing manifest location to standard output and terminating\n")
+		fmt.Printf("%s\n", manifestLocation)
+		return
+	}
 	log.Printf("Bundle creation/upload complete.")
 	log.Printf("Register your new AMI using e.g.:")
-	log.Printf("  `aws ec2 register-image --name %q --virtualization-type=hvm --block-device-mappings \"VirtualName=ami,DeviceName=sda VirtualName=ephemeral0,DeviceName=sdb\" --root-device=/dev/xvda --image-location %s`", path.Base(config.image), manifestLocation)
+	log.Printf("  `%s`", registerImageCommand(report, imageBaseName(config.image), config.architecture, manifestLocation))
 	log.Printf("Printing image location to standard output and terminating\n")
 	fmt.Printf("%s\n", manifestLocation)
 }
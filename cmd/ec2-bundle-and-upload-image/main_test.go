@@ -0,0 +1,36 @@
+package main
+
+import "testing"
+
+func TestByteSize(t *testing.T) {
+	for _, tt := range []struct {
+		value    string
+		expected int64
+	}{
+		{"0", 0},
+		{"512", 512},
+		{"20K", 20 << 10},
+		{"20k", 20 << 10},
+		{"20KiB", 20 << 10},
+		{"20KB", 20000},
+		{"20G", 20 << 30},
+		{"20GiB", 20 << 30},
+		{"20GB", 20000000000},
+		{"20GD", 20000000000},
+		{"7E", 7 << 60},
+	} {
+		var bs byteSize
+		if err := bs.Set(tt.value); err != nil {
+			t.Errorf("Set(%q) error = %v", tt.value, err)
+		} else if int64(bs) != tt.expected {
+			t.Errorf("Set(%q) = %d, expected %d", tt.value, bs, tt.expected)
+		}
+	}
+
+	for _, invalid := range []string{"", "G", "20I", "20B", "20iB", "20g B", "20GIB", "20Gb", "20p", "20X", "-20G", "+20G", "8E", "20 G"} {
+		var bs byteSize
+		if err := bs.Set(invalid); err == nil {
+			t.Errorf("Set(%q) = %d, expected an error", invalid, bs)
+		}
+	}
+}
@@ -0,0 +1,360 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/willglynn/go_ami_tools/aws_bundle_glue"
+)
+
+// imageFile is an image being read, whether it's local or remote.
+type imageFile interface {
+	io.Reader
+	io.ReaderAt
+	io.Seeker
+	io.Closer
+}
+
+// a dropped connection is retried this many times without making progress
+// before giving up
+const maxResumeAttempts = 5
+
+// how long to wait before each retry, multiplied by the attempt number
+var resumeDelay = time.Second
+
+// how long a read from a remote image waits for data before treating the
+// connection as dropped, since one which silently stops would otherwise
+// block it forever
+var readIdleTimeout = time.Minute
+
+// imageClient downloads images over HTTP(S). A download takes as long as it
+// takes, but connecting and waiting for a response don't.
+var imageClient = &http.Client{
+	Transport: &http.Transport{
+		Proxy:                 http.ProxyFromEnvironment,
+		DialContext:           (&net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second}).DialContext,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ResponseHeaderTimeout: time.Minute,
+		IdleConnTimeout:       90 * time.Second,
+	},
+}
+
+// errNoRanges is returned when reading a remote image anywhere but the start
+// requires range requests, and the server doesn't support them.
+var errNoRanges = errors.New("the server doesn't support range requests")
+
+// isRemote() indicates if an -image names something other than a local file.
+func isRemote(image string) bool {
+	return strings.HasPrefix(image, "https://") || strings.HasPrefix(image, "http://") || strings.HasPrefix(image, "s3://")
+}
+
+// imageBaseName() returns the last part of an -image's path, without any query
+// string.
+func imageBaseName(image string) string {
+	if isRemote(image) {
+		if u, err := url.Parse(image); err == nil && u.Path != "" {
+			return path.Base(u.Path)
+		}
+	}
+	return path.Base(image)
+}
+
+// openImageFile() opens a local file or block device, an HTTP(S) URL, or an
+// s3://bucket/key object, returning it along with its size.
+func openImageFile(image string) (imageFile, int64, error) {
+	switch {
+	case strings.HasPrefix(image, "s3://"):
+		u, err := url.Parse(image)
+		if err != nil || u.Host == "" || len(u.Path) < 2 {
+			return nil, 0, fmt.Errorf("invalid S3 location %q, expected s3://bucket/key", image)
+		}
+		region, err := aws_bundle_glue.BucketRegion(u.Host)
+		if err != nil {
+			return nil, 0, fmt.Errorf("unable to s3:GetBucketLocation for %q: %v", u.Host, err)
+		}
+		s3Svc := s3.New(session.New(), aws.NewConfig().WithRegion(region))
+		return openS3(s3Svc, u.Host, u.Path[1:])
+
+	case isRemote(image):
+		return openHTTP(imageClient, image)
+
+	default:
+		f, err := os.Open(image)
+		if err != nil {
+			return nil, 0, err
+		}
+		fi, err := f.Stat()
+		if err != nil {
+			f.Close()
+			return nil, 0, err
+		}
+		if fi.Mode()&os.ModeDevice != 0 && fi.Mode()&os.ModeCharDevice == 0 {
+			// Stat() says block devices are empty
+			bd, size, err := openBlockDevice(f, config.forceMounted)
+			if err != nil {
+				f.Close()
+			}
+			return bd, size, err
+		}
+		return f, fi.Size(), nil
+	}
+}
+
+// remoteFile reads an object over the network. Read() streams it in order,
+// picking up where it left off if the connection drops, while ReadAt() and
+// Seek() make a new request for each call which moves elsewhere.
+type remoteFile struct {
+	name string
+	size int64
+
+	// get() returns length bytes of the object starting at offset, or the rest
+	// of it if length is -1
+	get func(offset, length int64) (io.ReadCloser, error)
+
+	body io.ReadCloser // the response being read by Read(), if any
+	pos  int64
+}
+
+func (rf *remoteFile) Read(p []byte) (n int, err error) {
+	if rf.pos >= rf.size {
+		return 0, io.EOF
+	}
+	if int64(len(p)) > rf.size-rf.pos {
+		p = p[:rf.size-rf.pos]
+	}
+
+	for attempt := 0; ; attempt++ {
+		if rf.body == nil {
+			rf.body, err = rf.get(rf.pos, -1)
+		}
+		if err == nil {
+			n, err = rf.body.Read(p)
+			rf.pos += int64(n)
+			if n > 0 || err == nil {
+				return n, nil
+			}
+			if err == io.EOF {
+				// the object is bigger than that
+				err = io.ErrUnexpectedEOF
+			}
+			rf.body.Close()
+			rf.body = nil
+		}
+
+		if err == errNoRanges || attempt >= maxResumeAttempts {
+			return 0, fmt.Errorf("reading %s at byte %d: %w", rf.name, rf.pos, err)
+		}
+		log.Printf("Error reading %s at byte %d, resuming: %v", rf.name, rf.pos, err)
+		time.Sleep(time.Duration(attempt+1) * resumeDelay)
+	}
+}
+
+func (rf *remoteFile) ReadAt(p []byte, off int64) (n int, err error) {
+	if off < 0 {
+		return 0, errors.New("negative offset")
+	}
+	if off >= rf.size {
+		return 0, io.EOF
+	}
+	want := p
+	if int64(len(want)) > rf.size-off {
+		want = want[:rf.size-off]
+	}
+
+	for attempt := 0; ; attempt++ {
+		var body io.ReadCloser
+		if body, err = rf.get(off, int64(len(want))); err == nil {
+			n, err = io.ReadFull(body, want)
+			body.Close()
+			if err == nil {
+				break
+			}
+		}
+
+		if err == errNoRanges || attempt >= maxResumeAttempts {
+			return 0, fmt.Errorf("reading %d bytes of %s at byte %d: %w", len(want), rf.name, off, err)
+		}
+		log.Printf("Error reading %s at byte %d, retrying: %v", rf.name, off, err)
+		time.Sleep(time.Duration(attempt+1) * resumeDelay)
+	}
+
+	if len(want) < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (rf *remoteFile) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekCurrent:
+		offset += rf.pos
+	case io.SeekEnd:
+		offset += rf.size
+	}
+	if offset < 0 {
+		return 0, errors.New("negative offset")
+	}
+
+	if offset != rf.pos && rf.body != nil {
+		rf.body.Close()
+		rf.body = nil
+	}
+	rf.pos = offset
+	return offset, nil
+}
+
+func (rf *remoteFile) Close() error {
+	if rf.body != nil {
+		rf.body.Close()
+		rf.body = nil
+	}
+	return nil
+}
+
+// idleBody is a response body whose reads fail after readIdleTimeout without
+// any data, by closing it.
+type idleBody struct {
+	io.ReadCloser
+}
+
+func (ib idleBody) Read(p []byte) (int, error) {
+	timer := time.AfterFunc(readIdleTimeout, func() { ib.ReadCloser.Close() })
+	n, err := ib.ReadCloser.Read(p)
+	if !timer.Stop() {
+		err = fmt.Errorf("no data for %v", readIdleTimeout)
+	}
+	return n, err
+}
+
+// httpRange() returns a Range header value.
+func httpRange(offset, length int64) string {
+	if length < 0 {
+		return fmt.Sprintf("bytes=%d-", offset)
+	}
+	return fmt.Sprintf("bytes=%d-%d", offset, offset+length-1)
+}
+
+// openHTTP() starts downloading an image over HTTP(S), learning its size from
+// the Content-Length. Later requests use Range and If-Range, so that if the
+// image changes partway through, the read fails rather than mixing versions.
+func openHTTP(client *http.Client, url string) (imageFile, int64, error) {
+	// GET rather than HEAD, since presigned URLs are only good for one method
+	resp, err := client.Get(url)
+	if err != nil {
+		return nil, 0, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, 0, fmt.Errorf("GET %s: %s", imageBaseName(url), resp.Status)
+	}
+	if resp.ContentLength < 0 {
+		resp.Body.Close()
+		return nil, 0, fmt.Errorf("GET %s: the server didn't send a Content-Length", imageBaseName(url))
+	}
+
+	validator := resp.Header.Get("ETag")
+	if validator == "" || strings.HasPrefix(validator, "W/") {
+		validator = resp.Header.Get("Last-Modified")
+	}
+	ranges := resp.Header.Get("Accept-Ranges") == "bytes"
+
+	rf := &remoteFile{
+		name: imageBaseName(url),
+		size: resp.ContentLength,
+		body: idleBody{resp.Body},
+	}
+	rf.get = func(offset, length int64) (io.ReadCloser, error) {
+		req, err := http.NewRequest("GET", url, nil)
+		if err != nil {
+			return nil, err
+		}
+		if offset > 0 || length >= 0 {
+			if !ranges || validator == "" {
+				if offset > 0 {
+					return nil, errNoRanges
+				}
+			} else {
+				req.Header.Set("Range", httpRange(offset, length))
+				req.Header.Set("If-Range", validator)
+			}
+		}
+
+		resp, err := client.Do(req)
+		if err != nil {
+			return nil, err
+		}
+		switch {
+		case resp.StatusCode == http.StatusPartialContent:
+			return idleBody{resp.Body}, nil
+		case resp.StatusCode == http.StatusOK && offset == 0:
+			// the whole thing, which is fine if it's the same size
+			if resp.ContentLength != rf.size {
+				resp.Body.Close()
+				return nil, fmt.Errorf("%s changed size from %d to %d bytes while reading it", rf.name, rf.size, resp.ContentLength)
+			}
+			return idleBody{resp.Body}, nil
+		case resp.StatusCode == http.StatusOK:
+			// If-Range didn't match
+			resp.Body.Close()
+			return nil, fmt.Errorf("%s changed while reading it", rf.name)
+		default:
+			resp.Body.Close()
+			return nil, fmt.Errorf("GET %s: %s", rf.name, resp.Status)
+		}
+	}
+	return rf, rf.size, nil
+}
+
+// s3ObjectAPI is the part of the S3 API needed to read objects.
+type s3ObjectAPI interface {
+	HeadObject(*s3.HeadObjectInput) (*s3.HeadObjectOutput, error)
+	GetObject(*s3.GetObjectInput) (*s3.GetObjectOutput, error)
+}
+
+// openS3() opens an image stored in S3, learning its size from HeadObject.
+// Every request is conditional on the ETag, so that if the object is replaced
+// partway through, the read fails rather than mixing versions.
+//
+// requires s3:GetObject
+func openS3(s3Svc s3ObjectAPI, bucket, key string) (imageFile, int64, error) {
+	head, err := s3Svc.HeadObject(&s3.HeadObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+
+	rf := &remoteFile{
+		name: "s3://" + bucket + "/" + key,
+		size: aws.Int64Value(head.ContentLength),
+	}
+	rf.get = func(offset, length int64) (io.ReadCloser, error) {
+		input := &s3.GetObjectInput{
+			Bucket:  aws.String(bucket),
+			Key:     aws.String(key),
+			IfMatch: head.ETag,
+		}
+		if offset > 0 || length >= 0 {
+			input.Range = aws.String(httpRange(offset, length))
+		}
+		output, err := s3Svc.GetObject(input)
+		if err != nil {
+			return nil, err
+		}
+		return output.Body, nil
+	}
+	return rf, rf.size, nil
+}
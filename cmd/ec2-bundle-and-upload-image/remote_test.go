@@ -0,0 +1,284 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+func init() {
+	resumeDelay = 0
+}
+
+// droppingWriter drops the connection after writing limit bytes, or if stall
+// is set, stops sending until stall is closed.
+type droppingWriter struct {
+	http.ResponseWriter
+	limit int
+	stall <-chan struct{}
+}
+
+func (dw *droppingWriter) Write(p []byte) (int, error) {
+	if len(p) > dw.limit {
+		dw.ResponseWriter.Write(p[:dw.limit])
+		if dw.stall != nil {
+			dw.ResponseWriter.(http.Flusher).Flush()
+			<-dw.stall
+		}
+		panic(http.ErrAbortHandler)
+	}
+	dw.limit -= len(p)
+	return dw.ResponseWriter.Write(p)
+}
+
+// testServer serves content, supporting range requests if etag is set, and
+// dropping each response after dropAfter bytes if it's positive, or stalling
+// it until the client gives up if stall is set.
+type testServer struct {
+	sync.Mutex
+	content   []byte
+	etag      string
+	dropAfter int
+	stall     bool
+	requests  []string
+}
+
+func (ts *testServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	ts.Lock()
+	ts.requests = append(ts.requests, r.Header.Get("Range"))
+	content, etag, dropAfter, stall := ts.content, ts.etag, ts.dropAfter, ts.stall
+	ts.Unlock()
+
+	if dropAfter > 0 {
+		dw := &droppingWriter{ResponseWriter: w, limit: dropAfter}
+		if stall {
+			dw.stall = r.Context().Done()
+		}
+		w = dw
+	}
+	if etag == "" {
+		w.Header().Set("Content-Length", fmt.Sprint(len(content)))
+		w.Write(content)
+		return
+	}
+	w.Header().Set("ETag", etag)
+	http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(content))
+}
+
+// set() changes what's served.
+func (ts *testServer) set(content []byte, etag string, dropAfter int) {
+	ts.Lock()
+	defer ts.Unlock()
+	ts.content, ts.etag, ts.dropAfter = content, etag, dropAfter
+}
+
+func TestOpenHTTP(t *testing.T) {
+	image := compressibleImage(1 << 20)
+	ts := &testServer{content: compressTestImage(t, "xz", image), etag: `"v1"`, dropAfter: 100 << 10}
+	server := httptest.NewServer(ts)
+	defer server.Close()
+
+	// xz metadata comes from range requests, then the image is streamed and
+	// resumed whenever the connection drops
+	r, size, err := open(server.URL + "/images/image.raw.xz?X-Amz-Signature=abc")
+	if err != nil {
+		t.Fatalf("open() error = %v", err)
+	}
+	actual, err := ioutil.ReadAll(r)
+	r.Close()
+	if err != nil {
+		t.Fatalf("ReadAll() error = %v", err)
+	}
+	if size != int64(len(image)) || !bytes.Equal(actual, image) {
+		t.Errorf("open() = %d bytes, read %d, expected %d", size, len(actual), len(image))
+	}
+
+	resumed := 0
+	for _, r := range ts.requests {
+		if strings.HasSuffix(r, "-") {
+			resumed++
+		}
+	}
+	if expected := len(ts.content) / ts.dropAfter; resumed != expected {
+		t.Errorf("resumed %d times, expected %d (requests: %q)", resumed, expected, ts.requests)
+	}
+}
+
+func TestOpenHTTPStalled(t *testing.T) {
+	defer func(timeout time.Duration) { readIdleTimeout = timeout }(readIdleTimeout)
+	readIdleTimeout = 50 * time.Millisecond
+
+	// a connection which stops sending without dropping is resumed too
+	image := compressibleImage(1 << 20)
+	ts := &testServer{content: compressTestImage(t, "xz", image), etag: `"v1"`, dropAfter: 100 << 10, stall: true}
+	server := httptest.NewServer(ts)
+	defer server.Close()
+
+	r, _, err := open(server.URL + "/image.raw.xz")
+	if err != nil {
+		t.Fatalf("open() error = %v", err)
+	}
+	actual, err := ioutil.ReadAll(r)
+	r.Close()
+	if err != nil || !bytes.Equal(actual, image) {
+		t.Errorf("ReadAll() = %d bytes, %v, expected %d", len(actual), err, len(image))
+	}
+	resumed := 0
+	for _, r := range ts.requests {
+		if strings.HasSuffix(r, "-") {
+			resumed++
+		}
+	}
+	if expected := len(ts.content) / ts.dropAfter; resumed != expected {
+		t.Errorf("resumed %d times, expected %d (requests: %q)", resumed, expected, ts.requests)
+	}
+}
+
+func TestOpenHTTPWithoutRanges(t *testing.T) {
+	image := compressibleImage(1 << 20)
+	ts := &testServer{content: image}
+	server := httptest.NewServer(ts)
+	defer server.Close()
+
+	// a plain image can be streamed as long as the connection holds up
+	r, size, err := open(server.URL + "/image.raw")
+	if err != nil {
+		t.Fatalf("open() error = %v", err)
+	}
+	actual, err := ioutil.ReadAll(r)
+	r.Close()
+	if err != nil || size != int64(len(image)) || !bytes.Equal(actual, image) {
+		t.Errorf("open() = %d bytes, read %d, error = %v", size, len(actual), err)
+	}
+
+	// but it can't be resumed if it doesn't
+	ts.set(image, "", 100<<10)
+	r, _, err = open(server.URL + "/image.raw")
+	if err != nil {
+		t.Fatalf("open() error = %v", err)
+	}
+	_, err = ioutil.ReadAll(r)
+	r.Close()
+	if err == nil || !strings.Contains(err.Error(), errNoRanges.Error()) {
+		t.Errorf("ReadAll() error = %v, expected %v", err, errNoRanges)
+	}
+}
+
+func TestOpenHTTPChanged(t *testing.T) {
+	ts := &testServer{content: compressibleImage(1 << 20), etag: `"v1"`, dropAfter: 100 << 10}
+	server := httptest.NewServer(ts)
+	defer server.Close()
+
+	r, _, err := open(server.URL + "/image.raw")
+	if err != nil {
+		t.Fatalf("open() error = %v", err)
+	}
+	ts.set(compressibleImage(1<<20+1), `"v2"`, 100<<10)
+	_, err = ioutil.ReadAll(r)
+	r.Close()
+	if err == nil || !strings.Contains(err.Error(), "changed") {
+		t.Errorf("ReadAll() error = %v, expected it to notice the change", err)
+	}
+}
+
+func TestOpenHTTPNotFound(t *testing.T) {
+	server := httptest.NewServer(http.NotFoundHandler())
+	defer server.Close()
+
+	if _, _, err := open(server.URL + "/image.raw"); err == nil || !strings.Contains(err.Error(), "404") {
+		t.Errorf("open() error = %v, expected a 404", err)
+	}
+}
+
+// fakeS3 serves one object, failing every other GetObject.
+type fakeS3 struct {
+	content []byte
+	etag    string
+	gets    int
+}
+
+func (fs *fakeS3) HeadObject(input *s3.HeadObjectInput) (*s3.HeadObjectOutput, error) {
+	return &s3.HeadObjectOutput{
+		ContentLength: aws.Int64(int64(len(fs.content))),
+		ETag:          aws.String(fs.etag),
+	}, nil
+}
+
+func (fs *fakeS3) GetObject(input *s3.GetObjectInput) (*s3.GetObjectOutput, error) {
+	fs.gets++
+	if fs.gets%2 == 0 {
+		return nil, fmt.Errorf("connection reset by peer")
+	}
+	if aws.StringValue(input.IfMatch) != fs.etag {
+		return nil, fmt.Errorf("PreconditionFailed")
+	}
+
+	var start, end int64 = 0, int64(len(fs.content)) - 1
+	if input.Range != nil {
+		if _, err := fmt.Sscanf(*input.Range, "bytes=%d-%d", &start, &end); err != nil && err != io.EOF {
+			return nil, fmt.Errorf("invalid range %q: %v", *input.Range, err)
+		}
+	}
+	body := fs.content[start : end+1]
+	return &s3.GetObjectOutput{
+		Body:          ioutil.NopCloser(bytes.NewReader(body)),
+		ContentLength: aws.Int64(int64(len(body))),
+	}, nil
+}
+
+func TestOpenS3(t *testing.T) {
+	fs := &fakeS3{content: compressibleImage(1 << 20), etag: `"abc"`}
+	f, size, err := openS3(fs, "bucket", "images/image.raw")
+	if err != nil {
+		t.Fatalf("openS3() error = %v", err)
+	}
+	if size != int64(len(fs.content)) {
+		t.Errorf("openS3() size = %d, expected %d", size, len(fs.content))
+	}
+
+	// random access
+	buf := make([]byte, 100)
+	if n, err := f.ReadAt(buf, size-50); n != 50 || err != io.EOF || !bytes.Equal(buf[:50], fs.content[size-50:]) {
+		t.Errorf("ReadAt() = %d, %v", n, err)
+	}
+
+	// sequential access, after seeking
+	if _, err := f.Seek(1000, io.SeekStart); err != nil {
+		t.Fatalf("Seek() error = %v", err)
+	}
+	actual, err := ioutil.ReadAll(f)
+	if err != nil || !bytes.Equal(actual, fs.content[1000:]) {
+		t.Errorf("ReadAll() read %d bytes, error = %v", len(actual), err)
+	}
+	f.Close()
+
+	// replacing the object breaks it
+	fs.etag = `"def"`
+	f.Seek(0, io.SeekStart)
+	if _, err := ioutil.ReadAll(f); err == nil {
+		t.Errorf("ReadAll() of a replaced object succeeded")
+	}
+}
+
+func TestImageBaseName(t *testing.T) {
+	for image, expected := range map[string]string{
+		"disk.raw":               "disk.raw",
+		"/tmp/images/disk.qcow2": "disk.qcow2",
+		"https://example.com/a/disk.raw.xz?sig=abc": "disk.raw.xz",
+		"s3://bucket/images/disk.vmdk":              "disk.vmdk",
+	} {
+		if actual := imageBaseName(image); actual != expected {
+			t.Errorf("imageBaseName(%q) = %q, expected %q", image, actual, expected)
+		}
+	}
+}
@@ -0,0 +1,150 @@
+//go:build linux
+
+package main
+
+import (
+	"errors"
+	"io"
+	"os"
+	"syscall"
+)
+
+// lseek() whence values for walking sparse files, which package os passes
+// through unmolested
+const (
+	seekData = 3 // SEEK_DATA
+	seekHole = 4 // SEEK_HOLE
+)
+
+// sparseFile reads a file, synthesizing zeros for holes rather than reading
+// them from disk. Filesystems which don't track holes report the whole file as
+// data, so this is never worse than reading the file directly.
+type sparseFile struct {
+	file *os.File
+	size int64 // the file size when opened; anything beyond is ignored
+	pos  int64
+
+	holeEnd int64 // [pos, holeEnd) is a hole
+	dataEnd int64 // [holeEnd, dataEnd) is data
+}
+
+// openSparse() wraps f, which is size bytes long, returning nil if f doesn't
+// support SEEK_DATA.
+func openSparse(f *os.File, size int64) io.ReadCloser {
+	sf := &sparseFile{file: f, size: size}
+	if err := sf.nextRegion(); err != nil {
+		return nil
+	}
+	return sf
+}
+
+// nextRegion() finds the hole and data region starting at pos.
+func (sf *sparseFile) nextRegion() error {
+	data, err := sf.file.Seek(sf.pos, seekData)
+	if errors.Is(err, syscall.ENXIO) || (err == nil && data >= sf.size) {
+		// nothing but hole from here to the end
+		sf.holeEnd, sf.dataEnd = sf.size, sf.size
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	hole, err := sf.file.Seek(data, seekHole)
+	if err != nil {
+		return err
+	}
+	if hole > sf.size {
+		hole = sf.size
+	}
+
+	sf.holeEnd, sf.dataEnd = data, hole
+	return nil
+}
+
+func (sf *sparseFile) Read(p []byte) (n int, err error) {
+	if sf.pos >= sf.size {
+		return 0, io.EOF
+	}
+	if sf.pos >= sf.dataEnd {
+		if err := sf.nextRegion(); err != nil {
+			return 0, err
+		}
+	}
+
+	if sf.pos < sf.holeEnd {
+		// we're in a hole
+		if remaining := sf.holeEnd - sf.pos; int64(len(p)) > remaining {
+			p = p[:remaining]
+		}
+		for i := range p {
+			p[i] = 0
+		}
+		sf.pos += int64(len(p))
+		return len(p), nil
+	}
+
+	// we're in data
+	if remaining := sf.dataEnd - sf.pos; int64(len(p)) > remaining {
+		p = p[:remaining]
+	}
+	n, err = sf.file.ReadAt(p, sf.pos)
+	sf.pos += int64(n)
+	if err == io.EOF && n > 0 {
+		// the file shrank, which we'll notice on the next Read()
+		err = nil
+	}
+	return n, err
+}
+
+// WriteTo() copies the file to w, writing holes from a shared buffer of
+// zeros instead of clearing and re-clearing a read buffer. io.Copy() uses
+// this automatically.
+func (sf *sparseFile) WriteTo(w io.Writer) (n int64, err error) {
+	buf := make([]byte, 1<<20)
+	for sf.pos < sf.size {
+		if sf.pos >= sf.dataEnd {
+			if err := sf.nextRegion(); err != nil {
+				return n, err
+			}
+		}
+
+		if sf.pos < sf.holeEnd {
+			for sf.pos < sf.holeEnd {
+				chunk := sparseZeros
+				if remaining := sf.holeEnd - sf.pos; int64(len(chunk)) > remaining {
+					chunk = chunk[:remaining]
+				}
+				written, err := w.Write(chunk)
+				n += int64(written)
+				sf.pos += int64(written)
+				if err != nil {
+					return n, err
+				}
+			}
+			continue
+		}
+
+		read, err := sf.Read(buf)
+		if read > 0 {
+			written, werr := w.Write(buf[:read])
+			n += int64(written)
+			if werr != nil {
+				return n, werr
+			}
+		}
+		if err == io.EOF {
+			// the file shrank out from under us, which the Writer will notice
+			break
+		} else if err != nil {
+			return n, err
+		}
+	}
+	return n, nil
+}
+
+func (sf *sparseFile) Close() error {
+	return sf.file.Close()
+}
+
+// never written, only read
+var sparseZeros = make([]byte, 1<<20)
@@ -0,0 +1,92 @@
+//go:build linux
+
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// writeSparseFile() makes a file of size bytes containing random data at each
+// of the given offsets, and holes everywhere else (if the filesystem allows).
+func writeSparseFile(t *testing.T, size int64, offsets ...int64) (*os.File, []byte) {
+	f, err := os.Create(filepath.Join(t.TempDir(), "sparse.img"))
+	if err != nil {
+		t.Fatalf("os.Create() error = %v", err)
+	}
+	t.Cleanup(func() { f.Close() })
+
+	if err := f.Truncate(size); err != nil {
+		t.Fatalf("Truncate() error = %v", err)
+	}
+	expected := make([]byte, size)
+	for _, offset := range offsets {
+		data := make([]byte, 5000)
+		rand.Read(data)
+		if _, err := f.WriteAt(data, offset); err != nil {
+			t.Fatalf("WriteAt() error = %v", err)
+		}
+		copy(expected[offset:], data)
+	}
+	return f, expected
+}
+
+func TestSparseFile(t *testing.T) {
+	tests := []struct {
+		name    string
+		size    int64
+		offsets []int64
+	}{
+		{"empty", 0, nil},
+		{"all hole", 3 << 20, nil},
+		{"leading data", 4 << 20, []int64{0}},
+		{"trailing data", 4<<20 + 5000, []int64{4 << 20}},
+		{"scattered", 16 << 20, []int64{0, 1 << 20, 5<<20 + 17, 9 << 20}},
+	}
+	for _, tt := range tests {
+		f, expected := writeSparseFile(t, tt.size, tt.offsets...)
+
+		// via io.Copy(), which uses WriteTo()
+		sf := openSparse(f, tt.size)
+		if sf == nil {
+			t.Skipf("filesystem does not support SEEK_DATA")
+		}
+		var buf bytes.Buffer
+		if n, err := io.Copy(&buf, sf); err != nil || n != tt.size {
+			t.Errorf("%s: io.Copy() = %d, %v, expected %d, nil", tt.name, n, err, tt.size)
+		} else if !bytes.Equal(buf.Bytes(), expected) {
+			t.Errorf("%s: io.Copy() produced the wrong bytes", tt.name)
+		}
+
+		// via Read(), in awkward sizes
+		sf = openSparse(f, tt.size)
+		actual, err := ioutil.ReadAll(io.LimitReader(struct{ io.Reader }{sf}, tt.size+1))
+		if err != nil {
+			t.Errorf("%s: Read() error = %v", tt.name, err)
+		} else if !bytes.Equal(actual, expected) {
+			t.Errorf("%s: Read() produced the wrong bytes", tt.name)
+		}
+	}
+}
+
+func TestSparseFileGrew(t *testing.T) {
+	f, expected := writeSparseFile(t, 2<<20, 1<<20)
+	sf := openSparse(f, 2<<20)
+	if sf == nil {
+		t.Skipf("filesystem does not support SEEK_DATA")
+	}
+
+	// anything appended after opening is ignored
+	if _, err := f.WriteAt([]byte("more"), 2<<20); err != nil {
+		t.Fatalf("WriteAt() error = %v", err)
+	}
+	actual, err := ioutil.ReadAll(sf)
+	if err != nil || !bytes.Equal(actual, expected) {
+		t.Errorf("ReadAll() = %d bytes, %v, expected %d bytes", len(actual), err, len(expected))
+	}
+}
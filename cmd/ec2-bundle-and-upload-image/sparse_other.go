@@ -0,0 +1,14 @@
+//go:build !linux
+
+package main
+
+import (
+	"io"
+	"os"
+)
+
+// openSparse() returns nil, since SEEK_DATA and SEEK_HOLE are only used on
+// Linux; images are read in their entirety elsewhere.
+func openSparse(f *os.File, size int64) io.ReadCloser {
+	return nil
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+
+	"github.com/willglynn/go_ami_tools/aws_bundle_glue"
+)
+
+// `ec2-bundle-and-upload-image upload` uploads a bundle from an archive made
+// with -dest tar://, e.g. once it's been carried out of an isolated network
+func uploadMain(args []string) {
+	fs := flag.NewFlagSet("upload", flag.ExitOnError)
+	archive := fs.String("archive", "", "tar archive written with \"-dest tar://...\", or \"-\" to read it from standard input")
+	fs.StringVar(&config.dest, "dest", "", "where to upload the bundle, as for bundling, e.g. s3://bucket/prefix/ (optionally with ?region=)")
+	fs.StringVar(&config.bucket, "s3-bucket", "", "S3 bucket to which the bundle should be uploaded (instead of -dest)")
+	fs.StringVar(&config.prefix, "s3-prefix", "", "prefix to use within the S3 bucket (optional, should probably end with \"/\" if specified)")
+	fs.StringVar(&config.broker, "broker", "", "https:// URL of a broker which presigns S3 URLs (the same as -dest with that URL)")
+	fs.StringVar(&config.region, "region", "", "region of the S3 bucket (determined automatically)")
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage:\n  %s upload -archive <bundle.tar> -s3-bucket <bucket name>\n  %s upload -archive <bundle.tar> -dest <URL>\n\nFull parameters:\n", os.Args[0], os.Args[0])
+		fs.PrintDefaults()
+		fmt.Fprintf(os.Stderr, `
+Each part is checked against the SHA1s in the bundle's manifest and the
+archive's index as it's uploaded, and the manifest is uploaded last, only if
+they all match, so that a damaged bundle can't be registered.
+
+`)
+	}
+	fs.Parse(args)
+
+	if *archive == "" || !oneDestination() {
+		fmt.Fprintf(os.Stderr, "Error: -archive and one of -dest, -s3-bucket, or -broker must be specified\n\n")
+		fs.Usage()
+		os.Exit(1)
+	}
+
+	var r io.Reader = os.Stdin
+	if *archive != "-" {
+		f, err := os.Open(*archive)
+		if err != nil {
+			log.Fatalf("Unable to open archive: %v", err)
+		}
+		defer f.Close()
+		r = f
+	}
+
+	dest, destDescription := openDestination()
+	uploaded, err := aws_bundle_glue.UploadArchive(bufio.NewReaderSize(r, 1<<20), &loggingSink{sink: dest, dest: destDescription})
+	if err != nil {
+		log.Fatalf("Error uploading bundle: %v", err)
+	}
+	if closer, ok := dest.(io.Closer); ok {
+		if err := closer.Close(); err != nil {
+			log.Fatalf("Error finishing %s: %v", destDescription, err)
+		}
+	}
+	log.Printf("Uploaded %d parts totaling %d bytes, all matching the manifest", len(uploaded.Parts), uploaded.BundledSize)
+	log.Printf("Image SHA1 %s", uploaded.ImageDigest)
+
+	manifestLocation, inS3 := dest.Location(uploaded.ManifestFilename)
+	if manifestLocation == "" {
+		manifestLocation = uploaded.ManifestFilename
+	}
+	if inS3 {
+		log.Printf("Register your new AMI as suggested when it was bundled, with:")
+		log.Printf("  `--image-location %s`", manifestLocation)
+	}
+	log.Printf("Printing manifest location to standard output and terminating\n")
+	fmt.Printf("%s\n", manifestLocation)
+}
@@ -0,0 +1,157 @@
+package disk_image
+
+import (
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Image is a virtual disk, read sequentially as if it were a raw disk image.
+type Image interface {
+	io.Reader
+
+	// Format() returns the name of the container format, e.g. "qcow2".
+	Format() string
+
+	// VirtualSize() returns the size of the raw disk image, which is exactly
+	// the number of bytes Read() will produce.
+	VirtualSize() int64
+}
+
+// ErrUnknownFormat is returned by Open() when the input is not in any
+// container format this package recognizes, which usually means it's already
+// a raw disk image.
+var ErrUnknownFormat = errors.New("unknown disk image format")
+
+// UnsupportedError indicates that the input is in a recognized format, but
+// uses a feature this package can't handle, such as a backing file.
+type UnsupportedError struct {
+	Format  string
+	Feature string
+}
+
+func (e *UnsupportedError) Error() string {
+	return fmt.Sprintf("%s images with %s are not supported", e.Format, e.Feature)
+}
+
+// CorruptError indicates that the input is not a valid image of its format.
+type CorruptError struct {
+	Format string
+	Reason string
+}
+
+func (e *CorruptError) Error() string {
+	return fmt.Sprintf("corrupt %s image: %s", e.Format, e.Reason)
+}
+
+// formats, in the order in which Open() tries them
+var formats = []struct {
+	name string
+	open func(r io.ReaderAt, size int64) (Image, error) // returns ErrUnknownFormat if it's not this format
+}{
+	{"qcow2", openQcow2},
+	{"vmdk", openVmdk},
+	{"vhdx", openVhdx},
+	{"vhd", openVhd},
+}
+
+// Open() identifies the container format of the size-byte image r, returning
+// an Image which converts it to a raw disk image on the fly. If r is not in a
+// recognized format, Open() returns ErrUnknownFormat.
+//
+// Most container formats can only be interpreted with random access, hence the
+// io.ReaderAt. The Image reads r in order as much as possible, though, and
+// reads each part of r at most once (unless it's referenced more than once).
+func Open(r io.ReaderAt, size int64) (Image, error) {
+	for _, format := range formats {
+		image, err := format.open(r, size)
+		if err != ErrUnknownFormat {
+			return image, err
+		}
+	}
+	return nil, ErrUnknownFormat
+}
+
+// clusterReader implements Image for formats which divide the virtual disk
+// into fixed-size units, each of which may be stored in its own way.
+type clusterReader struct {
+	format      string
+	virtualSize int64
+	clusterSize int64
+
+	// readCluster() fills buf with the contents of the cluster at index,
+	// where buf is clusterSize bytes long, or shorter for the last cluster
+	readCluster func(index int64, buf []byte) error
+
+	next    int64 // the index of the next cluster to read
+	buf     []byte
+	pending []byte
+	err     error
+}
+
+func newClusterReader(format string, virtualSize, clusterSize int64, readCluster func(int64, []byte) error) *clusterReader {
+	return &clusterReader{
+		format:      format,
+		virtualSize: virtualSize,
+		clusterSize: clusterSize,
+		readCluster: readCluster,
+		buf:         make([]byte, clusterSize),
+	}
+}
+
+func (cr *clusterReader) Format() string {
+	return cr.format
+}
+
+func (cr *clusterReader) VirtualSize() int64 {
+	return cr.virtualSize
+}
+
+func (cr *clusterReader) Read(p []byte) (n int, err error) {
+	for len(cr.pending) == 0 {
+		if cr.err != nil {
+			return 0, cr.err
+		}
+
+		offset := cr.next * cr.clusterSize
+		if offset >= cr.virtualSize {
+			cr.err = io.EOF
+			continue
+		}
+
+		buf := cr.buf
+		if remaining := cr.virtualSize - offset; remaining < int64(len(buf)) {
+			buf = buf[:remaining]
+		}
+		if err := cr.readCluster(cr.next, buf); err != nil {
+			cr.err = err
+			continue
+		}
+		cr.next++
+		cr.pending = buf
+	}
+
+	n = copy(p, cr.pending)
+	cr.pending = cr.pending[n:]
+	return n, nil
+}
+
+// readFull() reads exactly len(buf) bytes at offset, treating a short read as
+// corruption, since it means the image refers past its own end.
+func readFull(r io.ReaderAt, format string, buf []byte, offset int64) error {
+	n, err := r.ReadAt(buf, offset)
+	if n == len(buf) {
+		return nil
+	}
+	if err == io.EOF || err == nil {
+		return &CorruptError{format, fmt.Sprintf("%d bytes at offset %d extend past the end of the file", len(buf), offset)}
+	}
+	return err
+}
+
+// zero() clears buf.
+func zero(buf []byte) {
+	for i := range buf {
+		buf[i] = 0
+	}
+}
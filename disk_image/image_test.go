@@ -0,0 +1,103 @@
+package disk_image
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"testing"
+)
+
+// testRawImage() returns size bytes of disk, divided into unit-sized pieces
+// of random data, zeros, and compressible text, with everything in
+// [zeroFrom, zeroTo) zeroed.
+func testRawImage(size, unit, zeroFrom, zeroTo int64) []byte {
+	rng := rand.New(rand.NewSource(size))
+	raw := make([]byte, size)
+	for i := int64(0); i*unit < size; i++ {
+		piece := raw[i*unit:]
+		if int64(len(piece)) > unit {
+			piece = piece[:unit]
+		}
+		switch i % 4 {
+		case 0, 3:
+			rng.Read(piece)
+		case 1:
+			// zeros
+		case 2:
+			copy(piece, bytes.Repeat([]byte(fmt.Sprintf("piece %d ", i)), len(piece)))
+		}
+	}
+	for i := zeroFrom; i < zeroTo && i < size; i++ {
+		raw[i] = 0
+	}
+	return raw
+}
+
+// isZero() indicates if b is all zeros.
+func isZero(b []byte) bool {
+	for _, c := range b {
+		if c != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// checkImage() opens an image and checks that it reads back as raw.
+func checkImage(t *testing.T, name, format string, image, raw []byte) {
+	t.Helper()
+
+	img, err := Open(bytes.NewReader(image), int64(len(image)))
+	if err != nil {
+		t.Errorf("%s: Open() error = %v", name, err)
+		return
+	}
+	if img.Format() != format || img.VirtualSize() != int64(len(raw)) {
+		t.Errorf("%s: Open() = %s of %d bytes, expected %s of %d bytes", name, img.Format(), img.VirtualSize(), format, len(raw))
+	}
+
+	actual, err := ioutil.ReadAll(img)
+	if err != nil {
+		t.Errorf("%s: ReadAll() error = %v", name, err)
+	} else if len(actual) != len(raw) {
+		t.Errorf("%s: read %d bytes, expected %d", name, len(actual), len(raw))
+	} else if !bytes.Equal(actual, raw) {
+		for i := range raw {
+			if actual[i] != raw[i] {
+				t.Errorf("%s: first difference at offset %d", name, i)
+				break
+			}
+		}
+	}
+}
+
+// checkImageError() checks that an image fails to open, or fails to read, with
+// an error of the given type.
+func checkImageError(t *testing.T, name string, image []byte, target interface{}) {
+	t.Helper()
+
+	img, err := Open(bytes.NewReader(image), int64(len(image)))
+	if err == nil {
+		_, err = ioutil.ReadAll(img)
+	}
+	if err == nil {
+		t.Errorf("%s: succeeded, expected an error", name)
+	} else if !errors.As(err, target) {
+		t.Errorf("%s: error = %v (%T), expected a %T", name, err, err, target)
+	}
+}
+
+func TestOpenUnknown(t *testing.T) {
+	for _, image := range [][]byte{
+		nil,
+		[]byte("QFI"),
+		make([]byte, 4096),
+		testRawImage(1<<20, 4096, 0, 0),
+	} {
+		if _, err := Open(bytes.NewReader(image), int64(len(image))); err != ErrUnknownFormat {
+			t.Errorf("Open() of %d bytes = %v, expected ErrUnknownFormat", len(image), err)
+		}
+	}
+}
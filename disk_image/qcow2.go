@@ -0,0 +1,229 @@
+package disk_image
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"fmt"
+	"io"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// qcow2 is QEMU's native format, described in docs/interop/qcow2.txt in the
+// QEMU source tree. Every field is big-endian.
+
+var qcow2Magic = []byte{'Q', 'F', 'I', 0xfb}
+
+const (
+	qcow2IncompatDirty        = 1 << 0
+	qcow2IncompatCorrupt      = 1 << 1
+	qcow2IncompatExternalData = 1 << 2
+	qcow2IncompatCompression  = 1 << 3
+	qcow2IncompatExtendedL2   = 1 << 4
+
+	qcow2OffsetMask      = 0x00fffffffffffe00 // bits 9-55
+	qcow2EntryCompressed = 1 << 62
+	qcow2EntryZero       = 1 << 0
+
+	qcow2CompressionDeflate = 0
+	qcow2CompressionZstd    = 1
+)
+
+type qcow2Image struct {
+	r           io.ReaderAt
+	clusterBits uint
+	l1          []uint64
+	compression byte
+
+	// the most recently used L2 table
+	l2Index int64
+	l2      []uint64
+
+	compressed []byte
+	zstd       *zstd.Decoder
+}
+
+func openQcow2(r io.ReaderAt, size int64) (Image, error) {
+	header := make([]byte, 105)
+	n, err := r.ReadAt(header, 0)
+	if n < 4 || !bytes.Equal(header[:4], qcow2Magic) {
+		return nil, ErrUnknownFormat
+	}
+	if n < 72 {
+		if err == nil || err == io.EOF {
+			return nil, &CorruptError{"qcow2", "truncated header"}
+		}
+		return nil, err
+	}
+
+	version := binary.BigEndian.Uint32(header[4:])
+	backingFileOffset := binary.BigEndian.Uint64(header[8:])
+	clusterBits := binary.BigEndian.Uint32(header[20:])
+	virtualSize := binary.BigEndian.Uint64(header[24:])
+	cryptMethod := binary.BigEndian.Uint32(header[32:])
+	l1Size := binary.BigEndian.Uint32(header[36:])
+	l1Offset := binary.BigEndian.Uint64(header[40:])
+
+	if version != 2 && version != 3 {
+		return nil, &UnsupportedError{"qcow2", fmt.Sprintf("version %d", version)}
+	}
+	if backingFileOffset != 0 {
+		return nil, &UnsupportedError{"qcow2", "a backing file"}
+	}
+	if cryptMethod != 0 {
+		return nil, &UnsupportedError{"qcow2", "encryption"}
+	}
+	if clusterBits < 9 || clusterBits > 21 {
+		return nil, &CorruptError{"qcow2", fmt.Sprintf("invalid cluster size 2^%d", clusterBits)}
+	}
+	if virtualSize > 1<<62 {
+		return nil, &CorruptError{"qcow2", "implausible virtual size"}
+	}
+
+	qi := &qcow2Image{
+		r:           r,
+		clusterBits: uint(clusterBits),
+		l2Index:     -1,
+	}
+
+	if version >= 3 {
+		if n < 104 {
+			return nil, &CorruptError{"qcow2", "truncated header"}
+		}
+		incompatible := binary.BigEndian.Uint64(header[72:])
+		headerLength := binary.BigEndian.Uint32(header[100:])
+		switch {
+		case incompatible&qcow2IncompatCorrupt != 0:
+			return nil, &CorruptError{"qcow2", "the image is marked corrupt"}
+		case incompatible&qcow2IncompatExternalData != 0:
+			return nil, &UnsupportedError{"qcow2", "an external data file"}
+		case incompatible&qcow2IncompatExtendedL2 != 0:
+			return nil, &UnsupportedError{"qcow2", "extended L2 entries"}
+		case incompatible&^(qcow2IncompatDirty|qcow2IncompatCompression) != 0:
+			return nil, &UnsupportedError{"qcow2", fmt.Sprintf("incompatible features %#x", incompatible)}
+		}
+		if incompatible&qcow2IncompatCompression != 0 && headerLength > 104 && n > 104 {
+			qi.compression = header[104]
+		}
+		if qi.compression != qcow2CompressionDeflate && qi.compression != qcow2CompressionZstd {
+			return nil, &UnsupportedError{"qcow2", fmt.Sprintf("compression type %d", qi.compression)}
+		}
+	}
+
+	// the L1 table must cover the whole disk
+	l2Entries := uint64(1) << (clusterBits - 3)
+	clusters := (virtualSize + (1 << clusterBits) - 1) >> clusterBits
+	if uint64(l1Size) < (clusters+l2Entries-1)/l2Entries || uint64(l1Size)*8 > uint64(size) {
+		return nil, &CorruptError{"qcow2", fmt.Sprintf("L1 table has %d entries, which doesn't fit the disk or the file", l1Size)}
+	}
+	l1Bytes := make([]byte, 8*int64(l1Size))
+	if err := readFull(r, "qcow2", l1Bytes, int64(l1Offset)); err != nil {
+		return nil, err
+	}
+	qi.l1 = make([]uint64, l1Size)
+	for i := range qi.l1 {
+		qi.l1[i] = binary.BigEndian.Uint64(l1Bytes[8*i:])
+	}
+
+	return newClusterReader("qcow2", int64(virtualSize), 1<<clusterBits, qi.readCluster), nil
+}
+
+// loadL2() makes the L2 table for l1Index current, returning false if it's
+// unallocated.
+func (qi *qcow2Image) loadL2(l1Index int64) (bool, error) {
+	if qi.l2Index == l1Index {
+		return qi.l2 != nil, nil
+	}
+
+	qi.l2Index = l1Index
+	qi.l2 = nil
+	offset := qi.l1[l1Index] & qcow2OffsetMask
+	if offset == 0 {
+		return false, nil
+	}
+
+	l2Bytes := make([]byte, 1<<qi.clusterBits)
+	if err := readFull(qi.r, "qcow2", l2Bytes, int64(offset)); err != nil {
+		return false, err
+	}
+	qi.l2 = make([]uint64, len(l2Bytes)/8)
+	for i := range qi.l2 {
+		qi.l2[i] = binary.BigEndian.Uint64(l2Bytes[8*i:])
+	}
+	return true, nil
+}
+
+func (qi *qcow2Image) readCluster(index int64, buf []byte) error {
+	l2Entries := int64(1) << (qi.clusterBits - 3)
+	if ok, err := qi.loadL2(index / l2Entries); err != nil {
+		return err
+	} else if !ok {
+		// unallocated, and there's no backing file
+		zero(buf)
+		return nil
+	}
+
+	entry := qi.l2[index%l2Entries]
+	if entry&qcow2EntryCompressed != 0 {
+		return qi.readCompressed(entry, buf)
+	}
+
+	offset := entry & qcow2OffsetMask
+	if entry&qcow2EntryZero != 0 || offset == 0 {
+		zero(buf)
+		return nil
+	}
+	return readFull(qi.r, "qcow2", buf, int64(offset))
+}
+
+func (qi *qcow2Image) readCompressed(entry uint64, buf []byte) error {
+	// the descriptor holds a byte offset and a count of additional sectors,
+	// with the split depending on the cluster size
+	offsetBits := 62 - (qi.clusterBits - 8)
+	offset := int64(entry & (1<<offsetBits - 1))
+	sectors := int64((entry&(1<<62-1))>>offsetBits) + 1
+	length := sectors*512 - offset%512
+
+	// compressed data can run right up to the end of the file, in which case
+	// the sector count overstates it
+	if int64(cap(qi.compressed)) < length {
+		qi.compressed = make([]byte, length)
+	}
+	compressed := qi.compressed[:length]
+	n, err := qi.r.ReadAt(compressed, offset)
+	if n == 0 && err != nil {
+		return err
+	}
+	compressed = compressed[:n]
+
+	// a compressed cluster always decompresses to a whole cluster
+	full := buf
+	if int64(len(full)) < 1<<qi.clusterBits {
+		full = make([]byte, 1<<qi.clusterBits)
+	}
+
+	switch qi.compression {
+	case qcow2CompressionDeflate:
+		fr := flate.NewReader(bytes.NewReader(compressed))
+		if _, err := io.ReadFull(fr, full); err != nil {
+			return &CorruptError{"qcow2", fmt.Sprintf("compressed cluster at offset %d: %v", offset, err)}
+		}
+	case qcow2CompressionZstd:
+		if qi.zstd == nil {
+			if qi.zstd, err = zstd.NewReader(nil, zstd.WithDecoderConcurrency(1)); err != nil {
+				return err
+			}
+		}
+		// the frame may be followed by padding, so stop once the cluster is full
+		if err := qi.zstd.Reset(bytes.NewReader(compressed)); err != nil {
+			return err
+		}
+		if _, err := io.ReadFull(qi.zstd, full); err != nil {
+			return &CorruptError{"qcow2", fmt.Sprintf("compressed cluster at offset %d: %v", offset, err)}
+		}
+	}
+
+	copy(buf, full)
+	return nil
+}
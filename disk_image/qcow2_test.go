@@ -0,0 +1,129 @@
+package disk_image
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"testing"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+type qcow2Options struct {
+	version     uint32
+	clusterBits uint
+	compression int // -1 for none, or a qcow2Compression* constant
+}
+
+// buildQcow2() lays out raw as a qcow2 image the way qemu would: header, L1
+// table, L2 tables, then data.
+func buildQcow2(t *testing.T, raw []byte, opts qcow2Options) []byte {
+	clusterSize := int64(1) << opts.clusterBits
+	clusters := (int64(len(raw)) + clusterSize - 1) / clusterSize
+	l2Entries := clusterSize / 8
+	l1Size := (clusters + l2Entries - 1) / l2Entries
+
+	// header in cluster 0, L1 in cluster 1, L2s after that
+	image := make([]byte, (2+l1Size)*clusterSize)
+	copy(image, qcow2Magic)
+	binary.BigEndian.PutUint32(image[4:], opts.version)
+	binary.BigEndian.PutUint32(image[20:], uint32(opts.clusterBits))
+	binary.BigEndian.PutUint64(image[24:], uint64(len(raw)))
+	binary.BigEndian.PutUint32(image[36:], uint32(l1Size))
+	binary.BigEndian.PutUint64(image[40:], uint64(clusterSize))
+	if opts.version >= 3 {
+		binary.BigEndian.PutUint32(image[100:], 112)
+		if opts.compression == qcow2CompressionZstd {
+			binary.BigEndian.PutUint64(image[72:], qcow2IncompatCompression)
+			image[104] = qcow2CompressionZstd
+		}
+	}
+
+	var enc *zstd.Encoder
+	if opts.compression == qcow2CompressionZstd {
+		enc, _ = zstd.NewWriter(nil)
+	}
+
+	for i := int64(0); i < clusters; i++ {
+		cluster := make([]byte, clusterSize)
+		copy(cluster, raw[i*clusterSize:])
+
+		l2Offset := int64(binary.BigEndian.Uint64(image[clusterSize+8*(i/l2Entries):])) & qcow2OffsetMask
+		var entry uint64
+		switch {
+		case isZero(cluster) && (i%2 == 0 || i/l2Entries == 1):
+			// unallocated, leaving the second L2 table unallocated too
+			continue
+		case isZero(cluster) && opts.version >= 3:
+			entry = qcow2EntryZero
+		case opts.compression >= 0 && i%3 != 0:
+			var compressed []byte
+			if opts.compression == qcow2CompressionZstd {
+				compressed = enc.EncodeAll(cluster, nil)
+				compressed = append(compressed, 0, 0, 0) // padding, which must be ignored
+			} else {
+				var buf bytes.Buffer
+				fw, _ := flate.NewWriter(&buf, flate.BestCompression)
+				fw.Write(cluster)
+				fw.Close()
+				compressed = buf.Bytes()
+			}
+			offset := int64(len(image))
+			sectors := (offset%512 + int64(len(compressed)) + 511) / 512
+			offsetBits := 62 - (opts.clusterBits - 8)
+			entry = qcow2EntryCompressed | uint64(offset) | uint64(sectors-1)<<offsetBits
+			image = append(image, compressed...)
+		default:
+			for int64(len(image))%clusterSize != 0 {
+				image = append(image, 0)
+			}
+			entry = 1<<63 | uint64(len(image))
+			image = append(image, cluster...)
+		}
+
+		// allocate the L2 table on demand
+		if l2Offset == 0 {
+			l2Offset = (2 + i/l2Entries) * clusterSize
+			binary.BigEndian.PutUint64(image[clusterSize+8*(i/l2Entries):], 1<<63|uint64(l2Offset))
+		}
+		binary.BigEndian.PutUint64(image[l2Offset+8*(i%l2Entries):], entry)
+	}
+
+	return image
+}
+
+func TestQcow2(t *testing.T) {
+	// 4 KiB clusters make 2 MiB per L2 table, so the zeros leave one unallocated
+	raw := testRawImage(5<<20+1000, 4096, 2<<20, 4<<20)
+
+	for name, opts := range map[string]qcow2Options{
+		"v2":                  {2, 12, -1},
+		"v3":                  {3, 12, -1},
+		"v2 deflate":          {2, 12, qcow2CompressionDeflate},
+		"v3 deflate":          {3, 12, qcow2CompressionDeflate},
+		"v3 zstd":             {3, 12, qcow2CompressionZstd},
+		"v3 64 KiB clusters":  {3, 16, -1},
+		"v3 64 KiB, deflated": {3, 16, qcow2CompressionDeflate},
+	} {
+		checkImage(t, name, "qcow2", buildQcow2(t, raw, opts), raw)
+	}
+}
+
+func TestQcow2Unsupported(t *testing.T) {
+	raw := testRawImage(1<<20, 4096, 0, 0)
+	tweak := func(f func(image []byte)) []byte {
+		image := buildQcow2(t, raw, qcow2Options{3, 12, -1})
+		f(image)
+		return image
+	}
+
+	var unsupported *UnsupportedError
+	var corrupt *CorruptError
+	checkImageError(t, "backing file", tweak(func(image []byte) { binary.BigEndian.PutUint64(image[8:], 1000) }), &unsupported)
+	checkImageError(t, "encrypted", tweak(func(image []byte) { binary.BigEndian.PutUint32(image[32:], 1) }), &unsupported)
+	checkImageError(t, "version 4", tweak(func(image []byte) { binary.BigEndian.PutUint32(image[4:], 4) }), &unsupported)
+	checkImageError(t, "external data", tweak(func(image []byte) { binary.BigEndian.PutUint64(image[72:], qcow2IncompatExternalData) }), &unsupported)
+	checkImageError(t, "marked corrupt", tweak(func(image []byte) { binary.BigEndian.PutUint64(image[72:], qcow2IncompatCorrupt) }), &corrupt)
+	checkImageError(t, "short L1", tweak(func(image []byte) { binary.BigEndian.PutUint32(image[36:], 0) }), &corrupt)
+	checkImageError(t, "truncated", tweak(func(image []byte) {})[:20<<10], &corrupt)
+}
@@ -0,0 +1,146 @@
+package disk_image
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// VHD is Microsoft's older format, described in the "Virtual Hard Disk Image
+// Format Specification". This reads fixed and dynamic disks, but not
+// differencing disks. Every field is big-endian.
+
+var (
+	vhdFooterCookie  = []byte("conectix")
+	vhdDynamicCookie = []byte("cxsparse")
+)
+
+const (
+	vhdTypeFixed        = 2
+	vhdTypeDynamic      = 3
+	vhdTypeDifferencing = 4
+
+	vhdUnallocated = 0xffffffff
+
+	// blocks are read in pieces no bigger than this
+	maxVhdChunk = 1 << 20
+)
+
+type vhdImage struct {
+	r         io.ReaderAt
+	blockSize int64
+	chunkSize int64
+	bitmap    int64 // the size of the sector bitmap preceding each block
+	bat       []uint32
+}
+
+// vhdChecksum() returns the one's complement of the sum of the bytes in b,
+// skipping the checksum itself.
+func vhdChecksum(b []byte, checksumOffset int) uint32 {
+	var sum uint32
+	for i, c := range b {
+		if i < checksumOffset || i >= checksumOffset+4 {
+			sum += uint32(c)
+		}
+	}
+	return ^sum
+}
+
+func openVhd(r io.ReaderAt, size int64) (Image, error) {
+	// the footer is at the end of the file; dynamic disks also have a copy at
+	// the start, but fixed disks start with the disk itself
+	footer := make([]byte, 512)
+	if size < 512 {
+		return nil, ErrUnknownFormat
+	}
+	if err := readFull(r, "vhd", footer, size-512); err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(footer[:8], vhdFooterCookie) {
+		return nil, ErrUnknownFormat
+	}
+	if vhdChecksum(footer, 64) != binary.BigEndian.Uint32(footer[64:]) {
+		return nil, &CorruptError{"vhd", "footer checksum mismatch"}
+	}
+
+	dataOffset := binary.BigEndian.Uint64(footer[16:])
+	currentSize := int64(binary.BigEndian.Uint64(footer[48:]))
+	diskType := binary.BigEndian.Uint32(footer[60:])
+	if currentSize < 0 || currentSize > 1<<62 {
+		return nil, &CorruptError{"vhd", "implausible size"}
+	}
+
+	switch diskType {
+	case vhdTypeFixed:
+		// a raw image, with a footer
+		if currentSize > size-512 {
+			return nil, &CorruptError{"vhd", fmt.Sprintf("fixed disk of %d bytes is in a file of %d bytes", currentSize, size)}
+		}
+		return newClusterReader("vhd", currentSize, maxVhdChunk, func(index int64, buf []byte) error {
+			return readFull(r, "vhd", buf, index*maxVhdChunk)
+		}), nil
+	case vhdTypeDynamic:
+		// carry on
+	case vhdTypeDifferencing:
+		return nil, &UnsupportedError{"vhd", "a parent disk"}
+	default:
+		return nil, &UnsupportedError{"vhd", fmt.Sprintf("disk type %d", diskType)}
+	}
+
+	// dynamic disks have a header, which points to a block allocation table
+	header := make([]byte, 1024)
+	if err := readFull(r, "vhd", header, int64(dataOffset)); err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(header[:8], vhdDynamicCookie) {
+		return nil, &CorruptError{"vhd", "dynamic disk header not found"}
+	}
+	if vhdChecksum(header, 36) != binary.BigEndian.Uint32(header[36:]) {
+		return nil, &CorruptError{"vhd", "dynamic disk header checksum mismatch"}
+	}
+
+	batOffset := int64(binary.BigEndian.Uint64(header[16:]))
+	batEntries := int64(binary.BigEndian.Uint32(header[28:]))
+	blockSize := int64(binary.BigEndian.Uint32(header[32:]))
+	if blockSize < 512 || blockSize&(blockSize-1) != 0 {
+		return nil, &CorruptError{"vhd", fmt.Sprintf("invalid block size %d", blockSize)}
+	}
+	if batEntries*blockSize < currentSize || batEntries*4 > size {
+		return nil, &CorruptError{"vhd", fmt.Sprintf("block allocation table has %d entries, which doesn't fit the disk or the file", batEntries)}
+	}
+
+	batBytes := make([]byte, batEntries*4)
+	if err := readFull(r, "vhd", batBytes, batOffset); err != nil {
+		return nil, err
+	}
+	vi := &vhdImage{
+		r:         r,
+		blockSize: blockSize,
+		chunkSize: blockSize,
+		bitmap:    (blockSize/512/8 + 511) &^ 511,
+		bat:       make([]uint32, batEntries),
+	}
+	for i := range vi.bat {
+		vi.bat[i] = binary.BigEndian.Uint32(batBytes[4*i:])
+	}
+	if vi.chunkSize > maxVhdChunk {
+		vi.chunkSize = maxVhdChunk
+	}
+
+	return newClusterReader("vhd", currentSize, vi.chunkSize, vi.readCluster), nil
+}
+
+func (vi *vhdImage) readCluster(index int64, buf []byte) error {
+	offset := index * vi.chunkSize
+	block := offset / vi.blockSize
+
+	// like qemu, ignore the sector bitmap: once a block is allocated, all of
+	// it is data
+	sector := vi.bat[block]
+	if sector == vhdUnallocated {
+		zero(buf)
+		return nil
+	}
+	return readFull(vi.r, "vhd", buf, int64(sector)*512+vi.bitmap+offset%vi.blockSize)
+}
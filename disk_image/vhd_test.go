@@ -0,0 +1,92 @@
+package disk_image
+
+import (
+	"encoding/binary"
+	"testing"
+)
+
+const testVhdBlockSize = 2 << 20
+
+// vhdTestFooter() returns a VHD footer.
+func vhdTestFooter(diskType uint32, dataOffset uint64, size int64) []byte {
+	footer := make([]byte, 512)
+	copy(footer, vhdFooterCookie)
+	binary.BigEndian.PutUint32(footer[8:], 2)
+	binary.BigEndian.PutUint32(footer[12:], 0x10000)
+	binary.BigEndian.PutUint64(footer[16:], dataOffset)
+	binary.BigEndian.PutUint64(footer[40:], uint64(size))
+	binary.BigEndian.PutUint64(footer[48:], uint64(size))
+	binary.BigEndian.PutUint32(footer[60:], diskType)
+	binary.BigEndian.PutUint32(footer[64:], vhdChecksum(footer, 64))
+	return footer
+}
+
+// buildVhd() lays out raw as a fixed or dynamic VHD the way Hyper-V would.
+func buildVhd(t *testing.T, raw []byte, diskType uint32) []byte {
+	if diskType != vhdTypeDynamic {
+		image := append([]byte{}, raw...)
+		return append(image, vhdTestFooter(diskType, 0xffffffffffffffff, int64(len(raw)))...)
+	}
+
+	// footer copy, dynamic header, BAT, then blocks
+	blocks := (int64(len(raw)) + testVhdBlockSize - 1) / testVhdBlockSize
+	batSize := (blocks*4 + 511) &^ 511
+	footer := vhdTestFooter(diskType, 512, int64(len(raw)))
+	image := append([]byte{}, footer...)
+
+	header := make([]byte, 1024)
+	copy(header, vhdDynamicCookie)
+	binary.BigEndian.PutUint64(header[8:], 0xffffffffffffffff)
+	binary.BigEndian.PutUint64(header[16:], 1536)
+	binary.BigEndian.PutUint32(header[24:], 0x10000)
+	binary.BigEndian.PutUint32(header[28:], uint32(blocks))
+	binary.BigEndian.PutUint32(header[32:], testVhdBlockSize)
+	binary.BigEndian.PutUint32(header[36:], vhdChecksum(header, 36))
+	image = append(image, header...)
+
+	bat := make([]byte, batSize)
+	for i := range bat {
+		bat[i] = 0xff
+	}
+	image = append(image, bat...)
+
+	for i := int64(0); i < blocks; i++ {
+		block := make([]byte, testVhdBlockSize)
+		copy(block, raw[i*testVhdBlockSize:])
+		if isZero(block) {
+			continue
+		}
+		binary.BigEndian.PutUint32(image[1536+4*i:], uint32(len(image)/512))
+		bitmap := make([]byte, 512)
+		for j := range bitmap {
+			bitmap[j] = 0xff
+		}
+		image = append(image, bitmap...)
+		image = append(image, block...)
+	}
+
+	return append(image, footer...)
+}
+
+func TestVhd(t *testing.T) {
+	// 2 MiB blocks, so the zeros leave one unallocated
+	raw := testRawImage(5<<20+1024, 4096, 2<<20, 4<<20)
+
+	checkImage(t, "fixed", "vhd", buildVhd(t, raw, vhdTypeFixed), raw)
+	checkImage(t, "dynamic", "vhd", buildVhd(t, raw, vhdTypeDynamic), raw)
+}
+
+func TestVhdUnsupported(t *testing.T) {
+	raw := testRawImage(1<<20, 4096, 0, 0)
+
+	var unsupported *UnsupportedError
+	var corrupt *CorruptError
+	checkImageError(t, "differencing", buildVhd(t, raw, vhdTypeDifferencing), &unsupported)
+
+	image := buildVhd(t, raw, vhdTypeDynamic)
+	image[len(image)-1]++
+	checkImageError(t, "footer checksum", image, &corrupt)
+
+	image = buildVhd(t, raw, vhdTypeDynamic)
+	checkImageError(t, "truncated", append(image[:len(image)/2:len(image)/2], image[len(image)-512:]...), &corrupt)
+}
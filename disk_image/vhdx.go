@@ -0,0 +1,243 @@
+package disk_image
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"strings"
+)
+
+// VHDX is Microsoft's newer format, described in [MS-VHDX]. This reads fixed
+// and dynamic disks, but not differencing disks. Every field is little-endian.
+
+var vhdxSignature = []byte("vhdxfile")
+
+var (
+	vhdxBATRegion      = vhdxGUID("2DC27766-F623-4200-9D64-115E9BFD4A08")
+	vhdxMetadataRegion = vhdxGUID("8B7CA206-4790-4B9A-B8FE-575F050F886E")
+
+	vhdxFileParameters    = vhdxGUID("CAA16737-FA36-4D43-B3B6-33F0AA44E76B")
+	vhdxVirtualDiskSize   = vhdxGUID("2FA54224-CD1B-4876-B211-5DBED83BF4B8")
+	vhdxLogicalSectorSize = vhdxGUID("8141BF1D-A96F-4709-BA47-F233A8FAAB5F")
+)
+
+const (
+	vhdxHeader1Offset      = 64 << 10
+	vhdxHeader2Offset      = 128 << 10
+	vhdxRegionTable1Offset = 192 << 10
+	vhdxRegionTable2Offset = 256 << 10
+	vhdxHeaderSize         = 4 << 10
+	vhdxRegionTableSize    = 64 << 10
+
+	vhdxFileParametersHasParent = 1 << 1
+
+	// payload block states
+	vhdxBlockNotPresent       = 0
+	vhdxBlockUndefined        = 1
+	vhdxBlockZero             = 2
+	vhdxBlockUnmapped         = 3
+	vhdxBlockFullyPresent     = 6
+	vhdxBlockPartiallyPresent = 7
+
+	// blocks are read in pieces no bigger than this
+	maxVhdxChunk = 1 << 20
+)
+
+var crc32c = crc32.MakeTable(crc32.Castagnoli)
+
+// vhdxGUID() converts a GUID from its string form to its on-disk form, where
+// the first three groups are little-endian.
+func vhdxGUID(s string) []byte {
+	b, err := hex.DecodeString(strings.Replace(s, "-", "", -1))
+	if err != nil || len(b) != 16 {
+		panic("invalid GUID " + s)
+	}
+	b[0], b[1], b[2], b[3] = b[3], b[2], b[1], b[0]
+	b[4], b[5] = b[5], b[4]
+	b[6], b[7] = b[7], b[6]
+	return b
+}
+
+// vhdxChecksumOK() verifies the CRC-32C stored at offset 4 of a structure.
+func vhdxChecksumOK(b []byte) bool {
+	stored := binary.LittleEndian.Uint32(b[4:])
+	copied := append([]byte{}, b...)
+	binary.LittleEndian.PutUint32(copied[4:], 0)
+	return crc32.Checksum(copied, crc32c) == stored
+}
+
+type vhdxImage struct {
+	r          io.ReaderAt
+	blockSize  int64
+	chunkSize  int64
+	chunkRatio int64
+	bat        []uint64
+}
+
+func openVhdx(r io.ReaderAt, size int64) (Image, error) {
+	signature := make([]byte, 8)
+	if n, _ := r.ReadAt(signature, 0); n < 8 || !bytes.Equal(signature, vhdxSignature) {
+		return nil, ErrUnknownFormat
+	}
+
+	// there are two copies of the header; the valid one with the highest
+	// sequence number is current
+	var header []byte
+	var sequence uint64
+	for _, offset := range []int64{vhdxHeader1Offset, vhdxHeader2Offset} {
+		candidate := make([]byte, vhdxHeaderSize)
+		if err := readFull(r, "vhdx", candidate, offset); err != nil {
+			return nil, err
+		}
+		if !bytes.Equal(candidate[:4], []byte("head")) || !vhdxChecksumOK(candidate) {
+			continue
+		}
+		if seq := binary.LittleEndian.Uint64(candidate[8:]); header == nil || seq > sequence {
+			header, sequence = candidate, seq
+		}
+	}
+	if header == nil {
+		return nil, &CorruptError{"vhdx", "no valid header"}
+	}
+	if version := binary.LittleEndian.Uint16(header[66:]); version != 1 {
+		return nil, &UnsupportedError{"vhdx", fmt.Sprintf("version %d", version)}
+	}
+	if !bytes.Equal(header[48:64], make([]byte, 16)) {
+		return nil, &UnsupportedError{"vhdx", "a log which needs replaying (attach and detach it in Hyper-V first)"}
+	}
+
+	// the region tables should be identical, so use the first valid one
+	var regions []byte
+	for _, offset := range []int64{vhdxRegionTable1Offset, vhdxRegionTable2Offset} {
+		candidate := make([]byte, vhdxRegionTableSize)
+		if err := readFull(r, "vhdx", candidate, offset); err != nil {
+			return nil, err
+		}
+		if bytes.Equal(candidate[:4], []byte("regi")) && vhdxChecksumOK(candidate) {
+			regions = candidate
+			break
+		}
+	}
+	if regions == nil {
+		return nil, &CorruptError{"vhdx", "no valid region table"}
+	}
+
+	var batOffset, batLength, metadataOffset, metadataLength int64
+	entries := int(binary.LittleEndian.Uint32(regions[8:]))
+	if entries > (vhdxRegionTableSize-16)/32 {
+		return nil, &CorruptError{"vhdx", "too many regions"}
+	}
+	for i := 0; i < entries; i++ {
+		entry := regions[16+32*i : 16+32*(i+1)]
+		offset := int64(binary.LittleEndian.Uint64(entry[16:]))
+		length := int64(binary.LittleEndian.Uint32(entry[24:]))
+		required := binary.LittleEndian.Uint32(entry[28:])&1 != 0
+		switch {
+		case bytes.Equal(entry[:16], vhdxBATRegion):
+			batOffset, batLength = offset, length
+		case bytes.Equal(entry[:16], vhdxMetadataRegion):
+			metadataOffset, metadataLength = offset, length
+		case required:
+			return nil, &UnsupportedError{"vhdx", fmt.Sprintf("required region %X", entry[:16])}
+		}
+	}
+	if batLength == 0 || metadataLength < 64<<10 || metadataLength > 1<<20 {
+		return nil, &CorruptError{"vhdx", "missing BAT or metadata region"}
+	}
+
+	// the metadata region says how big the disk is, and how it's divided
+	metadata := make([]byte, metadataLength)
+	if err := readFull(r, "vhdx", metadata, metadataOffset); err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(metadata[:8], []byte("metadata")) {
+		return nil, &CorruptError{"vhdx", "metadata region signature not found"}
+	}
+	items := make(map[string][]byte)
+	entries = int(binary.LittleEndian.Uint16(metadata[10:]))
+	if entries > 2047 {
+		return nil, &CorruptError{"vhdx", "too many metadata items"}
+	}
+	for i := 0; i < entries; i++ {
+		entry := metadata[32+32*i : 32+32*(i+1)]
+		offset := int64(binary.LittleEndian.Uint32(entry[16:]))
+		length := int64(binary.LittleEndian.Uint32(entry[20:]))
+		if offset+length > metadataLength {
+			return nil, &CorruptError{"vhdx", "metadata item extends past the metadata region"}
+		}
+		items[string(entry[:16])] = metadata[offset : offset+length]
+	}
+
+	fileParameters := items[string(vhdxFileParameters)]
+	virtualDiskSize := items[string(vhdxVirtualDiskSize)]
+	logicalSectorSize := items[string(vhdxLogicalSectorSize)]
+	if len(fileParameters) < 8 || len(virtualDiskSize) < 8 || len(logicalSectorSize) < 4 {
+		return nil, &CorruptError{"vhdx", "missing required metadata"}
+	}
+
+	blockSize := int64(binary.LittleEndian.Uint32(fileParameters))
+	if binary.LittleEndian.Uint32(fileParameters[4:])&vhdxFileParametersHasParent != 0 {
+		return nil, &UnsupportedError{"vhdx", "a parent disk"}
+	}
+	diskSize := int64(binary.LittleEndian.Uint64(virtualDiskSize))
+	sectorSize := int64(binary.LittleEndian.Uint32(logicalSectorSize))
+	if blockSize < 1<<20 || blockSize > 256<<20 || blockSize&(blockSize-1) != 0 {
+		return nil, &CorruptError{"vhdx", fmt.Sprintf("invalid block size %d", blockSize)}
+	}
+	if sectorSize != 512 && sectorSize != 4096 {
+		return nil, &CorruptError{"vhdx", fmt.Sprintf("invalid logical sector size %d", sectorSize)}
+	}
+	if diskSize < 0 || diskSize > 64<<40 {
+		return nil, &CorruptError{"vhdx", "implausible virtual disk size"}
+	}
+
+	// every chunkRatio payload blocks are followed by a sector bitmap block,
+	// which is only meaningful for differencing disks
+	vi := &vhdxImage{
+		r:          r,
+		blockSize:  blockSize,
+		chunkSize:  maxVhdxChunk,
+		chunkRatio: (1 << 23) * sectorSize / blockSize,
+	}
+	blocks := (diskSize + blockSize - 1) / blockSize
+	batEntries := blocks
+	if blocks > 0 {
+		batEntries += (blocks - 1) / vi.chunkRatio
+	}
+	if batEntries*8 > batLength {
+		return nil, &CorruptError{"vhdx", "BAT region is too small for the disk"}
+	}
+
+	batBytes := make([]byte, batEntries*8)
+	if err := readFull(r, "vhdx", batBytes, batOffset); err != nil {
+		return nil, err
+	}
+	vi.bat = make([]uint64, batEntries)
+	for i := range vi.bat {
+		vi.bat[i] = binary.LittleEndian.Uint64(batBytes[8*i:])
+	}
+
+	return newClusterReader("vhdx", diskSize, vi.chunkSize, vi.readCluster), nil
+}
+
+func (vi *vhdxImage) readCluster(index int64, buf []byte) error {
+	offset := index * vi.chunkSize
+	block := offset / vi.blockSize
+	entry := vi.bat[block+block/vi.chunkRatio]
+
+	switch state := entry & 7; state {
+	case vhdxBlockNotPresent, vhdxBlockUndefined, vhdxBlockZero, vhdxBlockUnmapped:
+		zero(buf)
+		return nil
+	case vhdxBlockFullyPresent:
+		fileOffset := int64(entry>>20) << 20
+		return readFull(vi.r, "vhdx", buf, fileOffset+offset%vi.blockSize)
+	case vhdxBlockPartiallyPresent:
+		return &UnsupportedError{"vhdx", "a parent disk"}
+	default:
+		return &CorruptError{"vhdx", fmt.Sprintf("block %d has invalid state %d", block, state)}
+	}
+}
@@ -0,0 +1,179 @@
+package disk_image
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"testing"
+)
+
+const (
+	testVhdxBlockSize      = 1 << 20
+	testVhdxMetadataOffset = 1 << 20
+	testVhdxBATOffset      = 2 << 20
+	testVhdxDataOffset     = 3 << 20
+)
+
+// vhdxSetChecksum() stores the CRC-32C of a structure at offset 4.
+func vhdxSetChecksum(b []byte) {
+	binary.LittleEndian.PutUint32(b[4:], 0)
+	binary.LittleEndian.PutUint32(b[4:], crc32.Checksum(b, crc32c))
+}
+
+// buildVhdx() lays out a dynamic VHDX of diskSize bytes, where block() returns
+// the contents of each payload block, or nil if it's not present.
+func buildVhdx(t *testing.T, diskSize int64, block func(i int64) []byte) []byte {
+	image := make([]byte, testVhdxDataOffset)
+	copy(image, vhdxSignature)
+
+	for i, offset := range []int{vhdxHeader1Offset, vhdxHeader2Offset} {
+		header := image[offset : offset+vhdxHeaderSize]
+		copy(header, "head")
+		binary.LittleEndian.PutUint64(header[8:], uint64(10+i))
+		binary.LittleEndian.PutUint16(header[66:], 1)
+		vhdxSetChecksum(header)
+	}
+
+	for _, offset := range []int{vhdxRegionTable1Offset, vhdxRegionTable2Offset} {
+		regions := image[offset : offset+vhdxRegionTableSize]
+		copy(regions, "regi")
+		binary.LittleEndian.PutUint32(regions[8:], 2)
+		copy(regions[16:], vhdxBATRegion)
+		binary.LittleEndian.PutUint64(regions[32:], testVhdxBATOffset)
+		binary.LittleEndian.PutUint32(regions[40:], 1<<20)
+		binary.LittleEndian.PutUint32(regions[44:], 1)
+		copy(regions[48:], vhdxMetadataRegion)
+		binary.LittleEndian.PutUint64(regions[64:], testVhdxMetadataOffset)
+		binary.LittleEndian.PutUint32(regions[72:], 1<<20)
+		binary.LittleEndian.PutUint32(regions[76:], 1)
+		vhdxSetChecksum(regions)
+	}
+
+	metadata := image[testVhdxMetadataOffset : testVhdxMetadataOffset+1<<20]
+	copy(metadata, "metadata")
+	binary.LittleEndian.PutUint16(metadata[10:], 3)
+	for i, item := range []struct {
+		id    []byte
+		value []byte
+	}{
+		{vhdxFileParameters, []byte{0, 0, 0x10, 0, 0, 0, 0, 0}},
+		{vhdxVirtualDiskSize, make([]byte, 8)},
+		{vhdxLogicalSectorSize, []byte{0, 2, 0, 0}},
+	} {
+		entry := metadata[32+32*i:]
+		copy(entry, item.id)
+		binary.LittleEndian.PutUint32(entry[16:], uint32(64<<10+8*i))
+		binary.LittleEndian.PutUint32(entry[20:], uint32(len(item.value)))
+		copy(metadata[64<<10+8*i:], item.value)
+	}
+	binary.LittleEndian.PutUint64(metadata[64<<10+8:], uint64(diskSize))
+
+	// with 512-byte sectors, a sector bitmap block follows every 4096 payload
+	// blocks
+	chunkRatio := int64(1<<23) * 512 / testVhdxBlockSize
+	blocks := (diskSize + testVhdxBlockSize - 1) / testVhdxBlockSize
+	for i := int64(0); i < blocks; i++ {
+		entry := image[testVhdxBATOffset+8*(i+i/chunkRatio):]
+		data := block(i)
+		switch {
+		case data == nil && i%2 == 0:
+			binary.LittleEndian.PutUint64(entry, vhdxBlockNotPresent)
+		case data == nil:
+			binary.LittleEndian.PutUint64(entry, vhdxBlockZero)
+		default:
+			binary.LittleEndian.PutUint64(entry, uint64(len(image))|vhdxBlockFullyPresent)
+			padded := make([]byte, testVhdxBlockSize)
+			copy(padded, data)
+			image = append(image, padded...)
+		}
+	}
+	return image
+}
+
+// buildVhdxFrom() lays out raw as a dynamic VHDX.
+func buildVhdxFrom(t *testing.T, raw []byte) []byte {
+	return buildVhdx(t, int64(len(raw)), func(i int64) []byte {
+		block := raw[i*testVhdxBlockSize:]
+		if len(block) > testVhdxBlockSize {
+			block = block[:testVhdxBlockSize]
+		}
+		if isZero(block) {
+			return nil
+		}
+		return block
+	})
+}
+
+func TestVhdx(t *testing.T) {
+	raw := testRawImage(5<<20+1024, 4096, 1<<20, 4<<20)
+	checkImage(t, "dynamic", "vhdx", buildVhdxFrom(t, raw), raw)
+
+	// the second header has a higher sequence number, but if it's corrupt, the
+	// first one is still good
+	image := buildVhdxFrom(t, raw)
+	image[vhdxHeader2Offset+100]++
+	checkImage(t, "one bad header", "vhdx", image, raw)
+}
+
+func TestVhdxSectorBitmaps(t *testing.T) {
+	// blocks past the first 4096 are offset in the BAT by a sector bitmap entry
+	marker := func(i int64) []byte {
+		return bytes.Repeat([]byte{byte(i), byte(i >> 8)}, testVhdxBlockSize/2)
+	}
+	image := buildVhdx(t, 4097*testVhdxBlockSize, func(i int64) []byte {
+		if i == 4095 || i == 4096 {
+			return marker(i)
+		}
+		return nil
+	})
+
+	img, err := Open(bytes.NewReader(image), int64(len(image)))
+	if err != nil {
+		t.Fatalf("Open() error = %v", err)
+	}
+	cr := img.(*clusterReader)
+	buf := make([]byte, testVhdxBlockSize)
+	for _, i := range []int64{4094, 4095, 4096} {
+		if err := cr.readCluster(i, buf); err != nil {
+			t.Errorf("readCluster(%d) error = %v", i, err)
+			continue
+		}
+		expected := make([]byte, testVhdxBlockSize)
+		if i != 4094 {
+			expected = marker(i)
+		}
+		if !bytes.Equal(buf, expected) {
+			t.Errorf("readCluster(%d) returned the wrong block", i)
+		}
+	}
+}
+
+func TestVhdxUnsupported(t *testing.T) {
+	raw := testRawImage(2<<20, 4096, 0, 0)
+
+	var unsupported *UnsupportedError
+	var corrupt *CorruptError
+
+	image := buildVhdxFrom(t, raw)
+	for _, offset := range []int{vhdxHeader1Offset, vhdxHeader2Offset} {
+		image[offset+48] = 1
+		vhdxSetChecksum(image[offset : offset+vhdxHeaderSize])
+	}
+	checkImageError(t, "log", image, &unsupported)
+
+	image = buildVhdxFrom(t, raw)
+	image[testVhdxMetadataOffset+64<<10+4] = 2
+	checkImageError(t, "parent", image, &unsupported)
+
+	image = buildVhdxFrom(t, raw)
+	binary.LittleEndian.PutUint64(image[testVhdxBATOffset:], testVhdxDataOffset|vhdxBlockPartiallyPresent)
+	checkImageError(t, "partially present block", image, &unsupported)
+
+	image = buildVhdxFrom(t, raw)
+	image[vhdxRegionTable1Offset+100]++
+	image[vhdxRegionTable2Offset+100]++
+	checkImageError(t, "region tables", image, &corrupt)
+
+	image = buildVhdxFrom(t, raw)
+	checkImageError(t, "truncated", image[:len(image)-1], &corrupt)
+}
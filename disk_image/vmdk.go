@@ -0,0 +1,237 @@
+package disk_image
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"regexp"
+	"strings"
+)
+
+// VMDK is VMware's format, described in "Virtual Disk Format 5.0". This reads
+// single-file sparse extents: monolithicSparse, as made by VMware Workstation,
+// and streamOptimized, as used in OVAs. Every field is little-endian.
+
+var vmdkMagic = []byte("KDMV")
+
+const (
+	vmdkFlagCompressed = 1 << 16
+
+	vmdkCompressionDeflate = 1
+
+	vmdkGDAtEnd = 0xffffffffffffffff
+)
+
+var vmdkParentCID = regexp.MustCompile(`(?m)^\s*parentCID\s*=\s*"?([0-9a-fA-F]+)"?`)
+
+type vmdkImage struct {
+	r          io.ReaderAt
+	grainSize  int64 // bytes
+	gtEntries  int64
+	gd         []uint32
+	compressed bool
+
+	// the most recently used grain table
+	gtIndex int64
+	gt      []uint32
+
+	grain []byte
+}
+
+// vmdkHeader is the interesting part of a SparseExtentHeader.
+type vmdkHeader struct {
+	version          uint32
+	flags            uint32
+	capacity         uint64 // sectors
+	grainSize        uint64 // sectors
+	descriptorOffset uint64 // sectors
+	descriptorSize   uint64 // sectors
+	gtEntries        uint32
+	gdOffset         uint64 // sectors
+	compression      uint16
+}
+
+func parseVmdkHeader(b []byte) vmdkHeader {
+	return vmdkHeader{
+		version:          binary.LittleEndian.Uint32(b[4:]),
+		flags:            binary.LittleEndian.Uint32(b[8:]),
+		capacity:         binary.LittleEndian.Uint64(b[12:]),
+		grainSize:        binary.LittleEndian.Uint64(b[20:]),
+		descriptorOffset: binary.LittleEndian.Uint64(b[28:]),
+		descriptorSize:   binary.LittleEndian.Uint64(b[36:]),
+		gtEntries:        binary.LittleEndian.Uint32(b[44:]),
+		gdOffset:         binary.LittleEndian.Uint64(b[56:]),
+		compression:      binary.LittleEndian.Uint16(b[77:]),
+	}
+}
+
+func openVmdk(r io.ReaderAt, size int64) (Image, error) {
+	headerBytes := make([]byte, 512)
+	n, err := r.ReadAt(headerBytes, 0)
+	if n >= 4 && bytes.Equal(headerBytes[:4], vmdkMagic) {
+		// carry on
+	} else if n >= 21 && bytes.Equal(headerBytes[:21], []byte("# Disk DescriptorFile")) {
+		// a text descriptor pointing to extents in other files
+		return nil, &UnsupportedError{"vmdk", "separate descriptor and extent files; specify the extent itself"}
+	} else {
+		return nil, ErrUnknownFormat
+	}
+	if n < len(headerBytes) {
+		if err == nil || err == io.EOF {
+			return nil, &CorruptError{"vmdk", "truncated header"}
+		}
+		return nil, err
+	}
+
+	header := parseVmdkHeader(headerBytes)
+	if header.version < 1 || header.version > 3 {
+		return nil, &UnsupportedError{"vmdk", fmt.Sprintf("version %d", header.version)}
+	}
+
+	// streamOptimized images put the real header in a footer, just before
+	// the end-of-stream marker
+	if header.gdOffset == vmdkGDAtEnd {
+		if size < 3*512 {
+			return nil, &CorruptError{"vmdk", "missing footer"}
+		}
+		if err := readFull(r, "vmdk", headerBytes, size-1024); err != nil {
+			return nil, err
+		}
+		if !bytes.Equal(headerBytes[:4], vmdkMagic) {
+			return nil, &CorruptError{"vmdk", "missing footer"}
+		}
+		footer := parseVmdkHeader(headerBytes)
+		header.gdOffset = footer.gdOffset
+		header.gtEntries = footer.gtEntries
+		header.grainSize = footer.grainSize
+		header.capacity = footer.capacity
+	}
+
+	if header.grainSize < 1 || header.grainSize > 1<<12 || header.grainSize&(header.grainSize-1) != 0 {
+		return nil, &CorruptError{"vmdk", fmt.Sprintf("invalid grain size %d", header.grainSize)}
+	}
+	if header.gtEntries < 1 || header.gtEntries > 1<<16 {
+		return nil, &CorruptError{"vmdk", fmt.Sprintf("invalid grain table size %d", header.gtEntries)}
+	}
+	if header.capacity > 1<<53 {
+		return nil, &CorruptError{"vmdk", "implausible capacity"}
+	}
+	compressed := header.flags&vmdkFlagCompressed != 0
+	if compressed && header.compression != vmdkCompressionDeflate {
+		return nil, &UnsupportedError{"vmdk", fmt.Sprintf("compression algorithm %d", header.compression)}
+	}
+
+	// the embedded descriptor says whether this is a delta disk
+	if header.descriptorOffset > 0 && header.descriptorSize > 0 && header.descriptorSize < 2048 {
+		descriptor := make([]byte, header.descriptorSize*512)
+		if err := readFull(r, "vmdk", descriptor, int64(header.descriptorOffset)*512); err != nil {
+			return nil, err
+		}
+		if m := vmdkParentCID.FindSubmatch(descriptor); m != nil && !strings.EqualFold(string(m[1]), "ffffffff") {
+			return nil, &UnsupportedError{"vmdk", "a parent disk"}
+		}
+	}
+
+	// read the grain directory
+	grains := (header.capacity + header.grainSize - 1) / header.grainSize
+	gdEntries := (grains + uint64(header.gtEntries) - 1) / uint64(header.gtEntries)
+	if gdEntries*4 > uint64(size) {
+		return nil, &CorruptError{"vmdk", "grain directory is larger than the file"}
+	}
+	gdBytes := make([]byte, gdEntries*4)
+	if err := readFull(r, "vmdk", gdBytes, int64(header.gdOffset)*512); err != nil {
+		return nil, err
+	}
+
+	vi := &vmdkImage{
+		r:          r,
+		grainSize:  int64(header.grainSize) * 512,
+		gtEntries:  int64(header.gtEntries),
+		gd:         make([]uint32, gdEntries),
+		compressed: compressed,
+		gtIndex:    -1,
+	}
+	for i := range vi.gd {
+		vi.gd[i] = binary.LittleEndian.Uint32(gdBytes[4*i:])
+	}
+
+	return newClusterReader("vmdk", int64(header.capacity)*512, vi.grainSize, vi.readCluster), nil
+}
+
+// loadGT() makes the grain table for gdIndex current, returning false if it's
+// unallocated.
+func (vi *vmdkImage) loadGT(gdIndex int64) (bool, error) {
+	if vi.gtIndex == gdIndex {
+		return vi.gt != nil, nil
+	}
+
+	vi.gtIndex = gdIndex
+	vi.gt = nil
+	if vi.gd[gdIndex] == 0 {
+		return false, nil
+	}
+
+	gtBytes := make([]byte, vi.gtEntries*4)
+	if err := readFull(vi.r, "vmdk", gtBytes, int64(vi.gd[gdIndex])*512); err != nil {
+		return false, err
+	}
+	vi.gt = make([]uint32, vi.gtEntries)
+	for i := range vi.gt {
+		vi.gt[i] = binary.LittleEndian.Uint32(gtBytes[4*i:])
+	}
+	return true, nil
+}
+
+func (vi *vmdkImage) readCluster(index int64, buf []byte) error {
+	if ok, err := vi.loadGT(index / vi.gtEntries); err != nil {
+		return err
+	} else if !ok {
+		zero(buf)
+		return nil
+	}
+
+	// 0 means unallocated, and 1 means explicitly zeroed
+	sector := vi.gt[index%vi.gtEntries]
+	if sector <= 1 {
+		zero(buf)
+		return nil
+	}
+	offset := int64(sector) * 512
+
+	if !vi.compressed {
+		return readFull(vi.r, "vmdk", buf, offset)
+	}
+
+	// compressed grains start with a marker: the LBA, then the data length
+	var marker [12]byte
+	if err := readFull(vi.r, "vmdk", marker[:], offset); err != nil {
+		return err
+	}
+	length := int64(binary.LittleEndian.Uint32(marker[8:]))
+	if length > 2*vi.grainSize+1024 {
+		return &CorruptError{"vmdk", fmt.Sprintf("grain at offset %d is implausibly large", offset)}
+	}
+	if int64(cap(vi.grain)) < length {
+		vi.grain = make([]byte, length)
+	}
+	grain := vi.grain[:length]
+	if err := readFull(vi.r, "vmdk", grain, offset+12); err != nil {
+		return err
+	}
+
+	zr, err := zlib.NewReader(bytes.NewReader(grain))
+	if err != nil {
+		return &CorruptError{"vmdk", fmt.Sprintf("grain at offset %d: %v", offset, err)}
+	}
+	n, err := io.ReadFull(zr, buf)
+	if err == io.ErrUnexpectedEOF || err == io.EOF {
+		// a grain can decompress short, e.g. at the end of the disk, in
+		// which case the rest is zeros
+		zero(buf[n:])
+	} else if err != nil {
+		return &CorruptError{"vmdk", fmt.Sprintf("grain at offset %d: %v", offset, err)}
+	}
+	return nil
+}
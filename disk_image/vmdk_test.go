@@ -0,0 +1,135 @@
+package disk_image
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"fmt"
+	"testing"
+)
+
+const (
+	testGrainSectors = 8 // 4 KiB grains
+	testGTEntries    = 512
+)
+
+// vmdkTestHeader() returns a SparseExtentHeader.
+func vmdkTestHeader(flags uint32, capacity, descriptorOffset, gdOffset uint64) []byte {
+	header := make([]byte, 512)
+	copy(header, vmdkMagic)
+	binary.LittleEndian.PutUint32(header[4:], 3)
+	binary.LittleEndian.PutUint32(header[8:], flags)
+	binary.LittleEndian.PutUint64(header[12:], capacity)
+	binary.LittleEndian.PutUint64(header[20:], testGrainSectors)
+	binary.LittleEndian.PutUint64(header[28:], descriptorOffset)
+	binary.LittleEndian.PutUint64(header[36:], 1)
+	binary.LittleEndian.PutUint32(header[44:], testGTEntries)
+	binary.LittleEndian.PutUint64(header[56:], gdOffset)
+	copy(header[73:], "\n \r\n")
+	if flags&vmdkFlagCompressed != 0 {
+		binary.LittleEndian.PutUint16(header[77:], vmdkCompressionDeflate)
+	}
+	return header
+}
+
+// buildVmdk() lays out raw as a monolithicSparse or streamOptimized VMDK.
+func buildVmdk(t *testing.T, raw []byte, streamOptimized bool, parentCID string) []byte {
+	grainSize := int64(testGrainSectors * 512)
+	capacity := (int64(len(raw)) + 511) / 512
+	grains := (int64(len(raw)) + grainSize - 1) / grainSize
+	gdEntries := (grains + testGTEntries - 1) / testGTEntries
+
+	pad := func(image []byte) []byte {
+		for len(image)%512 != 0 {
+			image = append(image, 0)
+		}
+		return image
+	}
+
+	// header, then descriptor
+	var image []byte
+	var flags uint32 = 1
+	if streamOptimized {
+		flags |= vmdkFlagCompressed | 1<<17
+		image = vmdkTestHeader(flags, uint64(capacity), 1, vmdkGDAtEnd)
+	} else {
+		image = vmdkTestHeader(flags, uint64(capacity), 1, 0)
+	}
+	image = append(image, fmt.Sprintf("# Disk DescriptorFile\nversion=1\nCID=12345678\nparentCID=%s\ncreateType=\"monolithicSparse\"\n", parentCID)...)
+	image = pad(image)
+
+	// grains, then grain tables, then the grain directory
+	gts := make([]uint32, gdEntries*testGTEntries)
+	for i := int64(0); i < grains; i++ {
+		grain := make([]byte, grainSize)
+		copy(grain, raw[i*grainSize:])
+		if isZero(grain) {
+			if i%2 == 0 {
+				gts[i] = 1 // explicitly zero
+			}
+			continue
+		}
+
+		gts[i] = uint32(len(image) / 512)
+		if streamOptimized {
+			var buf bytes.Buffer
+			zw := zlib.NewWriter(&buf)
+			zw.Write(grain)
+			zw.Close()
+			marker := make([]byte, 12)
+			binary.LittleEndian.PutUint64(marker, uint64(i*testGrainSectors))
+			binary.LittleEndian.PutUint32(marker[8:], uint32(buf.Len()))
+			image = append(image, marker...)
+			image = append(image, buf.Bytes()...)
+		} else {
+			image = append(image, grain...)
+		}
+		image = pad(image)
+	}
+
+	gd := make([]byte, gdEntries*4)
+	for i := int64(0); i < gdEntries; i++ {
+		gt := make([]byte, testGTEntries*4)
+		allZero := true
+		for j := int64(0); j < testGTEntries; j++ {
+			binary.LittleEndian.PutUint32(gt[4*j:], gts[i*testGTEntries+j])
+			allZero = allZero && gts[i*testGTEntries+j] == 0
+		}
+		if allZero {
+			continue
+		}
+		binary.LittleEndian.PutUint32(gd[4*i:], uint32(len(image)/512))
+		image = pad(append(image, gt...))
+	}
+	gdOffset := len(image) / 512
+	image = pad(append(image, gd...))
+
+	if streamOptimized {
+		// footer marker, footer, end-of-stream marker
+		image = append(image, make([]byte, 512)...)
+		image = append(image, vmdkTestHeader(flags, uint64(capacity), 1, uint64(gdOffset))...)
+		image = append(image, make([]byte, 512)...)
+	} else {
+		binary.LittleEndian.PutUint64(image[56:], uint64(gdOffset))
+	}
+	return image
+}
+
+func TestVmdk(t *testing.T) {
+	// 4 KiB grains make 2 MiB per grain table, so the zeros leave one unallocated
+	raw := testRawImage(5<<20+1024, 4096, 2<<20, 4<<20)
+
+	checkImage(t, "monolithicSparse", "vmdk", buildVmdk(t, raw, false, "ffffffff"), raw)
+	checkImage(t, "streamOptimized", "vmdk", buildVmdk(t, raw, true, "ffffffff"), raw)
+}
+
+func TestVmdkUnsupported(t *testing.T) {
+	raw := testRawImage(1<<20, 4096, 0, 0)
+
+	var unsupported *UnsupportedError
+	var corrupt *CorruptError
+	checkImageError(t, "parent", buildVmdk(t, raw, false, "87654321"), &unsupported)
+	checkImageError(t, "descriptor", []byte("# Disk DescriptorFile\nversion=1\n"), &unsupported)
+	stream := buildVmdk(t, raw, true, "ffffffff")
+	checkImageError(t, "truncated", stream[:len(stream)-512], &corrupt)
+}
@@ -0,0 +1,272 @@
+package disk_inspect
+
+import (
+	"bytes"
+	"encoding/binary"
+	"strings"
+)
+
+// superblockLength is enough of a filesystem's start to identify it, reaching
+// btrfs's superblock at 64 KiB.
+const superblockLength = 0x10000 + 0x1000
+
+// ext superblock feature flags which distinguish ext3 and ext4
+const (
+	extCompatHasJournal     = 0x4
+	extIncompatExtents      = 0x40
+	extIncompat64Bit        = 0x80
+	extIncompatFlexBG       = 0x200
+	extROCompatHugeFile     = 0x8
+	extROCompatGDTCsum      = 0x10
+	extROCompatDirNlink     = 0x20
+	extROCompatExtraIsize   = 0x40
+	extROCompatMetadataCsum = 0x400
+)
+
+// identify() names the filesystem which starts with b, or returns "" if it's
+// not one this package recognizes.
+func identify(b []byte) string {
+	at := func(offset int, magic string) bool {
+		return len(b) >= offset+len(magic) && string(b[offset:offset+len(magic)]) == magic
+	}
+
+	switch {
+	case at(0, "XFSB"):
+		return "xfs"
+	case at(1080, "\x53\xef") && len(b) >= 1024+104:
+		sb := b[1024:]
+		compat := binary.LittleEndian.Uint32(sb[92:])
+		incompat := binary.LittleEndian.Uint32(sb[96:])
+		roCompat := binary.LittleEndian.Uint32(sb[100:])
+		switch {
+		case incompat&(extIncompatExtents|extIncompat64Bit|extIncompatFlexBG) != 0,
+			roCompat&(extROCompatHugeFile|extROCompatGDTCsum|extROCompatDirNlink|extROCompatExtraIsize|extROCompatMetadataCsum) != 0:
+			return "ext4"
+		case compat&extCompatHasJournal != 0:
+			return "ext3"
+		default:
+			return "ext2"
+		}
+	case at(0x10040, "_BHRfS_M"):
+		return "btrfs"
+	case at(4086, "SWAPSPACE2"):
+		return "swap"
+	case at(512, "LABELONE"):
+		return "LVM2_member"
+	case at(3, "NTFS    "):
+		return "ntfs"
+	case at(3, "EXFAT   "):
+		return "exfat"
+	}
+
+	if _, ok := parseFAT(b); ok {
+		return "vfat"
+	}
+	return ""
+}
+
+// filesystem() identifies the filesystem at offset.
+func (in *inspector) filesystem(offset int64) (string, error) {
+	b, err := in.read(offset, superblockLength)
+	if err != nil {
+		return "", err
+	}
+	return identify(b), nil
+}
+
+// fat describes a FAT filesystem's layout, from its boot sector.
+type fat struct {
+	bytesPerSector    int64
+	sectorsPerCluster int64
+	fatStart          int64 // in bytes from the start of the filesystem
+	fatLength         int64
+	rootStart         int64 // for FAT12 and FAT16, whose root directory is fixed
+	rootLength        int64
+	rootCluster       uint32 // for FAT32
+	dataStart         int64
+	clusters          uint32
+	bits              int // 12, 16, or 32
+}
+
+// parseFAT() reads a FAT boot sector.
+func parseFAT(b []byte) (*fat, bool) {
+	if len(b) < sectorSize || b[510] != 0x55 || b[511] != 0xaa || (b[0] != 0xeb && b[0] != 0xe9) {
+		return nil, false
+	}
+	// the filesystem type field is informational, but everything fills it in,
+	// and it tells a FAT boot sector from an MBR whose boot code jumps similarly
+	if string(b[54:57]) != "FAT" && string(b[82:85]) != "FAT" {
+		return nil, false
+	}
+	bps := int64(binary.LittleEndian.Uint16(b[11:]))
+	spc := int64(b[13])
+	reserved := int64(binary.LittleEndian.Uint16(b[14:]))
+	fats := int64(b[16])
+	rootEntries := int64(binary.LittleEndian.Uint16(b[17:]))
+	totalSectors := int64(binary.LittleEndian.Uint16(b[19:]))
+	if totalSectors == 0 {
+		totalSectors = int64(binary.LittleEndian.Uint32(b[32:]))
+	}
+	fatSectors := int64(binary.LittleEndian.Uint16(b[22:]))
+	if fatSectors == 0 {
+		fatSectors = int64(binary.LittleEndian.Uint32(b[36:]))
+	}
+	if bps < 512 || bps > 4096 || bps&(bps-1) != 0 || spc == 0 || spc&(spc-1) != 0 || reserved == 0 || fats == 0 || fatSectors == 0 {
+		return nil, false
+	}
+
+	f := &fat{
+		bytesPerSector:    bps,
+		sectorsPerCluster: spc,
+		fatStart:          reserved * bps,
+		fatLength:         fatSectors * bps,
+		rootStart:         (reserved + fats*fatSectors) * bps,
+		rootLength:        rootEntries * 32,
+	}
+	rootSectors := (f.rootLength + bps - 1) / bps
+	dataSectors := totalSectors - reserved - fats*fatSectors - rootSectors
+	if dataSectors <= 0 {
+		return nil, false
+	}
+	f.dataStart = f.rootStart + rootSectors*bps
+	f.clusters = uint32(dataSectors / spc)
+	switch {
+	case f.clusters < 4085:
+		f.bits = 12
+	case f.clusters < 65525:
+		f.bits = 16
+	default:
+		f.bits = 32
+		f.rootCluster = binary.LittleEndian.Uint32(b[44:])
+	}
+	return f, true
+}
+
+// next() returns the cluster after c in a chain, or 0 at its end.
+func (f *fat) next(table []byte, c uint32) uint32 {
+	var next uint32
+	switch f.bits {
+	case 12:
+		i := int(c) * 3 / 2
+		if i+1 >= len(table) {
+			return 0
+		}
+		next = uint32(binary.LittleEndian.Uint16(table[i:]))
+		if c%2 == 1 {
+			next >>= 4
+		}
+		next &= 0xfff
+	case 16:
+		if int(c)*2+1 >= len(table) {
+			return 0
+		}
+		next = uint32(binary.LittleEndian.Uint16(table[c*2:]))
+	default:
+		if int(c)*4+3 >= len(table) {
+			return 0
+		}
+		next = binary.LittleEndian.Uint32(table[c*4:]) & 0x0fffffff
+	}
+	if next < 2 || next >= f.clusters+2 {
+		return 0
+	}
+	return next
+}
+
+// maxFATLength and maxDirectoryClusters keep corrupt filesystems from taking
+// too much memory.
+const (
+	maxFATLength         = 16 << 20
+	maxDirectoryClusters = 256
+)
+
+// efiArchitectures maps the removable media boot loaders' short names to the
+// architectures they're for.
+var efiArchitectures = map[string]string{
+	"BOOTX64 EFI": "x86_64",
+	"BOOTAA64EFI": "arm64",
+	"BOOTIA32EFI": "i386",
+	"BOOTARM EFI": "arm",
+}
+
+// efiBootLoaders() looks for \EFI\BOOT\BOOT*.EFI in the FAT filesystem at
+// offset.
+func (in *inspector) efiBootLoaders(offset int64) error {
+	bootSector, err := in.read(offset, sectorSize)
+	if err != nil || bootSector == nil {
+		return err
+	}
+	f, ok := parseFAT(bootSector)
+	if !ok {
+		return nil
+	}
+	if f.fatLength > maxFATLength {
+		in.report.Incomplete = true
+		return nil
+	}
+	table, err := in.read(offset+f.fatStart, f.fatLength)
+	if err != nil || table == nil {
+		return err
+	}
+
+	// directory() reads a directory, given its first cluster
+	directory := func(cluster uint32) ([]byte, error) {
+		if cluster == 0 && f.bits != 32 {
+			return in.read(offset+f.rootStart, f.rootLength)
+		}
+		var dir []byte
+		clusterSize := f.sectorsPerCluster * f.bytesPerSector
+		for i := 0; cluster != 0 && i < maxDirectoryClusters; i++ {
+			b, err := in.read(offset+f.dataStart+int64(cluster-2)*clusterSize, clusterSize)
+			if err != nil || b == nil {
+				return dir, err
+			}
+			dir = append(dir, b...)
+			cluster = f.next(table, cluster)
+		}
+		return dir, nil
+	}
+
+	dir, err := directory(f.rootCluster)
+	for _, name := range []string{"EFI", "BOOT"} {
+		if err != nil {
+			return err
+		}
+		cluster, found := findEntry(dir, name, true)
+		if !found {
+			return nil
+		}
+		dir, err = directory(cluster)
+	}
+	if err != nil {
+		return err
+	}
+
+	for i := 0; i+32 <= len(dir) && dir[i] != 0; i += 32 {
+		entry := dir[i : i+32]
+		if entry[0] == 0xe5 || entry[11]&0x18 != 0 {
+			// deleted, a long name, a volume label, or a directory
+			continue
+		}
+		if arch, ok := efiArchitectures[string(entry[:11])]; ok {
+			in.report.EFIArchitectures = append(in.report.EFIArchitectures, arch)
+		}
+	}
+	return nil
+}
+
+// findEntry() finds a file or directory by its short name in a directory,
+// returning its first cluster.
+func findEntry(dir []byte, name string, isDir bool) (uint32, bool) {
+	shortName := []byte(strings.ToUpper(name) + strings.Repeat(" ", 11-len(name)))
+	for i := 0; i+32 <= len(dir) && dir[i] != 0; i += 32 {
+		entry := dir[i : i+32]
+		if entry[0] == 0xe5 || entry[11]&0x0f == 0x0f || entry[11]&0x08 != 0 {
+			continue
+		}
+		if bytes.Equal(entry[:11], shortName) && (entry[11]&0x10 != 0) == isDir {
+			return uint32(binary.LittleEndian.Uint16(entry[20:]))<<16 | uint32(binary.LittleEndian.Uint16(entry[26:])), true
+		}
+	}
+	return 0, false
+}
@@ -0,0 +1,291 @@
+package disk_inspect
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"math"
+)
+
+// ext superblock fields and flags which matter for finding free blocks
+const (
+	extStateValid        = 0x1
+	extStateErrors       = 0x2
+	extIncompatRecover   = 0x4
+	extIncompatMetaBG    = 0x10
+	extROCompatBigalloc  = 0x200
+	extGroupBlockUninit  = 0x2
+	extMinDescSize       = 32
+	extMaxGroupDescBytes = 64 << 20
+)
+
+// FreeBlocks reads a disk image, replacing the contents of ext2, ext3, and
+// ext4 filesystems' unallocated blocks with zeros, which compress much better
+// than whatever deleted files left behind. Filesystems are found in MBR and
+// GPT partitions, or at the start of a disk with no partition table.
+//
+// Only what's read is changed, never the source. Block bitmaps are read as
+// they go by, so a block whose bitmap comes after it is left alone, as are
+// filesystems which might not be consistent: ones which need journal
+// recovery, weren't cleanly unmounted, or have errors. Block groups whose
+// bitmaps were never initialized are left alone too.
+type FreeBlocks struct {
+	r       io.Reader
+	pos     int64
+	started bool
+	head    []byte
+	fs      []*extFreeBlocks
+	zeroed  int64
+}
+
+// ZeroFreeBlocks() returns a reader which zeros r's free ext blocks.
+func ZeroFreeBlocks(r io.Reader) *FreeBlocks {
+	return &FreeBlocks{r: r}
+}
+
+// Zeroed() returns how many bytes have been replaced with zeros so far.
+func (fb *FreeBlocks) Zeroed() int64 {
+	return fb.zeroed
+}
+
+// Read() reads the disk image, zeroing free blocks.
+func (fb *FreeBlocks) Read(p []byte) (int, error) {
+	if !fb.started {
+		// read ahead far enough to find the partitions
+		head := make([]byte, gptEntriesEnd)
+		n, err := io.ReadFull(fb.r, head)
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			err = nil
+		} else if err != nil {
+			return 0, err
+		}
+		fb.head, fb.started = head[:n], true
+		fb.findFilesystems()
+	}
+
+	var n int
+	var err error
+	if fb.pos < int64(len(fb.head)) {
+		n = copy(p, fb.head[fb.pos:])
+	} else {
+		fb.head = nil
+		n, err = fb.r.Read(p)
+	}
+	for _, fs := range fb.fs {
+		fb.zeroed += fs.process(p[:n], fb.pos)
+	}
+	fb.pos += int64(n)
+	return n, err
+}
+
+// findFilesystems() lists where filesystems might be, given the start of the
+// disk.
+func (fb *FreeBlocks) findFilesystems() {
+	if len(fb.head) >= sectorSize {
+		in := &inspector{r: bytes.NewReader(fb.head), size: int64(len(fb.head)), report: &Report{}}
+		if in.partitions(fb.head) == nil && in.report.PartitionTable != "" {
+			for _, p := range in.report.Partitions {
+				// partitions() leaves out entries which don't fit on a disk,
+				// but a bad one here would zero the wrong blocks
+				if p.Start < 0 || p.Size <= 0 || p.Start > math.MaxInt64-p.Size {
+					continue
+				}
+				fb.fs = append(fb.fs, &extFreeBlocks{start: p.Start, end: p.Start + p.Size})
+			}
+			return
+		}
+	}
+	fb.fs = []*extFreeBlocks{{start: 0, end: math.MaxInt64}}
+}
+
+// extFreeBlocks tracks an ext filesystem as it goes by: its superblock, then
+// its group descriptors, then its block bitmaps, with which it zeros the
+// free blocks that follow.
+type extFreeBlocks struct {
+	start, end int64
+	disabled   bool
+
+	superblock []byte
+	gdt        []byte
+	gdtStart   int64
+
+	blockSize      int64
+	firstDataBlock int64
+	blocksPerGroup int64
+	blocks         int64
+	descSize       int64
+
+	// block bitmaps' groups by their location, then the bitmaps themselves
+	// by group once they're read
+	bitmapGroups map[int64]int64
+	partial      map[int64][]byte
+	bitmaps      map[int64][]byte
+}
+
+// capture() copies whatever part of want, which is at wantStart, is in p,
+// which is at pos. It returns true once want's end has gone by.
+func capture(p []byte, pos int64, want []byte, wantStart int64) bool {
+	if wantStart < pos+int64(len(p)) && wantStart+int64(len(want)) > pos {
+		if wantStart >= pos {
+			copy(want, p[wantStart-pos:])
+		} else {
+			copy(want[pos-wantStart:], p)
+		}
+	}
+	return pos+int64(len(p)) >= wantStart+int64(len(want))
+}
+
+// process() looks at p, which is at pos in the disk image, zeroing any free
+// blocks and returning how many bytes it zeroed.
+func (fs *extFreeBlocks) process(p []byte, pos int64) int64 {
+	if fs.disabled || pos+int64(len(p)) <= fs.start || pos >= fs.end {
+		return 0
+	}
+
+	// the superblock is 1 KiB in
+	if fs.superblock == nil {
+		fs.superblock = make([]byte, 1024)
+	}
+	if fs.blockSize == 0 {
+		if !capture(p, pos, fs.superblock, fs.start+1024) {
+			return 0
+		} else if !fs.parseSuperblock() {
+			fs.disabled = true
+			return 0
+		}
+	}
+
+	// the group descriptors start in the block after the superblock
+	if fs.bitmapGroups == nil {
+		if !capture(p, pos, fs.gdt, fs.gdtStart) {
+			return 0
+		}
+		fs.parseGroupDescriptors(pos + int64(len(p)))
+	}
+
+	// block bitmaps come wherever the group descriptors say
+	end := pos + int64(len(p))
+	first, last := fs.block(pos), fs.block(end-1)
+	for b := first; b <= last && len(fs.bitmapGroups) > 0; b++ {
+		g, ok := fs.bitmapGroups[b]
+		if !ok {
+			continue
+		}
+		// a bitmap split across reads is captured a piece at a time
+		bitmap := fs.partial[b]
+		if bitmap == nil {
+			bitmap = make([]byte, fs.blockSize)
+		}
+		if capture(p, pos, bitmap, fs.start+b*fs.blockSize) {
+			delete(fs.bitmapGroups, b)
+			delete(fs.partial, b)
+			fs.bitmaps[g] = bitmap
+		} else {
+			fs.partial[b] = bitmap
+		}
+	}
+
+	// zero the free blocks
+	var zeroed int64
+	for b := first; b <= last; b++ {
+		if b < fs.firstDataBlock || b >= fs.blocks {
+			continue
+		}
+		g, bit := (b-fs.firstDataBlock)/fs.blocksPerGroup, (b-fs.firstDataBlock)%fs.blocksPerGroup
+		bitmap := fs.bitmaps[g]
+		if bitmap == nil || bitmap[bit/8]&(1<<uint(bit%8)) != 0 {
+			continue
+		}
+		blockStart, blockEnd := fs.start+b*fs.blockSize, fs.start+(b+1)*fs.blockSize
+		if blockStart < pos {
+			blockStart = pos
+		}
+		if blockEnd > end {
+			blockEnd = end
+		}
+		zero := p[blockStart-pos : blockEnd-pos]
+		for i := range zero {
+			zero[i] = 0
+		}
+		zeroed += int64(len(zero))
+	}
+
+	// forget bitmaps for groups which have gone by
+	for g := range fs.bitmaps {
+		if fs.start+(fs.firstDataBlock+(g+1)*fs.blocksPerGroup)*fs.blockSize <= end {
+			delete(fs.bitmaps, g)
+		}
+	}
+	return zeroed
+}
+
+// block() returns the filesystem block at offset in the disk image.
+func (fs *extFreeBlocks) block(offset int64) int64 {
+	if offset < fs.start {
+		return -1
+	}
+	return (offset - fs.start) / fs.blockSize
+}
+
+// parseSuperblock() reads the superblock, returning false if it's not an ext
+// filesystem whose free blocks can safely be zeroed.
+func (fs *extFreeBlocks) parseSuperblock() bool {
+	sb := fs.superblock
+	if binary.LittleEndian.Uint16(sb[56:]) != 0xef53 {
+		return false
+	}
+	state := binary.LittleEndian.Uint16(sb[58:])
+	incompat := binary.LittleEndian.Uint32(sb[96:])
+	roCompat := binary.LittleEndian.Uint32(sb[100:])
+	if state&extStateValid == 0 || state&extStateErrors != 0 ||
+		incompat&(extIncompatRecover|extIncompatMetaBG) != 0 || roCompat&extROCompatBigalloc != 0 {
+		return false
+	}
+
+	logBlockSize := binary.LittleEndian.Uint32(sb[24:])
+	if logBlockSize > 6 {
+		return false
+	}
+	fs.blockSize = 1024 << logBlockSize
+	fs.firstDataBlock = int64(binary.LittleEndian.Uint32(sb[20:]))
+	fs.blocksPerGroup = int64(binary.LittleEndian.Uint32(sb[32:]))
+	fs.blocks = int64(binary.LittleEndian.Uint32(sb[4:]))
+	fs.descSize = extMinDescSize
+	if incompat&extIncompat64Bit != 0 {
+		fs.blocks |= int64(binary.LittleEndian.Uint32(sb[0x150:])) << 32
+		fs.descSize = int64(binary.LittleEndian.Uint16(sb[0xfe:]))
+	}
+	if fs.blocksPerGroup == 0 || fs.blocksPerGroup > 8*fs.blockSize || fs.descSize < extMinDescSize ||
+		fs.blocks <= fs.firstDataBlock || fs.start+fs.blocks*fs.blockSize > fs.end {
+		return false
+	}
+
+	groups := (fs.blocks - fs.firstDataBlock + fs.blocksPerGroup - 1) / fs.blocksPerGroup
+	if groups*fs.descSize > extMaxGroupDescBytes {
+		return false
+	}
+	fs.gdt = make([]byte, groups*fs.descSize)
+	fs.gdtStart = fs.start + (fs.firstDataBlock+1)*fs.blockSize
+	return true
+}
+
+// parseGroupDescriptors() finds the block bitmaps which are yet to come,
+// given that the image has been read as far as pos.
+func (fs *extFreeBlocks) parseGroupDescriptors(pos int64) {
+	fs.bitmapGroups = make(map[int64]int64)
+	fs.partial = make(map[int64][]byte)
+	fs.bitmaps = make(map[int64][]byte)
+	for g := int64(0); g*fs.descSize < int64(len(fs.gdt)); g++ {
+		desc := fs.gdt[g*fs.descSize : (g+1)*fs.descSize]
+		if binary.LittleEndian.Uint16(desc[0x12:])&extGroupBlockUninit != 0 {
+			continue
+		}
+		bitmap := int64(binary.LittleEndian.Uint32(desc[0:]))
+		if fs.descSize >= 64 {
+			bitmap |= int64(binary.LittleEndian.Uint32(desc[0x20:])) << 32
+		}
+		if bitmap < fs.blocks && fs.start+bitmap*fs.blockSize >= pos {
+			fs.bitmapGroups[bitmap] = g
+		}
+	}
+}
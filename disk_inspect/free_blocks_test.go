@@ -0,0 +1,163 @@
+package disk_inspect
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	"github.com/willglynn/go_ami_tools/fs_image"
+)
+
+// oddReader returns reads of varying sizes, so that blocks and bitmaps are
+// split across them.
+type oddReader struct {
+	r    io.Reader
+	size int
+}
+
+func (or *oddReader) Read(p []byte) (int, error) {
+	or.size = or.size*7%65521 + 1
+	if len(p) > or.size {
+		p = p[:or.size]
+	}
+	return or.r.Read(p)
+}
+
+// testDeletedFile() makes an ext filesystem with mke2fs, holding a file "kept"
+// and a file "deleted" which is then deleted, returning the image and both
+// files' contents.
+func testDeletedFile(t *testing.T, dir string, mke2fsArgs ...string) (image, kept, deleted []byte) {
+	t.Helper()
+	rng := rand.New(rand.NewSource(1))
+	kept, deleted = make([]byte, 3<<20+123), make([]byte, 5<<20+456)
+	rng.Read(kept)
+	rng.Read(deleted)
+
+	root := filepath.Join(dir, "root")
+	os.RemoveAll(root)
+	if err := os.Mkdir(root, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	for name, contents := range map[string][]byte{"kept": kept, "deleted": deleted} {
+		if err := ioutil.WriteFile(filepath.Join(root, name), contents, 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	filename := filepath.Join(dir, "fs.img")
+	os.Remove(filename)
+	args := append(append([]string{"-q", "-F", "-d", root}, mke2fsArgs...), filename, "64M")
+	if out, err := exec.Command("mke2fs", args...).CombinedOutput(); err != nil {
+		t.Fatalf("mke2fs %q: %v\n%s", args, err, out)
+	}
+	if out, err := exec.Command("debugfs", "-w", "-R", "rm /deleted", filename).CombinedOutput(); err != nil {
+		t.Fatalf("debugfs: %v\n%s", err, out)
+	}
+	image, err := ioutil.ReadFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return image, kept, deleted
+}
+
+func TestZeroFreeBlocks(t *testing.T) {
+	for _, tool := range []string{"mke2fs", "debugfs", "e2fsck"} {
+		if _, err := exec.LookPath(tool); err != nil {
+			t.Skipf("%s not found", tool)
+		}
+	}
+	dir, err := ioutil.TempDir("", "free_blocks")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, test := range []struct {
+		name        string
+		mke2fsArgs  []string
+		partitioned bool
+	}{
+		{name: "ext4", mke2fsArgs: []string{"-t", "ext4", "-g", "1024"}},
+		{name: "ext2 with 1 KiB blocks", mke2fsArgs: []string{"-t", "ext2", "-b", "1024"}},
+		{name: "ext4 without flex_bg", mke2fsArgs: []string{"-t", "ext4", "-g", "1024", "-O", "^flex_bg,^metadata_csum,^uninit_bg"}},
+		{name: "GPT", mke2fsArgs: []string{"-t", "ext4", "-g", "1024"}, partitioned: true},
+	} {
+		image, kept, deleted := testDeletedFile(t, dir, test.mke2fsArgs...)
+		offset := 0
+		if test.partitioned {
+			diskSize := int64(len(image) + 2<<20)
+			p, err := fs_image.NewPartitioned(ioutil.NopCloser(io.MultiReader(bytes.NewReader(image), bytes.NewReader(make([]byte, fs_image.GPT.PartitionSize(diskSize)-int64(len(image)))))), diskSize, fs_image.GPT)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if image, err = ioutil.ReadAll(p); err != nil {
+				t.Fatal(err)
+			}
+			offset = 1 << 20
+		}
+		if !bytes.Contains(image, deleted[:4096]) {
+			t.Fatalf("%s: the deleted file's contents aren't in the image", test.name)
+		}
+
+		zfb := ZeroFreeBlocks(&oddReader{r: bytes.NewReader(image)})
+		zeroed, err := ioutil.ReadAll(zfb)
+		if err != nil {
+			t.Fatalf("%s: Read() error = %v", test.name, err)
+		}
+		if len(zeroed) != len(image) {
+			t.Fatalf("%s: read %d bytes, expected %d", test.name, len(zeroed), len(image))
+		}
+		if bytes.Contains(zeroed, deleted[:4096]) || bytes.Contains(zeroed, deleted[len(deleted)-4096:]) {
+			t.Errorf("%s: the deleted file's contents weren't zeroed", test.name)
+		}
+		if zfb.Zeroed() < int64(len(deleted))-4096 {
+			t.Errorf("%s: Zeroed() = %d, expected at least %d", test.name, zfb.Zeroed(), len(deleted))
+		}
+
+		filename := filepath.Join(dir, "zeroed.img")
+		if err := ioutil.WriteFile(filename, zeroed[offset:offset+64<<20], 0o644); err != nil {
+			t.Fatal(err)
+		}
+		if out, err := exec.Command("e2fsck", "-fn", filename).CombinedOutput(); err != nil {
+			t.Errorf("%s: e2fsck: %v\n%s", test.name, err, out)
+		}
+		if out, err := exec.Command("debugfs", "-R", "cat /kept", filename).Output(); err != nil || !bytes.Equal(out, kept) {
+			t.Errorf("%s: the kept file's contents changed (%v)", test.name, err)
+		}
+	}
+
+	// filesystems which weren't cleanly unmounted are left alone
+	image, _, _ := testDeletedFile(t, dir, "-t", "ext4")
+	image[1024+58] = 0
+	zfb := ZeroFreeBlocks(bytes.NewReader(image))
+	if zeroed, err := ioutil.ReadAll(zfb); err != nil || !bytes.Equal(zeroed, image) || zfb.Zeroed() != 0 {
+		t.Errorf("unclean filesystem: Zeroed() = %d, error %v", zfb.Zeroed(), err)
+	}
+}
+
+func TestZeroFreeBlocksOther(t *testing.T) {
+	for _, image := range [][]byte{
+		nil,
+		[]byte("short"),
+		testDisk(false, testGRUB, testPartition{mbrType: 0xef, contents: testFAT(16, "BOOTX64 EFI")}),
+		bytes.Repeat([]byte("not a filesystem"), 1<<16),
+	} {
+		zfb := ZeroFreeBlocks(&oddReader{r: bytes.NewReader(image)})
+		if zeroed, err := ioutil.ReadAll(zfb); err != nil || !bytes.Equal(zeroed, image) || zfb.Zeroed() != 0 {
+			t.Errorf("%d byte image: Zeroed() = %d, error %v", len(image), zfb.Zeroed(), err)
+		}
+	}
+
+	// disks whose GPTs point outside the disk pass through unchanged too
+	for name, image := range testCorruptGPTs() {
+		zfb := ZeroFreeBlocks(&oddReader{r: bytes.NewReader(image)})
+		if zeroed, err := ioutil.ReadAll(zfb); err != nil || !bytes.Equal(zeroed, image) || zfb.Zeroed() != 0 {
+			t.Errorf("%s: Zeroed() = %d, error %v", name, zfb.Zeroed(), err)
+		}
+	}
+}
@@ -0,0 +1,208 @@
+package disk_inspect
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+)
+
+// Report describes what's in a disk image, as far as booting it is concerned.
+type Report struct {
+	// PartitionTable is "MBR", "GPT", or "" if there isn't one.
+	PartitionTable string
+	Partitions     []Partition
+
+	// Filesystem is what the disk holds, if it has no partition table; see
+	// Partition.Filesystem.
+	Filesystem string
+
+	// BIOSBootLoader names the boot loader in the MBR, like "GRUB", or is
+	// "unknown" for boot code this package doesn't recognize, or "" if there's
+	// no boot code at all.
+	BIOSBootLoader string
+
+	// EFIArchitectures lists the architectures, like "x86_64" and "arm64",
+	// for which an EFI system partition has a boot loader at the removable
+	// media path, like \EFI\BOOT\BOOTX64.EFI.
+	EFIArchitectures []string
+
+	// Incomplete indicates that some of the image couldn't be examined, such
+	// as when it's read as a stream and something needed came before
+	// something else. The report says what could be found.
+	Incomplete bool
+}
+
+// Partition is an entry in a partition table.
+type Partition struct {
+	Number int
+	Start  int64
+	Size   int64
+
+	// Type describes the partition type, like "Linux filesystem" or "EFI
+	// system partition", or gives its MBR type byte or GPT type GUID.
+	Type string
+
+	// Bootable is set for MBR partitions marked active, and GPT partitions
+	// with the legacy BIOS bootable attribute.
+	Bootable bool
+
+	// Filesystem is what the partition holds, like "ext4", "xfs", or
+	// "vfat", or "" if it's not recognized.
+	Filesystem string
+}
+
+// ESP indicates if p is an EFI system partition.
+func (p *Partition) ESP() bool {
+	return p.Type == typeESP
+}
+
+// BIOSBoot indicates if the image has boot code in its MBR.
+func (r *Report) BIOSBoot() bool {
+	return r.BIOSBootLoader != ""
+}
+
+// UEFIBoot indicates if the image has an EFI system partition with a boot
+// loader on it.
+func (r *Report) UEFIBoot() bool {
+	return len(r.EFIArchitectures) > 0
+}
+
+// String() summarizes the report in a line.
+func (r *Report) String() string {
+	var parts []string
+	if r.PartitionTable == "" {
+		fs := r.Filesystem
+		if fs == "" {
+			fs = "unrecognized contents"
+		}
+		parts = append(parts, "no partition table, "+fs)
+	} else {
+		var partitions []string
+		for _, p := range r.Partitions {
+			description := fmt.Sprintf("%d: %s", p.Number, p.Type)
+			if p.Filesystem != "" {
+				description += " (" + p.Filesystem + ")"
+			}
+			partitions = append(partitions, description)
+		}
+		parts = append(parts, fmt.Sprintf("%s partition table [%s]", r.PartitionTable, strings.Join(partitions, ", ")))
+	}
+
+	switch {
+	case r.BIOSBoot() && r.UEFIBoot():
+		parts = append(parts, fmt.Sprintf("BIOS boot loader (%s) and UEFI boot loader (%s)", r.BIOSBootLoader, strings.Join(r.EFIArchitectures, ", ")))
+	case r.BIOSBoot():
+		parts = append(parts, fmt.Sprintf("BIOS boot loader (%s)", r.BIOSBootLoader))
+	case r.UEFIBoot():
+		parts = append(parts, fmt.Sprintf("UEFI boot loader (%s)", strings.Join(r.EFIArchitectures, ", ")))
+	default:
+		parts = append(parts, "no boot loader")
+	}
+	if r.Incomplete {
+		parts = append(parts, "incomplete")
+	}
+	return strings.Join(parts, "; ")
+}
+
+// errPassed indicates that something needed has already been streamed past.
+var errPassed = errors.New("already streamed past")
+
+// Inspect() examines a disk image of size bytes. It returns an error only if
+// r does; a disk full of garbage is just a Report of nothing much.
+func Inspect(r io.ReaderAt, size int64) (*Report, error) {
+	in := &inspector{r: r, size: size, report: &Report{}}
+	if err := in.inspect(); err != nil {
+		return nil, err
+	}
+	return in.report, nil
+}
+
+// inspector examines a disk image through a ReaderAt, which might be a
+// Stream.
+type inspector struct {
+	r      io.ReaderAt
+	size   int64
+	report *Report
+
+	// the last read is kept, since what's read next often overlaps it, and a
+	// Stream can't go back for it
+	last       []byte
+	lastOffset int64
+}
+
+// read() returns length bytes at offset, or fewer at the end of the image.
+// Reading past something a Stream has already passed marks the report as
+// incomplete and returns nil.
+func (in *inspector) read(offset, length int64) ([]byte, error) {
+	if offset >= in.size {
+		return nil, nil
+	}
+	if length > in.size-offset {
+		length = in.size - offset
+	}
+
+	// start with whatever overlaps the last read
+	var cached []byte
+	if offset >= in.lastOffset && offset < in.lastOffset+int64(len(in.last)) {
+		cached = in.last[offset-in.lastOffset:]
+		if int64(len(cached)) >= length {
+			return cached[:length], nil
+		}
+	}
+
+	b := make([]byte, length)
+	have := copy(b, cached)
+	n, err := in.r.ReadAt(b[have:], offset+int64(have))
+	if errors.Is(err, errPassed) {
+		in.report.Incomplete = true
+		return nil, nil
+	} else if err == io.EOF {
+		b = b[:have+n]
+	} else if err != nil {
+		return nil, err
+	}
+	in.last, in.lastOffset = b, offset
+	return b, nil
+}
+
+func (in *inspector) inspect() error {
+	// the MBR, GPT header, and GPT partition entries come first
+	head, err := in.read(0, gptEntriesEnd)
+	if err != nil || len(head) < sectorSize {
+		return err
+	}
+
+	if err := in.partitions(head); err != nil {
+		return err
+	}
+	if in.report.PartitionTable == "" {
+		fs, err := in.filesystem(0)
+		in.report.Filesystem = fs
+		return err
+	}
+
+	in.report.BIOSBootLoader = biosBootLoader(head[:sectorSize])
+
+	// partitions are examined in order, which matters for streams
+	partitions := make([]*Partition, len(in.report.Partitions))
+	for i := range in.report.Partitions {
+		partitions[i] = &in.report.Partitions[i]
+	}
+	sort.SliceStable(partitions, func(i, j int) bool {
+		return partitions[i].Start < partitions[j].Start
+	})
+	for _, p := range partitions {
+		if p.Filesystem, err = in.filesystem(p.Start); err != nil {
+			return err
+		}
+		if p.ESP() && p.Filesystem == "vfat" {
+			if err := in.efiBootLoaders(p.Start); err != nil {
+				return err
+			}
+		}
+	}
+	sort.Strings(in.report.EFIArchitectures)
+	return nil
+}
@@ -0,0 +1,412 @@
+package disk_inspect
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"hash/crc32"
+	"math"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// testFAT() returns a FAT16 or FAT32 filesystem holding the given files in
+// \EFI\BOOT, whose directory takes two clusters so that finding them means
+// following a cluster chain.
+func testFAT(bits int, loaders ...string) []byte {
+	var totalSectors, reserved, fatSectors, rootEntries int
+	if bits == 16 {
+		totalSectors, reserved, fatSectors, rootEntries = 8192, 1, 32, 512
+	} else {
+		totalSectors, reserved, fatSectors, rootEntries = 72000, 32, 563, 0
+	}
+	b := make([]byte, totalSectors*512)
+	copy(b, []byte{0xeb, 0x3c, 0x90})
+	copy(b[3:], "mkfs.fat")
+	binary.LittleEndian.PutUint16(b[11:], 512)
+	b[13] = 1
+	binary.LittleEndian.PutUint16(b[14:], uint16(reserved))
+	b[16] = 2
+	binary.LittleEndian.PutUint16(b[17:], uint16(rootEntries))
+	b[21] = 0xf8
+	b[510], b[511] = 0x55, 0xaa
+
+	fat := b[reserved*512 : (reserved+fatSectors)*512]
+	rootStart := (reserved + 2*fatSectors) * 512
+	dataStart := rootStart + rootEntries*32
+	cluster := func(c int) []byte {
+		return b[dataStart+(c-2)*512 : dataStart+(c-1)*512]
+	}
+	chain := func(c, next int) {
+		if bits == 16 {
+			if next == 0 {
+				next = 0xffff
+			}
+			binary.LittleEndian.PutUint16(fat[c*2:], uint16(next))
+		} else {
+			if next == 0 {
+				next = 0x0fffffff
+			}
+			binary.LittleEndian.PutUint32(fat[c*4:], uint32(next))
+		}
+	}
+	entry := func(dir []byte, i int, name string, attr byte, c int) {
+		e := dir[i*32 : i*32+32]
+		copy(e, name)
+		e[11] = attr
+		binary.LittleEndian.PutUint16(e[20:], uint16(c>>16))
+		binary.LittleEndian.PutUint16(e[26:], uint16(c))
+	}
+
+	var root []byte
+	var efi int
+	if bits == 16 {
+		binary.LittleEndian.PutUint16(b[19:], uint16(totalSectors))
+		binary.LittleEndian.PutUint16(b[22:], uint16(fatSectors))
+		copy(b[54:], "FAT16   ")
+		root = b[rootStart:dataStart]
+		efi = 2
+	} else {
+		binary.LittleEndian.PutUint32(b[32:], uint32(totalSectors))
+		binary.LittleEndian.PutUint32(b[36:], uint32(fatSectors))
+		binary.LittleEndian.PutUint32(b[44:], 2)
+		copy(b[82:], "FAT32   ")
+		root = cluster(2)
+		chain(2, 0)
+		efi = 3
+	}
+	boot, boot2, file := efi+1, efi+2, efi+3
+
+	entry(root, 0, "ESP        ", 0x08, 0)
+	entry(root, 1, "\xe5FI        ", 0x10, 0)
+	entry(root, 2, "EFI        ", 0x10, efi)
+	chain(efi, 0)
+	entry(cluster(efi), 0, ".          ", 0x10, efi)
+	entry(cluster(efi), 1, "..         ", 0x10, 0)
+	entry(cluster(efi), 2, "Bboot      ", 0x0f, 0) // a long name entry
+	entry(cluster(efi), 3, "BOOT       ", 0x10, boot)
+	chain(boot, boot2)
+	chain(boot2, 0)
+	for i := 0; i < 16; i++ {
+		entry(cluster(boot), i, "\xe5ELETED    ", 0x20, 0)
+	}
+	for i, name := range loaders {
+		entry(cluster(boot2), i, name, 0x20, file)
+	}
+	chain(file, 0)
+	return b
+}
+
+// testExt() returns the start of an ext filesystem with the given feature
+// flags.
+func testExt(compat, incompat uint32) []byte {
+	b := make([]byte, 64<<10)
+	sb := b[1024:]
+	binary.LittleEndian.PutUint16(sb[56:], 0xef53)
+	binary.LittleEndian.PutUint32(sb[92:], compat)
+	binary.LittleEndian.PutUint32(sb[96:], incompat)
+	return b
+}
+
+func testXFS() []byte {
+	b := make([]byte, 64<<10)
+	copy(b, "XFSB")
+	return b
+}
+
+type testPartition struct {
+	mbrType  byte
+	gptType  string
+	bootable bool
+	contents []byte
+}
+
+// testGUID() encodes a GUID the way guid() decodes it.
+func testGUID(s string) []byte {
+	raw, err := hex.DecodeString(strings.Replace(s, "-", "", -1))
+	if err != nil {
+		panic(err)
+	}
+	b := make([]byte, 16)
+	binary.LittleEndian.PutUint32(b[0:], binary.BigEndian.Uint32(raw[0:]))
+	binary.LittleEndian.PutUint16(b[4:], binary.BigEndian.Uint16(raw[4:]))
+	binary.LittleEndian.PutUint16(b[6:], binary.BigEndian.Uint16(raw[6:]))
+	copy(b[8:], raw[8:])
+	return b
+}
+
+// testDisk() lays out partitions 1 MiB apart, with an MBR or GPT.
+func testDisk(gpt bool, bootCode string, partitions ...testPartition) []byte {
+	var starts []int
+	size := 1 << 20
+	for _, p := range partitions {
+		starts = append(starts, size)
+		size += (len(p.contents) + 1<<20 - 1) &^ (1<<20 - 1)
+	}
+	size += 1 << 20
+	disk := make([]byte, size)
+	copy(disk, bootCode)
+	disk[510], disk[511] = 0x55, 0xaa
+
+	if !gpt {
+		for i, p := range partitions {
+			entry := disk[446+16*i:]
+			if p.bootable {
+				entry[0] = 0x80
+			}
+			entry[4] = p.mbrType
+			binary.LittleEndian.PutUint32(entry[8:], uint32(starts[i]/512))
+			binary.LittleEndian.PutUint32(entry[12:], uint32(len(p.contents)/512))
+			copy(disk[starts[i]:], p.contents)
+		}
+		return disk
+	}
+
+	entry := disk[446:]
+	entry[4] = 0xee
+	binary.LittleEndian.PutUint32(entry[8:], 1)
+	binary.LittleEndian.PutUint32(entry[12:], uint32(size/512-1))
+
+	entries := disk[1024 : 1024+128*128]
+	for i, p := range partitions {
+		e := entries[i*128:]
+		copy(e, testGUID(p.gptType))
+		copy(e[16:], testGUID("01234567-89AB-CDEF-0123-456789ABCDEF"))
+		binary.LittleEndian.PutUint64(e[32:], uint64(starts[i]/512))
+		binary.LittleEndian.PutUint64(e[40:], uint64((starts[i]+len(p.contents))/512-1))
+		if p.bootable {
+			binary.LittleEndian.PutUint64(e[48:], gptBIOSBootableAttribute)
+		}
+		copy(disk[starts[i]:], p.contents)
+	}
+	header := disk[512:1024]
+	copy(header, "EFI PART")
+	binary.LittleEndian.PutUint32(header[8:], 0x10000)
+	binary.LittleEndian.PutUint32(header[12:], 92)
+	binary.LittleEndian.PutUint64(header[24:], 1)
+	binary.LittleEndian.PutUint64(header[72:], 2)
+	binary.LittleEndian.PutUint32(header[80:], 128)
+	binary.LittleEndian.PutUint32(header[84:], 128)
+	binary.LittleEndian.PutUint32(header[88:], crc32.ChecksumIEEE(entries))
+	binary.LittleEndian.PutUint32(header[16:], crc32.ChecksumIEEE(header[:92]))
+	return disk
+}
+
+const testGRUB = "\xeb\x63\x90\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00GRUB \x00Geom\x00Hard Disk\x00Read\x00 Error"
+
+func TestInspect(t *testing.T) {
+	for _, test := range []struct {
+		name   string
+		disk   []byte
+		report string
+		want   Report
+	}{
+		{
+			name: "GPT hybrid",
+			disk: testDisk(true, testGRUB,
+				testPartition{gptType: "21686148-6449-6E6F-744E-656564454649", contents: make([]byte, 1<<20)},
+				testPartition{gptType: "C12A7328-F81F-11D2-BA4B-00A0C93EC93B", contents: testFAT(32, "BOOTX64 EFI", "GRUBX64 EFI", "BOOTAA64EFI")},
+				testPartition{gptType: "0FC63DAF-8483-4772-8E79-3D69D8477DE4", contents: testExt(extCompatHasJournal, extIncompatExtents)},
+			),
+			report: "GPT partition table [1: BIOS boot partition, 2: EFI system partition (vfat), 3: Linux filesystem (ext4)]; BIOS boot loader (GRUB) and UEFI boot loader (arm64, x86_64)",
+			want: Report{
+				PartitionTable: "GPT",
+				Partitions: []Partition{
+					{Number: 1, Start: 1 << 20, Size: 1 << 20, Type: typeBIOSBoot},
+					{Number: 2, Start: 2 << 20, Size: 72000 * 512, Type: typeESP, Filesystem: "vfat"},
+					{Number: 3, Start: 38 << 20, Size: 64 << 10, Type: "Linux filesystem", Filesystem: "ext4"},
+				},
+				BIOSBootLoader:   "GRUB",
+				EFIArchitectures: []string{"arm64", "x86_64"},
+			},
+		},
+		{
+			name: "MBR UEFI",
+			disk: testDisk(false, "",
+				testPartition{mbrType: 0xef, contents: testFAT(16, "BOOTAA64EFI")},
+				testPartition{mbrType: 0x83, contents: testXFS()},
+			),
+			report: "MBR partition table [1: EFI system partition (vfat), 2: Linux (xfs)]; UEFI boot loader (arm64)",
+			want: Report{
+				PartitionTable: "MBR",
+				Partitions: []Partition{
+					{Number: 1, Start: 1 << 20, Size: 4 << 20, Type: typeESP, Filesystem: "vfat"},
+					{Number: 2, Start: 5 << 20, Size: 64 << 10, Type: "Linux", Filesystem: "xfs"},
+				},
+				EFIArchitectures: []string{"arm64"},
+			},
+		},
+		{
+			name: "MBR without boot code",
+			disk: testDisk(false, "",
+				testPartition{mbrType: 0x83, bootable: true, contents: testExt(0, 0)},
+				testPartition{mbrType: 0xda, contents: make([]byte, 512)},
+			),
+			report: "MBR partition table [1: Linux (ext2), 2: type 0xda]; no boot loader",
+			want: Report{
+				PartitionTable: "MBR",
+				Partitions: []Partition{
+					{Number: 1, Start: 1 << 20, Size: 64 << 10, Type: "Linux", Bootable: true, Filesystem: "ext2"},
+					{Number: 2, Start: 2 << 20, Size: 512, Type: "type 0xda"},
+				},
+			},
+		},
+		{
+			name:   "GPT empty ESP",
+			disk:   testDisk(true, "\xfa\xeb\xfe", testPartition{gptType: "C12A7328-F81F-11D2-BA4B-00A0C93EC93B", bootable: true, contents: testFAT(16, "SHIMX64 EFI")}),
+			report: "GPT partition table [1: EFI system partition (vfat)]; BIOS boot loader (unknown)",
+			want: Report{
+				PartitionTable: "GPT",
+				Partitions:     []Partition{{Number: 1, Start: 1 << 20, Size: 4 << 20, Type: typeESP, Bootable: true, Filesystem: "vfat"}},
+				BIOSBootLoader: "unknown",
+			},
+		},
+		{
+			name:   "ext3",
+			disk:   testExt(extCompatHasJournal, 0),
+			report: "no partition table, ext3; no boot loader",
+			want:   Report{Filesystem: "ext3"},
+		},
+		{
+			name:   "FAT",
+			disk:   testFAT(16),
+			report: "no partition table, vfat; no boot loader",
+			want:   Report{Filesystem: "vfat"},
+		},
+		{
+			name:   "zeros",
+			disk:   make([]byte, 1<<20),
+			report: "no partition table, unrecognized contents; no boot loader",
+			want:   Report{},
+		},
+		{
+			name:   "tiny",
+			disk:   []byte("tiny"),
+			report: "no partition table, unrecognized contents; no boot loader",
+			want:   Report{},
+		},
+	} {
+		got, err := Inspect(bytes.NewReader(test.disk), int64(len(test.disk)))
+		if err != nil {
+			t.Errorf("%s: Inspect() error = %v", test.name, err)
+		} else if !reflect.DeepEqual(*got, test.want) {
+			t.Errorf("%s: Inspect() = %+v, want %+v", test.name, *got, test.want)
+		} else if got.String() != test.report {
+			t.Errorf("%s: String() = %q, want %q", test.name, got.String(), test.report)
+		}
+
+		for _, chunk := range []int{511, 64 << 10, 1 << 20} {
+			s := NewStream(int64(len(test.disk)))
+			for i := 0; i < len(test.disk); i += chunk {
+				end := i + chunk
+				if end > len(test.disk) {
+					end = len(test.disk)
+				}
+				if n, err := s.Write(test.disk[i:end]); n != end-i || err != nil {
+					t.Fatalf("%s: Write() = %d, %v", test.name, n, err)
+				}
+			}
+			got, err := s.Report()
+			if err != nil {
+				t.Errorf("%s: %d byte writes: Report() error = %v", test.name, chunk, err)
+			} else if !reflect.DeepEqual(*got, test.want) {
+				t.Errorf("%s: %d byte writes: Report() = %+v, want %+v", test.name, chunk, *got, test.want)
+			}
+		}
+	}
+}
+
+func TestStreamIncomplete(t *testing.T) {
+	// the BOOT directory comes before the EFI directory, and both are past
+	// what's read to identify the filesystem
+	esp := testFAT(16, "BOOTX64 EFI")
+	fat, root, data := esp[512:], esp[(1+64)*512:], esp[(1+64+32)*512:]
+	cluster := func(c int) []byte {
+		return data[(c-2)*512 : (c-1)*512]
+	}
+	copy(cluster(200), cluster(2))
+	copy(cluster(150), cluster(3))
+	root[2*32+26] = 200
+	cluster(200)[3*32+26] = 150
+	binary.LittleEndian.PutUint16(fat[150*2:], 4)
+	binary.LittleEndian.PutUint16(fat[200*2:], 0xffff)
+	disk := testDisk(false, testGRUB, testPartition{mbrType: 0xef, contents: esp})
+
+	if report, err := Inspect(bytes.NewReader(disk), int64(len(disk))); err != nil || report.Incomplete || len(report.EFIArchitectures) != 1 {
+		t.Errorf("Inspect() = %+v, %v", report, err)
+	}
+
+	s := NewStream(int64(len(disk)))
+	for i := 0; i < len(disk); i += 512 {
+		s.Write(disk[i : i+512])
+	}
+	report, err := s.Report()
+	if err != nil || !report.Incomplete || len(report.EFIArchitectures) != 0 {
+		t.Errorf("Report() = %+v, %v", report, err)
+	}
+	if want := "MBR partition table [1: EFI system partition (vfat)]; BIOS boot loader (GRUB); incomplete"; report.String() != want {
+		t.Errorf("String() = %q, want %q", report.String(), want)
+	}
+
+	// streams which end early are reported on as far as they go
+	s = NewStream(int64(len(disk)))
+	s.Write(disk[:1<<20])
+	report, err = s.Report()
+	if err != nil || report.PartitionTable != "MBR" || report.Partitions[0].Filesystem != "" {
+		t.Errorf("short stream: Report() = %+v, %v", report, err)
+	}
+}
+
+// testCorruptGPTs() returns GPT disks whose header and entries have valid
+// CRCs, but nonsensical contents.
+func testCorruptGPTs() map[string][]byte {
+	disks := make(map[string][]byte)
+	for name, corrupt := range map[string]func(header, entries []byte){
+		"entries past the end": func(header, entries []byte) {
+			binary.LittleEndian.PutUint64(header[72:], math.MaxUint64)
+		},
+		"entries in the MBR": func(header, entries []byte) {
+			binary.LittleEndian.PutUint64(header[72:], 0)
+		},
+		"too many entries": func(header, entries []byte) {
+			binary.LittleEndian.PutUint32(header[80:], math.MaxUint32)
+			binary.LittleEndian.PutUint32(header[84:], math.MaxUint32)
+		},
+		"backwards partition": func(header, entries []byte) {
+			binary.LittleEndian.PutUint64(entries[40:], 1)
+		},
+		"partition past the end": func(header, entries []byte) {
+			binary.LittleEndian.PutUint64(entries[32:], 1<<62)
+			binary.LittleEndian.PutUint64(entries[40:], math.MaxUint64)
+		},
+	} {
+		disk := testDisk(true, testGRUB, testPartition{gptType: "0FC63DAF-8483-4772-8E79-3D69D8477DE4", contents: testExt(0, 0)})
+		header, entries := disk[512:1024], disk[1024:1024+128*128]
+		corrupt(header, entries)
+		binary.LittleEndian.PutUint32(header[88:], crc32.ChecksumIEEE(entries))
+		binary.LittleEndian.PutUint32(header[16:], 0)
+		binary.LittleEndian.PutUint32(header[16:], crc32.ChecksumIEEE(header[:92]))
+		disks[name] = disk
+	}
+	return disks
+}
+
+func TestInspectCorruptGPT(t *testing.T) {
+	for name, disk := range testCorruptGPTs() {
+		report, err := Inspect(bytes.NewReader(disk), int64(len(disk)))
+		if err != nil {
+			t.Errorf("%s: Inspect() error = %v", name, err)
+			continue
+		}
+		if report.PartitionTable != "GPT" || len(report.Partitions) != 0 {
+			t.Errorf("%s: Inspect() = %+v", name, report)
+		}
+
+		s := NewStream(int64(len(disk)))
+		s.Write(disk)
+		if report, err := s.Report(); err != nil || len(report.Partitions) != 0 {
+			t.Errorf("%s: Report() = %+v, %v", name, report, err)
+		}
+	}
+}
@@ -0,0 +1,197 @@
+package disk_inspect
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"math"
+)
+
+const (
+	sectorSize = 512
+
+	// the MBR, the GPT header, and the usual 128 GPT partition entries
+	gptEntriesEnd = 34 * sectorSize
+
+	gptBIOSBootableAttribute = 1 << 2
+)
+
+const (
+	typeESP      = "EFI system partition"
+	typeBIOSBoot = "BIOS boot partition"
+)
+
+// mbrTypes names MBR partition types.
+var mbrTypes = map[byte]string{
+	0x01: "FAT12",
+	0x04: "FAT16",
+	0x05: "extended",
+	0x06: "FAT16",
+	0x07: "NTFS or exFAT",
+	0x0b: "FAT32",
+	0x0c: "FAT32",
+	0x0e: "FAT16",
+	0x0f: "extended",
+	0x82: "Linux swap",
+	0x83: "Linux",
+	0x85: "Linux extended",
+	0x8e: "Linux LVM",
+	0xee: "GPT protective",
+	0xef: typeESP,
+	0xfd: "Linux RAID",
+}
+
+// gptTypes names GPT partition type GUIDs.
+var gptTypes = map[string]string{
+	"C12A7328-F81F-11D2-BA4B-00A0C93EC93B": typeESP,
+	"21686148-6449-6E6F-744E-656564454649": typeBIOSBoot,
+	"0FC63DAF-8483-4772-8E79-3D69D8477DE4": "Linux filesystem",
+	"44479540-F297-41B2-9AF7-D131D5F0458A": "Linux root (x86)",
+	"4F68BCE3-E8CD-4DB1-96E7-FBCAF984B709": "Linux root (x86-64)",
+	"B921B045-1DF0-41C3-AF44-4C6F280D3FAE": "Linux root (ARM64)",
+	"BC13C2FF-59E6-4262-A352-B275FD6F7172": "Linux extended boot",
+	"0657FD6D-A4AB-43C4-84E5-0933C84B4F4F": "Linux swap",
+	"E6D6D379-F507-44C2-A23C-238F2A3DF928": "Linux LVM",
+	"A19D880F-05FC-4D3B-A006-743F0F84911E": "Linux RAID",
+	"EBD0A0A2-B9E5-4433-87C0-68B6B72699C7": "Microsoft basic data",
+}
+
+// guid() formats a GUID in GPT's mixed-endian encoding.
+func guid(b []byte) string {
+	return fmt.Sprintf("%08X-%04X-%04X-%X-%X",
+		binary.LittleEndian.Uint32(b[0:]), binary.LittleEndian.Uint16(b[4:]), binary.LittleEndian.Uint16(b[6:]), b[8:10], b[10:16])
+}
+
+// partitions() reads the partition table, if any, given the first sectors
+// of the disk.
+func (in *inspector) partitions(head []byte) error {
+	mbr := head[:sectorSize]
+	if mbr[510] != 0x55 || mbr[511] != 0xaa {
+		return nil
+	}
+
+	// a filesystem's boot sector has the same signature
+	if identify(head) != "" {
+		return nil
+	}
+
+	var partitions []Partition
+	for i := 0; i < 4; i++ {
+		entry := mbr[446+16*i : 462+16*i]
+		status, partitionType := entry[0], entry[4]
+		start := int64(binary.LittleEndian.Uint32(entry[8:])) * sectorSize
+		size := int64(binary.LittleEndian.Uint32(entry[12:])) * sectorSize
+		if status != 0 && status != 0x80 {
+			// this isn't an MBR after all
+			return nil
+		}
+		if partitionType == 0 || size == 0 {
+			continue
+		}
+		if partitionType == 0xee {
+			return in.gpt(head)
+		}
+		description, ok := mbrTypes[partitionType]
+		if !ok {
+			description = fmt.Sprintf("type %#02x", partitionType)
+		}
+		partitions = append(partitions, Partition{
+			Number:   i + 1,
+			Start:    start,
+			Size:     size,
+			Type:     description,
+			Bootable: status == 0x80,
+		})
+	}
+	if len(partitions) > 0 {
+		in.report.PartitionTable = "MBR"
+		in.report.Partitions = partitions
+	}
+	return nil
+}
+
+// gpt() reads a GUID partition table, given the first sectors of the disk.
+func (in *inspector) gpt(head []byte) error {
+	if len(head) < 2*sectorSize {
+		return nil
+	}
+	header := head[sectorSize : 2*sectorSize]
+	headerSize := binary.LittleEndian.Uint32(header[12:])
+	if !bytes.Equal(header[:8], []byte("EFI PART")) || headerSize < 92 || headerSize > sectorSize {
+		return nil
+	}
+	checked := append([]byte{}, header[:headerSize]...)
+	binary.LittleEndian.PutUint32(checked[16:], 0)
+	if crc32.ChecksumIEEE(checked) != binary.LittleEndian.Uint32(header[16:]) {
+		return nil
+	}
+	in.report.PartitionTable = "GPT"
+
+	// the entries come after the header and before the end of the disk, and
+	// there can't be more than 1 MiB of them
+	entriesLBA := binary.LittleEndian.Uint64(header[72:])
+	count := int64(binary.LittleEndian.Uint32(header[80:]))
+	entrySize := int64(binary.LittleEndian.Uint32(header[84:]))
+	if entriesLBA < 2 || entriesLBA >= uint64(in.size/sectorSize) || entrySize < 128 || count > (1<<20)/entrySize {
+		return nil
+	}
+	entriesStart := int64(entriesLBA) * sectorSize
+	var entries []byte
+	if entriesStart+count*entrySize <= int64(len(head)) {
+		entries = head[entriesStart : entriesStart+count*entrySize]
+	} else {
+		var err error
+		if entries, err = in.read(entriesStart, count*entrySize); err != nil {
+			return err
+		}
+	}
+
+	for i := int64(0); (i+1)*entrySize <= int64(len(entries)); i++ {
+		entry := entries[i*entrySize : (i+1)*entrySize]
+		if bytes.Equal(entry[:16], make([]byte, 16)) {
+			continue
+		}
+		first := binary.LittleEndian.Uint64(entry[32:])
+		last := binary.LittleEndian.Uint64(entry[40:])
+		if last < first || last >= math.MaxInt64/sectorSize {
+			continue
+		}
+		typeGUID := guid(entry[:16])
+		description, ok := gptTypes[typeGUID]
+		if !ok {
+			description = typeGUID
+		}
+		in.report.Partitions = append(in.report.Partitions, Partition{
+			Number:   int(i + 1),
+			Start:    int64(first) * sectorSize,
+			Size:     int64(last-first+1) * sectorSize,
+			Type:     description,
+			Bootable: binary.LittleEndian.Uint64(entry[48:])&gptBIOSBootableAttribute != 0,
+		})
+	}
+	return nil
+}
+
+// biosBootLoaders recognizes boot code by the messages it contains.
+var biosBootLoaders = []struct {
+	name, message string
+}{
+	{"GRUB", "GRUB"},
+	{"LILO", "LILO"},
+	{"Windows", "Invalid partition table"},
+}
+
+// biosBootLoader() identifies the boot loader in an MBR.
+func biosBootLoader(mbr []byte) string {
+	code := mbr[:440]
+	if bytes.Equal(code, make([]byte, len(code))) {
+		return ""
+	}
+	for _, bl := range biosBootLoaders {
+		if bytes.Contains(code, []byte(bl.message)) {
+			return bl.name
+		}
+	}
+	return "unknown"
+}
@@ -0,0 +1,107 @@
+package disk_inspect
+
+import (
+	"io"
+)
+
+// Stream inspects a disk image as it's written, for images which can only be
+// read once, like decompressed ones. Everything the inspector needs is
+// usually near the start of the image, or the start of a partition, so it
+// can keep up; when it can't, the Report is Incomplete.
+type Stream struct {
+	pos      int64
+	pending  *streamRequest
+	requests chan *streamRequest
+	closed   chan struct{}
+	done     chan struct{}
+
+	report *Report
+	err    error
+}
+
+// streamRequest is a ReadAt() call waiting for its data to be written.
+type streamRequest struct {
+	b      []byte
+	offset int64
+	n      int
+	result chan error
+}
+
+// NewStream() starts inspecting a disk image of size bytes, which is to be
+// written to the returned Stream.
+func NewStream(size int64) *Stream {
+	s := &Stream{
+		requests: make(chan *streamRequest),
+		closed:   make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	go func() {
+		defer close(s.done)
+		s.report, s.err = Inspect(streamReader{s}, size)
+	}()
+	return s
+}
+
+// Write() passes the next part of the disk image to the inspector. It never
+// fails, so a Stream can be used with io.TeeReader() or io.MultiWriter().
+func (s *Stream) Write(p []byte) (int, error) {
+	start, end := s.pos, s.pos+int64(len(p))
+	s.pos = end
+	for {
+		// wait until the inspector wants something, or is done
+		if s.pending == nil {
+			select {
+			case s.pending = <-s.requests:
+			case <-s.done:
+				return len(p), nil
+			}
+		}
+
+		req := s.pending
+		need := req.offset + int64(req.n)
+		if need < start {
+			req.result <- errPassed
+			s.pending = nil
+			continue
+		} else if need >= end {
+			return len(p), nil
+		}
+		req.n += copy(req.b[req.n:], p[need-start:])
+		if req.n < len(req.b) {
+			return len(p), nil
+		}
+		req.result <- nil
+		s.pending = nil
+	}
+}
+
+// Report() returns the inspector's findings, once the whole image has been
+// written. If the image was shorter than its size, the inspector sees it end
+// early.
+func (s *Stream) Report() (*Report, error) {
+	close(s.closed)
+	if s.pending != nil {
+		s.pending.result <- io.EOF
+		s.pending = nil
+	}
+	<-s.done
+	return s.report, s.err
+}
+
+// streamReader is the inspector's view of a Stream.
+type streamReader struct {
+	s *Stream
+}
+
+// ReadAt() waits for b to be written, failing with errPassed if it already
+// has been.
+func (sr streamReader) ReadAt(b []byte, offset int64) (int, error) {
+	req := &streamRequest{b: b, offset: offset, result: make(chan error, 1)}
+	select {
+	case sr.s.requests <- req:
+	case <-sr.s.closed:
+		return 0, io.EOF
+	}
+	err := <-req.result
+	return req.n, err
+}
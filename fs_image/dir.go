@@ -0,0 +1,113 @@
+package fs_image
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// FromDirectory() reads the tree under dir, including ownership, modes,
+// extended attributes, symlinks, device nodes, and hard links. File contents
+// aren't read until the Nodes' Open() is called.
+//
+// Anything which matches one of excludes is left out. Patterns containing a
+// slash are matched against the whole path, relative to dir and starting with
+// "/", like "/var/cache/*"; others are matched against each name, like
+// "*.pyc". Excluding "/proc/*" keeps /proc itself but leaves it empty.
+func FromDirectory(dir string, excludes []string) (*Node, error) {
+	for _, pattern := range excludes {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("invalid exclude pattern %q", pattern)
+		}
+	}
+
+	links := make(map[fileID]*Node)
+	fi, err := os.Lstat(dir)
+	if err != nil {
+		return nil, err
+	}
+	if !fi.IsDir() {
+		return nil, fmt.Errorf("%s is not a directory", dir)
+	}
+	return fromFile(dir, "/", fi, excludes, links)
+}
+
+// excluded() indicates if the path, which is relative to the tree's root,
+// matches any of excludes.
+func excluded(p string, excludes []string) bool {
+	for _, pattern := range excludes {
+		subject := path.Base(p)
+		if strings.Contains(pattern, "/") {
+			subject = p
+		}
+		if matched, _ := path.Match(pattern, subject); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// fromFile() returns a Node for the file at filename, which is at p in the
+// tree.
+func fromFile(filename, p string, fi os.FileInfo, excludes []string, links map[fileID]*Node) (*Node, error) {
+	info := statInfo(fi)
+	if !fi.IsDir() && info.nlink > 1 {
+		if n := links[info.id]; n != nil {
+			return n, nil
+		}
+	}
+
+	n := &Node{
+		Mode:    fi.Mode(),
+		UID:     info.uid,
+		GID:     info.gid,
+		ModTime: fi.ModTime(),
+		Major:   info.major,
+		Minor:   info.minor,
+	}
+	if !fi.IsDir() && info.nlink > 1 {
+		links[info.id] = n
+	}
+
+	var err error
+	if n.Xattrs, err = readXattrs(filename, fi); err != nil {
+		return nil, fmt.Errorf("%s: %v", filename, err)
+	}
+
+	switch {
+	case fi.IsDir():
+		entries, err := ioutil.ReadDir(filename)
+		if err != nil {
+			return nil, err
+		}
+		n.Children = make(map[string]*Node, len(entries))
+		for _, entry := range entries {
+			childPath := path.Join(p, entry.Name())
+			if excluded(childPath, excludes) {
+				continue
+			}
+			child, err := fromFile(filepath.Join(filename, entry.Name()), childPath, entry, excludes, links)
+			if err != nil {
+				return nil, err
+			}
+			n.Children[entry.Name()] = child
+		}
+
+	case fi.Mode()&os.ModeSymlink != 0:
+		if n.Target, err = os.Readlink(filename); err != nil {
+			return nil, err
+		}
+
+	case fi.Mode().IsRegular():
+		n.Size = fi.Size()
+		n.Open = func() (io.ReadCloser, error) {
+			return os.Open(filename)
+		}
+	}
+
+	return n, nil
+}
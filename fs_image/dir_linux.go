@@ -0,0 +1,72 @@
+//go:build linux
+
+package fs_image
+
+import (
+	"os"
+	"strings"
+	"syscall"
+)
+
+// fileID identifies a file, so that hard links can be found.
+type fileID struct {
+	dev uint64
+	ino uint64
+}
+
+// fileInfo is what FromDirectory() needs beyond os.FileInfo.
+type fileInfo struct {
+	id           fileID
+	nlink        uint64
+	uid, gid     uint32
+	major, minor uint32
+}
+
+func statInfo(fi os.FileInfo) fileInfo {
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok {
+		return fileInfo{}
+	}
+	rdev := uint64(st.Rdev)
+	return fileInfo{
+		id:    fileID{uint64(st.Dev), uint64(st.Ino)},
+		nlink: uint64(st.Nlink),
+		uid:   st.Uid,
+		gid:   st.Gid,
+		major: uint32((rdev>>8)&0xfff | (rdev>>32)&^0xfff),
+		minor: uint32(rdev&0xff | (rdev>>12)&^0xff),
+	}
+}
+
+// readXattrs() returns a file's extended attributes. Symlinks' are skipped,
+// since package syscall can only read them by following the link.
+func readXattrs(filename string, fi os.FileInfo) (map[string][]byte, error) {
+	if fi.Mode()&os.ModeSymlink != 0 || fi.Mode()&(os.ModeDevice|os.ModeNamedPipe|os.ModeSocket) != 0 {
+		return nil, nil
+	}
+
+	size, err := syscall.Listxattr(filename, nil)
+	if err == syscall.ENOTSUP || size == 0 {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	list := make([]byte, size)
+	if size, err = syscall.Listxattr(filename, list); err != nil {
+		return nil, err
+	}
+
+	xattrs := make(map[string][]byte)
+	for _, name := range strings.Split(strings.TrimRight(string(list[:size]), "\x00"), "\x00") {
+		size, err := syscall.Getxattr(filename, name, nil)
+		if err != nil {
+			return nil, err
+		}
+		value := make([]byte, size)
+		if size, err = syscall.Getxattr(filename, name, value); err != nil {
+			return nil, err
+		}
+		xattrs[name] = value[:size]
+	}
+	return xattrs, nil
+}
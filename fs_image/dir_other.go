@@ -0,0 +1,29 @@
+//go:build !linux
+
+package fs_image
+
+import (
+	"os"
+)
+
+// fileID identifies a file, but hard links are only detected on Linux.
+type fileID struct{}
+
+// fileInfo is what FromDirectory() needs beyond os.FileInfo, which is only
+// available on Linux; elsewhere, everything belongs to root.
+type fileInfo struct {
+	id           fileID
+	nlink        uint64
+	uid, gid     uint32
+	major, minor uint32
+}
+
+func statInfo(fi os.FileInfo) fileInfo {
+	return fileInfo{nlink: 1}
+}
+
+// readXattrs() returns nothing, since extended attributes are only read on
+// Linux.
+func readXattrs(filename string, fi os.FileInfo) (map[string][]byte, error) {
+	return nil, nil
+}
@@ -0,0 +1,101 @@
+package fs_image
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestFromDirectory(t *testing.T) {
+	root := t.TempDir()
+	for _, d := range []string{"etc", "proc/1", "var/cache/apt", "src"} {
+		if err := os.MkdirAll(filepath.Join(root, d), 0o755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for name, contents := range map[string]string{
+		"etc/hostname":        "test\n",
+		"var/cache/apt/pkg":   "cached",
+		"src/main.py":         "print()",
+		"src/main.pyc":        "compiled",
+		"proc/1/cmdline":      "init",
+		"etc/not-really.pyc~": "kept",
+	} {
+		if err := ioutil.WriteFile(filepath.Join(root, name), []byte(contents), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Link(filepath.Join(root, "etc/hostname"), filepath.Join(root, "etc/hostname.bak")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("../etc/hostname", filepath.Join(root, "src/link")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chmod(filepath.Join(root, "src/main.py"), os.ModeSetuid|0o700); err != nil {
+		t.Fatal(err)
+	}
+
+	tree, err := FromDirectory(root, []string{"/proc/*", "/var/cache/*", "*.pyc"})
+	if err != nil {
+		t.Fatalf("FromDirectory() error = %v", err)
+	}
+
+	listing := make(map[string]os.FileMode)
+	var walk func(n *Node, p string)
+	walk = func(n *Node, p string) {
+		listing[p] = n.Mode.Type()
+		for name, child := range n.Children {
+			walk(child, p+"/"+name)
+		}
+	}
+	walk(tree, "")
+	expected := map[string]os.FileMode{
+		"":                     os.ModeDir,
+		"/etc":                 os.ModeDir,
+		"/etc/hostname":        0,
+		"/etc/hostname.bak":    0,
+		"/etc/not-really.pyc~": 0,
+		"/proc":                os.ModeDir,
+		"/var":                 os.ModeDir,
+		"/var/cache":           os.ModeDir,
+		"/src":                 os.ModeDir,
+		"/src/main.py":         0,
+		"/src/link":            os.ModeSymlink,
+	}
+	if !reflect.DeepEqual(listing, expected) {
+		t.Errorf("FromDirectory() returned %v, expected %v", listing, expected)
+	}
+
+	if mode := tree.Children["src"].Children["main.py"].Mode; mode != os.ModeSetuid|0o700 {
+		t.Errorf("main.py has mode %v", mode)
+	}
+
+	etc := tree.Children["etc"]
+	if etc.Children["hostname"] != etc.Children["hostname.bak"] {
+		t.Errorf("hard links weren't preserved")
+	}
+	if target := tree.Children["src"].Children["link"].Target; target != "../etc/hostname" {
+		t.Errorf("symlink target = %q", target)
+	}
+	hostname := etc.Children["hostname"]
+	if hostname.Size != 5 || hostname.UID != uint32(os.Getuid()) {
+		t.Errorf("hostname = %+v", hostname)
+	}
+	r, err := hostname.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	if contents, err := ioutil.ReadAll(r); err != nil || string(contents) != "test\n" {
+		t.Errorf("hostname contains %q, %v", contents, err)
+	}
+
+	if _, err := FromDirectory(root, []string{"["}); err == nil {
+		t.Errorf("FromDirectory() accepted an invalid pattern")
+	}
+	if _, err := FromDirectory(filepath.Join(root, "etc/hostname"), nil); err == nil {
+		t.Errorf("FromDirectory() accepted a file")
+	}
+}
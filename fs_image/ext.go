@@ -0,0 +1,758 @@
+package fs_image
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// ext2 and ext4 share a layout, described in the kernel's
+// Documentation/filesystems/ext4/ directory. Either way, this produces a
+// filesystem with 4 KiB blocks, 256-byte inodes, and sparse superblock
+// backups. ext4 adds extents and a journal, but leaves out flex_bg and
+// metadata checksums, which keeps the layout simple enough to stream. Every
+// field is little-endian.
+
+const (
+	extBlockSize      = 4096
+	extBlocksPerGroup = 8 * extBlockSize // one block bitmap's worth
+	extInodeSize      = 256
+	extInodesPerBlock = extBlockSize / extInodeSize
+	extInodeRatio     = 16384 // bytes per inode, as mke2fs does by default
+	extDescSize       = 32
+	extReservedPct    = 5
+
+	extRootIno      = 2
+	extJournalIno   = 8
+	extLostFoundIno = 11
+	extFirstIno     = 11
+
+	// ext4 allows 65000 links; directories with more subdirectories than
+	// that have a link count of 1 instead
+	extMaxLinks = 65000
+
+	// a minimum of usable space in the last group, below which it's dropped
+	extMinLastGroup = 50
+)
+
+// superblock feature flags
+const (
+	extCompatHasJournal = 0x4
+	extCompatExtAttr    = 0x8
+
+	extIncompatFiletype = 0x2
+	extIncompatExtents  = 0x40
+
+	extROCompatSparseSuper = 0x1
+	extROCompatLargeFile   = 0x2
+	extROCompatHugeFile    = 0x8
+	extROCompatDirNlink    = 0x20
+	extROCompatExtraIsize  = 0x40
+
+	extDefaultMountXattrUser = 0x4
+	extDefaultMountACL       = 0x8
+)
+
+// inode flags
+const (
+	extExtentsFlag = 0x80000
+)
+
+// SizeError indicates that a filesystem doesn't fit in the requested size.
+type SizeError struct {
+	Needed int64 // approximately, in bytes
+	Size   int64
+}
+
+func (e *SizeError) Error() string {
+	return fmt.Sprintf("the filesystem needs at least %d bytes, but the image is only %d bytes", e.Needed, e.Size)
+}
+
+// ExtOptions controls how NewExt() lays out a filesystem.
+type ExtOptions struct {
+	// Size is the size of the image in bytes.
+	Size int64
+
+	// Ext2 makes an ext2 filesystem, which has no journal and maps blocks
+	// without extents, rather than ext4.
+	Ext2 bool
+
+	// Label is the volume label, of up to 16 bytes.
+	Label string
+
+	// UUID identifies the filesystem. It's random if left zero.
+	UUID [16]byte
+
+	// Time is when the filesystem was made. It's now if left zero.
+	Time time.Time
+}
+
+// ExtImage is an ext2 or ext4 filesystem image, generated as it's read. The
+// directory tree and all the metadata are laid out in advance, but file
+// contents are only read when the image gets to them.
+type ExtImage struct {
+	opts   ExtOptions
+	ext4   bool
+	layout extLayout
+
+	inodes     []byte // inode table entries, for inodes 1 to inodeCount
+	inodeCount uint32
+	usedDirs   []uint16 // per group
+	cursor     uint64   // the next data block to allocate
+
+	// everything but zeros, in order once NewExt() is done
+	extents []extExtent
+
+	numbers     map[*Node]uint32
+	links       map[*Node]uint32
+	xattrBlocks map[string]*extXattrBlock
+
+	pipe *io.PipeReader
+}
+
+// extExtent is a run of blocks in the image, and a way to write them.
+type extExtent struct {
+	block uint64
+	count uint64
+	write func(w io.Writer) error // writes count blocks
+}
+
+// blockRun is a run of contiguous blocks.
+type blockRun struct {
+	start uint64
+	count uint64
+}
+
+// extLayout describes where a filesystem's fixed structures go.
+type extLayout struct {
+	blocks           uint64 // in the filesystem, which may be less than in the image
+	groups           uint64
+	gdtBlocks        uint64
+	inodesPerGroup   uint64
+	inodeTableBlocks uint64
+}
+
+// newExtLayout() divides size bytes into block groups with room for inodes
+// inodes, or returns nil if it's too small.
+func newExtLayout(size int64, inodes uint64) *extLayout {
+	l := &extLayout{blocks: uint64(size) / extBlockSize}
+	for {
+		l.groups = (l.blocks + extBlocksPerGroup - 1) / extBlocksPerGroup
+		if l.groups == 0 {
+			return nil
+		}
+		l.gdtBlocks = (l.groups*extDescSize + extBlockSize - 1) / extBlockSize
+
+		total := l.blocks * extBlockSize / extInodeRatio
+		if total < inodes {
+			total = inodes
+		}
+		l.inodesPerGroup = (total + l.groups - 1) / l.groups
+		l.inodesPerGroup = (l.inodesPerGroup + extInodesPerBlock - 1) / extInodesPerBlock * extInodesPerBlock
+		if l.inodesPerGroup < extInodesPerBlock {
+			l.inodesPerGroup = extInodesPerBlock
+		}
+		if l.inodesPerGroup > extBlocksPerGroup {
+			l.inodesPerGroup = extBlocksPerGroup
+		}
+		l.inodeTableBlocks = l.inodesPerGroup / extInodesPerBlock
+
+		// the last group needs to be big enough to be worth having
+		last := l.groups - 1
+		if l.groupBlocks(last) >= l.overhead(last)+extMinLastGroup {
+			return l
+		}
+		if l.groups == 1 {
+			return nil
+		}
+		l.blocks = last * extBlocksPerGroup
+	}
+}
+
+// hasSuper() indicates if group g holds a copy of the superblock and group
+// descriptors, which sparse_super limits to groups 0, 1, and powers of 3, 5,
+// and 7.
+func (l *extLayout) hasSuper(g uint64) bool {
+	if g <= 1 {
+		return true
+	}
+	for _, base := range []uint64{3, 5, 7} {
+		n := base
+		for n < g {
+			n *= base
+		}
+		if n == g {
+			return true
+		}
+	}
+	return false
+}
+
+func (l *extLayout) groupStart(g uint64) uint64 {
+	return g * extBlocksPerGroup
+}
+
+// groupBlocks() returns the number of blocks in group g, which is less than
+// usual for the last one.
+func (l *extLayout) groupBlocks(g uint64) uint64 {
+	if remaining := l.blocks - l.groupStart(g); g == l.groups-1 && remaining < extBlocksPerGroup {
+		return remaining
+	}
+	return extBlocksPerGroup
+}
+
+// overhead() returns the number of blocks at the start of group g which hold
+// fixed structures.
+func (l *extLayout) overhead(g uint64) uint64 {
+	return l.superOverhead(g) + 2 + l.inodeTableBlocks
+}
+
+func (l *extLayout) superOverhead(g uint64) uint64 {
+	if l.hasSuper(g) {
+		return 1 + l.gdtBlocks
+	}
+	return 0
+}
+
+func (l *extLayout) blockBitmap(g uint64) uint64 {
+	return l.groupStart(g) + l.superOverhead(g)
+}
+
+func (l *extLayout) inodeBitmap(g uint64) uint64 {
+	return l.blockBitmap(g) + 1
+}
+
+func (l *extLayout) inodeTable(g uint64) uint64 {
+	return l.blockBitmap(g) + 2
+}
+
+// usedDataBlocks() returns how many of group g's data blocks lie below
+// cursor, which is to say, how many are in use.
+func (l *extLayout) usedDataBlocks(g, cursor uint64) uint64 {
+	dataStart := l.groupStart(g) + l.overhead(g)
+	dataBlocks := l.groupBlocks(g) - l.overhead(g)
+	switch {
+	case cursor <= dataStart:
+		return 0
+	case cursor-dataStart > dataBlocks:
+		return dataBlocks
+	default:
+		return cursor - dataStart
+	}
+}
+
+// NewExt() lays out an ext4 filesystem, or an ext2 filesystem if
+// opts.Ext2 is set, containing the tree under root. If root has no
+// lost+found directory, one is added.
+func NewExt(root *Node, opts ExtOptions) (*ExtImage, error) {
+	if !root.Mode.IsDir() {
+		return nil, fmt.Errorf("the root of the filesystem must be a directory")
+	}
+	if len(opts.Label) > 16 {
+		return nil, fmt.Errorf("volume label %q is longer than 16 bytes", opts.Label)
+	}
+	if opts.Size >= 1<<44 {
+		return nil, fmt.Errorf("filesystems of 16 TiB or more are not supported")
+	}
+	if opts.UUID == [16]byte{} {
+		if _, err := rand.Read(opts.UUID[:]); err != nil {
+			return nil, err
+		}
+		opts.UUID[6] = opts.UUID[6]&0x0f | 0x40 // version 4
+		opts.UUID[8] = opts.UUID[8]&0x3f | 0x80 // variant 1
+	}
+	if opts.Time.IsZero() {
+		opts.Time = time.Now()
+	}
+
+	e := &ExtImage{
+		opts:        opts,
+		ext4:        !opts.Ext2,
+		numbers:     make(map[*Node]uint32),
+		links:       make(map[*Node]uint32),
+		xattrBlocks: make(map[string]*extXattrBlock),
+	}
+
+	// lost+found gets inode 11, like mke2fs does
+	lostFound := root.Children["lost+found"]
+	if lostFound == nil {
+		lostFound = &Node{Mode: os.ModeDir | 0o700, ModTime: opts.Time}
+		children := map[string]*Node{"lost+found": lostFound}
+		for name, child := range root.Children {
+			children[name] = child
+		}
+		root = &Node{Mode: root.Mode, UID: root.UID, GID: root.GID, ModTime: root.ModTime, Xattrs: root.Xattrs, Children: children}
+	} else if !lostFound.Mode.IsDir() {
+		return nil, fmt.Errorf("lost+found must be a directory")
+	}
+
+	// number the inodes
+	e.numbers[root] = extRootIno
+	e.numbers[lostFound] = extLostFoundIno
+	e.inodeCount = extLostFoundIno
+	if err := e.number(root, "/"); err != nil {
+		return nil, err
+	}
+
+	// divide up the disk
+	layout := newExtLayout(opts.Size, uint64(e.inodeCount))
+	if layout == nil {
+		return nil, &SizeError{Needed: 8 << 20, Size: opts.Size}
+	}
+	if uint64(e.inodeCount) > layout.groups*layout.inodesPerGroup {
+		return nil, fmt.Errorf("%d files don't fit in a filesystem of %d bytes", e.inodeCount, opts.Size)
+	}
+	e.layout = *layout
+	e.inodes = make([]byte, int(e.inodeCount)*extInodeSize)
+	e.usedDirs = make([]uint16, layout.groups)
+	e.cursor = layout.overhead(0)
+
+	// allocate everything
+	if e.ext4 {
+		if err := e.addJournal(); err != nil {
+			return nil, err
+		}
+	}
+	if err := e.add(root, root, "/"); err != nil {
+		return nil, err
+	}
+	if e.cursor > layout.blocks {
+		needed := int64(e.cursor) * extBlockSize * 105 / 100
+		return nil, &SizeError{Needed: (needed + 1<<20 - 1) &^ (1<<20 - 1), Size: opts.Size}
+	}
+	for _, xb := range e.xattrBlocks {
+		xb.finish()
+	}
+
+	e.addFixedStructures()
+	sort.Slice(e.extents, func(i, j int) bool {
+		return e.extents[i].block < e.extents[j].block
+	})
+	return e, nil
+}
+
+// Size() returns the size of the image in bytes.
+func (e *ExtImage) Size() int64 {
+	return e.opts.Size
+}
+
+// number() assigns inode numbers to everything under dir, and counts links.
+func (e *ExtImage) number(dir *Node, path string) error {
+	for _, name := range dir.names() {
+		child := dir.Children[name]
+		if len(name) > 255 || name == "" || name == "." || name == ".." || strings.ContainsAny(name, "/\x00") {
+			return fmt.Errorf("%s: invalid name %q", path, name)
+		}
+		if child == nil {
+			return fmt.Errorf("%s: missing", childPath(path, name))
+		}
+
+		e.links[child]++
+		if _, ok := e.numbers[child]; ok && child.Mode.IsDir() && e.numbers[child] != extLostFoundIno {
+			return fmt.Errorf("%s: directories can't be hard links", childPath(path, name))
+		}
+		if _, ok := e.numbers[child]; !ok {
+			if e.inodeCount == 1<<32-1 {
+				return fmt.Errorf("too many files")
+			}
+			e.inodeCount++
+			e.numbers[child] = e.inodeCount
+		}
+		if child.Mode.IsDir() {
+			if err := e.number(child, childPath(path, name)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// allocate() reserves count data blocks, returning them as runs of
+// contiguous blocks. It carries on past the end of the filesystem, so that
+// NewExt() can say how much space it would have needed.
+func (e *ExtImage) allocate(count uint64) []blockRun {
+	var runs []blockRun
+	for count > 0 {
+		g := e.cursor / extBlocksPerGroup
+		if dataStart := e.layout.groupStart(g) + e.layout.overhead(g); e.cursor < dataStart {
+			e.cursor = dataStart
+		}
+		n := e.layout.groupStart(g) + extBlocksPerGroup - e.cursor
+		if n > count {
+			n = count
+		}
+		runs = append(runs, blockRun{e.cursor, n})
+		e.cursor += n
+		count -= n
+	}
+	return runs
+}
+
+// addBlocks() arranges for data to be written to runs, zero-padding the last
+// block.
+func (e *ExtImage) addBlocks(runs []blockRun, data []byte) {
+	for _, run := range runs {
+		piece := make([]byte, run.count*extBlockSize)
+		n := copy(piece, data)
+		data = data[n:]
+		e.extents = append(e.extents, extExtent{run.start, run.count, func(w io.Writer) error {
+			_, err := w.Write(piece)
+			return err
+		}})
+	}
+}
+
+// addFile() arranges for a regular file's contents to be written to runs.
+func (e *ExtImage) addFile(n *Node, path string, runs []blockRun) {
+	var r io.ReadCloser
+	remaining := n.Size
+	for i, run := range runs {
+		run, last := run, i == len(runs)-1
+		e.extents = append(e.extents, extExtent{run.start, run.count, func(w io.Writer) error {
+			if r == nil {
+				var err error
+				if r, err = n.Open(); err != nil {
+					return fmt.Errorf("%s: %v", path, err)
+				}
+			}
+
+			length := int64(run.count * extBlockSize)
+			if length > remaining {
+				length = remaining
+			}
+			if copied, err := io.CopyN(w, r, length); err == io.EOF {
+				r.Close()
+				return fmt.Errorf("%s: shrank from %d to %d bytes while being read", path, n.Size, n.Size-remaining+copied)
+			} else if err != nil {
+				r.Close()
+				return fmt.Errorf("%s: %v", path, err)
+			}
+			remaining -= length
+			if err := writeZeros(w, int64(run.count*extBlockSize)-length); err != nil {
+				return err
+			}
+
+			if last {
+				defer r.Close()
+				if n, _ := r.Read(make([]byte, 1)); n > 0 {
+					return fmt.Errorf("%s: grew while being read", path)
+				}
+			}
+			return nil
+		}})
+	}
+}
+
+// addJournal() makes an empty journal, sized as mke2fs would.
+func (e *ExtImage) addJournal() error {
+	var blocks uint64
+	switch b := e.layout.blocks; {
+	case b < 2048:
+		return nil
+	case b < 32768:
+		blocks = 1024
+	case b < 256*1024:
+		blocks = 4096
+	case b < 512*1024:
+		blocks = 8192
+	case b < 4096*1024:
+		blocks = 16384
+	case b < 8192*1024:
+		blocks = 32768
+	case b < 16384*1024:
+		blocks = 65536
+	case b < 32768*1024:
+		blocks = 131072
+	default:
+		blocks = 262144
+	}
+
+	// the journal superblock, which is big-endian, says it's empty
+	jsb := make([]byte, extBlockSize)
+	binary.BigEndian.PutUint32(jsb[0:], 0xc03b3998) // magic
+	binary.BigEndian.PutUint32(jsb[4:], 4)          // superblock v2
+	binary.BigEndian.PutUint32(jsb[12:], extBlockSize)
+	binary.BigEndian.PutUint32(jsb[16:], uint32(blocks))
+	binary.BigEndian.PutUint32(jsb[20:], 1) // first log block
+	binary.BigEndian.PutUint32(jsb[24:], 1) // first transaction ID
+	copy(jsb[48:], e.opts.UUID[:])
+	binary.BigEndian.PutUint32(jsb[64:], 1) // users
+
+	runs := e.allocate(blocks)
+	e.addBlocks(runs[:1], jsb)
+	iblock, mapBlocks, err := e.mapBlocks(runs)
+	if err != nil {
+		return err
+	}
+
+	journal := &Node{Mode: 0o600, ModTime: e.opts.Time}
+	e.putInode(extJournalIno, journal, 1, blocks*extBlockSize, blocks+mapBlocks, iblock, extExtentsFlag, 0)
+	return nil
+}
+
+// add() allocates space for n, and everything under it if it's a directory,
+// and fills in their inodes.
+func (e *ExtImage) add(n, parent *Node, path string) error {
+	ino := e.numbers[n]
+	if binary.LittleEndian.Uint16(e.inodes[(ino-1)*extInodeSize:]) != 0 {
+		// another link to something already added
+		return nil
+	}
+
+	// extended attributes go in a block, shared with identical sets
+	var xattrBlock, xattrBlocks uint64
+	if len(n.Xattrs) > 0 {
+		content, err := extXattrs(n.Xattrs)
+		if err != nil {
+			return fmt.Errorf("%s: %v", path, err)
+		}
+		xb := e.xattrBlocks[string(content)]
+		if xb == nil {
+			xb = &extXattrBlock{content: content, block: e.allocate(1)[0].start}
+			e.xattrBlocks[string(content)] = xb
+			e.extents = append(e.extents, extExtent{xb.block, 1, func(w io.Writer) error {
+				// by now, the reference count is filled in
+				_, err := w.Write(xb.content)
+				return err
+			}})
+		}
+		xb.refs++
+		xattrBlock, xattrBlocks = xb.block, 1
+	}
+
+	links := e.links[n]
+	var flags uint32
+	var iblock [60]byte
+	var size, blocks uint64
+
+	switch {
+	case n.Mode.IsDir():
+		links = 2
+		for _, child := range n.Children {
+			if child.Mode.IsDir() {
+				links++
+			}
+		}
+		if links > extMaxLinks {
+			if !e.ext4 {
+				return fmt.Errorf("%s: ext2 directories can't have more than %d subdirectories", path, extMaxLinks-2)
+			}
+			links = 1
+		}
+		g := uint64(ino-1) / e.layout.inodesPerGroup
+		e.usedDirs[g]++
+
+		content := e.directory(n, parent)
+		if ino == extLostFoundIno && len(content) < 4*extBlockSize {
+			// leave room to reconnect orphans without allocating
+			for len(content) < 4*extBlockSize {
+				content = append(content, extEmptyDirBlock()...)
+			}
+		}
+		size = uint64(len(content))
+		runs := e.allocate(size / extBlockSize)
+		e.addBlocks(runs, content)
+		var mapBlocks uint64
+		var err error
+		if iblock, mapBlocks, err = e.mapBlocks(runs); err != nil {
+			return fmt.Errorf("%s: %v", path, err)
+		}
+		blocks = size/extBlockSize + mapBlocks
+		if e.ext4 {
+			flags |= extExtentsFlag
+		}
+
+	case n.Mode&os.ModeSymlink != 0:
+		size = uint64(len(n.Target))
+		if size < 60 {
+			// a fast symlink, which lives in the inode
+			copy(iblock[:], n.Target)
+			break
+		}
+		if size >= extBlockSize {
+			return fmt.Errorf("%s: symlink target is too long", path)
+		}
+		runs := e.allocate(1)
+		e.addBlocks(runs, []byte(n.Target))
+		var mapBlocks uint64
+		var err error
+		if iblock, mapBlocks, err = e.mapBlocks(runs); err != nil {
+			return err
+		}
+		blocks = 1 + mapBlocks
+		if e.ext4 {
+			flags |= extExtentsFlag
+		}
+
+	case n.Mode&os.ModeDevice != 0:
+		if n.Major < 256 && n.Minor < 256 {
+			binary.LittleEndian.PutUint32(iblock[0:], n.Major<<8|n.Minor)
+		} else {
+			binary.LittleEndian.PutUint32(iblock[4:], n.Minor&0xff|n.Major<<8|(n.Minor&^0xff)<<12)
+		}
+
+	case n.Mode&(os.ModeNamedPipe|os.ModeSocket) != 0:
+		// nothing but the inode
+
+	default:
+		if n.Size < 0 || (n.Size > 0 && n.Open == nil) {
+			return fmt.Errorf("%s: no contents", path)
+		}
+		size = uint64(n.Size)
+		runs := e.allocate((size + extBlockSize - 1) / extBlockSize)
+		e.addFile(n, path, runs)
+		var mapBlocks uint64
+		var err error
+		if iblock, mapBlocks, err = e.mapBlocks(runs); err != nil {
+			return fmt.Errorf("%s: %v", path, err)
+		}
+		blocks = (size+extBlockSize-1)/extBlockSize + mapBlocks
+		if e.ext4 {
+			flags |= extExtentsFlag
+		}
+	}
+
+	if links > 0xffff {
+		return fmt.Errorf("%s: too many hard links", path)
+	}
+	e.putInode(ino, n, uint16(links), size, blocks+xattrBlocks, iblock, flags, xattrBlock)
+
+	if n.Mode.IsDir() {
+		for _, name := range n.names() {
+			if err := e.add(n.Children[name], n, childPath(path, name)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// childPath() returns the path of name in the directory at path.
+func childPath(path, name string) string {
+	if path == "/" {
+		return "/" + name
+	}
+	return path + "/" + name
+}
+
+// extFileType() returns the directory entry file type for n.
+func extFileType(n *Node) byte {
+	switch mode := n.unixMode() & 0o170000; mode {
+	case 0o100000:
+		return 1
+	case 0o040000:
+		return 2
+	case 0o020000:
+		return 3
+	case 0o060000:
+		return 4
+	case 0o010000:
+		return 5
+	case 0o140000:
+		return 6
+	default:
+		return 7
+	}
+}
+
+// directory() returns the contents of a directory.
+func (e *ExtImage) directory(n, parent *Node) []byte {
+	var content []byte
+	block := make([]byte, 0, extBlockSize)
+	lastEntry := -1
+
+	add := func(ino uint32, name string, fileType byte) {
+		length := (8 + len(name) + 3) &^ 3
+		if len(block)+length > extBlockSize {
+			// stretch the last entry to the end of the block
+			binary.LittleEndian.PutUint16(block[lastEntry+4:], uint16(extBlockSize-lastEntry))
+			content = append(content, block[:extBlockSize]...)
+			block = block[:0]
+		}
+
+		lastEntry = len(block)
+		entry := make([]byte, length)
+		binary.LittleEndian.PutUint32(entry[0:], ino)
+		binary.LittleEndian.PutUint16(entry[4:], uint16(length))
+		entry[6] = byte(len(name))
+		entry[7] = fileType
+		copy(entry[8:], name)
+		block = append(block, entry...)
+	}
+
+	add(e.numbers[n], ".", 2)
+	add(e.numbers[parent], "..", 2)
+	for _, name := range n.names() {
+		child := n.Children[name]
+		add(e.numbers[child], name, extFileType(child))
+	}
+
+	binary.LittleEndian.PutUint16(block[lastEntry+4:], uint16(extBlockSize-lastEntry))
+	return append(content, block[:extBlockSize]...)
+}
+
+// extEmptyDirBlock() returns a directory block with no entries.
+func extEmptyDirBlock() []byte {
+	block := make([]byte, extBlockSize)
+	binary.LittleEndian.PutUint16(block[4:], extBlockSize)
+	return block
+}
+
+// extTime() splits t into the seconds and extra fields of an inode timestamp.
+func extTime(t time.Time) (seconds, extra uint32) {
+	s := t.Unix()
+	epoch := uint32((s-int64(int32(s)))>>32) & 3
+	return uint32(s), uint32(t.Nanosecond())<<2 | epoch
+}
+
+// putInode() fills in inode ino.
+func (e *ExtImage) putInode(ino uint32, n *Node, links uint16, size, blocks uint64, iblock [60]byte, flags uint32, xattrBlock uint64) {
+	inode := e.inodes[(ino-1)*extInodeSize : ino*extInodeSize]
+	seconds, extra := extTime(n.ModTime)
+	sectors := blocks * (extBlockSize / 512)
+
+	binary.LittleEndian.PutUint16(inode[0:], n.unixMode())
+	binary.LittleEndian.PutUint16(inode[2:], uint16(n.UID))
+	binary.LittleEndian.PutUint32(inode[4:], uint32(size))
+	binary.LittleEndian.PutUint32(inode[8:], seconds)  // atime
+	binary.LittleEndian.PutUint32(inode[12:], seconds) // ctime
+	binary.LittleEndian.PutUint32(inode[16:], seconds) // mtime
+	binary.LittleEndian.PutUint16(inode[24:], uint16(n.GID))
+	binary.LittleEndian.PutUint16(inode[26:], links)
+	binary.LittleEndian.PutUint32(inode[28:], uint32(sectors))
+	binary.LittleEndian.PutUint32(inode[32:], flags)
+	copy(inode[40:100], iblock[:])
+	binary.LittleEndian.PutUint32(inode[104:], uint32(xattrBlock))
+	binary.LittleEndian.PutUint32(inode[108:], uint32(size>>32))
+	binary.LittleEndian.PutUint16(inode[116:], uint16(sectors>>32))
+	binary.LittleEndian.PutUint16(inode[120:], uint16(n.UID>>16))
+	binary.LittleEndian.PutUint16(inode[122:], uint16(n.GID>>16))
+	binary.LittleEndian.PutUint16(inode[128:], 32) // extra inode size
+	binary.LittleEndian.PutUint32(inode[132:], extra)
+	binary.LittleEndian.PutUint32(inode[136:], extra)
+	binary.LittleEndian.PutUint32(inode[140:], extra)
+	binary.LittleEndian.PutUint32(inode[144:], seconds) // crtime
+	binary.LittleEndian.PutUint32(inode[148:], extra)
+}
+
+// writeZeros() writes n zero bytes.
+func writeZeros(w io.Writer, n int64) error {
+	for n > 0 {
+		chunk := zeros
+		if int64(len(chunk)) > n {
+			chunk = chunk[:n]
+		}
+		if _, err := w.Write(chunk); err != nil {
+			return err
+		}
+		n -= int64(len(chunk))
+	}
+	return nil
+}
+
+var zeros = make([]byte, 1<<20)
@@ -0,0 +1,145 @@
+package fs_image
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+const (
+	extExtentMagic    = 0xf30a
+	extMaxExtentLen   = 32768 // for initialized extents
+	extInodeExtents   = 4     // in the 60 bytes of i_block, after the header
+	extLeafExtents    = (extBlockSize - 12) / 12
+	extDirectBlocks   = 12
+	extPtrsPerBlock   = extBlockSize / 4
+	extIndirectLevels = 3
+)
+
+// mapBlocks() returns the i_block field which maps a file's data to runs,
+// allocating and filling in any extra blocks that takes, and returns the
+// number of extra blocks. ext4 uses extents, while ext2 uses block maps.
+func (e *ExtImage) mapBlocks(runs []blockRun) (iblock [60]byte, mapBlocks uint64, err error) {
+	if e.ext4 {
+		return e.mapExtents(runs)
+	}
+	return e.mapIndirect(runs)
+}
+
+// extExtentHeader() fills in an extent tree node's header.
+func extExtentHeader(b []byte, entries, max, depth int) {
+	binary.LittleEndian.PutUint16(b[0:], extExtentMagic)
+	binary.LittleEndian.PutUint16(b[2:], uint16(entries))
+	binary.LittleEndian.PutUint16(b[4:], uint16(max))
+	binary.LittleEndian.PutUint16(b[6:], uint16(depth))
+}
+
+// mapExtents() builds an extent tree for runs. Up to four extents fit in the
+// inode; beyond that, they go in leaf blocks, indexed from the inode.
+func (e *ExtImage) mapExtents(runs []blockRun) (iblock [60]byte, mapBlocks uint64, err error) {
+	// each extent is 12 bytes: logical block, length, and physical block
+	var extents [][12]byte
+	var logical uint64
+	for _, run := range runs {
+		for start, remaining := run.start, run.count; remaining > 0; {
+			n := remaining
+			if n > extMaxExtentLen {
+				n = extMaxExtentLen
+			}
+			var extent [12]byte
+			binary.LittleEndian.PutUint32(extent[0:], uint32(logical))
+			binary.LittleEndian.PutUint16(extent[4:], uint16(n))
+			binary.LittleEndian.PutUint16(extent[6:], uint16(start>>32))
+			binary.LittleEndian.PutUint32(extent[8:], uint32(start))
+			extents = append(extents, extent)
+			logical += n
+			start += n
+			remaining -= n
+		}
+	}
+
+	if len(extents) <= extInodeExtents {
+		extExtentHeader(iblock[:], len(extents), extInodeExtents, 0)
+		for i, extent := range extents {
+			copy(iblock[12+12*i:], extent[:])
+		}
+		return iblock, 0, nil
+	}
+
+	leaves := (len(extents) + extLeafExtents - 1) / extLeafExtents
+	if leaves > extInodeExtents {
+		return iblock, 0, fmt.Errorf("too fragmented, with %d extents", len(extents))
+	}
+	extExtentHeader(iblock[:], leaves, extInodeExtents, 1)
+	index := iblock[12:]
+	for _, run := range e.allocate(uint64(leaves)) {
+		for j := uint64(0); j < run.count; j++ {
+			leaf := make([]byte, extBlockSize)
+			chunk := extents
+			if len(chunk) > extLeafExtents {
+				chunk = chunk[:extLeafExtents]
+			}
+			extents = extents[len(chunk):]
+			extExtentHeader(leaf, len(chunk), extLeafExtents, 0)
+			for k, extent := range chunk {
+				copy(leaf[12+12*k:], extent[:])
+			}
+
+			// the index points at the leaf, starting from its first logical block
+			copy(index[0:4], chunk[0][0:4])
+			binary.LittleEndian.PutUint32(index[4:], uint32(run.start+j))
+			binary.LittleEndian.PutUint16(index[8:], uint16((run.start+j)>>32))
+			index = index[12:]
+			e.addBlocks([]blockRun{{run.start + j, 1}}, leaf)
+		}
+	}
+	return iblock, uint64(leaves), nil
+}
+
+// mapIndirect() builds a block map for runs: twelve direct pointers, then
+// single, double, and triple indirect blocks.
+func (e *ExtImage) mapIndirect(runs []blockRun) (iblock [60]byte, mapBlocks uint64, err error) {
+	var blocks []uint32
+	for _, run := range runs {
+		for b := run.start; b < run.start+run.count; b++ {
+			blocks = append(blocks, uint32(b))
+		}
+	}
+
+	for i := 0; i < extDirectBlocks && len(blocks) > 0; i++ {
+		binary.LittleEndian.PutUint32(iblock[4*i:], blocks[0])
+		blocks = blocks[1:]
+	}
+	for level := 1; level <= extIndirectLevels && len(blocks) > 0; level++ {
+		var block uint32
+		var n uint64
+		block, blocks, n = e.indirect(level, blocks)
+		binary.LittleEndian.PutUint32(iblock[4*(extDirectBlocks+level-1):], block)
+		mapBlocks += n
+	}
+	if len(blocks) > 0 {
+		return iblock, 0, fmt.Errorf("too large for a block map")
+	}
+	return iblock, mapBlocks, nil
+}
+
+// indirect() fills an indirect block at level (1 for single indirect) with as
+// many of blocks as it can map, returning its block number, the blocks left
+// over, and the number of indirect blocks it took.
+func (e *ExtImage) indirect(level int, blocks []uint32) (block uint32, remaining []uint32, n uint64) {
+	block = uint32(e.allocate(1)[0].start)
+	n = 1
+	content := make([]byte, extBlockSize)
+	for i := 0; i < extPtrsPerBlock && len(blocks) > 0; i++ {
+		ptr := blocks[0]
+		if level == 1 {
+			blocks = blocks[1:]
+		} else {
+			var more uint64
+			ptr, blocks, more = e.indirect(level-1, blocks)
+			n += more
+		}
+		binary.LittleEndian.PutUint32(content[4*i:], ptr)
+	}
+	e.addBlocks([]blockRun{{uint64(block), 1}}, content)
+	return block, blocks, n
+}
@@ -0,0 +1,376 @@
+package fs_image
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// patternReader produces size bytes, where each 4 KiB block starts with its
+// index and is otherwise zero, so that it's cheap to make and to check.
+type patternReader struct {
+	size, pos int64
+}
+
+func (pr *patternReader) Read(p []byte) (int, error) {
+	if pr.pos >= pr.size {
+		return 0, io.EOF
+	}
+	if int64(len(p)) > pr.size-pr.pos {
+		p = p[:pr.size-pr.pos]
+	}
+	for i := range p {
+		offset := pr.pos + int64(i)
+		var header [8]byte
+		binary.LittleEndian.PutUint64(header[:], uint64(offset/4096)+1)
+		if offset%4096 < 8 {
+			p[i] = header[offset%4096]
+		} else {
+			p[i] = 0
+		}
+	}
+	pr.pos += int64(len(p))
+	return len(p), nil
+}
+
+func (pr *patternReader) Close() error {
+	return nil
+}
+
+// file() returns a regular file Node with the given contents.
+func file(mode os.FileMode, content []byte) *Node {
+	return &Node{
+		Mode:    mode,
+		ModTime: time.Unix(1500000000, 0),
+		Size:    int64(len(content)),
+		Open: func() (io.ReadCloser, error) {
+			return ioutil.NopCloser(bytes.NewReader(content)), nil
+		},
+	}
+}
+
+// dir() returns a directory Node.
+func dir(children map[string]*Node) *Node {
+	return &Node{Mode: os.ModeDir | 0o755, ModTime: time.Unix(1500000000, 0), Children: children}
+}
+
+// testTree() returns a tree with a bit of everything, including a file of
+// bigSize bytes.
+func testTree(bigSize int64) *Node {
+	hardLinked := file(0o644, []byte("linked\n"))
+	many := make(map[string]*Node)
+	for i := 0; i < 1000; i++ {
+		many[fmt.Sprintf("file-with-a-longish-name-%04d", i)] = file(0o644, []byte(fmt.Sprint(i)))
+	}
+	owned := file(os.ModeSetuid|0o755, []byte("#!/bin/sh\n"))
+	owned.UID, owned.GID = 70000, 70001
+	ping := file(0o755, []byte("ping"))
+	ping.Xattrs = map[string][]byte{
+		"security.capability": {0, 0, 0, 2, 0, 0x20, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0},
+		"user.comment":        []byte("hello"),
+	}
+	acl := dir(nil)
+	acl.Xattrs = map[string][]byte{
+		// user::rwx, user:1000:r-x, group::r-x, mask::r-x, other::---
+		"system.posix_acl_access": {
+			2, 0, 0, 0,
+			1, 0, 7, 0, 0xff, 0xff, 0xff, 0xff,
+			2, 0, 5, 0, 0xe8, 3, 0, 0,
+			4, 0, 5, 0, 0xff, 0xff, 0xff, 0xff,
+			0x10, 0, 5, 0, 0xff, 0xff, 0xff, 0xff,
+			0x20, 0, 0, 0, 0xff, 0xff, 0xff, 0xff,
+		},
+	}
+
+	return dir(map[string]*Node{
+		"etc": dir(map[string]*Node{
+			"hostname": file(0o644, []byte("test\n")),
+			"empty":    file(0o644, nil),
+			"block":    file(0o644, bytes.Repeat([]byte{'x'}, 4096)),
+			"block+1":  file(0o644, bytes.Repeat([]byte{'y'}, 4097)),
+			"link1":    hardLinked,
+			"link2":    hardLinked,
+		}),
+		"bin": dir(map[string]*Node{
+			"owned": owned,
+			"ping":  ping,
+			"short": {Mode: os.ModeSymlink | 0o777, Target: "owned"},
+			"long":  {Mode: os.ModeSymlink | 0o777, Target: "/" + strings.Repeat("long/", 30) + "target"},
+		}),
+		"dev": dir(map[string]*Node{
+			"null": {Mode: os.ModeDevice | os.ModeCharDevice | 0o666, Major: 1, Minor: 3},
+			"nvme": {Mode: os.ModeDevice | 0o660, Major: 259, Minor: 300},
+			"fifo": {Mode: os.ModeNamedPipe | 0o600},
+			"sock": {Mode: os.ModeSocket | 0o600},
+		}),
+		"tmp":  {Mode: os.ModeDir | os.ModeSticky | 0o777, ModTime: time.Unix(1<<32+5, 123456789), Children: map[string]*Node{}},
+		"many": dir(many),
+		"acl":  acl,
+		"big": {
+			Mode: 0o644,
+			Size: bigSize,
+			Open: func() (io.ReadCloser, error) {
+				return &patternReader{size: bigSize}, nil
+			},
+		},
+	})
+}
+
+// sparseWriter writes to a file, skipping blocks of zeros.
+type sparseWriter struct {
+	f *os.File
+}
+
+func (sw *sparseWriter) Write(p []byte) (int, error) {
+	for i := 0; i < len(p); i += 4096 {
+		chunk := p[i:]
+		if len(chunk) > 4096 {
+			chunk = chunk[:4096]
+		}
+		if bytes.Equal(chunk, zeros[:len(chunk)]) {
+			if _, err := sw.f.Seek(int64(len(chunk)), io.SeekCurrent); err != nil {
+				return i, err
+			}
+		} else if _, err := sw.f.Write(chunk); err != nil {
+			return i, err
+		}
+	}
+	return len(p), nil
+}
+
+// writeImage() writes img to a file, returning its name.
+func writeImage(t *testing.T, img *ExtImage) string {
+	t.Helper()
+	filename := filepath.Join(t.TempDir(), "fs.img")
+	f, err := os.Create(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if n, err := img.WriteTo(&sparseWriter{f}); err != nil {
+		t.Fatalf("WriteTo() error = %v", err)
+	} else if n != img.Size() {
+		t.Fatalf("WriteTo() wrote %d bytes, expected %d", n, img.Size())
+	}
+	if err := f.Truncate(img.Size()); err != nil {
+		t.Fatal(err)
+	}
+	return filename
+}
+
+// debugfs() runs a debugfs command against an image.
+func debugfs(t *testing.T, filename, command string) string {
+	t.Helper()
+	out, err := exec.Command("debugfs", "-R", command, filename).Output()
+	if err != nil {
+		t.Fatalf("debugfs -R %q: %v", command, err)
+	}
+	return string(out)
+}
+
+func TestExt(t *testing.T) {
+	for _, tool := range []string{"e2fsck", "debugfs"} {
+		if _, err := exec.LookPath(tool); err != nil {
+			t.Skipf("%s not found", tool)
+		}
+	}
+
+	// big enough to span five block groups, so it needs an extent tree or a
+	// double indirect block
+	const bigSize = 600<<20 + 1234
+	tree := testTree(bigSize)
+
+	for _, ext2 := range []bool{false, true} {
+		name := map[bool]string{false: "ext4", true: "ext2"}[ext2]
+		img, err := NewExt(tree, ExtOptions{Size: 1 << 30, Ext2: ext2, Label: "root"})
+		if err != nil {
+			t.Fatalf("%s: NewExt() error = %v", name, err)
+		}
+		filename := writeImage(t, img)
+
+		if out, err := exec.Command("e2fsck", "-fn", filename).CombinedOutput(); err != nil {
+			t.Errorf("%s: e2fsck: %v\n%s", name, err, out)
+		}
+
+		for path, expected := range map[string]string{
+			"/etc/hostname":                       "test\n",
+			"/etc/link2":                          "linked\n",
+			"/many/file-with-a-longish-name-0999": "999",
+		} {
+			if actual := debugfs(t, filename, "cat "+path); actual != expected {
+				t.Errorf("%s: %s contains %q, expected %q", name, path, actual, expected)
+			}
+		}
+		if actual := debugfs(t, filename, "cat /etc/block+1"); actual != strings.Repeat("y", 4097) {
+			t.Errorf("%s: /etc/block+1 has the wrong contents", name)
+		}
+
+		for path, expected := range map[string][]string{
+			"/bin/owned": {"Mode:  04755", "User: 70000", "Group: 70001", "Links: 1"},
+			"/etc/link1": {"Links: 2"},
+			"/bin/short": {"Fast link dest: \"owned\""},
+			"/dev/null":  {"Type: character special", "Device major/minor number: 01:03"},
+			"/dev/nvme":  {"Type: block special", "Device major/minor number: 259:300"},
+			"/dev/fifo":  {"Type: FIFO"},
+			"/dev/sock":  {"Type: socket"},
+			"/tmp":       {"Mode:  01777", "Links: 2"},
+			"/":          {"Links: 9"},
+			"/bin/ping":  {"security.capability (20)", "user.comment (5) = \"hello\""},
+			"/acl":       {"system.posix_acl_access (28) = "},
+		} {
+			out := debugfs(t, filename, "stat "+path)
+			for _, e := range expected {
+				if !strings.Contains(out, e) {
+					t.Errorf("%s: stat %s doesn't contain %q:\n%s", name, path, e, out)
+				}
+			}
+		}
+		if out := debugfs(t, filename, "stat /tmp"); !strings.Contains(out, "2106") {
+			t.Errorf("%s: /tmp has the wrong modification time:\n%s", name, out)
+		}
+		if out := debugfs(t, filename, "stat /bin/long"); !strings.Contains(out, "Size: 157") || strings.Contains(out, "Fast link") {
+			t.Errorf("%s: /bin/long isn't a slow symlink:\n%s", name, out)
+		}
+
+		// the big file
+		dumped := filepath.Join(t.TempDir(), "big")
+		debugfs(t, filename, "dump /big "+dumped)
+		actual, err := os.Open(dumped)
+		if err != nil {
+			t.Fatal(err)
+		}
+		buf := make([]byte, 1<<20)
+		expected := &patternReader{size: bigSize}
+		var offset int64
+		for {
+			n, err := io.ReadFull(actual, buf)
+			want := make([]byte, n)
+			io.ReadFull(expected, want)
+			if !bytes.Equal(buf[:n], want) {
+				t.Errorf("%s: /big differs around offset %d", name, offset)
+				break
+			}
+			offset += int64(n)
+			if err != nil {
+				break
+			}
+		}
+		actual.Close()
+		if offset != bigSize {
+			t.Errorf("%s: /big is %d bytes, expected %d", name, offset, bigSize)
+		}
+	}
+}
+
+func TestExtErrors(t *testing.T) {
+	hardLinkedDir := dir(nil)
+	for _, tc := range []struct {
+		name string
+		root *Node
+		size int64
+	}{
+		{"not a directory", file(0o644, nil), 64 << 20},
+		{"hard-linked directory", dir(map[string]*Node{"a": hardLinkedDir, "b": hardLinkedDir}), 64 << 20},
+		{"slash in name", dir(map[string]*Node{"a/b": file(0o644, nil)}), 64 << 20},
+		{"long name", dir(map[string]*Node{strings.Repeat("a", 256): file(0o644, nil)}), 64 << 20},
+		{"lost+found is a file", dir(map[string]*Node{"lost+found": file(0o644, nil)}), 64 << 20},
+	} {
+		if _, err := NewExt(tc.root, ExtOptions{Size: tc.size}); err == nil {
+			t.Errorf("%s: NewExt() succeeded", tc.name)
+		}
+	}
+}
+
+func TestExtSizeError(t *testing.T) {
+	for _, size := range []int64{1 << 20, 64 << 20} {
+		_, err := NewExt(testTree(100<<20), ExtOptions{Size: size})
+		if sizeErr, ok := err.(*SizeError); !ok {
+			t.Errorf("NewExt() of %d bytes error = %v, expected a SizeError", size, err)
+		} else if sizeErr.Size != size || sizeErr.Needed <= size {
+			t.Errorf("NewExt() of %d bytes error = %+v", size, sizeErr)
+		}
+	}
+
+	// the suggested size is enough
+	_, err := NewExt(testTree(100<<20), ExtOptions{Size: 64 << 20})
+	needed := err.(*SizeError).Needed
+	if _, err := NewExt(testTree(100<<20), ExtOptions{Size: needed}); err != nil {
+		t.Errorf("NewExt() of %d bytes error = %v", needed, err)
+	}
+}
+
+func TestExtChangedFile(t *testing.T) {
+	for _, tc := range []struct {
+		size     int64
+		contents string
+		err      string
+	}{
+		{5, "hello", ""},
+		{5, "hell", "shrank from 5 to 4 bytes"},
+		{5, "hello!", "grew"},
+		{5000, strings.Repeat("x", 4999), "shrank from 5000 to 4999 bytes"},
+	} {
+		changing := file(0o644, []byte(tc.contents))
+		changing.Size = tc.size
+		img, err := NewExt(dir(map[string]*Node{"changing": changing}), ExtOptions{Size: 64 << 20})
+		if err != nil {
+			t.Fatalf("NewExt() error = %v", err)
+		}
+		_, err = img.WriteTo(ioutil.Discard)
+		switch {
+		case tc.err == "" && err != nil:
+			t.Errorf("%q: WriteTo() error = %v", tc.contents, err)
+		case tc.err != "" && (err == nil || !strings.Contains(err.Error(), tc.err)):
+			t.Errorf("%q: WriteTo() error = %v, expected %q", tc.contents, err, tc.err)
+		}
+	}
+}
+
+func TestExtRead(t *testing.T) {
+	img, err := NewExt(testTree(12345), ExtOptions{Size: 64 << 20})
+	if err != nil {
+		t.Fatalf("NewExt() error = %v", err)
+	}
+	n, err := io.Copy(ioutil.Discard, img)
+	if err != nil || n != img.Size() {
+		t.Errorf("Read() returned %d bytes, error %v", n, err)
+	}
+	if err := img.Close(); err != nil {
+		t.Errorf("Close() error = %v", err)
+	}
+	if _, err := img.WriteTo(ioutil.Discard); err == nil {
+		t.Errorf("WriteTo() after Read() succeeded")
+	}
+}
+
+func TestExtACL(t *testing.T) {
+	acl, err := extACL([]byte{
+		2, 0, 0, 0,
+		1, 0, 7, 0, 0xff, 0xff, 0xff, 0xff,
+		2, 0, 5, 0, 0xe8, 3, 0, 0,
+		0x20, 0, 0, 0, 0xff, 0xff, 0xff, 0xff,
+	})
+	expected := []byte{
+		1, 0, 0, 0,
+		1, 0, 7, 0,
+		2, 0, 5, 0, 0xe8, 3, 0, 0,
+		0x20, 0, 0, 0,
+	}
+	if err != nil || !bytes.Equal(acl, expected) {
+		t.Errorf("extACL() = %v, %v; expected %v", acl, err, expected)
+	}
+
+	for _, invalid := range [][]byte{nil, {1, 0, 0, 0}, {2, 0, 0, 0, 1, 0}} {
+		if _, err := extACL(invalid); err == nil {
+			t.Errorf("extACL(%v) succeeded", invalid)
+		}
+	}
+}
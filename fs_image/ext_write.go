@@ -0,0 +1,242 @@
+package fs_image
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// addFixedStructures() arranges for each group's superblock, group
+// descriptors, bitmaps, and inode table to be written.
+func (e *ExtImage) addFixedStructures() {
+	l := &e.layout
+	gdt := e.groupDescriptors()
+
+	for g := uint64(0); g < l.groups; g++ {
+		g := g
+		if l.hasSuper(g) {
+			e.extents = append(e.extents, extExtent{l.groupStart(g), l.superOverhead(g), func(w io.Writer) error {
+				block := make([]byte, extBlockSize)
+				if g == 0 {
+					// the first 1024 bytes are left for a boot loader
+					copy(block[1024:], e.superblock(g))
+				} else {
+					copy(block, e.superblock(g))
+				}
+				if _, err := w.Write(block); err != nil {
+					return err
+				}
+				_, err := w.Write(gdt)
+				return err
+			}})
+		}
+
+		e.extents = append(e.extents, extExtent{l.blockBitmap(g), 2, func(w io.Writer) error {
+			_, err := w.Write(e.bitmaps(g))
+			return err
+		}})
+
+		e.extents = append(e.extents, extExtent{l.inodeTable(g), l.inodeTableBlocks, func(w io.Writer) error {
+			// inodes are numbered from 1
+			first := g * l.inodesPerGroup
+			length := l.inodesPerGroup * extInodeSize
+			var used []byte
+			if first < uint64(e.inodeCount) {
+				used = e.inodes[first*extInodeSize:]
+				if uint64(len(used)) > length {
+					used = used[:length]
+				}
+			}
+			if _, err := w.Write(used); err != nil {
+				return err
+			}
+			return writeZeros(w, int64(length)-int64(len(used)))
+		}})
+	}
+}
+
+// usedInodes() returns how many of group g's inodes are in use.
+func (e *ExtImage) usedInodes(g uint64) uint64 {
+	first := g * e.layout.inodesPerGroup
+	switch {
+	case uint64(e.inodeCount) <= first:
+		return 0
+	case uint64(e.inodeCount)-first > e.layout.inodesPerGroup:
+		return e.layout.inodesPerGroup
+	default:
+		return uint64(e.inodeCount) - first
+	}
+}
+
+// freeBlocks() returns how many of group g's blocks are free.
+func (e *ExtImage) freeBlocks(g uint64) uint64 {
+	l := &e.layout
+	return l.groupBlocks(g) - l.overhead(g) - l.usedDataBlocks(g, e.cursor)
+}
+
+// groupDescriptors() returns the group descriptor table, padded to a whole
+// number of blocks.
+func (e *ExtImage) groupDescriptors() []byte {
+	l := &e.layout
+	gdt := make([]byte, l.gdtBlocks*extBlockSize)
+	for g := uint64(0); g < l.groups; g++ {
+		d := gdt[g*extDescSize:]
+		binary.LittleEndian.PutUint32(d[0:], uint32(l.blockBitmap(g)))
+		binary.LittleEndian.PutUint32(d[4:], uint32(l.inodeBitmap(g)))
+		binary.LittleEndian.PutUint32(d[8:], uint32(l.inodeTable(g)))
+		binary.LittleEndian.PutUint16(d[12:], uint16(e.freeBlocks(g)))
+		binary.LittleEndian.PutUint16(d[14:], uint16(l.inodesPerGroup-e.usedInodes(g)))
+		binary.LittleEndian.PutUint16(d[16:], e.usedDirs[g])
+	}
+	return gdt
+}
+
+// bitmaps() returns group g's block bitmap and inode bitmap. Bits past the end
+// of the group are set, as e2fsck expects.
+func (e *ExtImage) bitmaps(g uint64) []byte {
+	l := &e.layout
+	b := make([]byte, 2*extBlockSize)
+	set := func(bitmap []byte, from, to uint64) {
+		for i := from; i < to; i++ {
+			bitmap[i/8] |= 1 << (i % 8)
+		}
+	}
+
+	blocks := b[:extBlockSize]
+	set(blocks, 0, l.overhead(g)+l.usedDataBlocks(g, e.cursor))
+	set(blocks, l.groupBlocks(g), extBlocksPerGroup)
+
+	inodes := b[extBlockSize:]
+	set(inodes, 0, e.usedInodes(g))
+	set(inodes, l.inodesPerGroup, extBlocksPerGroup)
+	return b
+}
+
+// superblock() returns the copy of the superblock kept in group g.
+func (e *ExtImage) superblock(g uint64) []byte {
+	l := &e.layout
+	var freeBlocks, freeInodes uint64
+	for g := uint64(0); g < l.groups; g++ {
+		freeBlocks += e.freeBlocks(g)
+		freeInodes += l.inodesPerGroup - e.usedInodes(g)
+	}
+	now := uint32(e.opts.Time.Unix())
+
+	compat := uint32(extCompatExtAttr)
+	incompat := uint32(extIncompatFiletype)
+	roCompat := uint32(extROCompatSparseSuper | extROCompatLargeFile)
+	if e.ext4 {
+		incompat |= extIncompatExtents
+		roCompat |= extROCompatHugeFile | extROCompatDirNlink | extROCompatExtraIsize
+	}
+
+	sb := make([]byte, 1024)
+	binary.LittleEndian.PutUint32(sb[0:], uint32(l.groups*l.inodesPerGroup))
+	binary.LittleEndian.PutUint32(sb[4:], uint32(l.blocks))
+	binary.LittleEndian.PutUint32(sb[8:], uint32(l.blocks*extReservedPct/100))
+	binary.LittleEndian.PutUint32(sb[12:], uint32(freeBlocks))
+	binary.LittleEndian.PutUint32(sb[16:], uint32(freeInodes))
+	binary.LittleEndian.PutUint32(sb[20:], 0) // first data block
+	binary.LittleEndian.PutUint32(sb[24:], 2) // 1024 << 2 byte blocks
+	binary.LittleEndian.PutUint32(sb[28:], 2) // and clusters
+	binary.LittleEndian.PutUint32(sb[32:], extBlocksPerGroup)
+	binary.LittleEndian.PutUint32(sb[36:], extBlocksPerGroup)
+	binary.LittleEndian.PutUint32(sb[40:], uint32(l.inodesPerGroup))
+	binary.LittleEndian.PutUint32(sb[48:], now)    // write time
+	binary.LittleEndian.PutUint16(sb[54:], 0xffff) // max mount count
+	binary.LittleEndian.PutUint16(sb[56:], 0xef53) // magic
+	binary.LittleEndian.PutUint16(sb[58:], 1)      // clean
+	binary.LittleEndian.PutUint16(sb[60:], 1)      // continue on errors
+	binary.LittleEndian.PutUint32(sb[64:], now)    // last check
+	binary.LittleEndian.PutUint32(sb[76:], 1)      // dynamic revision
+	binary.LittleEndian.PutUint32(sb[84:], extFirstIno)
+	binary.LittleEndian.PutUint16(sb[88:], extInodeSize)
+	binary.LittleEndian.PutUint16(sb[90:], uint16(g))
+	binary.LittleEndian.PutUint32(sb[92:], compat)
+	binary.LittleEndian.PutUint32(sb[96:], incompat)
+	binary.LittleEndian.PutUint32(sb[100:], roCompat)
+	copy(sb[104:], e.opts.UUID[:])
+	copy(sb[120:], e.opts.Label)
+	copy(sb[236:], e.opts.UUID[:]) // the directory hash seed, which is only used with dir_index
+	sb[252] = 1                    // half MD4
+	binary.LittleEndian.PutUint32(sb[256:], extDefaultMountXattrUser|extDefaultMountACL)
+	binary.LittleEndian.PutUint32(sb[264:], now) // creation time
+	if e.ext4 {
+		binary.LittleEndian.PutUint16(sb[348:], 32) // minimum extra inode size
+		binary.LittleEndian.PutUint16(sb[350:], 32) // desired extra inode size
+	}
+
+	journal := e.inodes[(extJournalIno-1)*extInodeSize:]
+	if binary.LittleEndian.Uint16(journal) != 0 {
+		binary.LittleEndian.PutUint32(sb[92:], compat|extCompatHasJournal)
+		binary.LittleEndian.PutUint32(sb[224:], extJournalIno)
+		sb[253] = 1 // the journal inode's blocks are backed up here
+		copy(sb[268:328], journal[40:100])
+		copy(sb[328:332], journal[108:112])
+		copy(sb[332:336], journal[4:8])
+	}
+
+	return sb
+}
+
+// WriteTo() writes the image to w. It can only be called once, and not after
+// Read().
+func (e *ExtImage) WriteTo(w io.Writer) (int64, error) {
+	cw := &countingWriter{w: w}
+	if e.extents == nil {
+		return 0, errors.New("the image has already been read")
+	}
+	extents := e.extents
+	e.extents = nil
+
+	var pos uint64
+	for _, extent := range extents {
+		if err := writeZeros(cw, int64(extent.block-pos)*extBlockSize); err != nil {
+			return cw.n, err
+		}
+		before := cw.n
+		if err := extent.write(cw); err != nil {
+			return cw.n, err
+		}
+		if cw.n-before != int64(extent.count*extBlockSize) {
+			return cw.n, fmt.Errorf("internal error: wrote %d bytes for %d blocks at block %d", cw.n-before, extent.count, extent.block)
+		}
+		pos = extent.block + extent.count
+	}
+	err := writeZeros(cw, e.opts.Size-int64(pos)*extBlockSize)
+	return cw.n, err
+}
+
+// Read() reads the image.
+func (e *ExtImage) Read(p []byte) (int, error) {
+	if e.pipe == nil {
+		r, w := io.Pipe()
+		e.pipe = r
+		go func() {
+			_, err := e.WriteTo(w)
+			w.CloseWithError(err)
+		}()
+	}
+	return e.pipe.Read(p)
+}
+
+// Close() stops reading the image, which closes any file being read.
+func (e *ExtImage) Close() error {
+	if e.pipe != nil {
+		e.pipe.Close()
+	}
+	return nil
+}
+
+// countingWriter counts the bytes written through it.
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (cw *countingWriter) Write(p []byte) (int, error) {
+	n, err := cw.w.Write(p)
+	cw.n += int64(n)
+	return n, err
+}
@@ -0,0 +1,156 @@
+package fs_image
+
+import (
+	"encoding/binary"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+const (
+	extXattrMagic = 0xea020000
+
+	// POSIX ACLs, as getxattr() returns them and as ext4 stores them
+	posixACLXattrVersion = 2
+	extACLVersion        = 1
+	aclUser              = 0x02
+	aclGroup             = 0x08
+)
+
+// xattr names are stored as an index, which implies a prefix, and the rest of
+// the name
+var extXattrPrefixes = []struct {
+	prefix string
+	index  byte
+}{
+	{"user.", 1},
+	{"system.posix_acl_access", 2},
+	{"system.posix_acl_default", 3},
+	{"trusted.", 4},
+	{"security.", 6},
+	{"system.", 7},
+}
+
+// extXattrBlock is a block of extended attributes, shared by every inode with
+// the same set.
+type extXattrBlock struct {
+	content []byte
+	block   uint64
+	refs    uint32
+}
+
+// finish() fills in the reference count.
+func (xb *extXattrBlock) finish() {
+	binary.LittleEndian.PutUint32(xb.content[4:], xb.refs)
+}
+
+type extXattr struct {
+	index byte
+	name  string
+	value []byte
+}
+
+// extXattrs() returns the content of an extended attribute block holding
+// xattrs, except for the reference count.
+func extXattrs(xattrs map[string][]byte) ([]byte, error) {
+	var entries []extXattr
+	for name, value := range xattrs {
+		entry := extXattr{name: name, value: value}
+		for _, p := range extXattrPrefixes {
+			if strings.HasPrefix(name, p.prefix) {
+				entry.index, entry.name = p.index, name[len(p.prefix):]
+				break
+			}
+		}
+		if entry.index == 0 {
+			return nil, fmt.Errorf("unsupported extended attribute %q", name)
+		}
+		if entry.index == 2 || entry.index == 3 {
+			if entry.name != "" {
+				return nil, fmt.Errorf("unsupported extended attribute %q", name)
+			}
+			var err error
+			if entry.value, err = extACL(value); err != nil {
+				return nil, fmt.Errorf("%s: %v", name, err)
+			}
+		}
+		if len(entry.name) > 255 {
+			return nil, fmt.Errorf("extended attribute name %q is too long", name)
+		}
+		entries = append(entries, entry)
+	}
+
+	// the kernel expects them in order
+	sort.Slice(entries, func(i, j int) bool {
+		a, b := entries[i], entries[j]
+		if a.index != b.index {
+			return a.index < b.index
+		}
+		if len(a.name) != len(b.name) {
+			return len(a.name) < len(b.name)
+		}
+		return a.name < b.name
+	})
+
+	// a header, then entries from the start, and values from the end
+	block := make([]byte, extBlockSize)
+	binary.LittleEndian.PutUint32(block[0:], extXattrMagic)
+	binary.LittleEndian.PutUint32(block[8:], 1) // blocks
+	entryOffset, valueOffset := 32, extBlockSize
+	var blockHash uint32
+	for _, entry := range entries {
+		entryLength := (16 + len(entry.name) + 3) &^ 3
+		valueLength := (len(entry.value) + 3) &^ 3
+		valueOffset -= valueLength
+		if entryOffset+entryLength+4 > valueOffset {
+			return nil, fmt.Errorf("extended attributes don't fit in a block")
+		}
+		copy(block[valueOffset:], entry.value)
+
+		e := block[entryOffset:]
+		e[0] = byte(len(entry.name))
+		e[1] = entry.index
+		binary.LittleEndian.PutUint16(e[2:], uint16(valueOffset))
+		binary.LittleEndian.PutUint32(e[8:], uint32(len(entry.value)))
+		copy(e[16:], entry.name)
+		hash := extXattrHash(entry.name, block[valueOffset:valueOffset+valueLength])
+		binary.LittleEndian.PutUint32(e[12:], hash)
+		entryOffset += entryLength
+
+		blockHash = blockHash<<16 ^ blockHash>>16 ^ hash
+	}
+	binary.LittleEndian.PutUint32(block[12:], blockHash)
+	return block, nil
+}
+
+// extXattrHash() returns the hash of an extended attribute entry, given its
+// zero-padded value.
+func extXattrHash(name string, paddedValue []byte) uint32 {
+	var hash uint32
+	for i := 0; i < len(name); i++ {
+		hash = hash<<5 ^ hash>>27 ^ uint32(name[i])
+	}
+	for i := 0; i < len(paddedValue); i += 4 {
+		hash = hash<<16 ^ hash>>16 ^ binary.LittleEndian.Uint32(paddedValue[i:])
+	}
+	return hash
+}
+
+// extACL() converts a POSIX ACL from the form getxattr() returns to the more
+// compact form ext2 and ext4 store.
+func extACL(value []byte) ([]byte, error) {
+	if len(value) < 4 || (len(value)-4)%8 != 0 || binary.LittleEndian.Uint32(value) != posixACLXattrVersion {
+		return nil, fmt.Errorf("invalid POSIX ACL")
+	}
+
+	acl := make([]byte, 4, len(value))
+	binary.LittleEndian.PutUint32(acl, extACLVersion)
+	for entry := value[4:]; len(entry) > 0; entry = entry[8:] {
+		tag := binary.LittleEndian.Uint16(entry)
+		acl = append(acl, entry[:4]...)
+		if tag == aclUser || tag == aclGroup {
+			acl = append(acl, entry[4:8]...)
+		}
+	}
+	return acl, nil
+}
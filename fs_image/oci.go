@@ -0,0 +1,407 @@
+package fs_image
+
+import (
+	"archive/tar"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Container images come in two layouts. An OCI image layout is a directory
+// with an index.json listing manifests, which list layers, all stored by
+// digest under blobs/. `docker save` writes a tarball with a manifest.json
+// listing each image's config and layers by path; newer versions of Docker
+// also include an OCI image layout in the same tarball. Either way, layers
+// are tarballs, possibly compressed, which are applied in order.
+
+// ErrNotOCI indicates that something isn't an OCI image layout or a
+// `docker save` archive.
+var ErrNotOCI = errors.New("not an OCI image layout or docker save archive")
+
+const (
+	ociRefNameAnnotation   = "org.opencontainers.image.ref.name"
+	ociImageNameAnnotation = "io.containerd.image.name"
+
+	ociIndexMediaType           = "application/vnd.oci.image.index.v1+json"
+	dockerManifestListMediaType = "application/vnd.docker.distribution.manifest.list.v2+json"
+)
+
+// OCIOptions controls which image OpenOCI() picks, when there's more than one.
+type OCIOptions struct {
+	// Reference picks an image by name, like "myimage:latest", matching a
+	// `docker save` tag or the OCI ref.name annotation.
+	Reference string
+
+	// Architecture picks among the platforms in a multi-platform image, in
+	// OCI terms, like "amd64" or "arm64".
+	Architecture string
+}
+
+// OCIImage is a container image's root filesystem, assembled from its layers.
+type OCIImage struct {
+	// Root is the top of the filesystem. Files' contents are read from the
+	// layers when they're opened, so they can only be read until Close().
+	Root *Node
+
+	// Architecture and OS come from the image's configuration, like "amd64"
+	// and "linux".
+	Architecture string
+	OS           string
+
+	source ociSource
+	layers []*ociLayer
+}
+
+// OpenOCI() reads the image in an OCI image layout directory, or a directory
+// containing an extracted `docker save` archive.
+func OpenOCI(dir string, opts OCIOptions) (*OCIImage, error) {
+	return openOCI(&ociDirectory{dir: dir}, opts)
+}
+
+// OpenOCIArchive() reads the image in a `docker save` archive, or a tarball
+// of an OCI image layout. The archive must not be compressed, since its
+// layers are read in place.
+func OpenOCIArchive(r io.ReaderAt, size int64, opts OCIOptions) (*OCIImage, error) {
+	archive, err := newOCIArchive(r, size)
+	if err != nil {
+		return nil, err
+	}
+	return openOCI(archive, opts)
+}
+
+func openOCI(src ociSource, opts OCIOptions) (*OCIImage, error) {
+	img := &OCIImage{source: src}
+	if err := img.open(opts); err != nil {
+		img.Close()
+		return nil, err
+	}
+	return img, nil
+}
+
+// Close() closes the image's layers.
+func (img *OCIImage) Close() error {
+	for _, l := range img.layers {
+		l.close()
+	}
+	return img.source.Close()
+}
+
+// ociSource finds files in an image layout or archive.
+type ociSource interface {
+	open(name string) (*io.SectionReader, error)
+	Close() error
+}
+
+// ociDirectory finds files in a directory.
+type ociDirectory struct {
+	dir   string
+	files []*os.File
+}
+
+func (d *ociDirectory) open(name string) (*io.SectionReader, error) {
+	f, err := os.Open(filepath.Join(d.dir, filepath.FromSlash(path.Clean("/"+name))))
+	if err != nil {
+		return nil, err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	d.files = append(d.files, f)
+	return io.NewSectionReader(f, 0, fi.Size()), nil
+}
+
+func (d *ociDirectory) Close() error {
+	for _, f := range d.files {
+		f.Close()
+	}
+	d.files = nil
+	return nil
+}
+
+// ociArchive finds files in a tarball, which it indexes up front.
+type ociArchive struct {
+	r        io.ReaderAt
+	files    map[string]*io.SectionReader
+	symlinks map[string]string
+}
+
+func newOCIArchive(r io.ReaderAt, size int64) (*ociArchive, error) {
+	a := &ociArchive{r: r, files: make(map[string]*io.SectionReader), symlinks: make(map[string]string)}
+	pr := &positionSeeker{positionReader{r: io.NewSectionReader(r, 0, size)}}
+	tr := tar.NewReader(pr)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrNotOCI, err)
+		}
+		name := path.Clean("/" + hdr.Name)
+		switch hdr.Typeflag {
+		case tar.TypeReg:
+			a.files[name] = io.NewSectionReader(r, pr.pos, hdr.Size)
+		case tar.TypeSymlink:
+			// `docker save` links identical layers together
+			a.symlinks[name] = path.Join(path.Dir(name), hdr.Linkname)
+		}
+	}
+	return a, nil
+}
+
+func (a *ociArchive) open(name string) (*io.SectionReader, error) {
+	name = path.Clean("/" + name)
+	for i := 0; i < 10; i++ {
+		if f := a.files[name]; f != nil {
+			return io.NewSectionReader(f, 0, f.Size()), nil
+		}
+		target, ok := a.symlinks[name]
+		if !ok {
+			break
+		}
+		name = target
+	}
+	return nil, fmt.Errorf("%s: %w", name, os.ErrNotExist)
+}
+
+func (a *ociArchive) Close() error {
+	return nil
+}
+
+// readJSON() decodes a JSON file from src.
+func readJSON(src ociSource, name string, v interface{}) error {
+	f, err := src.open(name)
+	if err != nil {
+		return err
+	}
+	if err := json.NewDecoder(f).Decode(v); err != nil {
+		return fmt.Errorf("%s: %v", name, err)
+	}
+	return nil
+}
+
+// ociBlob() returns the path to a blob, given its digest.
+func ociBlob(digest string) (string, error) {
+	algorithm, hex := path.Split(strings.Replace(digest, ":", "/", 1))
+	if algorithm == "" || hex == "" || strings.ContainsAny(hex, "/.") {
+		return "", fmt.Errorf("invalid digest %q", digest)
+	}
+	return "blobs/" + algorithm + hex, nil
+}
+
+// ociDescriptor refers to a blob.
+type ociDescriptor struct {
+	MediaType   string            `json:"mediaType"`
+	Digest      string            `json:"digest"`
+	Annotations map[string]string `json:"annotations"`
+	Platform    *struct {
+		Architecture string `json:"architecture"`
+		OS           string `json:"os"`
+	} `json:"platform"`
+}
+
+// ociCandidate is an image which OpenOCI() might pick.
+type ociCandidate struct {
+	refs         []string
+	architecture string
+	os           string
+	config       string
+	layers       []string
+}
+
+func (c *ociCandidate) String() string {
+	name := "untagged image"
+	if len(c.refs) > 0 {
+		name = strings.Join(c.refs, ", ")
+	}
+	return fmt.Sprintf("%s (%s/%s)", name, c.os, c.architecture)
+}
+
+// candidates() lists the images in an OCI image layout, or failing that, in a
+// `docker save` manifest.
+func (img *OCIImage) candidates() ([]*ociCandidate, error) {
+	var index struct {
+		Manifests []ociDescriptor `json:"manifests"`
+	}
+	err := readJSON(img.source, "index.json", &index)
+	if errors.Is(err, os.ErrNotExist) {
+		return img.dockerCandidates()
+	} else if err != nil {
+		return nil, err
+	}
+
+	var candidates []*ociCandidate
+	var add func(d ociDescriptor, refs []string, depth int) error
+	add = func(d ociDescriptor, refs []string, depth int) error {
+		for _, key := range []string{ociImageNameAnnotation, ociRefNameAnnotation} {
+			if ref := d.Annotations[key]; ref != "" {
+				refs = append(refs[:len(refs):len(refs)], ref)
+			}
+		}
+		blob, err := ociBlob(d.Digest)
+		if err != nil {
+			return err
+		}
+
+		if d.MediaType == ociIndexMediaType || d.MediaType == dockerManifestListMediaType {
+			if depth > 4 {
+				return fmt.Errorf("%s: image indexes are nested too deeply", blob)
+			}
+			var nested struct {
+				Manifests []ociDescriptor `json:"manifests"`
+			}
+			if err := readJSON(img.source, blob, &nested); err != nil {
+				return err
+			}
+			for _, m := range nested.Manifests {
+				if err := add(m, refs, depth+1); err != nil {
+					return err
+				}
+			}
+			return nil
+		}
+
+		var manifest struct {
+			Config ociDescriptor   `json:"config"`
+			Layers []ociDescriptor `json:"layers"`
+		}
+		if err := readJSON(img.source, blob, &manifest); err != nil {
+			return err
+		}
+		c := &ociCandidate{refs: refs}
+		if d.Platform != nil {
+			c.architecture, c.os = d.Platform.Architecture, d.Platform.OS
+		}
+		if c.config, err = ociBlob(manifest.Config.Digest); err != nil {
+			return err
+		}
+		for _, layer := range manifest.Layers {
+			l, err := ociBlob(layer.Digest)
+			if err != nil {
+				return err
+			}
+			c.layers = append(c.layers, l)
+		}
+		candidates = append(candidates, c)
+		return nil
+	}
+	for _, m := range index.Manifests {
+		if err := add(m, nil, 0); err != nil {
+			return nil, err
+		}
+	}
+	return candidates, nil
+}
+
+// dockerCandidates() lists the images in a `docker save` manifest.
+func (img *OCIImage) dockerCandidates() ([]*ociCandidate, error) {
+	var manifest []struct {
+		Config   string
+		RepoTags []string
+		Layers   []string
+	}
+	err := readJSON(img.source, "manifest.json", &manifest)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, ErrNotOCI
+	} else if err != nil {
+		return nil, err
+	}
+
+	var candidates []*ociCandidate
+	for _, m := range manifest {
+		candidates = append(candidates, &ociCandidate{refs: m.RepoTags, config: m.Config, layers: m.Layers})
+	}
+	return candidates, nil
+}
+
+// ociConfig is the part of an image's configuration that matters here.
+type ociConfig struct {
+	Architecture string    `json:"architecture"`
+	OS           string    `json:"os"`
+	Created      time.Time `json:"created"`
+}
+
+// open() picks an image and applies its layers.
+func (img *OCIImage) open(opts OCIOptions) error {
+	candidates, err := img.candidates()
+	if err != nil {
+		return err
+	}
+
+	// fill in platforms from the configs, and skip things like attestations
+	configs := make(map[*ociCandidate]*ociConfig)
+	var images []*ociCandidate
+	for _, c := range candidates {
+		if c.architecture == "unknown" {
+			continue
+		}
+		config := &ociConfig{}
+		if err := readJSON(img.source, c.config, config); err != nil {
+			return err
+		}
+		if c.architecture == "" {
+			c.architecture, c.os = config.Architecture, config.OS
+		}
+		if c.os != "" && c.os != "linux" {
+			continue
+		}
+		configs[c] = config
+		images = append(images, c)
+	}
+
+	filter := func(keep func(c *ociCandidate) bool) {
+		var kept []*ociCandidate
+		for _, c := range images {
+			if keep(c) {
+				kept = append(kept, c)
+			}
+		}
+		images = kept
+	}
+	if opts.Reference != "" {
+		filter(func(c *ociCandidate) bool {
+			for _, ref := range c.refs {
+				short := strings.TrimPrefix(strings.TrimPrefix(ref, "docker.io/"), "library/")
+				if ref == opts.Reference || short == opts.Reference {
+					return true
+				}
+			}
+			return false
+		})
+	}
+	if opts.Architecture != "" && len(images) > 1 {
+		filter(func(c *ociCandidate) bool {
+			return c.architecture == opts.Architecture
+		})
+	}
+
+	switch {
+	case len(images) == 0 && len(candidates) == 0:
+		return errors.New("the archive contains no images")
+	case len(images) == 0:
+		return fmt.Errorf("no Linux image matches; the archive contains %s", describeCandidates(candidates))
+	case len(images) > 1:
+		return fmt.Errorf("specify which image to use; the archive contains %s", describeCandidates(images))
+	}
+
+	c := images[0]
+	img.Architecture, img.OS = c.architecture, c.os
+	return img.applyLayers(c.layers, configs[c].Created)
+}
+
+func describeCandidates(candidates []*ociCandidate) string {
+	var descriptions []string
+	for _, c := range candidates {
+		descriptions = append(descriptions, c.String())
+	}
+	sort.Strings(descriptions)
+	return strings.Join(descriptions, "; ")
+}
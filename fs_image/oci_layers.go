@@ -0,0 +1,344 @@
+package fs_image
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// Layers mark deletions with whiteout files: ".wh.name" removes name from
+// the layers below, and ".wh..wh..opq" in a directory removes everything the
+// layers below put there.
+const (
+	ociWhiteoutPrefix = ".wh."
+	ociOpaqueWhiteout = ".wh..wh..opq"
+)
+
+// applyLayers() builds Root by applying each layer in turn. Directories which
+// no layer mentions are dated created.
+func (img *OCIImage) applyLayers(layers []string, created time.Time) error {
+	if created.IsZero() {
+		created = time.Unix(0, 0)
+	}
+	img.Root = &Node{Mode: os.ModeDir | 0o755, ModTime: created, Children: make(map[string]*Node)}
+
+	for _, name := range layers {
+		blob, err := img.source.open(name)
+		if err != nil {
+			return err
+		}
+		l, err := newOCILayer(blob)
+		if err != nil {
+			return fmt.Errorf("%s: %v", name, err)
+		}
+		img.layers = append(img.layers, l)
+		if err := l.apply(img.Root, created); err != nil {
+			return fmt.Errorf("%s: %v", name, err)
+		}
+	}
+	return nil
+}
+
+// ociLayer is a layer, which streams files' contents out of its blob.
+type ociLayer struct {
+	blob *io.SectionReader
+
+	// decompress() is nil for uncompressed layers, which are read in place;
+	// compressed ones are decompressed in order, starting over if a file
+	// before the last one is needed.
+	decompress func(io.Reader) (io.ReadCloser, error)
+	stream     io.ReadCloser
+	pos        int64
+}
+
+// newOCILayer() identifies how a layer is compressed from its first bytes.
+func newOCILayer(blob *io.SectionReader) (*ociLayer, error) {
+	l := &ociLayer{blob: blob}
+	magic := make([]byte, 4)
+	n, err := blob.ReadAt(magic, 0)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	switch magic = magic[:n]; {
+	case bytes.HasPrefix(magic, []byte{0x1f, 0x8b}):
+		l.decompress = func(r io.Reader) (io.ReadCloser, error) {
+			return gzip.NewReader(r)
+		}
+	case bytes.HasPrefix(magic, []byte{0x28, 0xb5, 0x2f, 0xfd}):
+		l.decompress = func(r io.Reader) (io.ReadCloser, error) {
+			d, err := zstd.NewReader(r, zstd.WithDecoderConcurrency(1))
+			if err != nil {
+				return nil, err
+			}
+			return d.IOReadCloser(), nil
+		}
+	}
+	return l, nil
+}
+
+// rewind() starts reading the decompressed layer from the beginning.
+func (l *ociLayer) rewind() error {
+	l.close()
+	stream, err := l.decompress(io.NewSectionReader(l.blob, 0, l.blob.Size()))
+	if err != nil {
+		return err
+	}
+	l.stream, l.pos = stream, 0
+	return nil
+}
+
+func (l *ociLayer) close() {
+	if l.stream != nil {
+		l.stream.Close()
+		l.stream = nil
+	}
+}
+
+// open() returns a reader for size bytes at offset in the layer's tarball.
+func (l *ociLayer) open(offset, size int64) (io.ReadCloser, error) {
+	if l.decompress == nil {
+		return ioutil.NopCloser(io.NewSectionReader(l.blob, offset, size)), nil
+	}
+	if l.stream == nil || offset < l.pos {
+		if err := l.rewind(); err != nil {
+			return nil, err
+		}
+	}
+	if _, err := io.CopyN(ioutil.Discard, l.stream, offset-l.pos); err != nil {
+		l.close()
+		return nil, err
+	}
+	l.pos = offset
+	return &ociLayerFile{l: l, remaining: size}, nil
+}
+
+// ociLayerFile reads a file out of a compressed layer.
+type ociLayerFile struct {
+	l         *ociLayer
+	remaining int64
+}
+
+func (f *ociLayerFile) Read(p []byte) (int, error) {
+	if f.remaining <= 0 {
+		return 0, io.EOF
+	} else if f.l.stream == nil {
+		return 0, os.ErrClosed
+	}
+	if int64(len(p)) > f.remaining {
+		p = p[:f.remaining]
+	}
+	n, err := f.l.stream.Read(p)
+	f.l.pos += int64(n)
+	f.remaining -= int64(n)
+	if err == io.EOF && f.remaining > 0 {
+		err = io.ErrUnexpectedEOF
+	}
+	if err != nil && err != io.EOF {
+		f.l.close()
+	}
+	return n, err
+}
+
+func (f *ociLayerFile) Close() error {
+	return nil
+}
+
+// apply() applies the layer's changes to root.
+func (l *ociLayer) apply(root *Node, created time.Time) error {
+	var pr io.Reader
+	var position func() int64
+	if l.decompress == nil {
+		ps := &positionSeeker{positionReader{r: io.NewSectionReader(l.blob, 0, l.blob.Size())}}
+		pr, position = ps, func() int64 { return ps.pos }
+	} else {
+		stream, err := l.decompress(io.NewSectionReader(l.blob, 0, l.blob.Size()))
+		if err != nil {
+			return err
+		}
+		defer stream.Close()
+		p := &positionReader{r: stream}
+		pr, position = p, func() int64 { return p.pos }
+	}
+
+	// whiteouts only apply to what the layers below added, not this one
+	added := make(map[*Node]bool)
+	tr := tar.NewReader(pr)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		p := path.Clean("/" + hdr.Name)
+		dirName, name := path.Split(p)
+		if p == "/" {
+			if hdr.Typeflag == tar.TypeDir {
+				setMetadata(root, hdr)
+			}
+			continue
+		}
+		parent := lookupDir(root, dirName, created, added)
+
+		switch {
+		case name == ociOpaqueWhiteout:
+			for childName, child := range parent.Children {
+				if !added[child] {
+					delete(parent.Children, childName)
+				}
+			}
+			continue
+		case strings.HasPrefix(name, ociWhiteoutPrefix+ociWhiteoutPrefix):
+			// other AUFS metadata
+			continue
+		case strings.HasPrefix(name, ociWhiteoutPrefix):
+			name = strings.TrimPrefix(name, ociWhiteoutPrefix)
+			if child := parent.Children[name]; child != nil && !added[child] {
+				delete(parent.Children, name)
+			}
+			continue
+		}
+
+		var n *Node
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			// directories merge with what's below
+			if existing := parent.Children[name]; existing != nil && existing.Mode.IsDir() {
+				n = existing
+			} else {
+				n = &Node{Children: make(map[string]*Node)}
+			}
+			setMetadata(n, hdr)
+
+		case tar.TypeLink:
+			target := lookup(root, path.Clean("/"+hdr.Linkname))
+			if target == nil || target.Mode.IsDir() {
+				return fmt.Errorf("%s: hard link to missing file %s", p, hdr.Linkname)
+			}
+			n = target
+
+		case tar.TypeReg:
+			if ociSparse(hdr) {
+				return fmt.Errorf("%s: sparse files aren't supported", p)
+			}
+			n = &Node{Size: hdr.Size}
+			setMetadata(n, hdr)
+			offset, size := position(), hdr.Size
+			n.Open = func() (io.ReadCloser, error) {
+				return l.open(offset, size)
+			}
+
+		case tar.TypeSymlink, tar.TypeChar, tar.TypeBlock, tar.TypeFifo:
+			n = &Node{Target: hdr.Linkname, Major: uint32(hdr.Devmajor), Minor: uint32(hdr.Devminor)}
+			setMetadata(n, hdr)
+			if hdr.Typeflag == tar.TypeSymlink {
+				n.Mode |= 0o777
+			}
+
+		default:
+			return fmt.Errorf("%s: unsupported tar entry type %q", p, hdr.Typeflag)
+		}
+		parent.Children[name] = n
+		added[n] = true
+	}
+}
+
+// ociSparse() indicates if a tar entry is a sparse file, whose data isn't
+// stored contiguously.
+func ociSparse(hdr *tar.Header) bool {
+	if hdr.Typeflag == tar.TypeGNUSparse {
+		return true
+	}
+	for key := range hdr.PAXRecords {
+		if strings.HasPrefix(key, "GNU.sparse.") {
+			return true
+		}
+	}
+	return false
+}
+
+// setMetadata() copies a tar entry's metadata to n.
+func setMetadata(n *Node, hdr *tar.Header) {
+	n.Mode = hdr.FileInfo().Mode()
+	n.UID, n.GID = uint32(hdr.Uid), uint32(hdr.Gid)
+	n.ModTime = hdr.ModTime
+	n.Xattrs = nil
+	for key, value := range hdr.PAXRecords {
+		if name := strings.TrimPrefix(key, "SCHILY.xattr."); name != key {
+			if n.Xattrs == nil {
+				n.Xattrs = make(map[string][]byte)
+			}
+			n.Xattrs[name] = []byte(value)
+		}
+	}
+}
+
+// lookup() finds the Node at p, or returns nil.
+func lookup(root *Node, p string) *Node {
+	n := root
+	for _, name := range strings.Split(strings.Trim(p, "/"), "/") {
+		if name == "" {
+			continue
+		}
+		if n = n.Children[name]; n == nil {
+			return nil
+		}
+	}
+	return n
+}
+
+// lookupDir() finds the directory at p, making it and its parents as needed,
+// since layers needn't mention every directory.
+func lookupDir(root *Node, p string, created time.Time, added map[*Node]bool) *Node {
+	n := root
+	for _, name := range strings.Split(strings.Trim(p, "/"), "/") {
+		if name == "" {
+			continue
+		}
+		child := n.Children[name]
+		if child == nil || !child.Mode.IsDir() {
+			child = &Node{Mode: os.ModeDir | 0o755, ModTime: created, Children: make(map[string]*Node)}
+			n.Children[name] = child
+			added[child] = true
+		}
+		n = child
+	}
+	return n
+}
+
+// positionReader keeps track of how far it's read, so that files' offsets in
+// a tarball can be found.
+type positionReader struct {
+	r   io.Reader
+	pos int64
+}
+
+func (pr *positionReader) Read(p []byte) (int, error) {
+	n, err := pr.r.Read(p)
+	pr.pos += int64(n)
+	return n, err
+}
+
+// positionSeeker is a positionReader which lets archive/tar seek past files
+// rather than reading them.
+type positionSeeker struct {
+	positionReader
+}
+
+func (ps *positionSeeker) Seek(offset int64, whence int) (int64, error) {
+	pos, err := ps.r.(io.Seeker).Seek(offset, whence)
+	if err == nil {
+		ps.pos = pos
+	}
+	return pos, err
+}
@@ -0,0 +1,394 @@
+package fs_image
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// tarEntry is a file in a layer.
+type tarEntry struct {
+	tar.Header
+	content string
+}
+
+// layerTar() returns a tarball of entries.
+func layerTar(t *testing.T, entries ...tarEntry) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, e := range entries {
+		hdr := e.Header
+		if hdr.Typeflag == 0 {
+			hdr.Typeflag = tar.TypeReg
+		}
+		if hdr.Mode == 0 {
+			hdr.Mode = 0o644
+		}
+		hdr.Size = int64(len(e.content))
+		hdr.ModTime = time.Unix(1600000000, 0)
+		if err := tw.WriteHeader(&hdr); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write([]byte(e.content)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func gzipped(t *testing.T, data []byte) []byte {
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	w.Write(data)
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func zstdCompressed(t *testing.T, data []byte) []byte {
+	w, err := zstd.NewWriter(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return w.EncodeAll(data, nil)
+}
+
+// ociLayout accumulates the files of an OCI image layout.
+type ociLayout map[string][]byte
+
+// blob() adds a blob, returning its descriptor.
+func (l ociLayout) blob(mediaType string, content []byte) map[string]interface{} {
+	digest := fmt.Sprintf("sha256:%x", sha256.Sum256(content))
+	l["blobs/sha256/"+digest[7:]] = content
+	return map[string]interface{}{"mediaType": mediaType, "digest": digest, "size": len(content)}
+}
+
+func (l ociLayout) json(mediaType string, v interface{}) map[string]interface{} {
+	content, _ := json.Marshal(v)
+	return l.blob(mediaType, content)
+}
+
+// image() adds an image with the given layers, returning its manifest's
+// descriptor.
+func (l ociLayout) image(arch string, layers ...[]byte) map[string]interface{} {
+	config := l.json("application/vnd.oci.image.config.v1+json", map[string]interface{}{
+		"architecture": arch,
+		"os":           "linux",
+		"created":      "2021-01-02T03:04:05Z",
+	})
+	var descriptors []interface{}
+	for _, layer := range layers {
+		descriptors = append(descriptors, l.blob("application/vnd.oci.image.layer.v1.tar", layer))
+	}
+	return l.json("application/vnd.oci.image.manifest.v1+json", map[string]interface{}{
+		"schemaVersion": 2,
+		"config":        config,
+		"layers":        descriptors,
+	})
+}
+
+// index() sets index.json.
+func (l ociLayout) index(manifests ...map[string]interface{}) {
+	l["oci-layout"] = []byte(`{"imageLayoutVersion":"1.0.0"}`)
+	l["index.json"], _ = json.Marshal(map[string]interface{}{"schemaVersion": 2, "manifests": manifests})
+}
+
+// write() writes the layout to a directory.
+func (l ociLayout) write(t *testing.T) string {
+	t.Helper()
+	dir := t.TempDir()
+	for name, content := range l {
+		filename := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(filename), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(filename, content, 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+// archive() returns the layout as a tarball.
+func (l ociLayout) archive(t *testing.T, symlinks map[string]string) []byte {
+	t.Helper()
+	var names []string
+	for name := range l {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var entries []tarEntry
+	for _, name := range names {
+		entries = append(entries, tarEntry{tar.Header{Name: name}, string(l[name])})
+	}
+	for name, target := range symlinks {
+		entries = append(entries, tarEntry{tar.Header{Name: name, Typeflag: tar.TypeSymlink, Linkname: target}, ""})
+	}
+	return layerTar(t, entries...)
+}
+
+// readNode() returns a regular file's contents.
+func readNode(t *testing.T, n *Node) string {
+	t.Helper()
+	if n == nil || n.Open == nil {
+		t.Fatalf("not a regular file: %+v", n)
+	}
+	r, err := n.Open()
+	if err != nil {
+		t.Fatalf("Open() error = %v", err)
+	}
+	defer r.Close()
+	content, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatalf("ReadAll() error = %v", err)
+	}
+	if int64(len(content)) != n.Size {
+		t.Errorf("read %d bytes, but Size is %d", len(content), n.Size)
+	}
+	return string(content)
+}
+
+// testLayers() returns three layers, compressed three ways, which exercise
+// whiteouts, hard links, and the like.
+func testLayers(t *testing.T) [][]byte {
+	dir := func(name string) tarEntry {
+		return tarEntry{tar.Header{Name: name, Typeflag: tar.TypeDir, Mode: 0o755}, ""}
+	}
+	base := layerTar(t,
+		dir("./"),
+		dir("bin/"),
+		tarEntry{tar.Header{Name: "bin/sh", Mode: 0o755}, "#!shell"},
+		tarEntry{tar.Header{Name: "bin/ping", Mode: 0o4755, PAXRecords: map[string]string{"SCHILY.xattr.security.capability": "\x01\x00\x00\x02"}}, "ping"},
+		tarEntry{tar.Header{Name: "bin/bash", Typeflag: tar.TypeLink, Linkname: "bin/sh"}, ""},
+		dir("etc/"),
+		tarEntry{tar.Header{Name: "etc/passwd"}, "root:x:0:0\n"},
+		tarEntry{tar.Header{Name: "etc/shadow", Mode: 0o600}, "secret"},
+		dir("var/cache/"),
+		tarEntry{tar.Header{Name: "var/cache/old"}, "stale"},
+		tarEntry{tar.Header{Name: "dev/null", Typeflag: tar.TypeChar, Mode: 0o666, Devmajor: 1, Devminor: 3}, ""},
+		tarEntry{tar.Header{Name: "dev/initctl", Typeflag: tar.TypeFifo, Mode: 0o600}, ""},
+	)
+	middle := layerTar(t,
+		tarEntry{tar.Header{Name: "etc/passwd"}, "root:x:0:0\nuser:x:1000:1000\n"},
+		tarEntry{tar.Header{Name: "etc/.wh.shadow"}, ""},
+		tarEntry{tar.Header{Name: "var/cache/.wh..wh..opq"}, ""},
+		tarEntry{tar.Header{Name: "var/cache/new", Uid: 1000, Gid: 1000}, "fresh"},
+		tarEntry{tar.Header{Name: "usr/lib/os-release", Uname: "root"}, "ID=test\n"},
+		tarEntry{tar.Header{Name: "usr/bin/python", Typeflag: tar.TypeSymlink, Linkname: "python3"}, ""},
+	)
+	top := layerTar(t,
+		tarEntry{tar.Header{Name: "bin/sh", Mode: 0o755}, "#!new shell"},
+		dir("etc/"),
+		tarEntry{tar.Header{Name: "etc/hostname"}, "container\n"},
+		tarEntry{tar.Header{Name: "usr/.wh.lib"}, ""},
+		tarEntry{tar.Header{Name: ".wh..wh.plnk"}, ""},
+	)
+	return [][]byte{gzipped(t, base), zstdCompressed(t, middle), top}
+}
+
+// checkTestLayers() checks the result of applying testLayers().
+func checkTestLayers(t *testing.T, img *OCIImage) {
+	t.Helper()
+	root := img.Root
+	var listing []string
+	var walk func(n *Node, p string)
+	walk = func(n *Node, p string) {
+		for _, name := range n.names() {
+			listing = append(listing, p+name)
+			walk(n.Children[name], p+name+"/")
+		}
+	}
+	walk(root, "/")
+	expected := []string{
+		"/bin", "/bin/bash", "/bin/ping", "/bin/sh",
+		"/dev", "/dev/initctl", "/dev/null",
+		"/etc", "/etc/hostname", "/etc/passwd",
+		"/usr", "/usr/bin", "/usr/bin/python",
+		"/var", "/var/cache", "/var/cache/new",
+	}
+	if strings.Join(listing, " ") != strings.Join(expected, " ") {
+		t.Errorf("tree contains %v, expected %v", listing, expected)
+	}
+
+	bin := root.Children["bin"]
+	if content := readNode(t, bin.Children["sh"]); content != "#!new shell" {
+		t.Errorf("/bin/sh contains %q", content)
+	}
+	// the hard link is to the original, which was replaced under the other name
+	if content := readNode(t, bin.Children["bash"]); content != "#!shell" {
+		t.Errorf("/bin/bash contains %q", content)
+	}
+	ping := bin.Children["ping"]
+	if ping.Mode != os.ModeSetuid|0o755 || string(ping.Xattrs["security.capability"]) != "\x01\x00\x00\x02" {
+		t.Errorf("/bin/ping = %+v", ping)
+	}
+	if content := readNode(t, root.Children["etc"].Children["passwd"]); !strings.Contains(content, "user") {
+		t.Errorf("/etc/passwd contains %q", content)
+	}
+	if n := root.Children["var"].Children["cache"].Children["new"]; n.UID != 1000 || readNode(t, n) != "fresh" {
+		t.Errorf("/var/cache/new = %+v", n)
+	}
+	if n := root.Children["usr"].Children["bin"].Children["python"]; n.Mode != os.ModeSymlink|0o777 || n.Target != "python3" {
+		t.Errorf("/usr/bin/python = %+v", n)
+	}
+	if n := root.Children["dev"].Children["null"]; n.Mode != os.ModeDevice|os.ModeCharDevice|0o666 || n.Major != 1 || n.Minor != 3 {
+		t.Errorf("/dev/null = %+v", n)
+	}
+	if n := root.Children["dev"]; !n.ModTime.Equal(time.Date(2021, 1, 2, 3, 4, 5, 0, time.UTC)) {
+		t.Errorf("/dev, which is implied, has ModTime %v", n.ModTime)
+	}
+
+	// reading out of order starts the compressed layers over
+	if content := readNode(t, bin.Children["bash"]); content != "#!shell" {
+		t.Errorf("/bin/bash contains %q the second time", content)
+	}
+}
+
+func TestOpenOCI(t *testing.T) {
+	layout := ociLayout{}
+	layout.index(layout.image("arm64", testLayers(t)...))
+	img, err := OpenOCI(layout.write(t), OCIOptions{})
+	if err != nil {
+		t.Fatalf("OpenOCI() error = %v", err)
+	}
+	defer img.Close()
+	if img.Architecture != "arm64" || img.OS != "linux" {
+		t.Errorf("OpenOCI() platform = %s/%s", img.OS, img.Architecture)
+	}
+	checkTestLayers(t, img)
+
+	// it all goes in a filesystem
+	ext, err := NewExt(img.Root, ExtOptions{Size: 64 << 20})
+	if err != nil {
+		t.Fatalf("NewExt() error = %v", err)
+	}
+	if _, err := ext.WriteTo(ioutil.Discard); err != nil {
+		t.Errorf("WriteTo() error = %v", err)
+	}
+
+	if _, err := OpenOCI(t.TempDir(), OCIOptions{}); err != ErrNotOCI {
+		t.Errorf("OpenOCI() of an empty directory error = %v", err)
+	}
+}
+
+func TestOpenOCIArchive(t *testing.T) {
+	// docker save, before Docker 25, with one layer linked to another
+	layers := testLayers(t)
+	layout := ociLayout{
+		"1/layer.tar": layers[0],
+		"2/layer.tar": layers[1],
+		"3/layer.tar": layers[2],
+		"config.json": []byte(`{"architecture":"amd64","os":"linux","created":"2021-01-02T03:04:05Z"}`),
+		"manifest.json": []byte(`[
+			{"Config":"config.json","RepoTags":["test:latest"],"Layers":["1/layer.tar","2/layer.tar","3/layer.tar"]},
+			{"Config":"config.json","RepoTags":["other:1","other:2"],"Layers":["1/layer.tar","4/layer.tar"]}
+		]`),
+	}
+	archive := layout.archive(t, map[string]string{"4/layer.tar": "../2/layer.tar"})
+
+	_, err := OpenOCIArchive(bytes.NewReader(archive), int64(len(archive)), OCIOptions{})
+	if err == nil || !strings.Contains(err.Error(), "other:1, other:2 (linux/amd64); test:latest (linux/amd64)") {
+		t.Errorf("OpenOCIArchive() without a reference error = %v", err)
+	}
+
+	img, err := OpenOCIArchive(bytes.NewReader(archive), int64(len(archive)), OCIOptions{Reference: "test:latest"})
+	if err != nil {
+		t.Fatalf("OpenOCIArchive() error = %v", err)
+	}
+	defer img.Close()
+	if img.Architecture != "amd64" {
+		t.Errorf("OpenOCIArchive() architecture = %q", img.Architecture)
+	}
+	checkTestLayers(t, img)
+
+	other, err := OpenOCIArchive(bytes.NewReader(archive), int64(len(archive)), OCIOptions{Reference: "other:2"})
+	if err != nil {
+		t.Fatalf("OpenOCIArchive() of the linked layer error = %v", err)
+	}
+	defer other.Close()
+	if n := other.Root.Children["var"].Children["cache"].Children["new"]; n == nil || readNode(t, n) != "fresh" {
+		t.Errorf("/var/cache/new = %+v", n)
+	}
+
+	if _, err := OpenOCIArchive(bytes.NewReader(archive), int64(len(archive)), OCIOptions{Reference: "missing"}); err == nil {
+		t.Errorf("OpenOCIArchive() with a missing reference succeeded")
+	}
+	notTar := []byte("this is not a tarball")
+	if _, err := OpenOCIArchive(bytes.NewReader(notTar), int64(len(notTar)), OCIOptions{}); err == nil {
+		t.Errorf("OpenOCIArchive() of something else succeeded")
+	}
+}
+
+func TestOpenOCIPlatforms(t *testing.T) {
+	layer := func(content string) []byte {
+		return layerTar(t, tarEntry{tar.Header{Name: "arch"}, content})
+	}
+
+	// a multi-platform image, with an attestation, as buildx makes
+	layout := ociLayout{}
+	attestation := layout.image("unknown", layer("attestation"))
+	attestation["platform"] = map[string]string{"architecture": "unknown", "os": "unknown"}
+	amd64 := layout.image("amd64", layer("amd64"))
+	amd64["platform"] = map[string]string{"architecture": "amd64", "os": "linux"}
+	arm64 := layout.image("arm64", layer("arm64"))
+	arm64["platform"] = map[string]string{"architecture": "arm64", "os": "linux"}
+	index := layout.json("application/vnd.oci.image.index.v1+json", map[string]interface{}{
+		"schemaVersion": 2,
+		"manifests":     []interface{}{amd64, arm64, attestation},
+	})
+	index["annotations"] = map[string]string{"io.containerd.image.name": "docker.io/library/test:latest", "org.opencontainers.image.ref.name": "latest"}
+	layout.index(index)
+	dir := layout.write(t)
+
+	for _, arch := range []string{"amd64", "arm64"} {
+		img, err := OpenOCI(dir, OCIOptions{Architecture: arch, Reference: "test:latest"})
+		if err != nil {
+			t.Fatalf("OpenOCI() for %s error = %v", arch, err)
+		}
+		if content := readNode(t, img.Root.Children["arch"]); content != arch || img.Architecture != arch {
+			t.Errorf("OpenOCI() for %s picked %s", arch, content)
+		}
+		img.Close()
+	}
+
+	_, err := OpenOCI(dir, OCIOptions{})
+	if err == nil || !strings.Contains(err.Error(), "specify which image") {
+		t.Errorf("OpenOCI() without an architecture error = %v", err)
+	}
+	_, err = OpenOCI(dir, OCIOptions{Architecture: "riscv64"})
+	if err == nil || !strings.Contains(err.Error(), "(linux/arm64)") {
+		t.Errorf("OpenOCI() for a missing architecture error = %v", err)
+	}
+}
+
+func TestOCILayerErrors(t *testing.T) {
+	for name, layer := range map[string][]byte{
+		"dangling hard link": layerTar(t, tarEntry{tar.Header{Name: "a", Typeflag: tar.TypeLink, Linkname: "b"}, ""}),
+		"truncated":          layerTar(t, tarEntry{tar.Header{Name: "a"}, strings.Repeat("x", 10000)})[:5000],
+		"corrupt gzip":       gzipped(t, layerTar(t, tarEntry{tar.Header{Name: "a"}, "x"}))[:20],
+	} {
+		layout := ociLayout{}
+		layout.index(layout.image("amd64", layer))
+		if img, err := OpenOCI(layout.write(t), OCIOptions{}); err == nil {
+			img.Close()
+			t.Errorf("%s: OpenOCI() succeeded", name)
+		}
+	}
+}
@@ -0,0 +1,235 @@
+package fs_image
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"unicode/utf16"
+)
+
+// PartitionTable selects how NewPartitioned() describes a disk.
+type PartitionTable int
+
+const (
+	// MBR is a DOS partition table, which is limited to 2 TiB.
+	MBR PartitionTable = iota + 1
+	// GPT is a GUID partition table, with a protective MBR.
+	GPT
+)
+
+func (t PartitionTable) String() string {
+	switch t {
+	case MBR:
+		return "MBR"
+	case GPT:
+		return "GPT"
+	default:
+		return fmt.Sprintf("PartitionTable(%d)", int(t))
+	}
+}
+
+const (
+	sectorSize = 512
+
+	// the partition starts at 1 MiB, as partitioning tools have long done
+	partitionStart = 1 << 20
+
+	// GPT keeps a backup header and partition entries at the end of the disk
+	gptEntries       = 128
+	gptEntrySize     = 128
+	gptEntrySectors  = gptEntries * gptEntrySize / sectorSize
+	gptBackupSectors = gptEntrySectors + 1
+
+	mbrLinuxType      = 0x83
+	mbrProtectiveType = 0xee
+)
+
+// the "Linux filesystem data" partition type
+var gptLinuxType = [16]byte{0xaf, 0x3d, 0xc6, 0x0f, 0x83, 0x84, 0x72, 0x47, 0x8e, 0x79, 0x3d, 0x69, 0xd8, 0x47, 0x7d, 0xe4}
+
+// PartitionSize() returns how big the partition on a disk of diskSize bytes
+// can be. It's a whole number of 4 KiB blocks.
+func (t PartitionTable) PartitionSize(diskSize int64) int64 {
+	end := diskSize
+	if t == GPT {
+		end -= gptBackupSectors * sectorSize
+	}
+	return end&^4095 - partitionStart
+}
+
+// PartitionedImage is a disk image with a single partition, which holds a
+// filesystem image.
+type PartitionedImage struct {
+	size int64
+	fs   io.ReadCloser
+	r    io.Reader
+}
+
+// NewPartitioned() returns a disk image of diskSize bytes, partitioned
+// according to table, whose only partition is read from fs. fs must be
+// table.PartitionSize(diskSize) bytes long. No boot loader is installed.
+func NewPartitioned(fs io.ReadCloser, diskSize int64, table PartitionTable) (*PartitionedImage, error) {
+	partitionSize := table.PartitionSize(diskSize)
+	if diskSize%sectorSize != 0 {
+		return nil, fmt.Errorf("a disk of %d bytes isn't a whole number of sectors", diskSize)
+	} else if partitionSize <= 0 {
+		return nil, fmt.Errorf("a disk of %d bytes is too small to partition", diskSize)
+	}
+	sectors := uint64(diskSize / sectorSize)
+	first, last := uint64(partitionStart/sectorSize), uint64((partitionStart+partitionSize)/sectorSize-1)
+
+	var head, tail []byte
+	switch table {
+	case MBR:
+		if last >= 1<<32 {
+			return nil, fmt.Errorf("MBR partition tables are limited to 2 TiB; use GPT")
+		}
+		head = mbr(mbrLinuxType, first, last-first+1)
+
+	case GPT:
+		partition := make([]byte, gptEntries*gptEntrySize)
+		copy(partition[0:], gptLinuxType[:])
+		if err := randomGUID(partition[16:32]); err != nil {
+			return nil, err
+		}
+		binary.LittleEndian.PutUint64(partition[32:], first)
+		binary.LittleEndian.PutUint64(partition[40:], last)
+		for i, c := range utf16.Encode([]rune("root")) {
+			binary.LittleEndian.PutUint16(partition[56+2*i:], c)
+		}
+
+		var diskGUID [16]byte
+		if err := randomGUID(diskGUID[:]); err != nil {
+			return nil, err
+		}
+		primary := gptHeader(1, sectors-1, 2, sectors, diskGUID, partition)
+		backup := gptHeader(sectors-1, 1, sectors-gptBackupSectors, sectors, diskGUID, partition)
+
+		protective := sectors - 1
+		if protective >= 1<<32 {
+			protective = 1<<32 - 1
+		}
+		head = append(append(mbr(mbrProtectiveType, 1, protective), primary...), partition...)
+		tail = append(partition, backup...)
+
+	default:
+		return nil, fmt.Errorf("unsupported partition table %v", table)
+	}
+
+	gap := diskSize - partitionStart - partitionSize - int64(len(tail))
+	return &PartitionedImage{
+		size: diskSize,
+		fs:   fs,
+		r: io.MultiReader(
+			bytes.NewReader(head),
+			io.LimitReader(zeroReader{}, partitionStart-int64(len(head))),
+			&exactReader{r: fs, remaining: partitionSize},
+			io.LimitReader(zeroReader{}, gap),
+			bytes.NewReader(tail),
+		),
+	}, nil
+}
+
+// Size() returns the size of the disk image in bytes.
+func (p *PartitionedImage) Size() int64 {
+	return p.size
+}
+
+// Read() reads the disk image.
+func (p *PartitionedImage) Read(b []byte) (int, error) {
+	return p.r.Read(b)
+}
+
+// Close() closes the filesystem image.
+func (p *PartitionedImage) Close() error {
+	return p.fs.Close()
+}
+
+// mbr() returns a master boot record with a single partition, which is
+// marked bootable.
+func mbr(partitionType byte, first, sectors uint64) []byte {
+	b := make([]byte, sectorSize)
+	rand.Read(b[440:444]) // disk signature
+	entry := b[446:462]
+	entry[0] = 0x80
+	// CHS addresses are long obsolete; these mean "use the LBA fields"
+	copy(entry[1:4], []byte{0xfe, 0xff, 0xff})
+	entry[4] = partitionType
+	copy(entry[5:8], []byte{0xfe, 0xff, 0xff})
+	binary.LittleEndian.PutUint32(entry[8:], uint32(first))
+	binary.LittleEndian.PutUint32(entry[12:], uint32(sectors))
+	b[510], b[511] = 0x55, 0xaa
+	return b
+}
+
+// gptHeader() returns a GPT header sector, located at sector current, for a
+// disk with the given number of sectors.
+func gptHeader(current, backup, entries, sectors uint64, diskGUID [16]byte, partitions []byte) []byte {
+	b := make([]byte, sectorSize)
+	copy(b[0:], "EFI PART")
+	binary.LittleEndian.PutUint32(b[8:], 0x10000) // version 1.0
+	binary.LittleEndian.PutUint32(b[12:], 92)     // header size
+	binary.LittleEndian.PutUint64(b[24:], current)
+	binary.LittleEndian.PutUint64(b[32:], backup)
+	binary.LittleEndian.PutUint64(b[40:], 2+gptEntrySectors)          // first usable sector
+	binary.LittleEndian.PutUint64(b[48:], sectors-gptBackupSectors-1) // last usable sector
+	copy(b[56:], diskGUID[:])
+	binary.LittleEndian.PutUint64(b[72:], entries)
+	binary.LittleEndian.PutUint32(b[80:], gptEntries)
+	binary.LittleEndian.PutUint32(b[84:], gptEntrySize)
+	binary.LittleEndian.PutUint32(b[88:], crc32.ChecksumIEEE(partitions))
+	binary.LittleEndian.PutUint32(b[16:], crc32.ChecksumIEEE(b[:92]))
+	return b
+}
+
+// randomGUID() fills b with a random version 4 GUID, in GPT's mixed-endian
+// encoding.
+func randomGUID(b []byte) error {
+	if _, err := rand.Read(b[:16]); err != nil {
+		return err
+	}
+	b[7] = b[7]&0x0f | 0x40 // version 4, in the little-endian third field
+	b[8] = b[8]&0x3f | 0x80 // variant 1
+	return nil
+}
+
+// exactReader reads exactly remaining bytes from r, failing if r is shorter
+// or longer.
+type exactReader struct {
+	r         io.Reader
+	remaining int64
+}
+
+func (er *exactReader) Read(p []byte) (int, error) {
+	if er.remaining == 0 {
+		if n, _ := er.r.Read(make([]byte, 1)); n > 0 {
+			return 0, errors.New("the filesystem image is bigger than its partition")
+		}
+		return 0, io.EOF
+	}
+	if int64(len(p)) > er.remaining {
+		p = p[:er.remaining]
+	}
+	n, err := er.r.Read(p)
+	er.remaining -= int64(n)
+	if err == io.EOF && er.remaining > 0 {
+		return n, fmt.Errorf("the filesystem image is %d bytes short of its partition", er.remaining)
+	} else if err == io.EOF {
+		err = nil
+	}
+	return n, err
+}
+
+// zeroReader reads zeros forever.
+type zeroReader struct{}
+
+func (zeroReader) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = 0
+	}
+	return len(p), nil
+}
@@ -0,0 +1,114 @@
+package fs_image
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"strings"
+	"testing"
+)
+
+func TestPartitioned(t *testing.T) {
+	const diskSize = 16<<20 + 512
+	for _, table := range []PartitionTable{MBR, GPT} {
+		partitionSize := table.PartitionSize(diskSize)
+		if partitionSize%4096 != 0 || partitionSize < 14<<20 {
+			t.Errorf("%v: PartitionSize() = %d", table, partitionSize)
+		}
+		fs := bytes.Repeat([]byte("filesystem"), int(partitionSize/10+1))[:partitionSize]
+		p, err := NewPartitioned(ioutil.NopCloser(bytes.NewReader(fs)), diskSize, table)
+		if err != nil {
+			t.Fatalf("%v: NewPartitioned() error = %v", table, err)
+		}
+		disk, err := ioutil.ReadAll(p)
+		if err != nil || int64(len(disk)) != p.Size() || p.Size() != diskSize {
+			t.Fatalf("%v: read %d bytes, error %v", table, len(disk), err)
+		}
+		if !bytes.Equal(disk[partitionStart:partitionStart+partitionSize], fs) {
+			t.Errorf("%v: the partition doesn't hold the filesystem", table)
+		}
+
+		mbr := disk[:512]
+		entry := mbr[446:462]
+		if mbr[510] != 0x55 || mbr[511] != 0xaa {
+			t.Errorf("%v: no MBR signature", table)
+		}
+		if table == MBR {
+			if entry[4] != 0x83 || binary.LittleEndian.Uint32(entry[8:]) != 2048 || int64(binary.LittleEndian.Uint32(entry[12:]))*512 != partitionSize {
+				t.Errorf("MBR partition entry = %x", entry)
+			}
+			continue
+		}
+
+		if entry[4] != 0xee || binary.LittleEndian.Uint32(entry[12:]) != diskSize/512-1 {
+			t.Errorf("protective MBR partition entry = %x", entry)
+		}
+		sectors := uint64(diskSize / 512)
+		for _, h := range []struct {
+			name            string
+			header          []byte
+			current, backup uint64
+			entries         uint64
+		}{
+			{"primary", disk[512:1024], 1, sectors - 1, 2},
+			{"backup", disk[diskSize-512:], sectors - 1, 1, sectors - 33},
+		} {
+			header := append([]byte{}, h.header[:92]...)
+			sum := binary.LittleEndian.Uint32(header[16:])
+			binary.LittleEndian.PutUint32(header[16:], 0)
+			switch {
+			case string(header[:8]) != "EFI PART":
+				t.Errorf("%s GPT header has no signature", h.name)
+			case crc32.ChecksumIEEE(header) != sum:
+				t.Errorf("%s GPT header has the wrong checksum", h.name)
+			case binary.LittleEndian.Uint64(header[24:]) != h.current || binary.LittleEndian.Uint64(header[32:]) != h.backup:
+				t.Errorf("%s GPT header has the wrong locations", h.name)
+			case binary.LittleEndian.Uint64(header[72:]) != h.entries:
+				t.Errorf("%s GPT header has the wrong entries location", h.name)
+			}
+			entries := disk[h.entries*512 : h.entries*512+16384]
+			if crc32.ChecksumIEEE(entries) != binary.LittleEndian.Uint32(header[88:]) {
+				t.Errorf("%s GPT partition entries have the wrong checksum", h.name)
+			}
+			if !bytes.Equal(entries[:16], gptLinuxType[:]) || binary.LittleEndian.Uint64(entries[32:]) != 2048 ||
+				int64(binary.LittleEndian.Uint64(entries[40:])-2048+1)*512 != partitionSize {
+				t.Errorf("%s GPT partition entry = %x", h.name, entries[:128])
+			}
+			if last := binary.LittleEndian.Uint64(header[48:]); last != sectors-34 || last < binary.LittleEndian.Uint64(entries[40:]) {
+				t.Errorf("%s GPT header's last usable sector = %d", h.name, last)
+			}
+		}
+	}
+}
+
+func TestPartitionedErrors(t *testing.T) {
+	size := MBR.PartitionSize(16 << 20)
+	for name, fs := range map[string][]byte{
+		"short":  make([]byte, size-1),
+		"bigger": make([]byte, size+1),
+	} {
+		p, err := NewPartitioned(ioutil.NopCloser(bytes.NewReader(fs)), 16<<20, MBR)
+		if err != nil {
+			t.Fatalf("%s: NewPartitioned() error = %v", name, err)
+		}
+		if _, err := io.Copy(ioutil.Discard, p); err == nil || !strings.Contains(err.Error(), name) {
+			t.Errorf("%s: reading error = %v", name, err)
+		}
+	}
+
+	for _, tc := range []struct {
+		size  int64
+		table PartitionTable
+	}{
+		{1 << 20, MBR},
+		{16<<20 + 1, GPT},
+		{3 << 40, MBR},
+		{16 << 20, PartitionTable(0)},
+	} {
+		if _, err := NewPartitioned(ioutil.NopCloser(bytes.NewReader(nil)), tc.size, tc.table); err == nil {
+			t.Errorf("NewPartitioned() of %d bytes with %v succeeded", tc.size, tc.table)
+		}
+	}
+}
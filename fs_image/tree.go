@@ -0,0 +1,81 @@
+package fs_image
+
+import (
+	"io"
+	"os"
+	"sort"
+	"time"
+)
+
+// Node is a file, directory, symlink, device, FIFO, or socket. A Node which
+// appears under more than one name is a hard link; directories may only appear
+// once.
+type Node struct {
+	// Mode holds the type and permission bits, including setuid, setgid, and
+	// sticky.
+	Mode    os.FileMode
+	UID     uint32
+	GID     uint32
+	ModTime time.Time
+
+	// Xattrs maps extended attribute names, like "security.capability", to
+	// their values. POSIX ACLs are in the format Linux's getxattr() returns.
+	Xattrs map[string][]byte
+
+	// Size and Open() describe a regular file's contents. Open() is called
+	// when the contents are needed, which may be much later.
+	Size int64
+	Open func() (io.ReadCloser, error)
+
+	// Target is a symlink's target.
+	Target string
+
+	// Major and Minor are a device's numbers.
+	Major uint32
+	Minor uint32
+
+	// Children maps the names in a directory to what they refer to.
+	Children map[string]*Node
+}
+
+// names() returns a directory's entries in a stable order.
+func (n *Node) names() []string {
+	names := make([]string, 0, len(n.Children))
+	for name := range n.Children {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// unixMode() returns n's mode as Linux represents it.
+func (n *Node) unixMode() uint16 {
+	mode := uint16(n.Mode.Perm())
+	if n.Mode&os.ModeSetuid != 0 {
+		mode |= 0o4000
+	}
+	if n.Mode&os.ModeSetgid != 0 {
+		mode |= 0o2000
+	}
+	if n.Mode&os.ModeSticky != 0 {
+		mode |= 0o1000
+	}
+
+	switch {
+	case n.Mode.IsDir():
+		mode |= 0o040000
+	case n.Mode&os.ModeSymlink != 0:
+		mode |= 0o120000
+	case n.Mode&os.ModeCharDevice != 0:
+		mode |= 0o020000
+	case n.Mode&os.ModeDevice != 0:
+		mode |= 0o060000
+	case n.Mode&os.ModeNamedPipe != 0:
+		mode |= 0o010000
+	case n.Mode&os.ModeSocket != 0:
+		mode |= 0o140000
+	default:
+		mode |= 0o100000
+	}
+	return mode
+}